@@ -0,0 +1,78 @@
+// bounces records the delivery status of the welcome emails from the bounce messages (RFC 3464 delivery status notifications)
+// received in the bounce address of the mail configuration.
+// It reads the messages from the files given as arguments, or a single message from the standard input,
+// so the mail server can pipe the messages of the bounce address to it.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+	"github.com/hesusruiz/onboardng/internal/mail"
+)
+
+func main() {
+	envFlag := flag.String("env", "dev", "environment of the registrations (dev, pre or pro)")
+	dbFlag := flag.String("db", "data/onboarding.db", "path to the database")
+	flag.Parse()
+
+	dbService, err := db.Open(*dbFlag, configuration.RuntimeEnv(*envFlag))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening the database:", err)
+		os.Exit(1)
+	}
+	defer dbService.Close()
+
+	if flag.NArg() == 0 {
+		if err := processMessage(dbService, "stdin", os.Stdin); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	failed := false
+	for _, file := range flag.Args() {
+		f, err := os.Open(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			continue
+		}
+		if err := processMessage(dbService, file, f); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+		f.Close()
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// processMessage updates the delivery status of the recipients of a bounce message.
+// Messages that are not bounces (like auto-replies) are skipped.
+func processMessage(dbService *db.Service, name string, r io.Reader) error {
+	events, err := mail.ParseDSN(r)
+	if errors.Is(err, mail.ErrNotDSN) {
+		fmt.Println(name+":", "skipped, not a delivery status notification")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	for _, event := range events {
+		updated, err := dbService.UpdateDeliveryStatus(event.Recipient, event.Status)
+		if err != nil {
+			return fmt.Errorf("%s: error updating %s: %w", name, event.Recipient, err)
+		}
+		fmt.Printf("%s: %s %s (%s), %d registrations updated\n", name, event.Recipient, event.Status, event.Reason, updated)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// checkkey verifies that a private key corresponds to the expected did:key, without starting the server.
+// Use it when setting up credentials or rotating keys, before deploying.
+//
+// With -config, it checks the primary and secondary keys of an environment of the configuration, as the server
+// does when it starts, so a new key can be verified before promoting it. See "Rotating the issuer key" in the README.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/hesusruiz/onboardng/common"
+	"github.com/hesusruiz/onboardng/credissuance"
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func main() {
+	keyFile := flag.String("key", "", "file with the hex-encoded private key")
+	keyType := flag.String("type", "", "type of the private key: P-256, Ed25519 or secp256k1 (detected from the key length if empty)")
+	expected := flag.String("did", "", "the did:key expected for the private key")
+	configFile := flag.String("config", "", "check the keys of the configuration file, instead of -key")
+	envName := flag.String("env", "pro", "environment of the configuration to check (dev, pre or pro)")
+	flag.Parse()
+
+	if *configFile != "" {
+		checkConfig(*configFile, *envName)
+		return
+	}
+
+	if *keyFile == "" {
+		fmt.Fprintln(os.Stderr, "usage: checkkey -key <private key file> [-type <key type>] [-did <expected did:key>]")
+		fmt.Fprintln(os.Stderr, "       checkkey -config <configuration file> [-env <environment>]")
+		os.Exit(2)
+	}
+
+	privateKey, err := credissuance.ReadPrivateKey(*keyFile, common.KeyType(*keyType))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading the private key:", err)
+		os.Exit(1)
+	}
+
+	didKey, err := common.DidKeyFromPrivateKey(privateKey)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error deriving the did:key:", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("--- DERIVED DID:KEY ---")
+	fmt.Println(didKey)
+
+	if *expected == "" {
+		return
+	}
+
+	if didKey != *expected {
+		fmt.Println("\nMISMATCH: the private key does not correspond to", *expected)
+		os.Exit(1)
+	}
+	fmt.Println("\nOK: the private key corresponds to the expected did:key")
+}
+
+// checkConfig checks that the primary and secondary keys of the environment correspond to their did:key,
+// and that their machine credentials can be read
+func checkConfig(configFile string, envName string) {
+	cfg, err := configuration.Load(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading the configuration:", err)
+		os.Exit(1)
+	}
+	envConfig, ok := cfg.Environments[envName]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Environment not found in the configuration:", envName)
+		os.Exit(1)
+	}
+
+	keys := []struct {
+		name string
+		cfg  configuration.SigningKeyConfig
+	}{
+		{"primary", envConfig.PrimaryKey()},
+		{"secondary", envConfig.SecondaryKey},
+	}
+
+	failed := false
+	for _, key := range keys {
+		if !key.cfg.Enabled() {
+			fmt.Printf("%s key: not configured\n", key.name)
+			continue
+		}
+		if _, err := credissuance.LoadSigningKey(key.cfg); err != nil {
+			fmt.Printf("%s key: ERROR: %v\n", key.name, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s key: OK: %s\n", key.name, key.cfg.MyDidkey)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
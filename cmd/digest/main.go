@@ -0,0 +1,69 @@
+// digest sends the summary of the registrations of a day to the onboarding team, the same email the server sends
+// every day when the daily digest is enabled. Use it to send the digest from cron instead, or to send it again.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+	"github.com/hesusruiz/onboardng/internal/mail"
+)
+
+func main() {
+	configFlag := flag.String("config", "config.yaml", "path to the configuration file")
+	envFlag := flag.String("env", "dev", "environment of the registrations (dev, pre or pro)")
+	dbFlag := flag.String("db", "data/onboarding.db", "path to the database")
+	dayFlag := flag.String("day", "", "day of the registrations as YYYY-MM-DD, yesterday by default")
+	flag.Parse()
+
+	day := time.Now().AddDate(0, 0, -1)
+	if *dayFlag != "" {
+		var err error
+		day, err = time.ParseInLocation(time.DateOnly, *dayFlag, time.Local)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid day, expected YYYY-MM-DD:", *dayFlag)
+			os.Exit(2)
+		}
+	}
+
+	cfg, err := configuration.Load(*configFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading the configuration:", err)
+		os.Exit(1)
+	}
+	envConfig, ok := cfg.Environments[*envFlag]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Environment not found in the configuration:", *envFlag)
+		os.Exit(1)
+	}
+	runtime := configuration.RuntimeEnv(*envFlag)
+
+	dbService, err := db.Open(*dbFlag, runtime)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening the database:", err)
+		os.Exit(1)
+	}
+	defer dbService.Close()
+
+	mailService, err := mail.NewMailService(runtime, envConfig.Mail, os.DirFS(filepath.Join(cfg.SrcDir, "email")))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error creating the mail service:", err)
+		os.Exit(1)
+	}
+
+	sent, err := mailService.SendDailyDigest(dbService, day)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error sending the digest:", err)
+		os.Exit(1)
+	}
+	if !sent {
+		fmt.Println("Digest of", day.Format(time.DateOnly), "not sent: sending emails is disabled, or there were no registrations")
+		return
+	}
+	fmt.Println("Digest of", day.Format(time.DateOnly), "sent")
+}
@@ -1,53 +1,91 @@
+// priv2pem converts a raw hex-encoded P-256 private key into a PEM (PKCS#8) private key,
+// optionally printing the did:key associated to it.
+//
+// The hex key is read from the -key flag, the -in file or, if neither is given, from stdin.
 package main
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/x509"
-	"encoding/hex"
 	"encoding/pem"
+	"flag"
 	"fmt"
+	"io"
 	"os"
-	"strings"
 
-	"github.com/mr-tron/base58/base58"
+	"github.com/hesusruiz/onboardng/common"
+	"github.com/hesusruiz/onboardng/credissuance"
 )
 
 func main() {
-	hexKey := "0x0826f120c769d4de55ad686b31c60242d87615a2bb25f53c07b580d9e7a074af"
-	// Strip any '0x' or '0X' prefix from the key and decode it
-	hexKey = strings.TrimPrefix(hexKey, "0x")
-	hexKey = strings.TrimPrefix(hexKey, "0X")
+	keyFlag := flag.String("key", "", "hex-encoded private key (with or without 0x prefix)")
+	inFlag := flag.String("in", "", "file with the hex-encoded private key (default stdin)")
+	outFlag := flag.String("out", "", "file where the PEM private key is written (default stdout)")
+	curveFlag := flag.String("curve", "P-256", "curve of the private key (only P-256 is supported)")
+	didFlag := flag.Bool("did", false, "also print the did:key derived from the private key")
+	flag.Parse()
 
-	// Get the private key raw key bytes
-	dBytes, _ := hex.DecodeString(hexKey)
+	if err := run(*keyFlag, *inFlag, *outFlag, *curveFlag, *didFlag); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
 
-	curve := elliptic.P256()
+func run(hexKey, inFile, outFile, curve string, printDid bool) error {
+	if curve != "P-256" {
+		return fmt.Errorf("unsupported curve %q, only P-256 is supported", curve)
+	}
 
-	// Import the key with the new mechanism
-	privECDSA, err := ecdsa.ParseRawPrivateKey(curve, dBytes)
-	if err != nil {
-		panic(err)
+	if hexKey != "" && inFile != "" {
+		return fmt.Errorf("use either -key or -in, not both")
 	}
 
-	// PEM (PKCS#8)
-	derBytes, _ := x509.MarshalPKCS8PrivateKey(privECDSA)
-	fmt.Println("--- PEM PRIVATE KEY ---")
-	pem.Encode(os.Stdout, &pem.Block{Type: "PRIVATE KEY", Bytes: derBytes})
+	// Get the hex key from the flag, the input file or stdin
+	if hexKey == "" {
+		var in []byte
+		var err error
+		if inFile != "" {
+			in, err = os.ReadFile(inFile)
+		} else {
+			in, err = io.ReadAll(os.Stdin)
+		}
+		if err != nil {
+			return fmt.Errorf("reading the private key: %w", err)
+		}
+		hexKey = string(in)
+	}
 
-	// did:key derivation
+	privECDSA, err := credissuance.ParsePrivateKeyHex(hexKey)
+	if err != nil {
+		return err
+	}
 
-	// Derive public coordinates
-	privECDSA.PublicKey.X, privECDSA.PublicKey.Y = curve.ScalarBaseMult(dBytes)
+	// PEM (PKCS#8)
+	derBytes, err := x509.MarshalPKCS8PrivateKey(privECDSA)
+	if err != nil {
+		return fmt.Errorf("encoding the private key: %w", err)
+	}
 
-	// Compress the public key for the DID
-	pubBytes := elliptic.MarshalCompressed(curve, privECDSA.PublicKey.X, privECDSA.PublicKey.Y)
-	prefix := []byte{0x80, 0x24} // Varint for P-256
-	didKey := "did:key:z" + base58.Encode(append(prefix, pubBytes...))
+	out := os.Stdout
+	if outFile != "" {
+		out, err = os.OpenFile(outFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("creating the output file: %w", err)
+		}
+		defer out.Close()
+	}
+	if err := pem.Encode(out, &pem.Block{Type: "PRIVATE KEY", Bytes: derBytes}); err != nil {
+		return fmt.Errorf("writing the PEM private key: %w", err)
+	}
 
-	fmt.Println("\n--- DERIVED DID:KEY ---")
-	fmt.Println(didKey)
+	// did:key derivation, using the same logic as the issuance service
+	if printDid {
+		didKey, err := common.DidKeyFromPrivateKey(privECDSA)
+		if err != nil {
+			return fmt.Errorf("deriving the did:key: %w", err)
+		}
+		fmt.Fprintln(os.Stderr, "--- DERIVED DID:KEY ---")
+		fmt.Fprintln(os.Stderr, didKey)
+	}
 
-	// Use privECDSA here to sign your JWT with a library like golang-jwt/jwt
-	fmt.Println("\nSuccess: Use 'privECDSA' variable for JWT signing.")
+	return nil
 }
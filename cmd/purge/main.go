@@ -0,0 +1,62 @@
+// purge deletes or anonymizes the registrations older than the retention of the configuration, as the server does
+// periodically. Use it to purge on demand, e.g. after reducing the retention or when the server does not purge.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+func main() {
+	configFlag := flag.String("config", "config.yaml", "path to the configuration file")
+	envFlag := flag.String("env", "dev", "environment of the registrations (dev, pre or pro)")
+	dbFlag := flag.String("db", "data/onboarding.db", "path to the database")
+	maxAgeFlag := flag.Duration("max-age", 0, "purge the registrations older than this, instead of the retention of the configuration")
+	flag.Parse()
+
+	cfg, err := configuration.Load(*configFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading the configuration:", err)
+		os.Exit(1)
+	}
+	envConfig, ok := cfg.Environments[*envFlag]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Environment not found in the configuration:", *envFlag)
+		os.Exit(1)
+	}
+	envConfig.Runtime = configuration.RuntimeEnv(*envFlag)
+
+	retention := envConfig.Retention
+	if *maxAgeFlag > 0 {
+		retention.MaxAge = *maxAgeFlag
+	}
+	if !retention.Enabled() {
+		fmt.Fprintln(os.Stderr, "No retention in the configuration of", *envFlag+", use -max-age to purge anyway")
+		os.Exit(2)
+	}
+
+	dbService, err := db.Open(*dbFlag, envConfig.Runtime)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening the database:", err)
+		os.Exit(1)
+	}
+	defer dbService.Close()
+
+	opts := db.NewPurgeOptions(retention, time.Now())
+	purged, err := dbService.PurgeRegistrations(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error purging the registrations:", err)
+		os.Exit(1)
+	}
+
+	action := "Deleted"
+	if opts.Anonymize {
+		action = "Anonymized"
+	}
+	fmt.Printf("%s %d registrations created before %s\n", action, purged, opts.Before.Format(time.DateTime))
+}
@@ -0,0 +1,204 @@
+// reissue prints the request sent to the Issuer for a stored registration, and optionally sends it again.
+// Use it to recover a registration whose issuance failed, instead of copying the payload from the error email.
+// The request saved with the registration is sent as it was, unless -rebuild builds it from the current configuration.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hesusruiz/onboardng/credissuance"
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+func main() {
+	configFlag := flag.String("config", "config.yaml", "path to the configuration file")
+	envFlag := flag.String("env", "dev", "environment of the registration (dev, pre or pro)")
+	dbFlag := flag.String("db", "", "path to the SQLite database, instead of the database of the configuration")
+	idFlag := flag.String("id", "", "id of the registration")
+	rebuildFlag := flag.Bool("rebuild", false, "build the request with the powers and claims of the current configuration, instead of the one saved")
+	sendFlag := flag.Bool("send", false, "send the request to the Issuer, instead of only printing it")
+	forceFlag := flag.Bool("force", false, "send the request even if the credential was already issued")
+	flag.Parse()
+
+	if *idFlag == "" {
+		fmt.Fprintln(os.Stderr, "usage: reissue -id <registration id> [-env <environment>] [-config <config file>] [-db <database>] [-rebuild] [-send [-force]]")
+		os.Exit(2)
+	}
+
+	cfg, err := configuration.Load(*configFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading the configuration:", err)
+		os.Exit(1)
+	}
+	envConfig, ok := cfg.Environments[*envFlag]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Environment not found in the configuration:", *envFlag)
+		os.Exit(1)
+	}
+	envConfig.Runtime = configuration.RuntimeEnv(*envFlag)
+	// The result is recorded here, so the credential is issued synchronously even if the server uses the async mode
+	envConfig.Issuer.OperationMode = configuration.SyncOperationMode
+
+	if err := envConfig.Issuer.ValidateCredentialRequest(); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid issuer in the configuration:", err)
+		os.Exit(1)
+	}
+
+	// The database of the server, unless another SQLite file is given
+	dbConfig := envConfig.Database
+	if *dbFlag != "" {
+		dbConfig = configuration.DatabaseConfig{DSN: *dbFlag}
+	}
+	dbService, err := db.NewService(dbConfig, envConfig.Runtime)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening the database:", err)
+		os.Exit(1)
+	}
+	defer dbService.Close()
+
+	reg, err := dbService.GetRegistrationByID(*idFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading the registration:", err)
+		os.Exit(1)
+	}
+
+	var cred *credissuance.LEARIssuanceRequestBody
+	if *rebuildFlag {
+		cred, err = rebuildRequest(envConfig, reg)
+	} else {
+		cred, err = savedRequest(dbService, reg)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error building the request:", err)
+		os.Exit(1)
+	}
+	buf, err := json.MarshalIndent(cred, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error formatting the request:", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(buf))
+
+	if !*sendFlag {
+		return
+	}
+
+	if reg.Status == db.StatusIssued && !*forceFlag {
+		fmt.Fprintln(os.Stderr, "\nThe credential of registration", reg.RegistrationID, "was already issued, use -force to issue it again")
+		os.Exit(1)
+	}
+
+	issuer, err := credissuance.NewLEARIssuance(envConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error creating the issuance service:", err)
+		os.Exit(1)
+	}
+
+	// The saved request is replaced only by a rebuilt one, to keep the request actually sent
+	if *rebuildFlag {
+		if err := dbService.SaveIssuancePayload(reg.RegistrationID, string(buf)); err != nil {
+			fmt.Fprintln(os.Stderr, "Error saving the request in the registration:", err)
+		}
+	}
+
+	reg.IssuanceAt = time.Now()
+	resp, err := issuer.LEARIssuanceRequest(cred)
+	if resp != nil {
+		issuerResponse := &db.IssuerResponse{StatusCode: resp.StatusCode, Body: string(resp.Body), DurationMs: resp.Duration.Milliseconds()}
+		if err := dbService.SaveIssuerResponse(reg.RegistrationID, issuerResponse); err != nil {
+			fmt.Fprintln(os.Stderr, "Error saving the response of the Issuer in the registration:", err)
+		}
+	}
+	if err != nil {
+		reg.IssuanceError = err.Error()
+		reg.Status = db.StatusFailed
+		if updateErr := dbService.UpdateRegistrationStatus(reg); updateErr != nil {
+			fmt.Fprintln(os.Stderr, "Error updating the registration:", updateErr)
+		}
+		fmt.Fprintln(os.Stderr, "\nError issuing the credential:", err)
+		os.Exit(1)
+	}
+
+	// An error reported in the body fails the issuance, as in the server. Otherwise the Issuer accepted the request,
+	// and a response that can not be read only leaves the credential without identifier.
+	result, err := credissuance.ParseIssuanceResponse(resp.Body)
+	var issuerErr *credissuance.IssuerError
+	if errors.As(err, &issuerErr) {
+		reg.IssuanceError = err.Error()
+		reg.Status = db.StatusFailed
+		if updateErr := dbService.UpdateRegistrationStatus(reg); updateErr != nil {
+			fmt.Fprintln(os.Stderr, "Error updating the registration:", updateErr)
+		}
+		fmt.Fprintln(os.Stderr, "\nError issuing the credential:", err)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not read the response of the Issuer:", err)
+	}
+	if result == nil {
+		result = &credissuance.IssuanceResult{}
+	}
+	reg.CredentialID = result.CredentialID
+	reg.IssuanceError = ""
+	reg.Status = db.StatusIssued
+	if err := dbService.UpdateRegistrationStatus(reg); err != nil {
+		fmt.Fprintln(os.Stderr, "Error updating the registration:", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("\nOK: credential issued for registration", reg.RegistrationID)
+	if result.CredentialID != "" {
+		fmt.Println("Credential:", result.CredentialID)
+	}
+	if result.OfferURI != "" {
+		fmt.Println("Credential offer:", result.OfferURI)
+	}
+}
+
+// savedRequest returns the last request sent to the Issuer for the registration, in synchronous mode
+func savedRequest(dbService *db.Service, reg *db.Registration) (*credissuance.LEARIssuanceRequestBody, error) {
+	payload, err := dbService.GetIssuancePayload(reg.RegistrationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the saved request: %w", err)
+	}
+	if payload == "" {
+		return nil, fmt.Errorf("no request saved in registration %s, use -rebuild to build it from the configuration", reg.RegistrationID)
+	}
+	cred, err := credissuance.ParseLEARIssuanceRequestBody([]byte(payload))
+	if err != nil {
+		return nil, fmt.Errorf("invalid saved request: %w", err)
+	}
+
+	// The result is recorded here, so the Issuer must not send it to the response URI of the server
+	cred.OperationMode = configuration.SyncOperationMode
+	cred.ResponseUri = ""
+	return cred, nil
+}
+
+// rebuildRequest builds the request to issue the credential of the registration with the powers and claims
+// of the current configuration, as the server does when the registration is received
+func rebuildRequest(envConfig configuration.EnvConfig, reg *db.Registration) (*credissuance.LEARIssuanceRequestBody, error) {
+	powers := envConfig.CredentialPowers()
+	if err := configuration.ValidatePowers(powers); err != nil {
+		return nil, fmt.Errorf("invalid powers in the configuration: %w", err)
+	}
+	if err := envConfig.ValidateClaims(); err != nil {
+		return nil, fmt.Errorf("invalid claims in the configuration: %w", err)
+	}
+
+	applicant := credissuance.Applicant{
+		Email:       reg.Email,
+		FirstName:   reg.FirstName,
+		LastName:    reg.LastName,
+		CompanyName: reg.CompanyName,
+		Country:     reg.Country,
+		VatID:       reg.VatID,
+	}
+	return credissuance.NewLEARIssuanceRequestBody(applicant, powers, envConfig.CredentialClaims(reg.ExtraFields), envConfig.Issuer), nil
+}
@@ -0,0 +1,179 @@
+// seed fills the database with sample registrations, so the admin endpoints can be developed and demoed with
+// enough data to page and search through. The registrations have varied countries and statuses: most issued, and
+// some pending, with issuance errors or with bounced welcome emails. It refuses to run on the production database.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hesusruiz/onboardng/common"
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+// maxAttempts limits the retries of a registration whose random id, email or VAT ID is already taken
+const maxAttempts = 5
+
+var (
+	firstNames = []string{"Ana", "Luca", "Marie", "Jonas", "Sofia", "Pieter", "Eva", "Mateo", "Chiara", "Nils", "Inês", "Tomasz", "Aoife", "Mikko", "Elena"}
+	lastNames  = []string{"García", "Rossi", "Dubois", "Müller", "Jansen", "Novak", "Kowalski", "Silva", "Murphy", "Virtanen", "Papadopoulos", "Nielsen", "Horvat", "Popescu", "Berg"}
+	companies  = []string{"Acme", "Globex", "Initech", "Umbrella", "Stark", "Wayne", "Tyrell", "Cyberdyne", "Soylent", "Hooli", "Vandelay", "Wonka"}
+	suffixes   = []string{"Solutions", "Cloud", "Data", "Systems", "Labs", "Networks", "Digital"}
+
+	issuanceErrors = []string{
+		"the Issuer replied 503 Service Unavailable",
+		"the Issuer replied 400 Bad Request: invalid mandatee",
+		"error requesting the access token: context deadline exceeded",
+	}
+	emailErrors = []string{
+		"550 5.1.1 mailbox unavailable",
+		"552 5.2.2 mailbox full",
+	}
+)
+
+func main() {
+	configFlag := flag.String("config", "config.yaml", "path to the configuration file")
+	envFlag := flag.String("env", "dev", "environment of the registrations (dev or pre)")
+	dbFlag := flag.String("db", "data/onboarding.db", "path to the database")
+	countFlag := flag.Int("n", 100, "number of registrations to create")
+	flag.Parse()
+
+	runtime := configuration.RuntimeEnv(*envFlag)
+	if runtime == configuration.Production {
+		fmt.Fprintln(os.Stderr, "Refusing to seed the registrations of production")
+		os.Exit(2)
+	}
+	if *countFlag <= 0 {
+		fmt.Fprintln(os.Stderr, "usage: seed [-n <registrations>] [-env <environment>] [-config <config file>] [-db <database>]")
+		os.Exit(2)
+	}
+
+	cfg, err := configuration.Load(*configFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading the configuration:", err)
+		os.Exit(1)
+	}
+	if _, ok := cfg.Environments[*envFlag]; !ok {
+		fmt.Fprintln(os.Stderr, "Environment not found in the configuration:", *envFlag)
+		os.Exit(1)
+	}
+	if isProductionDatabase(cfg, *dbFlag) {
+		fmt.Fprintln(os.Stderr, "Refusing to seed", *dbFlag+", it is the database of production in the configuration")
+		os.Exit(2)
+	}
+
+	// The database logs each registration saved
+	slog.SetLogLoggerLevel(slog.LevelWarn)
+
+	dbService, err := db.Open(*dbFlag, runtime)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening the database:", err)
+		os.Exit(1)
+	}
+	defer dbService.Close()
+
+	statuses := map[string]int{}
+	for range *countFlag {
+		reg, err := seedRegistration(dbService)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error saving a registration:", err)
+			os.Exit(1)
+		}
+		statuses[reg.Status]++
+		if reg.NotifEmailError != "" {
+			statuses["email error"]++
+		}
+	}
+
+	fmt.Printf("Created %d registrations in %s: %d issued, %d failed, %d pending, %d with email errors\n",
+		*countFlag, *dbFlag, statuses[db.StatusIssued], statuses[db.StatusFailed], statuses[db.StatusPending], statuses["email error"])
+}
+
+// isProductionDatabase reports whether the SQLite database in path is the one of the pro environment of the
+// configuration, which uses the default path when it does not set one
+func isProductionDatabase(cfg *configuration.Config, path string) bool {
+	pro, ok := cfg.Environments[string(configuration.Production)]
+	if !ok {
+		return false
+	}
+	proPath := pro.Database.DSN
+	if proPath == "" {
+		proPath = "data/onboarding.db"
+	}
+	a, errA := filepath.Abs(proPath)
+	b, errB := filepath.Abs(path)
+	return errA == nil && errB == nil && a == b
+}
+
+// seedRegistration saves a random registration, and then sets the result of its issuance and welcome email.
+// A random id, email or VAT ID already taken is replaced, as they must be unique.
+func seedRegistration(dbService *db.Service) (*db.Registration, error) {
+	var err error
+	for range maxAttempts {
+		reg := randomRegistration()
+		if err = dbService.SaveRegistration(reg); err != nil {
+			if errors.Is(err, db.ErrDuplicateEmail) || errors.Is(err, db.ErrDuplicateVatID) || errors.Is(err, db.ErrDuplicateRegistrationID) {
+				continue
+			}
+			return nil, err
+		}
+
+		randomOutcome(reg)
+		return reg, dbService.UpdateRegistrationStatus(reg)
+	}
+	return nil, err
+}
+
+// randomRegistration returns a registration with a random person and company of a random country
+func randomRegistration() *db.Registration {
+	first := pick(firstNames)
+	last := pick(lastNames)
+	company := pick(companies) + " " + pick(suffixes)
+	country := pick(common.Countries).Code
+	domain := strings.ToLower(strings.ReplaceAll(company, " ", "-")) + ".example"
+
+	return &db.Registration{
+		RegistrationID: fmt.Sprintf("%s-%08d", time.Now().Format("20060102"), rand.IntN(100_000_000)),
+		Email:          fmt.Sprintf("%s.%s.%06d@%s", strings.ToLower(first), strings.ToLower(last), rand.IntN(1_000_000), domain),
+		FirstName:      first,
+		LastName:       last,
+		CompanyName:    company,
+		Country:        country,
+		VatID:          fmt.Sprintf("%s%09d", country, rand.IntN(1_000_000_000)),
+		Language:       common.ResolveLanguage("", country),
+	}
+}
+
+// randomOutcome sets the result of the issuance and of the welcome email of a saved registration:
+// 70% issued, 15% failed and 15% pending, and one of each ten issued ones with a bounced email
+func randomOutcome(reg *db.Registration) {
+	now := time.Now()
+	switch n := rand.IntN(100); {
+	case n < 70:
+		reg.Status = db.StatusIssued
+		reg.IssuanceAt = now
+		reg.CredentialID = fmt.Sprintf("urn:uuid:%08x-%04x-4%03x-8%03x-%012x", rand.Uint32(), rand.IntN(0x10000), rand.IntN(0x1000), rand.IntN(0x1000), rand.Int64N(1<<48))
+		reg.NotifEmailAt = now
+		reg.DeliveryStatus = db.DeliveryDelivered
+		if rand.IntN(10) == 0 {
+			reg.NotifEmailError = pick(emailErrors)
+			reg.DeliveryStatus = db.DeliveryBounced
+		}
+	case n < 85:
+		reg.Status = db.StatusFailed
+		reg.IssuanceAt = now
+		reg.IssuanceError = pick(issuanceErrors)
+	}
+}
+
+func pick[T any](values []T) T {
+	return values[rand.IntN(len(values))]
+}
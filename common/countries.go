@@ -1,8 +1,31 @@
 package common
 
+import (
+	_ "embed"
+	"encoding/json"
+)
+
 type Country struct {
-	Code string
-	Name string
+	Code string `json:"code"`
+	// Name is the name in English
+	Name string `json:"name"`
+	// Names are the names in the other languages, keyed by language code
+	Names map[string]string `json:"-"`
+}
+
+// countryNames are the localized names of the countries, keyed by country code and then by language
+//
+//go:embed country_names.json
+var countryNames []byte
+
+func init() {
+	var names map[string]map[string]string
+	if err := json.Unmarshal(countryNames, &names); err != nil {
+		panic("invalid embedded country names: " + err.Error())
+	}
+	for i := range Countries {
+		Countries[i].Names = names[Countries[i].Code]
+	}
 }
 
 var Countries = []Country{
@@ -38,15 +61,34 @@ var Countries = []Country{
 	{Code: "NZ", Name: "New Zealand"},
 }
 
-func GetCountryName(code string) string {
+// LocalizedName returns the name of the country in the given language, or in English if it is not localized
+func (c Country) LocalizedName(lang string) string {
+	if name, ok := c.Names[lang]; ok {
+		return name
+	}
+	return c.Name
+}
+
+// GetCountryName returns the name of the country in the given language, falling back to English,
+// or "" if the country is not supported
+func GetCountryName(code string, lang string) string {
 	for _, c := range Countries {
 		if c.Code == code {
-			return c.Name
+			return c.LocalizedName(lang)
 		}
 	}
 	return ""
 }
 
+// LocalizedCountries returns the supported countries with their name in the given language, falling back to English
+func LocalizedCountries(lang string) []Country {
+	result := make([]Country, len(Countries))
+	for i, c := range Countries {
+		result[i] = Country{Code: c.Code, Name: c.LocalizedName(lang), Names: c.Names}
+	}
+	return result
+}
+
 func IsValidCountry(code string) bool {
 	for _, c := range Countries {
 		if c.Code == code {
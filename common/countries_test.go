@@ -0,0 +1,40 @@
+package common
+
+import "testing"
+
+func TestGetCountryName(t *testing.T) {
+	tests := []struct {
+		code string
+		lang string
+		want string
+	}{
+		{code: "DE", lang: "en", want: "Germany"},
+		{code: "DE", lang: "de", want: "Deutschland"},
+		{code: "ES", lang: "fr", want: "Espagne"},
+		{code: "AT", lang: "it", want: "Austria"},
+		// Languages without localization fall back to English
+		{code: "DE", lang: "pl", want: "Germany"},
+		{code: "DE", lang: "", want: "Germany"},
+		{code: "XX", lang: "de", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := GetCountryName(tt.code, tt.lang); got != tt.want {
+			t.Errorf("GetCountryName(%q, %q) = %q, want %q", tt.code, tt.lang, got, tt.want)
+		}
+	}
+}
+
+func TestCountriesLocalized(t *testing.T) {
+	// Every supported country has a name in every supported language
+	for _, c := range Countries {
+		for _, lang := range SupportedLanguages {
+			if lang == DefaultLanguage {
+				continue
+			}
+			if c.Names[lang] == "" {
+				t.Errorf("country %s has no name in %q", c.Code, lang)
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"fmt"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/mr-tron/base58/base58"
+)
+
+// KeyType identifies the algorithm of the keys used to sign tokens and derive the did:key
+type KeyType string
+
+const (
+	// KeyTypeP256 is an ECDSA key on the NIST P-256 curve (the default)
+	KeyTypeP256 KeyType = "P-256"
+	// KeyTypeEd25519 is an EdDSA key on Curve25519
+	KeyTypeEd25519 KeyType = "Ed25519"
+	// KeyTypeSecp256k1 is an ECDSA key on the secp256k1 curve
+	KeyTypeSecp256k1 KeyType = "secp256k1"
+)
+
+// multicodecPrefixes are the varint-encoded multicodec prefixes of the public keys for each key type
+var multicodecPrefixes = map[KeyType][]byte{
+	KeyTypeP256:      {0x80, 0x24},
+	KeyTypeEd25519:   {0xed, 0x01},
+	KeyTypeSecp256k1: {0xe7, 0x01},
+}
+
+// publicKeySizes is the size of the encoded public key for each key type (compressed for the ECDSA curves)
+var publicKeySizes = map[KeyType]int{
+	KeyTypeP256:      33,
+	KeyTypeEd25519:   ed25519.PublicKeySize,
+	KeyTypeSecp256k1: 33,
+}
+
+// DidKeyFromPrivateKey derives the did:key associated to the public key of a P-256, Ed25519 or secp256k1 private key
+func DidKeyFromPrivateKey(priv crypto.Signer) (string, error) {
+	if priv == nil {
+		return "", fmt.Errorf("no private key")
+	}
+	return DidKeyFromPublicKey(priv.Public())
+}
+
+// DidKeyFromPublicKey encodes a P-256, Ed25519 or secp256k1 public key as a did:key
+func DidKeyFromPublicKey(pub crypto.PublicKey) (string, error) {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return "", fmt.Errorf("only P-256 ECDSA public keys are supported")
+		}
+		compressed, err := compressP256(pub)
+		if err != nil {
+			return "", err
+		}
+		return DidKeyFromEncodedPublicKey(KeyTypeP256, compressed)
+	case ed25519.PublicKey:
+		return DidKeyFromEncodedPublicKey(KeyTypeEd25519, pub)
+	case *secp256k1.PublicKey:
+		return DidKeyFromEncodedPublicKey(KeyTypeSecp256k1, pub.SerializeCompressed())
+	default:
+		return "", fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// DidKeyFromEncodedPublicKey encodes a public key given as bytes: compressed (33 bytes) for P-256 and secp256k1,
+// and raw (32 bytes) for Ed25519.
+// The did:key is the base58btc multibase encoding of the multicodec prefix followed by the public key.
+func DidKeyFromEncodedPublicKey(keyType KeyType, pub []byte) (string, error) {
+	prefix, ok := multicodecPrefixes[keyType]
+	if !ok {
+		return "", fmt.Errorf("unsupported key type %q", keyType)
+	}
+	if len(pub) != publicKeySizes[keyType] {
+		return "", fmt.Errorf("a %s public key must be %d bytes, got %d", keyType, publicKeySizes[keyType], len(pub))
+	}
+	if keyType != KeyTypeEd25519 && pub[0] != 0x02 && pub[0] != 0x03 {
+		return "", fmt.Errorf("the %s public key is not in compressed form", keyType)
+	}
+
+	keyBytes := make([]byte, 0, len(prefix)+len(pub))
+	keyBytes = append(keyBytes, prefix...)
+	keyBytes = append(keyBytes, pub...)
+
+	return "did:key:z" + base58.Encode(keyBytes), nil
+}
+
+// compressP256 returns the 33-byte compressed form of a P-256 public key
+func compressP256(pub *ecdsa.PublicKey) ([]byte, error) {
+	// This is the uncompressed public key: 0x04 || X || Y
+	uncompressed, err := pub.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	// Extract X and Y from the slice
+	// X is bytes [1:33], Y is bytes [33:65]
+	xBytes := uncompressed[1:33]
+	yLastByte := uncompressed[64]
+
+	// Determine the compressedPrefix (0x02 if Y is even, 0x03 if Y is odd)
+	var compressedPrefix byte = 0x02
+	if yLastByte%2 != 0 {
+		compressedPrefix = 0x03
+	}
+
+	return append([]byte{compressedPrefix}, xBytes...), nil
+}
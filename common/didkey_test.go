@@ -0,0 +1,176 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/mr-tron/base58/base58"
+)
+
+func TestDidKeyFromPrivateKey(t *testing.T) {
+	vectors := []struct {
+		name   string
+		hexKey string
+		didKey string
+	}{
+		{
+			// The private key 1 has the generator of the curve as public key
+			name:   "generator point",
+			hexKey: "0000000000000000000000000000000000000000000000000000000000000001",
+			didKey: "did:key:zDnaepsL7AXenJkVYdkh5KuKsSU7Ykh7kyXaLLU7auN9FWSiZ",
+		},
+		{
+			name:   "sample key",
+			hexKey: "0826f120c769d4de55ad686b31c60242d87615a2bb25f53c07b580d9e7a074af",
+			didKey: "did:key:zDnaehBC97ZSEc6cwHLXXr6Zfrj1Tv9bxtsuFGPkxcXMj6FaZ",
+		},
+	}
+
+	for _, v := range vectors {
+		t.Run(v.name, func(t *testing.T) {
+			d, err := hex.DecodeString(v.hexKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			priv, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), d)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := DidKeyFromPrivateKey(priv)
+			if err != nil {
+				t.Fatalf("DidKeyFromPrivateKey failed: %v", err)
+			}
+			if got != v.didKey {
+				t.Errorf("expected %s, got %s", v.didKey, got)
+			}
+		})
+	}
+}
+
+func TestDidKeyMatchesStandardCompression(t *testing.T) {
+	for range 20 {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		uncompressed, err := priv.PublicKey.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		x, y := elliptic.Unmarshal(elliptic.P256(), uncompressed)
+		compressed := elliptic.MarshalCompressed(elliptic.P256(), x, y)
+		want := "did:key:z" + base58.Encode(append([]byte{0x80, 0x24}, compressed...))
+
+		got, err := DidKeyFromPublicKey(&priv.PublicKey)
+		if err != nil {
+			t.Fatalf("DidKeyFromPublicKey failed: %v", err)
+		}
+		if got != want {
+			t.Fatalf("expected %s, got %s", want, got)
+		}
+	}
+}
+
+func TestDidKeyRejectsOtherCurves(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DidKeyFromPrivateKey(priv); err == nil {
+		t.Errorf("expected an error for a P-384 key")
+	}
+}
+
+func TestDidKeyEd25519(t *testing.T) {
+	// The key of the first test vector of RFC 8032, section 7.1
+	seed, err := hex.DecodeString("9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60")
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+	if got := hex.EncodeToString(priv.Public().(ed25519.PublicKey)); got != "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a" {
+		t.Fatalf("unexpected public key %s", got)
+	}
+
+	got, err := DidKeyFromPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("DidKeyFromPrivateKey failed: %v", err)
+	}
+	want := "did:key:z6MktwupdmLXVVqTzCw4i46r4uGyosGXRnR3XjN4Zq7oMMsw"
+	if got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestDidKeySecp256k1(t *testing.T) {
+	// The private key 1 has the generator of the curve as public key
+	one, err := hex.DecodeString("0000000000000000000000000000000000000000000000000000000000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv := secp256k1.PrivKeyFromBytes(one)
+
+	got, err := DidKeyFromPublicKey(priv.PubKey())
+	if err != nil {
+		t.Fatalf("DidKeyFromPublicKey failed: %v", err)
+	}
+	want := "did:key:zQ3shVc2UkAfJCdc1TR8E66J85h48P43r93q8jGPkPpjF9Ef9"
+	if got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestDidKeyFromEncodedPublicKey(t *testing.T) {
+	// The compressed generator point of secp256k1
+	secp256k1G, _ := hex.DecodeString("0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+	ed25519Pub := make([]byte, ed25519.PublicKeySize)
+
+	tests := []struct {
+		name    string
+		keyType KeyType
+		pub     []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "secp256k1", keyType: KeyTypeSecp256k1, pub: secp256k1G, want: "did:key:zQ3shVc2UkAfJCdc1TR8E66J85h48P43r93q8jGPkPpjF9Ef9"},
+		{name: "Ed25519 has the z6Mk prefix", keyType: KeyTypeEd25519, pub: ed25519Pub, want: "did:key:z6Mk"},
+		{name: "wrong length", keyType: KeyTypeSecp256k1, pub: secp256k1G[1:], wantErr: true},
+		{name: "uncompressed", keyType: KeyTypeP256, pub: append([]byte{0x04}, secp256k1G[1:]...), wantErr: true},
+		{name: "unknown key type", keyType: "RSA", pub: secp256k1G, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DidKeyFromEncodedPublicKey(tt.keyType, tt.pub)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DidKeyFromEncodedPublicKey failed: %v", err)
+			}
+			if !strings.HasPrefix(got, tt.want) {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+
+			// The multicodec prefix must be the one of the key type
+			decoded, err := base58.Decode(strings.TrimPrefix(got, "did:key:z"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prefix := decoded[:2]; string(prefix) != string(multicodecPrefixes[tt.keyType]) {
+				t.Errorf("expected multicodec prefix %x, got %x", multicodecPrefixes[tt.keyType], prefix)
+			}
+		})
+	}
+}
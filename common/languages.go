@@ -0,0 +1,41 @@
+package common
+
+import "strings"
+
+// DefaultLanguage is used when we have no better information about the language of the user
+const DefaultLanguage = "en"
+
+// SupportedLanguages are the languages for which we have localized content
+var SupportedLanguages = []string{"en", "es", "fr", "de", "it"}
+
+// countryLanguages maps a country code to the language we use for users from that country
+var countryLanguages = map[string]string{
+	"ES": "es",
+	"FR": "fr",
+	"DE": "de",
+	"AT": "de",
+	"IT": "it",
+}
+
+func IsSupportedLanguage(lang string) bool {
+	for _, l := range SupportedLanguages {
+		if l == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveLanguage returns the language to use for a user.
+// An explicit (supported) language preference wins, otherwise the language is derived from the country,
+// falling back to DefaultLanguage.
+func ResolveLanguage(preferred string, country string) string {
+	preferred = strings.ToLower(strings.TrimSpace(preferred))
+	if IsSupportedLanguage(preferred) {
+		return preferred
+	}
+	if lang, ok := countryLanguages[strings.ToUpper(country)]; ok {
+		return lang
+	}
+	return DefaultLanguage
+}
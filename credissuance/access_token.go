@@ -2,12 +2,17 @@ package credissuance
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"strings"
 	"time"
@@ -15,45 +20,113 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// maxErrorBodySize limits how much of an error response we include in the returned error
+const maxErrorBodySize = 4096
+
+// VerifierClient obtains access tokens from the token endpoint of the Verifier, authenticating
+// with a client assertion that wraps our LEARCredentialMachine in a Verifiable Presentation
+type VerifierClient struct {
+	// TokenEndpoint is the URL of the token endpoint of the Verifier
+	TokenEndpoint string
+	// VerifierURL is the audience of the client assertion
+	VerifierURL string
+	// MachineCredential is the LEARCredentialMachine, as a JWT
+	MachineCredential string
+	// DidKey identifies us as client, and must correspond to PrivateKey
+	DidKey string
+	// PrivateKey signs the client assertion and the Verifiable Presentation
+	PrivateKey crypto.Signer
+	// HTTPClient is used to call the token endpoint. If nil, http.DefaultClient is used
+	HTTPClient *http.Client
+
+	retry retryPolicy
+}
+
+// TokenError is the error replied by the token endpoint of the Verifier
+type TokenError struct {
+	StatusCode int
+	Status     string
+	// Body is the beginning of the response, which usually explains the error
+	Body string
+}
+
+func (e *TokenError) Error() string {
+	return fmt.Sprintf("error calling Token Endpoint: %v: %s", e.Status, e.Body)
+}
+
+// Rejected reports whether the Verifier rejected our credentials, instead of failing to process the request
+func (e *TokenError) Rejected() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500
+}
+
+// TokenRequest requests an access token from the Verifier with the default HTTP client
 func TokenRequest(
 	tokenEndpoint string,
 	machineCredential string,
 	didkey string,
 	verifierURL string,
-	privateKey *ecdsa.PrivateKey,
+	privateKey crypto.Signer,
 ) (string, error) {
+	v := &VerifierClient{
+		TokenEndpoint:     tokenEndpoint,
+		VerifierURL:       verifierURL,
+		MachineCredential: machineCredential,
+		DidKey:            didkey,
+		PrivateKey:        privateKey,
+	}
+	return v.RequestToken(context.Background())
+}
+
+// tokenRequestBody builds the form-encoded body of the request to the token endpoint
+func (v *VerifierClient) tokenRequestBody() (string, error) {
 
 	// The assertion to authenticate to the token endpoint
-	cliAssertion, err := NewCliAssertion(machineCredential, didkey, verifierURL, privateKey)
+	cliAssertion, err := NewCliAssertion(v.MachineCredential, v.DidKey, v.VerifierURL, v.PrivateKey)
 	if err != nil {
 		return "", err
 	}
 
-	// Build the request body for calling the token endpoint
 	var b bytes.Buffer
-	b.WriteString("client_id=" + didkey + "&")
+	b.WriteString("client_id=" + v.DidKey + "&")
 	b.WriteString("grant_type=client_credentials&")
 	b.WriteString("client_assertion_type=urn%3Aietf%3Aparams%3Aoauth%3Aclient-assertion-type%3Ajwt-bearer&")
 	b.WriteString("client_assertion=" + cliAssertion)
 
-	requestBody := b.String()
-	_ = requestBody
-	fmt.Println(requestBody)
+	return b.String(), nil
+}
 
-	// Initialize the request to the token endpoint
-	req, _ := http.NewRequest("POST", tokenEndpoint, &b)
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+// RequestToken calls the token endpoint of the Verifier and returns the access token in the response,
+// retrying transient failures according to the retry policy of the client.
+// When the Verifier rejects the request, the returned error includes the body of its response.
+func (v *VerifierClient) RequestToken(ctx context.Context) (string, error) {
+	client := v.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	requestBody, err := v.tokenRequestBody()
+	if err != nil {
+		return "", err
+	}
 
 	// Send the request to the token endpoint and get the response
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := v.retry.doWithRetry(ctx, client, retryTransient, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", v.TokenEndpoint, strings.NewReader(requestBody))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode > 399 {
-		fmt.Println("Error calling Token Endpoint:", resp.Status, req.Host, req.URL.String())
-		return "", fmt.Errorf("error calling Token Endpoint: %v", resp.Status)
+		errorBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		slog.Error("❌ Error calling Token Endpoint", "endpoint", v.TokenEndpoint, "status", resp.Status, "body", string(errorBody))
+		return "", &TokenError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(bytes.TrimSpace(errorBody))}
 	}
 
 	responseBody, err := io.ReadAll(resp.Body)
@@ -69,11 +142,13 @@ func TokenRequest(
 	at := &accessTokenResponse{}
 	err = json.Unmarshal(responseBody, at)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("invalid response from Token Endpoint: %w", err)
+	}
+	if at.AccessToken == "" {
+		return "", fmt.Errorf("the response from Token Endpoint does not contain an access token")
 	}
-	accessToken := at.AccessToken
 
-	return accessToken, nil
+	return at.AccessToken, nil
 }
 
 type CliAssertion struct {
@@ -81,11 +156,11 @@ type CliAssertion struct {
 	VpToken string `json:"vp_token"`
 }
 
-func NewCliAssertion(learCredential string, didkey string, verifierURL string, privateKey *ecdsa.PrivateKey) (string, error) {
+func NewCliAssertion(learCredential string, didkey string, verifierURL string, privateKey crypto.Signer) (string, error) {
 
 	vpStringToken, err := NewVPToken(string(learCredential), didkey, privateKey, verifierURL)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
 	// This is the object to create the Client Assertion
@@ -111,7 +186,11 @@ func NewCliAssertion(learCredential string, didkey string, verifierURL string, p
 	claims.ID = GenerateNonce()
 
 	// Generate and sign the token
-	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	method, err := signingMethod(privateKey)
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(method, claims)
 
 	// Add the kid header
 	token.Header["kid"] = didkey
@@ -144,7 +223,7 @@ func (o *VP) String() string {
 	return string(out)
 }
 
-func NewVPToken(vcStringToken string, didkey string, privateKey *ecdsa.PrivateKey, verifierSBX string) (string, error) {
+func NewVPToken(vcStringToken string, didkey string, privateKey crypto.Signer, verifierSBX string) (string, error) {
 
 	// This is the Verifiable Presentation object
 	vp := VP{
@@ -182,7 +261,11 @@ func NewVPToken(vcStringToken string, didkey string, privateKey *ecdsa.PrivateKe
 	claims.ID = GenerateNonce()
 
 	// Generate and sign the token
-	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	method, err := signingMethod(privateKey)
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(method, claims)
 
 	// Add the kid header
 	token.Header["kid"] = didkey
@@ -197,6 +280,23 @@ func NewVPToken(vcStringToken string, didkey string, privateKey *ecdsa.PrivateKe
 
 }
 
+// signingMethod returns the JWT algorithm matching the type of the private key
+func signingMethod(privateKey crypto.Signer) (jwt.SigningMethod, error) {
+	switch key := privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("only P-256 ECDSA keys are supported for signing")
+		}
+		return jwt.SigningMethodES256, nil
+	case ed25519.PrivateKey:
+		return jwt.SigningMethodEdDSA, nil
+	case secp256k1Key:
+		return signingMethodES256K, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", privateKey)
+	}
+}
+
 func GenerateNonce() string {
 	b := make([]byte, 16)
 	io.ReadFull(rand.Reader, b)
@@ -0,0 +1,180 @@
+package credissuance
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// roundTripFunc adapts a function to http.RoundTripper, so a test can inspect each request
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// newTestVerifierClient returns a VerifierClient with a fresh P-256 key, sending its requests to the given function
+func newTestVerifierClient(t *testing.T, rt roundTripFunc) *VerifierClient {
+	t.Helper()
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	return &VerifierClient{
+		TokenEndpoint:     mockTokenEndpoint,
+		VerifierURL:       "https://verifier.example.com",
+		MachineCredential: "mock_machine_credential",
+		DidKey:            "did:key:zMock",
+		PrivateKey:        privateKey,
+		HTTPClient:        &http.Client{Transport: rt},
+	}
+}
+
+func reply(statusCode int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: statusCode,
+		Status:     http.StatusText(statusCode),
+		Body:       io.NopCloser(bytes.NewBufferString(body)),
+		Header:     make(http.Header),
+	}
+}
+
+func TestRequestTokenBuildsClientCredentialsRequest(t *testing.T) {
+	var form url.Values
+	v := newTestVerifierClient(t, func(req *http.Request) (*http.Response, error) {
+		if req.Method != http.MethodPost {
+			t.Errorf("expected POST, got %s", req.Method)
+		}
+		if req.URL.String() != mockTokenEndpoint {
+			t.Errorf("expected request to %s, got %s", mockTokenEndpoint, req.URL)
+		}
+		if ct := req.Header.Get("Content-Type"); ct != "application/x-www-form-urlencoded" {
+			t.Errorf("unexpected Content-Type %q", ct)
+		}
+		body, _ := io.ReadAll(req.Body)
+		var err error
+		if form, err = url.ParseQuery(string(body)); err != nil {
+			t.Fatalf("the request body is not form-encoded: %v", err)
+		}
+		return reply(http.StatusOK, `{"access_token": "mock_token"}`), nil
+	})
+
+	token, err := v.RequestToken(context.Background())
+	if err != nil {
+		t.Fatalf("RequestToken failed: %v", err)
+	}
+	if token != "mock_token" {
+		t.Errorf("expected mock_token, got %q", token)
+	}
+
+	expected := map[string]string{
+		"client_id":             "did:key:zMock",
+		"grant_type":            "client_credentials",
+		"client_assertion_type": "urn:ietf:params:oauth:client-assertion-type:jwt-bearer",
+	}
+	for field, want := range expected {
+		if got := form.Get(field); got != want {
+			t.Errorf("expected %s=%q, got %q", field, want, got)
+		}
+	}
+
+	// The client assertion is signed by our key, issued by our did:key and addressed to the Verifier
+	claims := &CliAssertion{}
+	_, err = jwt.ParseWithClaims(form.Get("client_assertion"), claims, func(*jwt.Token) (any, error) {
+		return v.PrivateKey.Public(), nil
+	}, jwt.WithValidMethods([]string{"ES256"}), jwt.WithAudience(v.VerifierURL), jwt.WithIssuer(v.DidKey))
+	if err != nil {
+		t.Fatalf("invalid client assertion: %v", err)
+	}
+	if claims.VpToken == "" {
+		t.Errorf("the client assertion has no vp_token")
+	}
+}
+
+func TestRequestTokenResponses(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		wantToken  string
+		wantErr    []string
+	}{
+		{name: "access token", statusCode: http.StatusOK, body: `{"access_token": "mock_token", "token_type": "Bearer"}`, wantToken: "mock_token"},
+		{
+			name:       "verifier error is surfaced",
+			statusCode: http.StatusUnauthorized,
+			body:       `{"error": "invalid_client", "error_description": "unknown did"}`,
+			wantErr:    []string{"Unauthorized", "invalid_client", "unknown did"},
+		},
+		{name: "invalid json", statusCode: http.StatusOK, body: `<html>`, wantErr: []string{"invalid response"}},
+		{name: "no access token", statusCode: http.StatusOK, body: `{}`, wantErr: []string{"does not contain an access token"}},
+		{
+			name:       "long error bodies are truncated",
+			statusCode: http.StatusBadRequest,
+			body:       strings.Repeat("x", 2*maxErrorBodySize),
+			wantErr:    []string{strings.Repeat("x", maxErrorBodySize)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newTestVerifierClient(t, func(req *http.Request) (*http.Response, error) {
+				return reply(tt.statusCode, tt.body), nil
+			})
+
+			token, err := v.RequestToken(context.Background())
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("RequestToken failed: %v", err)
+				}
+				if token != tt.wantToken {
+					t.Errorf("expected token %q, got %q", tt.wantToken, token)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("expected an error, got token %q", token)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected the error to contain %q, got %q", want, err)
+				}
+			}
+			if len(err.Error()) > 2*maxErrorBodySize {
+				t.Errorf("the error is too long: %d bytes", len(err.Error()))
+			}
+		})
+	}
+}
+
+func TestRequestTokenStopsRetryingWhenContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	calls := 0
+	v := newTestVerifierClient(t, func(req *http.Request) (*http.Response, error) {
+		calls++
+		cancel()
+		return reply(http.StatusServiceUnavailable, ""), nil
+	})
+	v.retry = retryPolicy{maxAttempts: 5, backoff: time.Hour}
+
+	if _, err := v.RequestToken(ctx); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 call before the context was cancelled, got %d", calls)
+	}
+}
@@ -0,0 +1,56 @@
+package credissuance
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The kinds of failures of an issuance, matched with errors.Is on the errors of LEARIssuanceRequest so callers
+// can decide whether to retry it. The errors keep their details, e.g. a *TokenError or an *IssuerStatusError.
+var (
+	// ErrTokenRequest is a failure getting the access token from the Verifier
+	ErrTokenRequest = errors.New("the access token could not be obtained")
+	// ErrIssuerClient is the Issuer rejecting the request, which fails again if sent as it is
+	ErrIssuerClient = errors.New("the Issuer rejected the request")
+	// ErrIssuerServer is the Issuer failing or not reachable, which may work later
+	ErrIssuerServer = errors.New("the Issuer failed")
+	// ErrIssuerUnprocessed is an ErrIssuerServer where the Issuer surely did not process the request: it could not
+	// be sent, or the Issuer replied that it is overloaded or unavailable. After the other failures of the Issuer,
+	// e.g. a timeout, the credential may be issued already.
+	ErrIssuerUnprocessed = errors.New("the Issuer did not process the request")
+)
+
+// IssuerStatusError is an error status replied by the Issuer. It matches ErrIssuerClient for the 4xx statuses
+// but 429, and ErrIssuerServer for the others. 429 and 503 match ErrIssuerUnprocessed too.
+type IssuerStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *IssuerStatusError) Error() string {
+	return fmt.Sprintf("error calling LEAR Issuance Endpoint: %v", e.Status)
+}
+
+func (e *IssuerStatusError) Is(target error) bool {
+	if unprocessedStatus(e.StatusCode) {
+		return target == ErrIssuerServer || target == ErrIssuerUnprocessed
+	}
+	if e.StatusCode >= 400 && e.StatusCode < 500 {
+		return target == ErrIssuerClient
+	}
+	return target == ErrIssuerServer
+}
+
+// kindError tells the kind of an error, keeping its message and the error itself for errors.Is and errors.As
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
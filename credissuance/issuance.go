@@ -2,20 +2,35 @@ package credissuance
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"maps"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/hesusruiz/onboardng/common"
 	"github.com/hesusruiz/onboardng/internal/configuration"
-	"github.com/mr-tron/base58/base58"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// tracerName identifies the spans of the requests to the Verifier and the Issuer
+const tracerName = "github.com/hesusruiz/onboardng/credissuance"
+
 type LEARIssuanceRequestBody struct {
 	Schema        string  `json:"schema,omitempty"`
 	OperationMode string  `json:"operation_mode,omitempty"`
@@ -37,6 +52,43 @@ type Payload struct {
 	Mandator Mandator `json:"mandator"`
 	Mandatee Mandatee `json:"mandatee"`
 	Power    []Power  `json:"power,omitempty"`
+	// Claims are the other claims of the payload, from the configuration and the extra fields of the registration
+	Claims map[string]any `json:"-"`
+}
+
+// MarshalJSON adds the other claims to the mandator, mandatee and power of the payload
+func (p Payload) MarshalJSON() ([]byte, error) {
+	type payload Payload
+	if len(p.Claims) == 0 {
+		return json.Marshal(payload(p))
+	}
+
+	claims := maps.Clone(p.Claims)
+	claims["mandator"] = p.Mandator
+	claims["mandatee"] = p.Mandatee
+	if len(p.Power) > 0 {
+		claims["power"] = p.Power
+	}
+	return json.Marshal(claims)
+}
+
+// UnmarshalJSON reads the claims besides the mandator, mandatee and power into Claims
+func (p *Payload) UnmarshalJSON(b []byte) error {
+	type payload Payload
+	if err := json.Unmarshal(b, (*payload)(p)); err != nil {
+		return err
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return err
+	}
+	delete(claims, "mandator")
+	delete(claims, "mandatee")
+	delete(claims, "power")
+	if len(claims) > 0 {
+		p.Claims = claims
+	}
+	return nil
 }
 
 type Mandator struct {
@@ -74,133 +126,341 @@ func (s Strings) MarshalJSON() (b []byte, err error) {
 	return json.Marshal([]string(s))
 }
 
-type LEARIssuance struct {
-	privateKey        *ecdsa.PrivateKey
-	machineCredential string
+// UnmarshalJSON accepts both forms of the claim, a single string or an array of strings
+func (s *Strings) UnmarshalJSON(b []byte) error {
+	if string(bytes.TrimSpace(b)) == "null" {
+		return nil
+	}
 
-	verifierTokenEndpoint  string
-	verifierURL            string
-	myDidkey               string
-	credentialIssuancePath string
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*s = Strings{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("expected a string or an array of strings: %w", err)
+	}
+	*s = Strings(list)
+	return nil
 }
 
-func NewLEARIssuance(config configuration.EnvConfig) (*LEARIssuance, error) {
+// Applicant is the person who registered the company, as the mandatee of the credential on behalf of the company as mandator
+type Applicant struct {
+	Email       string
+	FirstName   string
+	LastName    string
+	CompanyName string
+	Country     string
+	VatID       string
+}
 
-	// Read the private key
-	pemBytesRaw, err := os.ReadFile(config.PrivateKeyFile)
+// NewLEARIssuanceRequestBody builds the request to issue the LEARCredentialEmployee of an applicant, with the given powers
+// and other claims, and the schema, operation mode and format configured for the Issuer.
+// The request only depends on its arguments, so the one of a failed registration can be rebuilt to retry the issuance.
+func NewLEARIssuanceRequestBody(reg Applicant, powers []configuration.PowerConfig, claims map[string]any, issuer configuration.IssuerConfig) *LEARIssuanceRequestBody {
+	credPowers := make([]Power, 0, len(powers))
+	for _, p := range powers {
+		credPowers = append(credPowers, Power{
+			Type:     p.Type,
+			Domain:   p.Domain,
+			Function: p.Function,
+			Action:   Strings(slices.Clone(p.Action)),
+		})
+	}
+
+	return &LEARIssuanceRequestBody{
+		Schema:        issuer.CredentialSchema(),
+		OperationMode: issuer.CredentialOperationMode(),
+		Format:        issuer.CredentialFormat(),
+		Payload: Payload{
+			Mandator: Mandator{
+				OrganizationIdentifier: reg.Country + "-" + reg.VatID,
+				Organization:           reg.CompanyName,
+				Country:                reg.Country,
+				CommonName:             reg.FirstName + " " + reg.LastName,
+				EmailAddress:           reg.Email,
+			},
+			Mandatee: Mandatee{
+				FirstName:   reg.FirstName,
+				LastName:    reg.LastName,
+				Nationality: reg.Country,
+				Email:       reg.Email,
+			},
+			Power:  credPowers,
+			Claims: maps.Clone(claims),
+		},
+	}
+}
+
+type LEARIssuance struct {
+	verifier *VerifierClient
+	// secondary authenticates with the secondary key when the Verifier rejects the primary one, nil without it
+	secondary              *VerifierClient
+	credentialIssuancePath string
+
+	httpClient *http.Client
+	retry      retryPolicy
+}
+
+// ReadPrivateKey reads a private key of the given type stored as a hex string (with an optional 0x prefix) in the given file.
+// See ParsePrivateKey for how the key type is detected when it is not specified.
+func ReadPrivateKey(file string, keyType common.KeyType) (crypto.Signer, error) {
+	pemBytesRaw, err := os.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
 
-	// Strip any '0x' or '0X' prefix from the key and decode it
-	hexKey := strings.TrimPrefix(string(pemBytesRaw), "0x")
-	hexKey = strings.TrimPrefix(hexKey, "0X")
-	dBytes, _ := hex.DecodeString(hexKey)
+	privateKey, err := ParsePrivateKey(string(pemBytesRaw), keyType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %s: %w", file, err)
+	}
+	return privateKey, nil
+}
 
-	// Create ECDSA Private Key from the raw private key
-	curve := elliptic.P256()
-	privateKey, err := ecdsa.ParseRawPrivateKey(curve, dBytes)
+// ParsePrivateKey parses a raw private key of the given type encoded as a hex string, with an optional 0x prefix.
+// When the key type is empty it is detected from the key length: 64 bytes is an Ed25519 private key
+// (seed followed by the public key), anything else is parsed as P-256.
+// A 32-byte Ed25519 seed or secp256k1 key can not be told apart from a P-256 key, so it requires the key type
+// to be configured.
+func ParsePrivateKey(hexKey string, keyType common.KeyType) (crypto.Signer, error) {
+	keyBytes, err := decodeHexKey(hexKey)
 	if err != nil {
 		return nil, err
 	}
 
-	// For safety, we are going to derive the associated did:key and compare to the one in the config
-	// We have to represent the public key as a compressed array of bytes,
-	// and then apply the encoding for did:key.
+	if keyType == "" {
+		keyType = common.KeyTypeP256
+		if len(keyBytes) == ed25519.PrivateKeySize {
+			keyType = common.KeyTypeEd25519
+		}
+	}
+
+	switch keyType {
+	case common.KeyTypeP256:
+		return parseP256PrivateKey(keyBytes)
+	case common.KeyTypeSecp256k1:
+		return parseSecp256k1PrivateKey(keyBytes)
+	case common.KeyTypeEd25519:
+		switch len(keyBytes) {
+		case ed25519.SeedSize:
+			return ed25519.NewKeyFromSeed(keyBytes), nil
+		case ed25519.PrivateKeySize:
+			priv := ed25519.PrivateKey(keyBytes)
+			// Make sure the embedded public key is the one of the seed
+			if !priv.Public().(ed25519.PublicKey).Equal(ed25519.NewKeyFromSeed(priv.Seed()).Public()) {
+				return nil, fmt.Errorf("the Ed25519 private key does not contain its own public key")
+			}
+			return priv, nil
+		default:
+			return nil, fmt.Errorf("an Ed25519 private key must be %d or %d bytes, got %d bytes",
+				ed25519.SeedSize, ed25519.PrivateKeySize, len(keyBytes))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", keyType)
+	}
+}
 
-	// This is the uncompressed public key
-	uncompressed, err := privateKey.PublicKey.Bytes()
+// ParsePrivateKeyHex parses a raw P-256 private key encoded as a hex string, with an optional 0x prefix
+func ParsePrivateKeyHex(hexKey string) (*ecdsa.PrivateKey, error) {
+	keyBytes, err := decodeHexKey(hexKey)
 	if err != nil {
 		return nil, err
 	}
+	return parseP256PrivateKey(keyBytes)
+}
 
-	// Extract X and Y from the slice
-	// X is bytes [1:33], Y is bytes [33:65]
-	xBytes := uncompressed[1:33]
-	yLastByte := uncompressed[64]
-
-	// Determine the compressedPrefix (0x02 if Y is even, 0x03 if Y is odd)
-	var compressedPrefix byte = 0x02
-	if yLastByte%2 != 0 {
-		compressedPrefix = 0x03
+// decodeHexKey decodes a hex string, ignoring surrounding whitespace and any '0x' or '0X' prefix
+func decodeHexKey(hexKey string) ([]byte, error) {
+	hexKey = strings.TrimSpace(hexKey)
+	hexKey = strings.TrimPrefix(hexKey, "0x")
+	hexKey = strings.TrimPrefix(hexKey, "0X")
+	keyBytes, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, fmt.Errorf("the private key is not a valid hex string: %w", err)
 	}
+	return keyBytes, nil
+}
 
-	// Construct the 33-byte compressed key
-	compressedBytes := append([]byte{compressedPrefix}, xBytes...)
+// parseP256PrivateKey creates an ECDSA P-256 private key from its raw bytes
+func parseP256PrivateKey(dBytes []byte) (*ecdsa.PrivateKey, error) {
+	curve := elliptic.P256()
+	if len(dBytes) != (curve.Params().BitSize+7)/8 {
+		return nil, fmt.Errorf("a P-256 private key must be %d bytes (%d hex characters), got %d bytes",
+			(curve.Params().BitSize+7)/8, (curve.Params().BitSize+7)/8*2, len(dBytes))
+	}
+	return ecdsa.ParseRawPrivateKey(curve, dBytes)
+}
 
-	// Compress the public key for the DID
-	varintPrefix := []byte{0x80, 0x24} // Varint for P-256
-	didKey := "did:key:z" + base58.Encode(append(varintPrefix, compressedBytes...))
+// NewLEARIssuance returns the client of the Verifier and the Issuer of the configuration.
+// The secondary key, if configured, is used when the Verifier rejects the primary one, to rotate the keys without downtime.
+func NewLEARIssuance(config configuration.EnvConfig) (*LEARIssuance, error) {
+	primary, err := LoadSigningKey(config.PrimaryKey())
+	if err != nil {
+		return nil, err
+	}
 
-	if didKey != config.MyDidkey {
-		return nil, fmt.Errorf("the private key does not correspond to the did:key in the configuration")
+	var secondary *SigningKey
+	if config.SecondaryKey.Enabled() {
+		secondary, err = LoadSigningKey(config.SecondaryKey)
+		if err != nil {
+			return nil, fmt.Errorf("secondary key: %w", err)
+		}
+		if secondary.DidKey == primary.DidKey {
+			return nil, fmt.Errorf("the secondary key is the same as the primary one")
+		}
 	}
 
-	// Read the LEARCredentialMachine
-	buf, err := os.ReadFile(config.MachineCredentialFile)
+	transport, err := NewHTTPTransport(config.Runtime, config.Issuer)
 	if err != nil {
 		return nil, err
 	}
-	machineCredential := string(buf)
+	httpClient := &http.Client{Transport: transport}
 
-	l := &LEARIssuance{
-		privateKey:        privateKey,
-		machineCredential: machineCredential,
+	retry := retryPolicy{
+		maxAttempts: config.Issuer.MaxAttempts,
+		backoff:     config.Issuer.RetryBackoff,
 	}
 
-	l.verifierTokenEndpoint = config.Verifier.TokenEndpoint
-	l.verifierURL = config.Verifier.URL
-	l.myDidkey = config.MyDidkey
-	l.credentialIssuancePath = config.Issuer.CredentialIssuancePath
+	l := &LEARIssuance{
+		verifier:               newVerifierClient(config.Verifier, primary, httpClient, retry),
+		credentialIssuancePath: config.Issuer.CredentialIssuancePath,
+		httpClient:             httpClient,
+		retry:                  retry,
+	}
+	if secondary != nil {
+		l.secondary = newVerifierClient(config.Verifier, secondary, httpClient, retry)
+	}
 
 	return l, nil
 
 }
 
-func (l *LEARIssuance) LEARIssuanceRequest(learCredData *LEARIssuanceRequestBody) ([]byte, error) {
+// newVerifierClient returns the client of the Verifier authenticating with the given key
+func newVerifierClient(config configuration.VerifierConfig, key *SigningKey, httpClient *http.Client, retry retryPolicy) *VerifierClient {
+	return &VerifierClient{
+		TokenEndpoint:     config.TokenEndpoint,
+		VerifierURL:       config.URL,
+		MachineCredential: key.MachineCredential,
+		DidKey:            key.DidKey,
+		PrivateKey:        key.PrivateKey,
+		HTTPClient:        httpClient,
+		retry:             retry,
+	}
+}
+
+// requestToken gets an access token from the Verifier with the primary key. While rotating the keys the Verifier
+// may not trust the new primary key yet, so if it is rejected the token is requested with the secondary key.
+func (l *LEARIssuance) requestToken(ctx context.Context) (token string, err error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "RequestToken", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("verifier.token_endpoint", l.verifier.TokenEndpoint)))
+	defer func() { endSpan(span, err) }()
+
+	token, err = l.verifier.RequestToken(ctx)
+	var tokenErr *TokenError
+	if err == nil || l.secondary == nil || !errors.As(err, &tokenErr) || !tokenErr.Rejected() {
+		return token, err
+	}
+
+	slog.WarnContext(ctx, "⚠️ The Verifier rejected the primary key, using the secondary one", "did", l.verifier.DidKey, "secondary_did", l.secondary.DidKey, "error", err)
+	token, secondaryErr := l.secondary.RequestToken(ctx)
+	if secondaryErr != nil {
+		return "", errors.Join(err, secondaryErr)
+	}
+	return token, nil
+}
+
+// IssuanceResponse is the reply of the Issuer to an issuance request, kept with the registration to diagnose failures
+type IssuanceResponse struct {
+	// StatusCode is the HTTP status of the response
+	StatusCode int
+	// Body is the response. When the Issuer fails, only its beginning is read.
+	Body []byte
+	// Duration is how long the Issuer took to reply, including the retries
+	Duration time.Duration
+}
+
+// LEARIssuanceRequest is LEARIssuanceRequestContext with the background context
+func (l *LEARIssuance) LEARIssuanceRequest(learCredData *LEARIssuanceRequestBody) (*IssuanceResponse, error) {
+	return l.LEARIssuanceRequestContext(context.Background(), learCredData)
+}
+
+// LEARIssuanceRequestContext gets an access token from the Verifier and asks the Issuer to issue the credential,
+// returning the response of the Issuer. The requests and the waits between their retries stop when ctx is done.
+// When the Issuer replies with an error status, the error is returned together with the response.
+// The errors match ErrTokenRequest, ErrIssuerClient or ErrIssuerServer, and ErrIssuerUnprocessed when the Issuer
+// did not process the request, to tell whether the issuance may be retried.
+func (l *LEARIssuance) LEARIssuanceRequestContext(ctx context.Context, learCredData *LEARIssuanceRequestBody) (issResponse *IssuanceResponse, err error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "LEARIssuanceRequest", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("registration.country", learCredData.Payload.Mandator.Country),
+			attribute.String("issuer.endpoint", l.credentialIssuancePath),
+		))
+	defer func() {
+		if issResponse != nil {
+			span.SetAttributes(attribute.Int("http.response.status_code", issResponse.StatusCode))
+		}
+		endSpan(span, err)
+	}()
 
 	// Get an access token from the Verifier
-	access_token, err := TokenRequest(
-		l.verifierTokenEndpoint,
-		l.machineCredential,
-		l.myDidkey,
-		l.verifierURL,
-		l.privateKey,
-	)
+	access_token, err := l.requestToken(ctx)
 	if err != nil {
-		return nil, err
+		return nil, &kindError{kind: ErrTokenRequest, err: err}
 	}
 
-	fmt.Printf("Access Token: %v\n", access_token)
-	fmt.Printf("Issuance Endpoint: %v\n", l.credentialIssuancePath)
+	// The access token is a credential, it is never logged
+	slog.DebugContext(ctx, "Calling the Issuer", "endpoint", l.credentialIssuancePath)
 
 	// The request buffer
 	buf, err := json.Marshal(learCredData)
 	if err != nil {
 		return nil, err
 	}
-	requestBody := bytes.NewBuffer(buf)
-
-	// The request to send
-	req, _ := http.NewRequest("POST", l.credentialIssuancePath, requestBody)
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", "Bearer "+access_token)
 
-	resp, err := http.DefaultClient.Do(req)
+	// The request to send, rebuilt on every attempt. It is only retried when the Issuer did not process it,
+	// as otherwise a retry could issue the credential twice.
+	start := time.Now()
+	resp, err := l.retry.doWithRetry(ctx, l.httpClient, retryUnprocessed, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", l.credentialIssuancePath, bytes.NewReader(buf))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Authorization", "Bearer "+access_token)
+		return req, nil
+	})
 	if err != nil {
-		return nil, err
+		if notSent(err) {
+			err = &kindError{kind: ErrIssuerUnprocessed, err: err}
+		}
+		return nil, &kindError{kind: ErrIssuerServer, err: err}
 	}
 	defer resp.Body.Close()
 
+	issResponse = &IssuanceResponse{StatusCode: resp.StatusCode}
 	if resp.StatusCode < 200 || resp.StatusCode > 399 {
-		fmt.Println("Error calling LEAR Issuance Endpoint:", resp.Status)
-		return nil, fmt.Errorf("error calling LEAR Issuance Endpoint: %v", resp.Status)
+		issResponse.Body, _ = io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		issResponse.Duration = time.Since(start)
+		slog.DebugContext(ctx, "The Issuer rejected the issuance", "endpoint", l.credentialIssuancePath, "status", resp.Status)
+		return issResponse, &IssuerStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
 
-	ResponseBody, err := io.ReadAll(resp.Body)
+	issResponse.Body, err = io.ReadAll(resp.Body)
+	issResponse.Duration = time.Since(start)
 	if err != nil {
-		return nil, err
+		return issResponse, &kindError{kind: ErrIssuerServer, err: err}
 	}
 
-	return ResponseBody, nil
+	return issResponse, nil
+}
+
+// endSpan ends the span, recording the error if there was one
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
 }
@@ -2,23 +2,76 @@ package credissuance
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hesusruiz/onboardng/common"
 	"github.com/hesusruiz/onboardng/internal/configuration"
 	"gopkg.in/yaml.v3"
 )
 
+// MockResponse is a scripted reply of the MockRoundTripper. If Err is set, the round trip fails with it
+type MockResponse struct {
+	StatusCode int
+	Body       string
+	Err        error
+}
+
+// MockRoundTripper replies with canned responses keyed by URL.
+// Responses always replies 200 with the given body. Sequences replies with each scripted response in turn,
+// repeating the last one when the script is exhausted, so we can simulate e.g. fail, fail, succeed.
+// The number of calls received by each URL is recorded and available via Calls.
 type MockRoundTripper struct {
 	OriginalTransport http.RoundTripper
 	Responses         map[string]string
+	Sequences         map[string][]MockResponse
+
+	mu    sync.Mutex
+	calls map[string]int
 }
 
 func (m *MockRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	url := req.URL.String()
+
+	m.mu.Lock()
+	if m.calls == nil {
+		m.calls = make(map[string]int)
+	}
+	call := m.calls[url]
+	m.calls[url]++
+	m.mu.Unlock()
+
+	if seq, ok := m.Sequences[url]; ok && len(seq) > 0 {
+		r := seq[min(call, len(seq)-1)]
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		return &http.Response{
+			StatusCode: r.StatusCode,
+			Status:     fmt.Sprintf("%d %s", r.StatusCode, http.StatusText(r.StatusCode)),
+			Body:       io.NopCloser(bytes.NewBufferString(r.Body)),
+			Header:     make(http.Header),
+		}, nil
+	}
 	if respBody, ok := m.Responses[url]; ok {
 		return &http.Response{
 			StatusCode: 200,
@@ -32,6 +85,13 @@ func (m *MockRoundTripper) RoundTrip(req *http.Request) (*http.Response, error)
 	return nil, fmt.Errorf("no mock response for %s", url)
 }
 
+// Calls returns the number of requests received for the given URL
+func (m *MockRoundTripper) Calls(url string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls[url]
+}
+
 type TestConfig struct {
 	DestDir      string                             `yaml:"dest_dir"`
 	SrcDir       string                             `yaml:"src_dir"`
@@ -67,10 +127,22 @@ func TestLEARIssuanceRequest(t *testing.T) {
 			CredentialIssuancePath: envCfg.Issuer.CredentialIssuancePath,
 		},
 	}
+	if _, err := os.Stat(issuerCfg.PrivateKeyFile); os.IsNotExist(err) {
+		// The keys of the environments are not in the repository, we sign with a fresh one instead
+		key := newTestSigningKey(t, "dev")
+		issuerCfg.PrivateKeyFile, issuerCfg.MachineCredentialFile, issuerCfg.MyDidkey = key.PrivateKeyFile, key.MachineCredentialFile, key.MyDidkey
+	}
 	issuer, err := NewLEARIssuance(issuerCfg)
 	if err != nil {
 		t.Fatalf("NewLEARIssuance failed: %v", err)
 	}
+	issuer.httpClient = &http.Client{Transport: &MockRoundTripper{
+		Responses: map[string]string{
+			issuerCfg.Verifier.TokenEndpoint:        `{"access_token": "mock_token"}`,
+			issuerCfg.Issuer.CredentialIssuancePath: `{"credential": "mock_credential"}`,
+		},
+	}}
+	issuer.verifier.HTTPClient = issuer.httpClient
 
 	// Use the first credential from sample_credentials.go
 	cred := Cred1()
@@ -83,7 +155,580 @@ func TestLEARIssuanceRequest(t *testing.T) {
 
 	// Verify the response
 	expectedResponse := `{"credential": "mock_credential"}`
-	if string(resp) != expectedResponse {
-		t.Errorf("expected response %s, got %s", expectedResponse, string(resp))
+	if string(resp.Body) != expectedResponse || resp.StatusCode != http.StatusOK {
+		t.Errorf("expected response %s, got %d %s", expectedResponse, resp.StatusCode, resp.Body)
+	}
+}
+
+const (
+	mockTokenEndpoint = "https://verifier.example.com/oidc/token"
+	mockIssuancePath  = "https://issuer.example.com/vci/v1/issuances"
+)
+
+// newMockIssuance returns a LEARIssuance with a fresh key, talking to the given mock transport
+func newMockIssuance(t *testing.T, mock *MockRoundTripper, maxAttempts int) *LEARIssuance {
+	t.Helper()
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	client := &http.Client{Transport: mock}
+	retry := retryPolicy{maxAttempts: maxAttempts, backoff: time.Millisecond}
+
+	return &LEARIssuance{
+		verifier: &VerifierClient{
+			TokenEndpoint:     mockTokenEndpoint,
+			VerifierURL:       "https://verifier.example.com",
+			MachineCredential: "mock_machine_credential",
+			DidKey:            "did:key:zMock",
+			PrivateKey:        privateKey,
+			HTTPClient:        client,
+			retry:             retry,
+		},
+		credentialIssuancePath: mockIssuancePath,
+		httpClient:             client,
+		retry:                  retry,
+	}
+}
+
+func TestLEARIssuanceRequestRetries(t *testing.T) {
+	tokenOK := MockResponse{StatusCode: 200, Body: `{"access_token": "mock_token"}`}
+	issuedOK := MockResponse{StatusCode: 200, Body: `{"credential": "mock_credential"}`}
+
+	tests := []struct {
+		name           string
+		maxAttempts    int
+		token          []MockResponse
+		issuance       []MockResponse
+		wantErr        bool
+		wantTokenCalls int
+		wantIssueCalls int
+	}{
+		{
+			name:           "success at first attempt",
+			maxAttempts:    3,
+			token:          []MockResponse{tokenOK},
+			issuance:       []MockResponse{issuedOK},
+			wantTokenCalls: 1,
+			wantIssueCalls: 1,
+		},
+		{
+			name:        "issuer fails twice then succeeds",
+			maxAttempts: 3,
+			token:       []MockResponse{tokenOK},
+			issuance: []MockResponse{
+				{StatusCode: 503},
+				{StatusCode: 429},
+				issuedOK,
+			},
+			wantTokenCalls: 1,
+			wantIssueCalls: 3,
+		},
+		{
+			name:        "issuer can not be reached then succeeds",
+			maxAttempts: 3,
+			token:       []MockResponse{tokenOK},
+			issuance: []MockResponse{
+				{Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}},
+				issuedOK,
+			},
+			wantTokenCalls: 1,
+			wantIssueCalls: 2,
+		},
+		{
+			name:           "issuer errors that may have issued the credential are not retried",
+			maxAttempts:    3,
+			token:          []MockResponse{tokenOK},
+			issuance:       []MockResponse{{StatusCode: 500}, issuedOK},
+			wantErr:        true,
+			wantTokenCalls: 1,
+			wantIssueCalls: 1,
+		},
+		{
+			name:           "issuer connection lost after sending is not retried",
+			maxAttempts:    3,
+			token:          []MockResponse{tokenOK},
+			issuance:       []MockResponse{{Err: &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset")}}, issuedOK},
+			wantErr:        true,
+			wantTokenCalls: 1,
+			wantIssueCalls: 1,
+		},
+		{
+			name:        "token endpoint server error then succeeds",
+			maxAttempts: 3,
+			token: []MockResponse{
+				{StatusCode: 500},
+				tokenOK,
+			},
+			issuance:       []MockResponse{issuedOK},
+			wantTokenCalls: 2,
+			wantIssueCalls: 1,
+		},
+		{
+			name:        "token endpoint network error then succeeds",
+			maxAttempts: 3,
+			token: []MockResponse{
+				{Err: errors.New("connection reset")},
+				tokenOK,
+			},
+			issuance:       []MockResponse{issuedOK},
+			wantTokenCalls: 2,
+			wantIssueCalls: 1,
+		},
+		{
+			name:           "issuer keeps failing until attempts are exhausted",
+			maxAttempts:    3,
+			token:          []MockResponse{tokenOK},
+			issuance:       []MockResponse{{StatusCode: 503}},
+			wantErr:        true,
+			wantTokenCalls: 1,
+			wantIssueCalls: 3,
+		},
+		{
+			name:           "client errors are not retried",
+			maxAttempts:    3,
+			token:          []MockResponse{tokenOK},
+			issuance:       []MockResponse{{StatusCode: 400}, issuedOK},
+			wantErr:        true,
+			wantTokenCalls: 1,
+			wantIssueCalls: 1,
+		},
+		{
+			name:           "no retries when a single attempt is configured",
+			maxAttempts:    1,
+			token:          []MockResponse{{StatusCode: 503}, tokenOK},
+			issuance:       []MockResponse{issuedOK},
+			wantErr:        true,
+			wantTokenCalls: 1,
+			wantIssueCalls: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &MockRoundTripper{
+				Sequences: map[string][]MockResponse{
+					mockTokenEndpoint: tt.token,
+					mockIssuancePath:  tt.issuance,
+				},
+			}
+			issuer := newMockIssuance(t, mock, tt.maxAttempts)
+
+			resp, err := issuer.LEARIssuanceRequest(Cred1())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got response %s", resp.Body)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("LEARIssuanceRequest failed: %v", err)
+				}
+				if string(resp.Body) != issuedOK.Body {
+					t.Errorf("expected response %s, got %s", issuedOK.Body, resp.Body)
+				}
+			}
+
+			if got := mock.Calls(mockTokenEndpoint); got != tt.wantTokenCalls {
+				t.Errorf("expected %d token calls, got %d", tt.wantTokenCalls, got)
+			}
+			if got := mock.Calls(mockIssuancePath); got != tt.wantIssueCalls {
+				t.Errorf("expected %d issuance calls, got %d", tt.wantIssueCalls, got)
+			}
+		})
+	}
+}
+
+func TestLEARIssuanceRequestErrorResponse(t *testing.T) {
+	mock := &MockRoundTripper{
+		Sequences: map[string][]MockResponse{
+			mockTokenEndpoint: {{StatusCode: 200, Body: `{"access_token": "mock_token"}`}},
+			mockIssuancePath:  {{StatusCode: 400, Body: `{"error": "invalid_request", "error_description": "` + strings.Repeat("x", 2*maxErrorBodySize) + `"}`}},
+		},
+	}
+	issuer := newMockIssuance(t, mock, 1)
+
+	// The response of the Issuer is returned with the error, to record why it failed
+	resp, err := issuer.LEARIssuanceRequest(Cred1())
+	if err == nil {
+		t.Fatalf("expected an error for the failed issuance")
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadRequest || resp.Duration <= 0 {
+		t.Fatalf("expected the response of the Issuer with the error, got %+v", resp)
+	}
+	if !strings.HasPrefix(string(resp.Body), `{"error": "invalid_request"`) || len(resp.Body) != maxErrorBodySize {
+		t.Errorf("expected the beginning of the error response, got %d bytes: %.40s", len(resp.Body), resp.Body)
+	}
+}
+
+func TestLEARIssuanceRequestDoesNotLogToken(t *testing.T) {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	mock := &MockRoundTripper{
+		Sequences: map[string][]MockResponse{
+			mockTokenEndpoint: {{StatusCode: 200, Body: `{"access_token": "secret_mock_token"}`}},
+			mockIssuancePath:  {{StatusCode: 400}},
+		},
+	}
+	issuer := newMockIssuance(t, mock, 1)
+	if _, err := issuer.LEARIssuanceRequest(Cred1()); err == nil {
+		t.Fatalf("expected an error for the failed issuance")
+	}
+
+	if !strings.Contains(buf.String(), mockIssuancePath) {
+		t.Errorf("expected the call to the Issuer in the debug logs, got: %s", buf.String())
+	}
+	if strings.Contains(buf.String(), "secret_mock_token") {
+		t.Errorf("the access token was logged: %s", buf.String())
+	}
+}
+
+func TestLEARIssuanceRequestErrorKinds(t *testing.T) {
+	token := MockResponse{StatusCode: 200, Body: `{"access_token": "mock_token"}`}
+	tests := []struct {
+		name            string
+		token           MockResponse
+		issuance        MockResponse
+		wantKind        error
+		wantStatus      int
+		wantUnprocessed bool
+	}{
+		{name: "token rejected", token: MockResponse{StatusCode: 401, Body: `{"error": "invalid_client"}`}, wantKind: ErrTokenRequest},
+		{name: "verifier down", token: MockResponse{StatusCode: 503}, wantKind: ErrTokenRequest},
+		{name: "verifier unreachable", token: MockResponse{Err: errors.New("connection refused")}, wantKind: ErrTokenRequest},
+		{name: "issuer bad request", token: token, issuance: MockResponse{StatusCode: 400}, wantKind: ErrIssuerClient, wantStatus: 400},
+		{name: "issuer forbidden", token: token, issuance: MockResponse{StatusCode: 403}, wantKind: ErrIssuerClient, wantStatus: 403},
+		{name: "issuer down", token: token, issuance: MockResponse{StatusCode: 502}, wantKind: ErrIssuerServer, wantStatus: 502},
+		{name: "issuer reset", token: token, issuance: MockResponse{Err: errors.New("connection reset by peer")}, wantKind: ErrIssuerServer},
+		{name: "issuer timeout", token: token, issuance: MockResponse{StatusCode: 504}, wantKind: ErrIssuerServer, wantStatus: 504},
+		{name: "issuer unavailable", token: token, issuance: MockResponse{StatusCode: 503}, wantKind: ErrIssuerServer, wantStatus: 503, wantUnprocessed: true},
+		{name: "issuer overloaded", token: token, issuance: MockResponse{StatusCode: 429}, wantKind: ErrIssuerServer, wantStatus: 429, wantUnprocessed: true},
+		{name: "issuer unreachable", token: token, issuance: MockResponse{Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}, wantKind: ErrIssuerServer, wantUnprocessed: true},
+	}
+
+	kinds := []error{ErrTokenRequest, ErrIssuerClient, ErrIssuerServer}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &MockRoundTripper{
+				Sequences: map[string][]MockResponse{
+					mockTokenEndpoint: {tt.token},
+					mockIssuancePath:  {tt.issuance},
+				},
+			}
+			issuer := newMockIssuance(t, mock, 1)
+
+			_, err := issuer.LEARIssuanceRequest(Cred1())
+			for _, kind := range kinds {
+				if errors.Is(err, kind) != (kind == tt.wantKind) {
+					t.Errorf("expected %v to match only %v, errors.Is(err, %v) = %v", err, tt.wantKind, kind, errors.Is(err, kind))
+				}
+			}
+
+			if errors.Is(err, ErrIssuerUnprocessed) != tt.wantUnprocessed {
+				t.Errorf("expected errors.Is(%v, ErrIssuerUnprocessed) = %v", err, tt.wantUnprocessed)
+			}
+
+			var statusErr *IssuerStatusError
+			if errors.As(err, &statusErr) != (tt.wantStatus != 0) || (statusErr != nil && statusErr.StatusCode != tt.wantStatus) {
+				t.Errorf("expected the status %d in the error, got %v", tt.wantStatus, err)
+			}
+			var tokenErr *TokenError
+			if tt.token.StatusCode >= 400 && !errors.As(err, &tokenErr) {
+				t.Errorf("expected the TokenError in the error, got %v", err)
+			}
+		})
+	}
+
+	// The errors reported by the Issuer in the body are rejections of the request
+	if !errors.Is(&IssuerError{Code: "invalid_request"}, ErrIssuerClient) {
+		t.Errorf("expected an IssuerError to match ErrIssuerClient")
+	}
+}
+
+func TestLEARIssuanceRequestCancelled(t *testing.T) {
+	mock := &MockRoundTripper{
+		Sequences: map[string][]MockResponse{
+			mockTokenEndpoint: {{StatusCode: 503}, {StatusCode: 200, Body: `{"access_token": "mock_token"}`}},
+			mockIssuancePath:  {{StatusCode: 200, Body: `{"credential": "mock_credential"}`}},
+		},
+	}
+	issuer := newMockIssuance(t, mock, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := issuer.LEARIssuanceRequestContext(ctx, Cred1()); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the issuance to be cancelled, got %v", err)
+	}
+	if got := mock.Calls(mockTokenEndpoint); got > 1 {
+		t.Errorf("expected the token request not to be retried, got %d calls", got)
+	}
+	if got := mock.Calls(mockIssuancePath); got != 0 {
+		t.Errorf("expected no issuance call, got %d", got)
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	p256Key := "0x0826f120c769d4de55ad686b31c60242d87615a2bb25f53c07b580d9e7a074af\n"
+	ed25519Seed := "9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60"
+	ed25519Full := ed25519Seed + "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a"
+
+	tests := []struct {
+		name    string
+		hexKey  string
+		keyType common.KeyType
+		wantDid string
+		wantErr bool
+	}{
+		{name: "P-256 by default", hexKey: p256Key, wantDid: "did:key:zDnaehBC97ZSEc6cwHLXXr6Zfrj1Tv9bxtsuFGPkxcXMj6FaZ"},
+		{name: "P-256 configured", hexKey: p256Key, keyType: common.KeyTypeP256, wantDid: "did:key:zDnaehBC97ZSEc6cwHLXXr6Zfrj1Tv9bxtsuFGPkxcXMj6FaZ"},
+		{name: "Ed25519 seed configured", hexKey: ed25519Seed, keyType: common.KeyTypeEd25519, wantDid: "did:key:z6MktwupdmLXVVqTzCw4i46r4uGyosGXRnR3XjN4Zq7oMMsw"},
+		{name: "Ed25519 detected from length", hexKey: ed25519Full, wantDid: "did:key:z6MktwupdmLXVVqTzCw4i46r4uGyosGXRnR3XjN4Zq7oMMsw"},
+		{name: "Ed25519 with wrong public key", hexKey: ed25519Seed + strings.Repeat("00", 32), keyType: common.KeyTypeEd25519, wantErr: true},
+		{name: "secp256k1 configured", hexKey: strings.Repeat("00", 31) + "01", keyType: common.KeyTypeSecp256k1, wantDid: "did:key:zQ3shVc2UkAfJCdc1TR8E66J85h48P43r93q8jGPkPpjF9Ef9"},
+		{name: "secp256k1 out of range", hexKey: strings.Repeat("ff", 32), keyType: common.KeyTypeSecp256k1, wantErr: true},
+		{name: "unknown key type", hexKey: p256Key, keyType: "RSA", wantErr: true},
+		{name: "wrong length", hexKey: "0102", wantErr: true},
+		{name: "not hex", hexKey: "zz", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParsePrivateKey(tt.hexKey, tt.keyType)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePrivateKey failed: %v", err)
+			}
+
+			didKey, err := common.DidKeyFromPrivateKey(key)
+			if err != nil {
+				t.Fatalf("DidKeyFromPrivateKey failed: %v", err)
+			}
+			if didKey != tt.wantDid {
+				t.Errorf("expected %s, got %s", tt.wantDid, didKey)
+			}
+		})
+	}
+}
+
+func TestCliAssertionSignedWithKeyAlgorithm(t *testing.T) {
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secp256k1Raw, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		key     crypto.Signer
+		wantAlg string
+	}{
+		{name: "P-256", key: p256Key, wantAlg: "ES256"},
+		{name: "Ed25519", key: ed25519Key, wantAlg: "EdDSA"},
+		{name: "secp256k1", key: secp256k1Key{secp256k1Raw}, wantAlg: "ES256K"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertion, err := NewCliAssertion("mock_machine_credential", "did:key:zMock", "https://verifier.example.com", tt.key)
+			if err != nil {
+				t.Fatalf("NewCliAssertion failed: %v", err)
+			}
+
+			// The signature must verify with the public key, using the expected algorithm
+			token, err := jwt.Parse(assertion, func(token *jwt.Token) (any, error) {
+				return tt.key.Public(), nil
+			}, jwt.WithValidMethods([]string{tt.wantAlg}))
+			if err != nil {
+				t.Fatalf("the assertion does not verify: %v", err)
+			}
+			if token.Header["alg"] != tt.wantAlg {
+				t.Errorf("expected alg %s, got %v", tt.wantAlg, token.Header["alg"])
+			}
+		})
+	}
+}
+
+func TestCliAssertionUnsupportedKey(t *testing.T) {
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key comes from the configuration, so it must fail the assertion instead of crashing
+	_, err = NewCliAssertion("mock_machine_credential", "did:key:zMock", "https://verifier.example.com", p384Key)
+	if err == nil {
+		t.Fatal("expected an error for a P-384 key")
+	}
+}
+
+func TestStringsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		action Strings
+		json   string
+	}{
+		{name: "single action", action: Strings{"execute"}, json: `"execute"`},
+		{name: "several actions", action: Strings{"execute", "verify"}, json: `["execute","verify"]`},
+		{name: "empty actions", action: Strings{}, json: `[]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := json.Marshal(tt.action)
+			if err != nil {
+				t.Fatalf("Marshal failed: %v", err)
+			}
+			if string(buf) != tt.json {
+				t.Errorf("expected %s, got %s", tt.json, buf)
+			}
+
+			var got Strings
+			if err := json.Unmarshal(buf, &got); err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+			if !slices.Equal(got, tt.action) {
+				t.Errorf("expected %q after the round trip, got %q", tt.action, got)
+			}
+		})
+	}
+}
+
+func TestStringsUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		want    Strings
+		wantErr bool
+	}{
+		{name: "string", json: `"execute"`, want: Strings{"execute"}},
+		{name: "array", json: `["execute", "verify"]`, want: Strings{"execute", "verify"}},
+		{name: "null", json: `null`, want: nil},
+		{name: "number", json: `1`, wantErr: true},
+		{name: "array of numbers", json: `[1, 2]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Strings
+			err := json.Unmarshal([]byte(tt.json), &got)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseLEARIssuanceRequestBodyPowers(t *testing.T) {
+	body := `{"payload": {"power": [
+		{"type": "domain", "domain": "DOME", "function": "Onboarding", "action": "execute"},
+		{"type": "domain", "domain": "DOME", "function": "ProductOffering", "action": ["Create", "Update"]}
+	]}}`
+
+	req, err := ParseLEARIssuanceRequestBody([]byte(body))
+	if err != nil {
+		t.Fatalf("ParseLEARIssuanceRequestBody failed: %v", err)
+	}
+	if len(req.Payload.Power) != 2 {
+		t.Fatalf("expected 2 powers, got %d", len(req.Payload.Power))
+	}
+	if !slices.Equal(req.Payload.Power[0].Action, Strings{"execute"}) {
+		t.Errorf("unexpected actions of the first power: %q", req.Payload.Power[0].Action)
+	}
+	if !slices.Equal(req.Payload.Power[1].Action, Strings{"Create", "Update"}) {
+		t.Errorf("unexpected actions of the second power: %q", req.Payload.Power[1].Action)
+	}
+}
+
+func TestNewLEARIssuanceRequestBody(t *testing.T) {
+	reg := Applicant{
+		Email:       "john@example.com",
+		FirstName:   "John",
+		LastName:    "Doe",
+		CompanyName: "Acme Corp",
+		Country:     "ES",
+		VatID:       "B12345678",
+	}
+	powers := []configuration.PowerConfig{
+		{Type: "domain", Domain: "DOME", Function: "ProductOffering", Action: []string{"Create", "Update"}},
+		{Type: "domain", Domain: "DOME", Function: "Onboarding", Action: []string{"execute"}},
+	}
+
+	buf, err := json.Marshal(NewLEARIssuanceRequestBody(reg, powers, nil, configuration.IssuerConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A single action is serialized as a string
+	want := `{"schema":"LEARCredentialEmployee","operation_mode":"S","format":"jwt_vc_json","payload":{` +
+		`"mandator":{"organizationIdentifier":"ES-B12345678","organization":"Acme Corp","country":"ES","commonName":"John Doe","emailAddress":"john@example.com"},` +
+		`"mandatee":{"firstName":"John","lastName":"Doe","nationality":"ES","email":"john@example.com"},` +
+		`"power":[{"type":"domain","domain":"DOME","function":"ProductOffering","action":["Create","Update"]},` +
+		`{"type":"domain","domain":"DOME","function":"Onboarding","action":"execute"}]}}`
+	if string(buf) != want {
+		t.Errorf("unexpected request body\nexpected %s\n     got %s", want, buf)
+	}
+}
+
+func TestNewLEARIssuanceRequestBodyIssuerConfig(t *testing.T) {
+	reg := Applicant{Email: "john@example.com", Country: "ES", VatID: "B12345678"}
+	issuer := configuration.IssuerConfig{OperationMode: "A", Format: "ldp_vc", Schema: "LEARCredentialMachine"}
+
+	req := NewLEARIssuanceRequestBody(reg, configuration.DefaultPowers, nil, issuer)
+	if req.OperationMode != "A" || req.Format != "ldp_vc" || req.Schema != "LEARCredentialMachine" {
+		t.Errorf("expected the configured mode, format and schema, got %q, %q and %q", req.OperationMode, req.Format, req.Schema)
+	}
+}
+
+func TestNewLEARIssuanceRequestBodyClaims(t *testing.T) {
+	reg := Applicant{Email: "john@example.com", FirstName: "John", Country: "ES", VatID: "B12345678"}
+	claims := map[string]any{"department": "Sales", "program": map[string]any{"name": "DOME"}}
+
+	req := NewLEARIssuanceRequestBody(reg, nil, claims, configuration.IssuerConfig{})
+	buf, err := json.Marshal(req.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The claims are next to the mandator and mandatee
+	want := `{"department":"Sales",` +
+		`"mandatee":{"firstName":"John","nationality":"ES","email":"john@example.com"},` +
+		`"mandator":{"organizationIdentifier":"ES-B12345678","country":"ES","commonName":"John ","emailAddress":"john@example.com"},` +
+		`"program":{"name":"DOME"}}`
+	if string(buf) != want {
+		t.Errorf("unexpected payload\nexpected %s\n     got %s", want, buf)
+	}
+
+	// They are read back from a stored request
+	var payload Payload
+	if err := json.Unmarshal(buf, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Mandatee.Email != reg.Email || payload.Claims["department"] != "Sales" || len(payload.Claims) != 2 {
+		t.Errorf("unexpected payload read %+v", payload)
 	}
 }
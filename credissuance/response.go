@@ -0,0 +1,150 @@
+package credissuance
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// IssuanceResult is what the onboarding needs from the response of the Issuer.
+// The fields are empty when the Issuer does not return them.
+type IssuanceResult struct {
+	// CredentialID identifies the issued credential, or the transaction that will deliver it in deferred mode
+	CredentialID string
+	// OfferURI is the link that wallets use to import the credential
+	OfferURI string
+}
+
+// IssuerError is an error reported by the Issuer in the body of its response, in the format of OAuth 2.0.
+// It matches ErrIssuerClient, as the Issuer processed the request and refused it.
+type IssuerError struct {
+	Code        string
+	Description string
+}
+
+func (e *IssuerError) Error() string {
+	if e.Description == "" {
+		return "the Issuer reported an error: " + e.Code
+	}
+	return "the Issuer reported an error: " + e.Code + ": " + e.Description
+}
+
+func (e *IssuerError) Is(target error) bool {
+	return target == ErrIssuerClient
+}
+
+// issuanceResponse is the shape of the responses of the Issuer. All the fields are optional.
+type issuanceResponse struct {
+	CredentialID       string          `json:"credential_id"`
+	ID                 string          `json:"id"`
+	TransactionID      string          `json:"transaction_id"`
+	Credential         json.RawMessage `json:"credential"`
+	CredentialOfferURI string          `json:"credential_offer_uri"`
+	CredentialOffer    json.RawMessage `json:"credential_offer"`
+	Error              string          `json:"error"`
+	ErrorDescription   string          `json:"error_description"`
+}
+
+// decodeIssuanceResponse decodes the body of a response of the Issuer
+func decodeIssuanceResponse(body []byte) (*issuanceResponse, error) {
+	var resp issuanceResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("invalid response from the Issuer: %w", err)
+	}
+	return &resp, nil
+}
+
+// ParseIssuanceResponse reads the issued credential and its offer from the response of the Issuer.
+// An empty body is accepted, as the Issuer may not return anything when the credential is sent by email.
+// A response with an "error" field is returned as an *IssuerError.
+// If the credential offer is invalid, the result is returned with the credential id and the error.
+func ParseIssuanceResponse(body []byte) (*IssuanceResult, error) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return &IssuanceResult{}, nil
+	}
+	resp, err := decodeIssuanceResponse(body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, &IssuerError{Code: resp.Error, Description: resp.ErrorDescription}
+	}
+
+	result := &IssuanceResult{CredentialID: resp.credentialID()}
+	result.OfferURI, err = resp.offerURI()
+	return result, err
+}
+
+// credentialID uses an explicit identifier field if the response has one, or else the "jti" claim or the "vc.id"
+// of the credential when it is returned as a JWT, or the "id" of the credential when it is returned as JSON.
+func (resp *issuanceResponse) credentialID() string {
+	for _, id := range []string{resp.CredentialID, resp.ID} {
+		if id != "" {
+			return id
+		}
+	}
+
+	var signed string
+	var credential struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(resp.Credential, &signed); err == nil && signed != "" {
+		// The credential was signed by the Issuer, we only read its claims to identify it
+		var claims struct {
+			jwt.RegisteredClaims
+			VC struct {
+				ID string `json:"id"`
+			} `json:"vc"`
+		}
+		if _, _, err := jwt.NewParser().ParseUnverified(signed, &claims); err == nil {
+			if claims.ID != "" {
+				return claims.ID
+			}
+			if claims.VC.ID != "" {
+				return claims.VC.ID
+			}
+		}
+	} else if err := json.Unmarshal(resp.Credential, &credential); err == nil && credential.ID != "" {
+		return credential.ID
+	}
+
+	// In deferred mode the Issuer only returns the transaction that will deliver the credential
+	return resp.TransactionID
+}
+
+// credentialOfferScheme is the scheme of the links that open a wallet to import a credential offer (OID4VCI)
+const credentialOfferScheme = "openid-credential-offer://"
+
+// offerURI returns the link that wallets use to import the credential. The Issuer may return the link itself,
+// the URI of the credential offer or the credential offer object, and in the last two cases the link is built from them.
+func (resp *issuanceResponse) offerURI() (string, error) {
+	if offerURI := strings.TrimSpace(resp.CredentialOfferURI); offerURI != "" {
+		if strings.HasPrefix(offerURI, credentialOfferScheme) {
+			return offerURI, nil
+		}
+		u, err := url.Parse(offerURI)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return "", fmt.Errorf("invalid credential offer URI from the Issuer: %q", offerURI)
+		}
+		return credentialOfferScheme + "?credential_offer_uri=" + url.QueryEscape(offerURI), nil
+	}
+
+	if len(resp.CredentialOffer) > 0 && string(resp.CredentialOffer) != "null" {
+		var offer map[string]any
+		if err := json.Unmarshal(resp.CredentialOffer, &offer); err != nil {
+			return "", fmt.Errorf("invalid credential offer from the Issuer: %w", err)
+		}
+		// Compact the offer, so the link is as short as possible
+		buf, err := json.Marshal(offer)
+		if err != nil {
+			return "", err
+		}
+		return credentialOfferScheme + "?credential_offer=" + url.QueryEscape(string(buf)), nil
+	}
+
+	return "", nil
+}
@@ -0,0 +1,200 @@
+package credissuance
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestParseIssuanceResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    IssuanceResult
+		wantErr *IssuerError
+	}{
+		{
+			name: "credential with offer URI",
+			body: `{
+				"credential_id": "urn:uuid:5b2c1a44-8f3e-4d5c-9a6b-1f2e3d4c5b6a",
+				"credential_offer_uri": "https://issuer.dome-marketplace.eu/oid4vci/v1/credential-offer/3f6a9c2e"
+			}`,
+			want: IssuanceResult{
+				CredentialID: "urn:uuid:5b2c1a44-8f3e-4d5c-9a6b-1f2e3d4c5b6a",
+				OfferURI:     "openid-credential-offer://?credential_offer_uri=" + url.QueryEscape("https://issuer.dome-marketplace.eu/oid4vci/v1/credential-offer/3f6a9c2e"),
+			},
+		},
+		{
+			name: "credential as JSON with offer object",
+			body: `{
+				"credential": {
+					"@context": ["https://www.w3.org/ns/credentials/v2"],
+					"id": "urn:uuid:8d7e6f5a-4b3c-2d1e-0f9a-8b7c6d5e4f3a",
+					"type": ["VerifiableCredential", "LEARCredentialEmployee"]
+				},
+				"credential_offer": {
+					"credential_issuer": "https://issuer.dome-marketplace.eu",
+					"credential_configuration_ids": ["LEARCredentialEmployee"],
+					"grants": {"urn:ietf:params:oauth:grant-type:pre-authorized_code": {"pre-authorized_code": "oaKazRN8I0IbtZ0C7JuMn5"}}
+				}
+			}`,
+			want: IssuanceResult{
+				CredentialID: "urn:uuid:8d7e6f5a-4b3c-2d1e-0f9a-8b7c6d5e4f3a",
+				OfferURI: "openid-credential-offer://?credential_offer=" + url.QueryEscape(
+					`{"credential_configuration_ids":["LEARCredentialEmployee"],"credential_issuer":"https://issuer.dome-marketplace.eu",`+
+						`"grants":{"urn:ietf:params:oauth:grant-type:pre-authorized_code":{"pre-authorized_code":"oaKazRN8I0IbtZ0C7JuMn5"}}}`),
+			},
+		},
+		{
+			name: "deferred issuance",
+			body: `{"transaction_id": "8xLOxBtZp8", "interval": 5}`,
+			want: IssuanceResult{CredentialID: "8xLOxBtZp8"},
+		},
+		{name: "empty body", body: ``},
+		{name: "empty object", body: `{}`},
+		{
+			name:    "error",
+			body:    `{"error": "invalid_request", "error_description": "The mandator organization identifier is missing"}`,
+			wantErr: &IssuerError{Code: "invalid_request", Description: "The mandator organization identifier is missing"},
+		},
+		{
+			name:    "error without description",
+			body:    `{"error": "server_error"}`,
+			wantErr: &IssuerError{Code: "server_error"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseIssuanceResponse([]byte(tt.body))
+			if tt.wantErr != nil {
+				var issuerErr *IssuerError
+				if !errors.As(err, &issuerErr) || *issuerErr != *tt.wantErr {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseIssuanceResponse failed: %v", err)
+			}
+			if *got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, *got)
+			}
+		})
+	}
+}
+
+func TestParseIssuanceResponseInvalid(t *testing.T) {
+	if _, err := ParseIssuanceResponse([]byte(`<html>Bad Gateway</html>`)); err == nil {
+		t.Errorf("expected an error for a response that is not JSON")
+	}
+
+	// The credential is identified even if its offer is invalid
+	got, err := ParseIssuanceResponse([]byte(`{"credential_id": "cred-1", "credential_offer_uri": "javascript:alert(1)"}`))
+	var issuerErr *IssuerError
+	if err == nil || errors.As(err, &issuerErr) {
+		t.Errorf("expected an error for the invalid offer, got %v", err)
+	}
+	if got == nil || got.CredentialID != "cred-1" || got.OfferURI != "" {
+		t.Errorf("expected the credential id without offer, got %+v", got)
+	}
+}
+
+func TestCredentialID(t *testing.T) {
+	// Only the claims of the credential are read, so the signature does not matter
+	signedCredential := func(claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{name: "explicit credential id", body: `{"credential_id": "cred-1", "id": "other"}`, want: "cred-1"},
+		{name: "id", body: `{"id": "urn:uuid:1234"}`, want: "urn:uuid:1234"},
+		{name: "jti of the credential", body: `{"credential": "` + signedCredential(jwt.MapClaims{"jti": "urn:uuid:jti", "vc": map[string]any{"id": "urn:uuid:vc"}}) + `"}`, want: "urn:uuid:jti"},
+		{name: "id of the vc claim", body: `{"credential": "` + signedCredential(jwt.MapClaims{"vc": map[string]any{"id": "urn:uuid:vc"}}) + `"}`, want: "urn:uuid:vc"},
+		{name: "deferred issuance", body: `{"transaction_id": "tx-1"}`, want: "tx-1"},
+		{name: "credential is not a JWT", body: `{"credential": "mock_credential"}`, want: ""},
+		{name: "empty object", body: `{}`, want: ""},
+		{name: "not json", body: `OK`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := decodeIssuanceResponse([]byte(tt.body))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", resp)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeIssuanceResponse failed: %v", err)
+			}
+			if got := resp.credentialID(); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestOfferURI(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "offer link",
+			body: `{"credential_offer_uri": "openid-credential-offer://?credential_offer_uri=https%3A%2F%2Fissuer.example.com%2Foffer%2F1"}`,
+			want: "openid-credential-offer://?credential_offer_uri=https%3A%2F%2Fissuer.example.com%2Foffer%2F1",
+		},
+		{
+			name: "offer URI",
+			body: `{"credential_offer_uri": "https://issuer.example.com/offer/1"}`,
+			want: "openid-credential-offer://?credential_offer_uri=https%3A%2F%2Fissuer.example.com%2Foffer%2F1",
+		},
+		{
+			name: "offer object",
+			body: `{"credential_offer": {"credential_issuer": "https://issuer.example.com", "credential_configuration_ids": ["LEARCredentialEmployee"]}}`,
+			want: "openid-credential-offer://?credential_offer=" + url.QueryEscape(`{"credential_configuration_ids":["LEARCredentialEmployee"],"credential_issuer":"https://issuer.example.com"}`),
+		},
+		{name: "no offer", body: `{"credential_id": "cred-1"}`, want: ""},
+		{name: "null offer", body: `{"credential_offer": null}`, want: ""},
+		{name: "offer URI not https", body: `{"credential_offer_uri": "javascript:alert(1)"}`, wantErr: true},
+		{name: "offer not an object", body: `{"credential_offer": "offer"}`, wantErr: true},
+		{name: "not json", body: `OK`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := decodeIssuanceResponse([]byte(tt.body))
+			var got string
+			if err == nil {
+				got, err = resp.offerURI()
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("offerURI failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
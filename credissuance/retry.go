@@ -0,0 +1,95 @@
+package credissuance
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// defaultRetryBackoff is the wait before the first retry when the configuration does not specify one.
+// The wait doubles after each failed attempt.
+const defaultRetryBackoff = 500 * time.Millisecond
+
+// retryPolicy controls how many times we call the Verifier and the Issuer before giving up
+type retryPolicy struct {
+	maxAttempts int
+	backoff     time.Duration
+}
+
+// retryFunc reports whether a failed attempt is worth retrying, given its response or error
+type retryFunc func(resp *http.Response, err error) bool
+
+// retryTransient retries on any network error and on the status codes of transient failures.
+// Only for requests that can be repeated safely, like getting an access token.
+func retryTransient(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// retryUnprocessed retries only when we know the server did not process the request: it was not sent because the
+// connection could not be established, or the server replied that it is overloaded or unavailable.
+// For requests that must not be repeated, like issuing a credential: after a timeout, a reset connection or any other
+// 5xx the credential may be issued already, and a retry would issue a duplicate.
+func retryUnprocessed(resp *http.Response, err error) bool {
+	if err != nil {
+		return notSent(err)
+	}
+	return unprocessedStatus(resp.StatusCode)
+}
+
+// notSent reports whether the error is a failure to connect to the server, before sending the request
+func notSent(err error) bool {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	return errors.As(err, &dnsErr) || (errors.As(err, &opErr) && opErr.Op == "dial")
+}
+
+// unprocessedStatus reports whether the status is the server refusing to process the request because it is
+// overloaded or unavailable
+func unprocessedStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+// doWithRetry sends the request built by newRequest, retrying the failed attempts that shouldRetry allows.
+// The request is rebuilt for each attempt because its body can be read only once.
+// The last response (or error) is returned to the caller, who is responsible for closing the body.
+// Waiting between attempts stops as soon as the context is done.
+func (p retryPolicy) doWithRetry(ctx context.Context, client *http.Client, shouldRetry retryFunc, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	attempts := max(p.maxAttempts, 1)
+	backoff := p.backoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+
+	var resp *http.Response
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var req *http.Request
+		req, err = newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err = client.Do(req)
+		if !shouldRetry(resp, err) || attempt == attempts {
+			break
+		}
+
+		if err != nil {
+			slog.Warn("⚠️ Request failed, retrying", "url", req.URL.String(), "attempt", attempt, "error", err)
+		} else {
+			slog.Warn("⚠️ Request failed, retrying", "url", req.URL.String(), "attempt", attempt, "status", resp.Status)
+			resp.Body.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	return resp, err
+}
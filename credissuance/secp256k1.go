@@ -0,0 +1,92 @@
+package credissuance
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	secpecdsa "github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// secp256k1Key is a private key on the secp256k1 curve, which the standard library does not implement
+type secp256k1Key struct {
+	*secp256k1.PrivateKey
+}
+
+// parseSecp256k1PrivateKey creates a secp256k1 private key from its raw bytes
+func parseSecp256k1PrivateKey(dBytes []byte) (secp256k1Key, error) {
+	if len(dBytes) != secp256k1.PrivKeyBytesLen {
+		return secp256k1Key{}, fmt.Errorf("a secp256k1 private key must be %d bytes (%d hex characters), got %d bytes",
+			secp256k1.PrivKeyBytesLen, secp256k1.PrivKeyBytesLen*2, len(dBytes))
+	}
+	var d secp256k1.ModNScalar
+	if overflow := d.SetByteSlice(dBytes); overflow || d.IsZero() {
+		return secp256k1Key{}, fmt.Errorf("the secp256k1 private key is out of the range of the curve")
+	}
+	return secp256k1Key{secp256k1.NewPrivateKey(&d)}, nil
+}
+
+// Public returns the *secp256k1.PublicKey of the key
+func (k secp256k1Key) Public() crypto.PublicKey {
+	return k.PubKey()
+}
+
+// Sign signs the digest with a deterministic nonce (RFC 6979), returning the signature in ASN.1 DER form
+// as the ECDSA keys of the standard library
+func (k secp256k1Key) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	return secpecdsa.Sign(k.PrivateKey, digest).Serialize(), nil
+}
+
+// es256kMethod signs the tokens with secp256k1 keys, as ES256K of RFC 8812.
+// The signature is R || S, 32 bytes each, as ES256.
+type es256kMethod struct{}
+
+// signingMethodES256K is the JWT algorithm of the secp256k1 keys, registered to verify the tokens with jwt.Parse
+var signingMethodES256K jwt.SigningMethod = es256kMethod{}
+
+func init() {
+	jwt.RegisterSigningMethod(signingMethodES256K.Alg(), func() jwt.SigningMethod { return signingMethodES256K })
+}
+
+func (es256kMethod) Alg() string {
+	return "ES256K"
+}
+
+// Sign signs with a secp256k1Key, as returned by ParsePrivateKey
+func (es256kMethod) Sign(signingString string, key any) ([]byte, error) {
+	k, ok := key.(secp256k1Key)
+	if !ok {
+		return nil, jwt.ErrInvalidKeyType
+	}
+	hash := sha256.Sum256([]byte(signingString))
+	signature := secpecdsa.Sign(k.PrivateKey, hash[:])
+
+	r, s := signature.R(), signature.S()
+	out := make([]byte, 64)
+	r.PutBytesUnchecked(out[:32])
+	s.PutBytesUnchecked(out[32:])
+	return out, nil
+}
+
+// Verify verifies with a *secp256k1.PublicKey
+func (es256kMethod) Verify(signingString string, sig []byte, key any) error {
+	pub, ok := key.(*secp256k1.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	if len(sig) != 64 {
+		return jwt.ErrSignatureInvalid
+	}
+	var r, s secp256k1.ModNScalar
+	if r.SetByteSlice(sig[:32]) || s.SetByteSlice(sig[32:]) {
+		return jwt.ErrSignatureInvalid
+	}
+	hash := sha256.Sum256([]byte(signingString))
+	if !secpecdsa.NewSignature(&r, &s).Verify(hash[:], pub) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
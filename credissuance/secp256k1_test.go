@@ -0,0 +1,53 @@
+package credissuance
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	secpecdsa "github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+)
+
+func TestSecp256k1KeySign(t *testing.T) {
+	raw, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := secp256k1Key{raw}
+	digest := sha256.Sum256([]byte("registration"))
+
+	// As a crypto.Signer the signature is in DER form
+	der, err := key.Sign(nil, digest[:], nil)
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	signature, err := secpecdsa.ParseDERSignature(der)
+	if err != nil {
+		t.Fatalf("the signature is not DER: %v", err)
+	}
+	if !signature.Verify(digest[:], key.Public().(*secp256k1.PublicKey)) {
+		t.Errorf("the signature does not verify with the public key")
+	}
+
+	// As ES256K the signature is R || S
+	sig, err := signingMethodES256K.Sign("header.payload", key)
+	if err != nil {
+		t.Fatalf("ES256K Sign failed: %v", err)
+	}
+	if len(sig) != 64 {
+		t.Fatalf("expected a 64-byte signature, got %d bytes", len(sig))
+	}
+	if err := signingMethodES256K.Verify("header.payload", sig, key.PubKey()); err != nil {
+		t.Errorf("the signature does not verify: %v", err)
+	}
+	if err := signingMethodES256K.Verify("header.other", sig, key.PubKey()); err == nil {
+		t.Errorf("expected the signature of another content to fail")
+	}
+	other, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signingMethodES256K.Verify("header.payload", sig, other.PubKey()); err == nil {
+		t.Errorf("expected the signature to fail with another key")
+	}
+}
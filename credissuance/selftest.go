@@ -0,0 +1,57 @@
+package credissuance
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// SelfTestResult is the outcome of the checks of SelfTest
+type SelfTestResult struct {
+	// DidKey is the did:key the access token was requested with
+	DidKey string
+	// TokenErr is the error getting an access token from the Verifier, nil if one was obtained
+	TokenErr error
+	// IssuerStatus is the status of the reply of the Issuer to the probe, 0 if it did not reply
+	IssuerStatus int
+	// IssuerErr is the error probing the issuance path, nil if the Issuer is reachable
+	IssuerErr error
+}
+
+// OK reports whether the access token was obtained and the Issuer is reachable
+func (r *SelfTestResult) OK() bool {
+	return r.TokenErr == nil && r.IssuerErr == nil
+}
+
+// SelfTest checks the connectivity with the Verifier and the Issuer without issuing a credential: it gets an
+// access token with the machine credential, and probes the issuance path with an OPTIONS request.
+// Any reply of the Issuer but a server error means it is reachable, as it may not allow OPTIONS.
+func (l *LEARIssuance) SelfTest(ctx context.Context) *SelfTestResult {
+	result := &SelfTestResult{DidKey: l.verifier.DidKey}
+
+	token, err := l.requestToken(ctx)
+	if err != nil {
+		result.TokenErr = err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodOptions, l.credentialIssuancePath, nil)
+	if err != nil {
+		result.IssuerErr = err
+		return result
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		result.IssuerErr = err
+		return result
+	}
+	resp.Body.Close()
+
+	result.IssuerStatus = resp.StatusCode
+	if resp.StatusCode >= 500 {
+		result.IssuerErr = fmt.Errorf("the Issuer replied %s", resp.Status)
+	}
+	return result
+}
@@ -0,0 +1,54 @@
+package credissuance
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	tokenOK := MockResponse{StatusCode: 200, Body: `{"access_token": "mock_token"}`}
+
+	tests := []struct {
+		name       string
+		token      MockResponse
+		issuer     MockResponse
+		wantToken  bool
+		wantIssuer bool
+		wantStatus int
+	}{
+		{name: "all reachable", token: tokenOK, issuer: MockResponse{StatusCode: 204}, wantToken: true, wantIssuer: true, wantStatus: 204},
+		{name: "OPTIONS not allowed", token: tokenOK, issuer: MockResponse{StatusCode: 405}, wantToken: true, wantIssuer: true, wantStatus: 405},
+		{name: "credential rejected", token: MockResponse{StatusCode: 401, Body: `{"error": "invalid_client"}`}, issuer: MockResponse{StatusCode: 401}, wantIssuer: true, wantStatus: 401},
+		{name: "Issuer failing", token: tokenOK, issuer: MockResponse{StatusCode: 503}, wantToken: true, wantStatus: 503},
+		{name: "Issuer unreachable", token: tokenOK, issuer: MockResponse{Err: errors.New("connection refused")}, wantToken: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &MockRoundTripper{
+				Sequences: map[string][]MockResponse{
+					mockTokenEndpoint: {tt.token},
+					mockIssuancePath:  {tt.issuer},
+				},
+			}
+			result := newMockIssuance(t, mock, 1).SelfTest(context.Background())
+
+			if (result.TokenErr == nil) != tt.wantToken {
+				t.Errorf("expected token obtained %v, got error %v", tt.wantToken, result.TokenErr)
+			}
+			if (result.IssuerErr == nil) != tt.wantIssuer {
+				t.Errorf("expected Issuer reachable %v, got error %v", tt.wantIssuer, result.IssuerErr)
+			}
+			if result.IssuerStatus != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, result.IssuerStatus)
+			}
+			if result.OK() != (tt.wantToken && tt.wantIssuer) {
+				t.Errorf("expected OK %v, got %v", tt.wantToken && tt.wantIssuer, result.OK())
+			}
+			if result.DidKey != "did:key:zMock" {
+				t.Errorf("expected the did:key of the machine credential, got %q", result.DidKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package credissuance
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+
+	"github.com/hesusruiz/onboardng/common"
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+// SigningKey authenticates us with the Verifier: the private key signs the LEARCredentialMachine issued to its did:key
+type SigningKey struct {
+	DidKey            string
+	PrivateKey        crypto.Signer
+	MachineCredential string
+}
+
+// LoadSigningKey reads the private key and the LEARCredentialMachine of the configuration.
+// For safety, it derives the did:key of the private key and checks that it is the one in the configuration.
+func LoadSigningKey(cfg configuration.SigningKeyConfig) (*SigningKey, error) {
+	privateKey, err := ReadPrivateKey(cfg.PrivateKeyFile, cfg.KeyType)
+	if err != nil {
+		return nil, err
+	}
+
+	didKey, err := common.DidKeyFromPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if didKey != cfg.MyDidkey {
+		return nil, fmt.Errorf("the private key does not correspond to the did:key in the configuration: it corresponds to %s", didKey)
+	}
+
+	buf, err := os.ReadFile(cfg.MachineCredentialFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningKey{
+		DidKey:            didKey,
+		PrivateKey:        privateKey,
+		MachineCredential: string(buf),
+	}, nil
+}
@@ -0,0 +1,192 @@
+package credissuance
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/common"
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+// newTestSigningKey writes a fresh P-256 key and a machine credential to files, returning their configuration
+func newTestSigningKey(t *testing.T, name string) configuration.SigningKeyConfig {
+	t.Helper()
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	raw, err := privateKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	didKey, err := common.DidKeyFromPrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	cfg := configuration.SigningKeyConfig{
+		PrivateKeyFile:        filepath.Join(dir, name+"_priv.txt"),
+		MachineCredentialFile: filepath.Join(dir, name+"_machine.txt"),
+		MyDidkey:              didKey,
+	}
+	if err := os.WriteFile(cfg.PrivateKeyFile, []byte(hex.EncodeToString(raw)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cfg.MachineCredentialFile, []byte(name+"_machine_credential"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	cfg := newTestSigningKey(t, "new")
+
+	key, err := LoadSigningKey(cfg)
+	if err != nil {
+		t.Fatalf("LoadSigningKey failed: %v", err)
+	}
+	if key.DidKey != cfg.MyDidkey || key.MachineCredential != "new_machine_credential" {
+		t.Errorf("unexpected key %s with machine credential %q", key.DidKey, key.MachineCredential)
+	}
+
+	// The did:key of another key is rejected, telling the right one
+	other := newTestSigningKey(t, "other")
+	cfg.MyDidkey = other.MyDidkey
+	if _, err := LoadSigningKey(cfg); err == nil || !strings.Contains(err.Error(), key.DidKey) {
+		t.Errorf("expected a mismatch naming %s, got %v", key.DidKey, err)
+	}
+}
+
+func TestNewLEARIssuanceSecondaryKey(t *testing.T) {
+	primary := newTestSigningKey(t, "new")
+	secondary := newTestSigningKey(t, "old")
+	config := func(primary, secondary configuration.SigningKeyConfig) configuration.EnvConfig {
+		return configuration.EnvConfig{
+			PrivateKeyFile:        primary.PrivateKeyFile,
+			MachineCredentialFile: primary.MachineCredentialFile,
+			MyDidkey:              primary.MyDidkey,
+			SecondaryKey:          secondary,
+		}
+	}
+
+	l, err := NewLEARIssuance(config(primary, configuration.SigningKeyConfig{}))
+	if err != nil {
+		t.Fatalf("NewLEARIssuance failed: %v", err)
+	}
+	if l.verifier.DidKey != primary.MyDidkey || l.secondary != nil {
+		t.Errorf("expected only the primary key, got %s and %v", l.verifier.DidKey, l.secondary)
+	}
+
+	l, err = NewLEARIssuance(config(primary, secondary))
+	if err != nil {
+		t.Fatalf("NewLEARIssuance failed: %v", err)
+	}
+	if l.verifier.DidKey != primary.MyDidkey || l.secondary == nil || l.secondary.DidKey != secondary.MyDidkey {
+		t.Errorf("expected the primary and secondary keys, got %s and %v", l.verifier.DidKey, l.secondary)
+	}
+	if l.secondary.MachineCredential != "old_machine_credential" {
+		t.Errorf("expected the machine credential of the secondary key, got %q", l.secondary.MachineCredential)
+	}
+
+	broken := secondary
+	broken.MyDidkey = primary.MyDidkey
+	if _, err := NewLEARIssuance(config(primary, broken)); err == nil || !strings.Contains(err.Error(), "secondary key") {
+		t.Errorf("expected an error for the secondary key not matching its did:key, got %v", err)
+	}
+	if _, err := NewLEARIssuance(config(primary, primary)); err == nil {
+		t.Errorf("expected an error for the same key as primary and secondary")
+	}
+}
+
+func TestLEARIssuanceKeySelection(t *testing.T) {
+	primary := newTestSigningKey(t, "new")
+	secondary := newTestSigningKey(t, "old")
+
+	tests := []struct {
+		name string
+		// trusted are the did:keys accepted by the Verifier
+		trusted      []string
+		verifierDown bool
+		withoutKey   bool
+		wantDid      []string
+		wantErr      bool
+	}{
+		{name: "new key trusted", trusted: []string{primary.MyDidkey, secondary.MyDidkey}, wantDid: []string{primary.MyDidkey}},
+		{name: "new key not trusted yet", trusted: []string{secondary.MyDidkey}, wantDid: []string{primary.MyDidkey, secondary.MyDidkey}},
+		{name: "old key removed", trusted: []string{primary.MyDidkey}, wantDid: []string{primary.MyDidkey}},
+		{name: "no key trusted", wantDid: []string{primary.MyDidkey, secondary.MyDidkey}, wantErr: true},
+		{name: "without secondary key", trusted: []string{secondary.MyDidkey}, withoutKey: true, wantDid: []string{primary.MyDidkey}, wantErr: true},
+		// The secondary key does not help when the Verifier fails
+		{name: "verifier down", verifierDown: true, wantDid: []string{primary.MyDidkey}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var used []string
+			client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				if req.URL.String() == mockIssuancePath {
+					return reply(http.StatusOK, `{"credential_id": "cred-1"}`), nil
+				}
+				body, _ := io.ReadAll(req.Body)
+				form, _ := url.ParseQuery(string(body))
+				did := form.Get("client_id")
+				used = append(used, did)
+				if tt.verifierDown {
+					return reply(http.StatusServiceUnavailable, "down"), nil
+				}
+				for _, trusted := range tt.trusted {
+					if did == trusted {
+						return reply(http.StatusOK, `{"access_token": "token"}`), nil
+					}
+				}
+				return reply(http.StatusUnauthorized, `{"error": "invalid_client"}`), nil
+			})}
+
+			cfg := configuration.EnvConfig{
+				PrivateKeyFile:        primary.PrivateKeyFile,
+				MachineCredentialFile: primary.MachineCredentialFile,
+				MyDidkey:              primary.MyDidkey,
+				SecondaryKey:          secondary,
+				Verifier:              configuration.VerifierConfig{URL: "https://verifier.example.com", TokenEndpoint: mockTokenEndpoint},
+				Issuer:                configuration.IssuerConfig{CredentialIssuancePath: mockIssuancePath, MaxAttempts: 1},
+			}
+			if tt.withoutKey {
+				cfg.SecondaryKey = configuration.SigningKeyConfig{}
+			}
+			l, err := NewLEARIssuance(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.httpClient = client
+			l.verifier.HTTPClient = client
+			if l.secondary != nil {
+				l.secondary.HTTPClient = client
+			}
+
+			_, err = l.LEARIssuanceRequestContext(context.Background(), Cred1())
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			var tokenErr *TokenError
+			if err != nil && !errors.As(err, &tokenErr) {
+				t.Errorf("expected a TokenError, got %v", err)
+			}
+			if strings.Join(used, ",") != strings.Join(tt.wantDid, ",") {
+				t.Errorf("expected the keys %v to be used, got %v", tt.wantDid, used)
+			}
+		})
+	}
+}
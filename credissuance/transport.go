@@ -0,0 +1,53 @@
+package credissuance
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+// NewHTTPTransport returns the transport to call the Verifier and Issuer, with the proxy and the extra CA
+// certificates of the configuration. Without a configured proxy, the one in the environment is used.
+// The certificates are not verified if the configuration says so, except in production.
+func NewHTTPTransport(runtime configuration.RuntimeEnv, config configuration.IssuerConfig) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if config.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.ProxyURL)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q", config.ProxyURL)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if config.CABundleFile != "" {
+		bundle, err := os.ReadFile(config.CABundleFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+
+		// SystemCertPool returns a copy, so the extra certificates are trusted in addition to the system ones
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no PEM certificates found in the CA bundle %s", config.CABundleFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+	}
+
+	if configuration.SkipTLSVerify(runtime, config.InsecureSkipVerify, "verifier and issuer") {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+
+	return transport, nil
+}
@@ -0,0 +1,121 @@
+package credissuance
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func TestNewHTTPTransport(t *testing.T) {
+	// An Issuer with a certificate of a private CA
+	issuer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer issuer.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issuer.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	transport, err := NewHTTPTransport(configuration.Production, configuration.IssuerConfig{
+		ProxyURL:     "http://proxy.example.com:3128",
+		CABundleFile: caFile,
+	})
+	if err != nil {
+		t.Fatalf("NewHTTPTransport failed: %v", err)
+	}
+
+	proxy, err := transport.Proxy(httptest.NewRequest(http.MethodPost, "https://issuer.example.com/issuance", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy == nil || proxy.String() != "http://proxy.example.com:3128" {
+		t.Errorf("expected the configured proxy, got %v", proxy)
+	}
+
+	// The CA bundle is trusted, without the proxy which does not exist
+	transport.Proxy = nil
+	resp, err := (&http.Client{Transport: transport}).Get(issuer.URL)
+	if err != nil {
+		t.Fatalf("expected the certificate of the CA bundle to be trusted: %v", err)
+	}
+	resp.Body.Close()
+
+	// Without a CA bundle, the private CA is not trusted
+	transport, err = NewHTTPTransport(configuration.Production, configuration.IssuerConfig{})
+	if err != nil {
+		t.Fatalf("NewHTTPTransport failed: %v", err)
+	}
+	if transport.Proxy == nil {
+		t.Errorf("expected the proxy of the environment to be used")
+	}
+	if _, err := (&http.Client{Transport: transport}).Get(issuer.URL); err == nil {
+		t.Errorf("expected the certificate of the private CA to be rejected")
+	}
+}
+
+func TestNewHTTPTransportInsecureSkipVerify(t *testing.T) {
+	// A staging Issuer with a self-signed certificate
+	issuer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer issuer.Close()
+
+	tests := []struct {
+		runtime configuration.RuntimeEnv
+		wantErr bool
+	}{
+		{runtime: configuration.Development},
+		{runtime: configuration.Preproduction},
+		// The flag is ignored in production
+		{runtime: configuration.Production, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.runtime), func(t *testing.T) {
+			transport, err := NewHTTPTransport(tt.runtime, configuration.IssuerConfig{InsecureSkipVerify: true})
+			if err != nil {
+				t.Fatalf("NewHTTPTransport failed: %v", err)
+			}
+			transport.Proxy = nil
+			resp, err := (&http.Client{Transport: transport}).Get(issuer.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestNewHTTPTransportInvalidConfig(t *testing.T) {
+	emptyBundle := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(emptyBundle, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config configuration.IssuerConfig
+	}{
+		{name: "proxy without scheme", config: configuration.IssuerConfig{ProxyURL: "proxy.example.com:3128"}},
+		{name: "missing CA bundle", config: configuration.IssuerConfig{CABundleFile: filepath.Join(t.TempDir(), "missing.pem")}},
+		{name: "CA bundle without certificates", config: configuration.IssuerConfig{CABundleFile: emptyBundle}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewHTTPTransport(configuration.Production, tt.config); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
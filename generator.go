@@ -1,21 +1,74 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
-	"io"
+	"io/fs"
 	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 
 	"github.com/hesusruiz/onboardng/common"
 	"github.com/hesusruiz/onboardng/internal/configuration"
 )
 
+// generate renders the whole site from scratch
 func generate(cfg configuration.Config) error {
+	g, err := newSiteGenerator(cfg)
+	if err != nil {
+		return err
+	}
+	return g.generateAll()
+}
+
+// siteGenerator renders the pages of the site.
+// It keeps the parsed layouts, so they are parsed once and only cloned for each page.
+type siteGenerator struct {
+	cfg configuration.Config
+	// mu serializes the regenerations by the watcher and the reloads on SIGHUP
+	mu     sync.Mutex
+	layout *template.Template
+
+	// liveReload makes the pages subscribe to the live reload endpoint. Only for watch mode.
+	liveReload bool
+	// minify the generated pages and the CSS assets
+	minify bool
+	// clean removes the files generated before that do not correspond to a page or asset of the source anymore
+	clean bool
+	// fingerprint copies the CSS and JS assets with the hash of their contents in the name
+	fingerprint bool
+	// assets maps the name of each asset in the source to its path in the destination, for the asset function
+	assets map[string]string
+	// basePath is the path the site is served under, like "/onboarding", or "" at the root
+	basePath string
+}
 
-	// Parse all layouts first
+// fingerprintLength is the number of hex digits of the content hash added to the name of the assets
+const fingerprintLength = 10
+
+// manifestFile lists in the destination the files of the last generation, so the next one with clean removes
+// the ones not generated anymore, without touching the other files of the destination
+const manifestFile = ".generated"
+
+func newSiteGenerator(cfg configuration.Config) (*siteGenerator, error) {
+	g := &siteGenerator{cfg: cfg}
+	if err := g.parseLayouts(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// parseLayouts parses all layouts, replacing the cached ones only if parsing succeeds
+func (g *siteGenerator) parseLayouts() error {
 	layoutTmpl, err := template.New("").Funcs(template.FuncMap{
 		"safe": func(s string) template.JS {
 			b, _ := json.Marshal(s)
@@ -35,87 +88,288 @@ func generate(cfg configuration.Config) error {
 			}
 			return dict, nil
 		},
-	}).ParseGlob(filepath.Join(cfg.SrcDir, "layouts/*.html"))
+		"asset": g.assetPath,
+	}).ParseGlob(filepath.Join(g.cfg.SrcDir, "layouts/*.html"))
 	if err != nil {
 		slog.Error("❌ Layout Template Error", "error", err)
 		return err
 	}
+	g.layout = layoutTmpl
+	return nil
+}
 
+// generateAll copies the assets and renders all the pages
+func (g *siteGenerator) generateAll() error {
 	// Find all page templates
-	pages, err := filepath.Glob(filepath.Join(cfg.SrcDir, "pages/*.html"))
+	pages, err := filepath.Glob(filepath.Join(g.cfg.SrcDir, "pages/*.html"))
 	if err != nil {
 		slog.Error("❌ Page Glob Error", "error", err)
 		return err
 	}
 
 	// Create the target dir if it doesn't exist
-	os.MkdirAll(cfg.DestDir, 0755)
-	slog.Info("Generating static files...", "dest_dir", cfg.DestDir)
+	os.MkdirAll(g.cfg.DestDir, 0755)
+	slog.Info("Generating static files...", "dest_dir", g.cfg.DestDir)
 
-	// If we have an assets directory in the source, copy it verbatim recursively
-	if _, err := os.Stat(filepath.Join(cfg.SrcDir, "assets")); err == nil {
-		copyDir(filepath.Join(cfg.SrcDir, "assets"), filepath.Join(cfg.DestDir, "assets"))
-	}
+	generated := g.copyAssets()
 
+	// A broken page should not prevent generating the rest, so we report all failures at the end.
+	// Its previous output is kept, as the page still exists.
+	var pageErrors []error
 	for _, page := range pages {
-		pageBase := filepath.Base(page)
+		generated = append(generated, filepath.Base(page))
+		if err := g.generatePage(page); err != nil {
+			pageErrors = append(pageErrors, err)
+		}
+	}
+	if g.clean {
+		if err := g.prune(generated); err != nil {
+			slog.Error("❌ Error removing the stale files", "dest_dir", g.cfg.DestDir, "error", err)
+		}
+	}
+	if len(pageErrors) > 0 {
+		slog.Error("❌ Some pages could not be generated", "failed", len(pageErrors), "total", len(pages))
+		return &pagesError{errs: pageErrors, total: len(pages)}
+	}
 
-		// Clone the layout template so we don't pollute the shared one with this page's content
-		tmpl, err := layoutTmpl.Clone()
-		if err != nil {
-			slog.Error("❌ Template Clone Error", "page", page, "error", err)
+	slog.Info("✅ Assets copied and HTML pages regenerated.")
+	return nil
+}
+
+// pagesError reports the pages that could not be generated. The rest were generated anyway.
+type pagesError struct {
+	errs  []error
+	total int
+}
+
+func (e *pagesError) Error() string {
+	return errors.Join(e.errs...).Error()
+}
+
+func (e *pagesError) Unwrap() []error {
+	return e.errs
+}
+
+// partial reports whether some of the pages were generated, so the site can still be deployed and served
+func (e *pagesError) partial() bool {
+	return len(e.errs) < e.total
+}
+
+// copyAssets copies recursively the assets directory of the source, if we have one, and records where each asset
+// was copied for the asset function. It returns the files of the assets, relative to the destination.
+func (g *siteGenerator) copyAssets() []string {
+	g.assets = map[string]string{}
+	if _, err := os.Stat(filepath.Join(g.cfg.SrcDir, "assets")); err != nil {
+		return nil
+	}
+	copied, err := copyDir(filepath.Join(g.cfg.SrcDir, "assets"), filepath.Join(g.cfg.DestDir, "assets"), g.minify, g.fingerprint)
+	if err != nil {
+		slog.Error("❌ Error copying the assets", "error", err)
+	}
+	var files []string
+	for name, file := range copied {
+		g.assets[name] = path.Join("assets", file)
+		files = append(files, path.Join("assets", file))
+	}
+	return files
+}
+
+// assetPath is the asset template function: it returns the path of the named asset in the generated site, with
+// the hash of its contents when fingerprinting, so the pages reference it like {{ asset "css/style.css" }}.
+// The name is relative to the assets directory of the source. The path is absolute under the base path if there is
+// one, so it does not depend on the trailing slash of the page URL, and relative otherwise.
+func (g *siteGenerator) assetPath(name string) (string, error) {
+	file, ok := g.assets[name]
+	if !ok {
+		return "", fmt.Errorf("asset %s not found in %s", name, filepath.Join(g.cfg.SrcDir, "assets"))
+	}
+	if g.basePath != "" {
+		return g.basePath + "/" + file, nil
+	}
+	return file, nil
+}
+
+// prune removes the files listed in the manifest of the previous generation that were not generated now,
+// and the directories left empty, and then records the files generated in the manifest
+func (g *siteGenerator) prune(generated []string) error {
+	manifest := filepath.Join(g.cfg.DestDir, manifestFile)
+	previous, err := os.ReadFile(manifest)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	current := make([]string, len(generated))
+	for i, file := range generated {
+		current[i] = filepath.ToSlash(file)
+	}
+	slices.Sort(current)
+
+	for _, file := range strings.Split(string(previous), "\n") {
+		// Never go out of the destination, whatever the manifest says
+		if file == "" || !filepath.IsLocal(file) || slices.Contains(current, file) {
 			continue
 		}
-
-		// Parse the specific page
-		_, err = tmpl.ParseFiles(page)
-		if err != nil {
-			slog.Error("❌ Page Template Parse Error", "page", page, "error", err)
+		path := filepath.Join(g.cfg.DestDir, filepath.FromSlash(file))
+		if err := os.Remove(path); err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				slog.Warn("⚠️ Could not remove a stale file", "file", path, "error", err)
+			}
 			continue
 		}
+		slog.Info("Removed stale file", "file", path)
+		for dir := filepath.Dir(path); dir != filepath.Clean(g.cfg.DestDir) && os.Remove(dir) == nil; dir = filepath.Dir(dir) {
+		}
+	}
+
+	return writeIfChanged(manifest, []byte(strings.Join(current, "\n")+"\n"))
+}
+
+// generatePage renders a single page with the cached layouts.
+// The page file is written only if rendering succeeds, so a failure never leaves a half-generated page.
+// The returned error names the page.
+func (g *siteGenerator) generatePage(page string) error {
+	pageBase := filepath.Base(page)
+
+	// Clone the layout template so we don't pollute the shared one with this page's content
+	tmpl, err := g.layout.Clone()
+	if err != nil {
+		slog.Error("❌ Template Clone Error", "page", page, "error", err)
+		return fmt.Errorf("page %s: %w", page, err)
+	}
+
+	// Parse the specific page
+	_, err = tmpl.ParseFiles(page)
+	if err != nil {
+		slog.Error("❌ Page Template Parse Error", "page", page, "error", err)
+		return fmt.Errorf("page %s: %w", page, err)
+	}
+
+	templateData := map[string]any{
+		"AppName":             g.cfg.AppName,
+		"Environments":        g.cfg.Environments,
+		"Countries":           common.Countries,
+		"CountriesByLanguage": countriesByLanguage(),
+		"LiveReload":          g.liveReload,
+		"LiveReloadPath":      g.basePath + liveReloadPath,
+		"BasePath":            g.basePath,
+	}
+
+	// We execute "layout.html" which should include "content" (defined in the page)
+	var out bytes.Buffer
+	err = tmpl.ExecuteTemplate(&out, "layout.html", templateData)
+	if err != nil {
+		slog.Error("❌ Template Execution Error", "page", page, "error", err)
+		return fmt.Errorf("page %s: %w", page, err)
+	}
+
+	content := out.Bytes()
+	if g.minify {
+		content = minifyHTML(content)
+	}
+	if err := writeIfChanged(filepath.Join(g.cfg.DestDir, pageBase), content); err != nil {
+		return fmt.Errorf("page %s: %w", page, err)
+	}
+	return nil
+}
 
-		outputFile, _ := os.Create(filepath.Join(cfg.DestDir, pageBase))
+// regenerate updates the site after changes in the given files.
+// Changes only in pages re-render just those pages, a change in a layout re-parses the layouts and renders all pages,
+// and anything else (assets, config) regenerates the whole site.
+func (g *siteGenerator) regenerate(changed ...string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 
-		templateData := map[string]any{
-			"AppName":      cfg.AppName,
-			"Environments": cfg.Environments,
-			"Countries":    common.Countries,
+	pagesDir, _ := filepath.Abs(filepath.Join(g.cfg.SrcDir, "pages"))
+	layoutsDir, _ := filepath.Abs(filepath.Join(g.cfg.SrcDir, "layouts"))
+
+	var pages []string
+	var layoutChanged, otherChanged bool
+	for _, file := range changed {
+		dir, err := filepath.Abs(filepath.Dir(file))
+		switch {
+		case err != nil:
+			otherChanged = true
+		case dir == pagesDir && filepath.Ext(file) == ".html":
+			pages = append(pages, file)
+		case dir == layoutsDir:
+			layoutChanged = true
+		default:
+			otherChanged = true
 		}
+	}
 
-		// We execute "layout.html" which should include "content" (defined in the page)
-		err = tmpl.ExecuteTemplate(outputFile, "layout.html", templateData)
-		if err != nil {
-			slog.Error("❌ Template Execution Error", "page", page, "error", err)
-			outputFile.Close() // Ensure file is closed on error
+	if layoutChanged {
+		if err := g.parseLayouts(); err != nil {
 			return err
 		}
-		outputFile.Close()
 	}
-	slog.Info("✅ Assets copied and HTML pages regenerated.")
-	return nil
+	if layoutChanged || otherChanged {
+		return g.generateAll()
+	}
+
+	var pageErrors []error
+	for _, page := range pages {
+		if _, err := os.Stat(page); err != nil {
+			// The page was removed or renamed, nothing to render. Its output is removed when cleaning.
+			if g.clean {
+				return g.generateAll()
+			}
+			continue
+		}
+		slog.Info("Regenerating page", "page", page)
+		if err := g.generatePage(page); err != nil {
+			pageErrors = append(pageErrors, err)
+		}
+	}
+	return errors.Join(pageErrors...)
+}
+
+// reload parses the layouts again and renders the whole site, without restarting the server.
+// If the layouts fail to parse, the pages already generated are kept.
+func (g *siteGenerator) reload() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err := g.parseLayouts(); err != nil {
+		return err
+	}
+	return g.generateAll()
 }
 
 // copyFile is a helper to move assets to the destination
 func copyFile(src, dst string) error {
-	in, err := os.Open(src)
+	in, err := os.ReadFile(src)
 	if err != nil {
 		return err
 	}
-	defer in.Close()
+	return writeIfChanged(dst, in)
+}
+
+// writeIfChanged writes the file only if its contents differ from the ones it has, so regenerating the site keeps
+// the modification time of the files that did not change, and the browsers can keep using their cached copies
+func writeIfChanged(dst string, content []byte) error {
+	if current, err := os.ReadFile(dst); err == nil && bytes.Equal(current, content) {
+		return nil
+	}
+	return os.WriteFile(dst, content, 0644)
+}
 
-	out, err := os.Create(dst)
+// minifyFile copies a CSS file minifying its contents
+func minifyFile(src, dst string) error {
+	in, err := os.ReadFile(src)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
-
-	_, err = io.Copy(out, in)
-	return err
+	return writeIfChanged(dst, minifyCSS(in))
 }
 
-// copyDir recursively copies assets
-func copyDir(src, dst string) error {
-	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+// copyDir recursively copies assets, minifying the CSS files if requested.
+// With fingerprint, the CSS and JS files are copied with the hash of their contents in the name, like
+// style.0123456789.css. Other assets keep their name, as the CSS files refer to them by it.
+// It returns the files copied, mapping their path relative to src to the one relative to dst, both slash-separated.
+func copyDir(src, dst string, minify, fingerprint bool) (map[string]string, error) {
+	files := map[string]string{}
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -125,6 +379,40 @@ func copyDir(src, dst string) error {
 		if info.IsDir() {
 			return os.MkdirAll(target, 0755)
 		}
+		ext := filepath.Ext(path)
+		if fingerprint && (ext == ".css" || ext == ".js") {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if minify && ext == ".css" {
+				content = minifyCSS(content)
+			}
+			hashed := fingerprintName(rel, content)
+			files[filepath.ToSlash(rel)] = filepath.ToSlash(hashed)
+			return writeIfChanged(filepath.Join(dst, hashed), content)
+		}
+		files[filepath.ToSlash(rel)] = filepath.ToSlash(rel)
+		if minify && ext == ".css" {
+			return minifyFile(path, target)
+		}
 		return copyFile(path, target)
 	})
+	return files, err
+}
+
+// fingerprintName adds the hash of the content to the name of the file, before its extension
+func fingerprintName(name string, content []byte) string {
+	sum := sha256.Sum256(content)
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hex.EncodeToString(sum[:])[:fingerprintLength] + ext
+}
+
+// countriesByLanguage returns the supported countries with their names in each supported language
+func countriesByLanguage() map[string][]common.Country {
+	result := make(map[string][]common.Country, len(common.SupportedLanguages))
+	for _, lang := range common.SupportedLanguages {
+		result[lang] = common.LocalizedCountries(lang)
+	}
+	return result
 }
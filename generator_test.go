@@ -0,0 +1,389 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+// newTestSite creates a source directory with the real layouts and assets and the given number of pages
+func newTestSite(b testing.TB, numPages int) configuration.Config {
+	b.Helper()
+
+	cfg := configuration.Config{
+		SrcDir:  b.TempDir(),
+		DestDir: b.TempDir(),
+		AppName: "Benchmark",
+	}
+
+	layouts := filepath.Join(cfg.SrcDir, "layouts")
+	pages := filepath.Join(cfg.SrcDir, "pages")
+	for _, dir := range []string{layouts, pages} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	realLayouts, err := filepath.Glob("src/layouts/*.html")
+	if err != nil || len(realLayouts) == 0 {
+		b.Fatalf("no layouts found: %v", err)
+	}
+	for _, layout := range realLayouts {
+		if err := copyFile(layout, filepath.Join(layouts, filepath.Base(layout))); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	if _, err := copyDir("src/assets", filepath.Join(cfg.SrcDir, "assets"), false, false); err != nil {
+		b.Fatal(err)
+	}
+
+	for i := range numPages {
+		page := fmt.Sprintf(`{{define "content"}}<h1>Page %d</h1>{{range .Countries}}<p>{{.Name}}</p>{{end}}{{end}}`, i)
+		if err := os.WriteFile(filepath.Join(pages, fmt.Sprintf("page%03d.html", i)), []byte(page), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return cfg
+}
+
+// BenchmarkRegenerateFull is what the watcher did before: parse the layouts and render every page on each change
+func BenchmarkRegenerateFull(b *testing.B) {
+	cfg := newTestSite(b, 200)
+
+	for b.Loop() {
+		if err := generate(cfg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkRegeneratePage renders only the changed page with the cached layouts
+func BenchmarkRegeneratePage(b *testing.B) {
+	cfg := newTestSite(b, 200)
+
+	g, err := newSiteGenerator(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	changed := filepath.Join(cfg.SrcDir, "pages", "page100.html")
+
+	for b.Loop() {
+		if err := g.regenerate(changed); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestGenerateReportsEveryFailedPage(t *testing.T) {
+	cfg := newTestSite(t, 3)
+
+	pages := filepath.Join(cfg.SrcDir, "pages")
+	broken := map[string]string{
+		"bad_parse.html": `{{define "content"}}{{if}}{{end}}`,
+		"bad_exec.html":  `{{define "content"}}{{template "missing" .}}{{end}}`,
+	}
+	for name, content := range broken {
+		if err := os.WriteFile(filepath.Join(pages, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := generate(cfg)
+	if err == nil {
+		t.Fatalf("expected an error for the broken pages")
+	}
+	for name := range broken {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("expected the error to name %s, got: %v", name, err)
+		}
+		if _, statErr := os.Stat(filepath.Join(cfg.DestDir, name)); statErr == nil {
+			t.Errorf("expected no output for the broken page %s", name)
+		}
+	}
+
+	// The good pages are generated anyway
+	for i := range 3 {
+		name := fmt.Sprintf("page%03d.html", i)
+		if _, err := os.Stat(filepath.Join(cfg.DestDir, name)); err != nil {
+			t.Errorf("expected %s to be generated: %v", name, err)
+		}
+	}
+
+	// So the site is still served, and only a site without any page stops the startup
+	var pagesErr *pagesError
+	if !errors.As(err, &pagesErr) || !pagesErr.partial() {
+		t.Errorf("expected a partial failure, got: %#v", err)
+	}
+	for i := range 3 {
+		os.Remove(filepath.Join(pages, fmt.Sprintf("page%03d.html", i)))
+	}
+	err = generate(cfg)
+	if !errors.As(err, &pagesErr) || pagesErr.partial() {
+		t.Errorf("expected every page to fail, got: %#v", err)
+	}
+}
+
+func TestReloadKeepsPagesOnLayoutError(t *testing.T) {
+	cfg := newTestSite(t, 1)
+	g, err := newSiteGenerator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.generateAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	layout := filepath.Join(cfg.SrcDir, "layouts", "layout.html")
+	if err := os.WriteFile(layout, []byte(`<main>Reloaded {{template "content" .}}</main>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	page := filepath.Join(cfg.DestDir, "page000.html")
+	generated, err := os.ReadFile(page)
+	if err != nil || !strings.Contains(string(generated), "Reloaded") {
+		t.Fatalf("expected the page rendered with the new layout, got %q: %v", generated, err)
+	}
+
+	// A broken layout keeps the cached one and the generated pages
+	if err := os.WriteFile(layout, []byte(`{{if}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.reload(); err == nil {
+		t.Fatalf("expected an error for the broken layout")
+	}
+	if after, _ := os.ReadFile(page); string(after) != string(generated) {
+		t.Errorf("expected the page to be kept, got %q", after)
+	}
+	if err := g.regenerate(filepath.Join(cfg.SrcDir, "pages", "page000.html")); err != nil {
+		t.Errorf("expected the cached layout to be used, got %v", err)
+	}
+}
+
+func TestCleanRemovesStaleFiles(t *testing.T) {
+	for _, clean := range []bool{true, false} {
+		t.Run(fmt.Sprintf("clean=%v", clean), func(t *testing.T) {
+			cfg := newTestSite(t, 2)
+			asset := filepath.Join(cfg.SrcDir, "assets", "img", "logo.svg")
+			if err := os.MkdirAll(filepath.Dir(asset), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(asset, []byte("<svg/>"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			unrelated := filepath.Join(cfg.DestDir, "CNAME")
+			if err := os.WriteFile(unrelated, []byte("example.com"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			g, err := newSiteGenerator(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			g.clean = clean
+			if err := g.generateAll(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Remove a page and an asset from the source
+			if err := os.Remove(filepath.Join(cfg.SrcDir, "pages", "page001.html")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Remove(asset); err != nil {
+				t.Fatal(err)
+			}
+			if err := g.regenerate(filepath.Join(cfg.SrcDir, "pages", "page001.html")); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, stale := range []string{"page001.html", filepath.Join("assets", "img", "logo.svg"), filepath.Join("assets", "img")} {
+				_, err := os.Stat(filepath.Join(cfg.DestDir, stale))
+				if clean && err == nil {
+					t.Errorf("expected %s to be removed", stale)
+				}
+				if !clean && err != nil {
+					t.Errorf("expected %s to be kept without clean: %v", stale, err)
+				}
+			}
+			for _, kept := range []string{"page000.html", "CNAME"} {
+				if _, err := os.Stat(filepath.Join(cfg.DestDir, kept)); err != nil {
+					t.Errorf("expected %s to be kept: %v", kept, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCleanStaysInsideDestDir(t *testing.T) {
+	cfg := newTestSite(t, 1)
+	outside := filepath.Join(t.TempDir(), "keep.txt")
+	if err := os.WriteFile(outside, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(cfg.DestDir, outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := filepath.ToSlash(rel) + "\n" + filepath.ToSlash(outside) + "\n"
+	if err := os.WriteFile(filepath.Join(cfg.DestDir, manifestFile), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := newSiteGenerator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.clean = true
+	if err := g.generateAll(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("expected the file outside the destination to be kept: %v", err)
+	}
+	recorded, err := os.ReadFile(filepath.Join(cfg.DestDir, manifestFile))
+	if err != nil || !strings.HasSuffix(string(recorded), "\npage000.html\n") || strings.Contains(string(recorded), "keep.txt") {
+		t.Errorf("expected the manifest to list only the generated files, got %q: %v", recorded, err)
+	}
+}
+
+func TestFingerprintAssets(t *testing.T) {
+	for _, fingerprint := range []bool{true, false} {
+		t.Run(fmt.Sprintf("fingerprint=%v", fingerprint), func(t *testing.T) {
+			cfg := newTestSite(t, 1)
+			g, err := newSiteGenerator(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			g.fingerprint = fingerprint
+			g.clean = true
+			if err := g.generateAll(); err != nil {
+				t.Fatal(err)
+			}
+
+			css, err := g.assetPath("dome.css")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fingerprint == (css == "assets/dome.css") {
+				t.Fatalf("unexpected path of the CSS with fingerprint=%v: %s", fingerprint, css)
+			}
+			// Other assets are referenced by name from the CSS files, so they keep it
+			if logo, err := g.assetPath("logos/DOME_Icon_White.svg"); err != nil || logo != "assets/logos/DOME_Icon_White.svg" {
+				t.Errorf("expected the logo to keep its name, got %q: %v", logo, err)
+			}
+			if _, err := g.assetPath("missing.css"); err == nil {
+				t.Errorf("expected an error for a missing asset")
+			}
+
+			page, err := os.ReadFile(filepath.Join(cfg.DestDir, "page000.html"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(page), `href="`+css+`"`) {
+				t.Errorf("expected the page to reference %s", css)
+			}
+			if _, err := os.Stat(filepath.Join(cfg.DestDir, css)); err != nil {
+				t.Errorf("expected %s to be generated: %v", css, err)
+			}
+			if !fingerprint {
+				return
+			}
+
+			// A change in the contents gives a new name, and the old one is cleaned
+			source := filepath.Join(cfg.SrcDir, "assets", "dome.css")
+			if err := os.WriteFile(source, []byte("body { color: red; }"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := g.regenerate(source); err != nil {
+				t.Fatal(err)
+			}
+			changed, _ := g.assetPath("dome.css")
+			if changed == css {
+				t.Errorf("expected a new name after changing the contents, got %s", changed)
+			}
+			if _, err := os.Stat(filepath.Join(cfg.DestDir, css)); err == nil {
+				t.Errorf("expected the old %s to be cleaned", css)
+			}
+		})
+	}
+}
+
+func TestRegenerateKeepsUnchangedFiles(t *testing.T) {
+	cfg := newTestSite(t, 2)
+	g, err := newSiteGenerator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.clean = true
+	if err := g.generateAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the generated files to the past, so a rewrite shows in their modification time
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	var files []string
+	err = filepath.WalkDir(cfg.DestDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		files = append(files, path)
+		return os.Chtimes(path, past, past)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.generateAll(); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(past) {
+			t.Errorf("expected %s not to be rewritten, modified at %v", file, info.ModTime())
+		}
+	}
+
+	// A change is still written
+	page := filepath.Join(cfg.SrcDir, "pages", "page000.html")
+	if err := os.WriteFile(page, []byte(`{{define "content"}}<h1>Changed</h1>{{end}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.regenerate(page); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(filepath.Join(cfg.DestDir, "page000.html")); info.ModTime().Equal(past) {
+		t.Errorf("expected the changed page to be written")
+	}
+}
+
+func TestBasePathInPages(t *testing.T) {
+	cfg := newTestSite(t, 1)
+	g, err := newSiteGenerator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.basePath = "/onboarding"
+	if err := g.generateAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := os.ReadFile(filepath.Join(cfg.DestDir, "page000.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(page), `href="/onboarding/assets/dome.css"`) {
+		t.Errorf("expected the assets under the base path, got %s", page)
+	}
+}
@@ -0,0 +1,56 @@
+// Package buildinfo identifies the build of the onboarding binary, to know which one is deployed.
+package buildinfo
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// The version, commit and date of the build, set when building the binary with
+//
+//	go build -ldflags "-X github.com/hesusruiz/onboardng/internal/buildinfo.Version=v1.2.0
+//	  -X github.com/hesusruiz/onboardng/internal/buildinfo.Commit=$(git rev-parse --short HEAD)
+//	  -X github.com/hesusruiz/onboardng/internal/buildinfo.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	Version = "dev"
+	Commit  = ""
+	Date    = ""
+)
+
+// Info identifies a build
+type Info struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit,omitempty"`
+	Date    string `json:"date,omitempty"`
+}
+
+// Get returns the build of the running binary. When the commit and date are not set with -ldflags,
+// they are taken from the version control information stamped by the Go toolchain, if any.
+func Get() Info {
+	info := Info{Version: Version, Commit: Commit, Date: Date}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.Date == "":
+				info.Date = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+// String returns the build as "version (commit ..., built ...)", omitting what is unknown
+func (i Info) String() string {
+	s := i.Version
+	switch {
+	case i.Commit != "" && i.Date != "":
+		s += fmt.Sprintf(" (commit %s, built %s)", i.Commit, i.Date)
+	case i.Commit != "":
+		s += fmt.Sprintf(" (commit %s)", i.Commit)
+	case i.Date != "":
+		s += fmt.Sprintf(" (built %s)", i.Date)
+	}
+	return s
+}
@@ -0,0 +1,30 @@
+package buildinfo
+
+import "testing"
+
+func TestInfoString(t *testing.T) {
+	tests := []struct {
+		info Info
+		want string
+	}{
+		{info: Info{Version: "dev"}, want: "dev"},
+		{info: Info{Version: "v1.2.0", Commit: "abc1234"}, want: "v1.2.0 (commit abc1234)"},
+		{info: Info{Version: "v1.2.0", Date: "2026-03-01T10:00:00Z"}, want: "v1.2.0 (built 2026-03-01T10:00:00Z)"},
+		{info: Info{Version: "v1.2.0", Commit: "abc1234", Date: "2026-03-01T10:00:00Z"}, want: "v1.2.0 (commit abc1234, built 2026-03-01T10:00:00Z)"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.info.String(); got != tt.want {
+			t.Errorf("expected %q, got %q", tt.want, got)
+		}
+	}
+}
+
+func TestGetInjectedValues(t *testing.T) {
+	defer func(version, commit, date string) { Version, Commit, Date = version, commit, date }(Version, Commit, Date)
+	Version, Commit, Date = "v1.2.0", "abc1234", "2026-03-01T10:00:00Z"
+
+	if got := Get(); got != (Info{Version: "v1.2.0", Commit: "abc1234", Date: "2026-03-01T10:00:00Z"}) {
+		t.Errorf("expected the values set with -ldflags, got %+v", got)
+	}
+}
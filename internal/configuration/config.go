@@ -1,5 +1,18 @@
 package configuration
 
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hesusruiz/onboardng/common"
+)
+
 type RuntimeEnv string
 
 const (
@@ -9,9 +22,18 @@ const (
 )
 
 type Config struct {
-	DestDir      string               `yaml:"dest_dir"`
-	SrcDir       string               `yaml:"src_dir"`
-	AppName      string               `yaml:"app_name"`
+	DestDir string `yaml:"dest_dir"`
+	SrcDir  string `yaml:"src_dir"`
+	AppName string `yaml:"app_name"`
+	// Minify the generated pages and CSS assets. It only applies to pre and pro builds.
+	Minify bool `yaml:"minify"`
+	// Clean removes from the destination the files generated before that do not correspond to a page or asset of the
+	// source anymore. Only the files listed by the previous generation are removed, so a shared destination is safe.
+	Clean bool `yaml:"clean,omitempty"`
+	// Fingerprint copies the CSS and JS assets with the hash of their contents in the name, so they can be cached
+	// for long without serving stale versions after a deploy. The pages must refer to them with the asset function.
+	// It does not apply in watch mode, to keep the names stable while editing.
+	Fingerprint  bool                 `yaml:"fingerprint,omitempty"`
 	Environments map[string]EnvConfig `yaml:"environments"`
 }
 
@@ -19,13 +41,403 @@ type EnvConfig struct {
 	Runtime RuntimeEnv `yaml:"name"`
 	ApiUrl  string     `yaml:"api_url"`
 	Debug   bool       `yaml:"debug"`
+	// BasePath is the path the site and the API are served under behind a reverse proxy, like "/onboarding".
+	// The proxy forwards the requests with the path as it is. The api_url does not include it.
+	BasePath string `yaml:"basePath,omitempty"`
+
+	PrivateKeyFile        string          `yaml:"privateKeyFile,omitempty"`
+	MachineCredentialFile string          `yaml:"machineCredentialFile,omitempty"`
+	MyDidkey              string          `yaml:"mydidkey,omitempty"`
+	Verifier              VerifierConfig  `yaml:"verifier"`
+	Issuer                IssuerConfig    `yaml:"issuer"`
+	Mail                  MailConfig      `yaml:"mail"`
+	Countries             CountryConfig   `yaml:"countries"`
+	Endpoints             EndpointsConfig `yaml:"endpoints"`
+	CSRF                  CSRFConfig      `yaml:"csrf"`
+	TLS                   TLSConfig       `yaml:"tls"`
+
+	// VerificationCode is the format of the codes sent to verify an email
+	VerificationCode VerificationCodeConfig `yaml:"verificationCode,omitempty"`
+
+	// VerificationCodeTTL is how long the code sent to validate an email is valid, 15 minutes by default
+	VerificationCodeTTL time.Duration `yaml:"verificationCodeTTL,omitempty"`
+
+	// RequireVerifiedEmail rejects the registrations whose email was not verified with a code shortly before
+	RequireVerifiedEmail bool `yaml:"requireVerifiedEmail,omitempty"`
+	// VerifiedEmailWindow is how long after verifying the email the registration is accepted, 30 minutes by default
+	VerifiedEmailWindow time.Duration `yaml:"verifiedEmailWindow,omitempty"`
+
+	// BotDetection controls the traps of the registration form catching the bots
+	BotDetection BotDetectionConfig `yaml:"botDetection,omitempty"`
+
+	// IdempotencyWindow is how long a repeated Idempotency-Key returns the original registration, 24 hours by default
+	IdempotencyWindow time.Duration `yaml:"idempotencyWindow,omitempty"`
+
+	// RegistrationID is the format of the ids of the registrations
+	RegistrationID RegistrationIDConfig `yaml:"registrationId,omitempty"`
+
+	// IssuanceRetry controls the retries in the background of the issuances that failed
+	IssuanceRetry IssuanceRetryConfig `yaml:"issuanceRetry,omitempty"`
+
+	// IssuanceLimit bounds the issuances in flight at once
+	IssuanceLimit IssuanceLimitConfig `yaml:"issuanceLimit,omitempty"`
+
+	// Webhook is notified of the new registrations, e.g. to add them to a CRM. Disabled without a URL.
+	Webhook WebhookConfig `yaml:"webhook,omitempty"`
+
+	// Outbox controls the delivery in the background of the welcome emails and webhook calls that failed
+	Outbox OutboxConfig `yaml:"outbox,omitempty"`
+
+	// Database selects where the registrations are stored, a SQLite file in data/onboarding.db by default
+	Database DatabaseConfig `yaml:"database,omitempty"`
+
+	// Redis keeps the rate limits and the verification codes, shared by the replicas of the server behind a load
+	// balancer. Without an address they are kept in the memory of each server.
+	Redis RedisConfig `yaml:"redis,omitempty"`
+
+	// Tracing exports the traces of the requests to an OpenTelemetry collector. Disabled without an endpoint.
+	Tracing TracingConfig `yaml:"tracing,omitempty"`
+
+	// Retention purges the registrations older than its maximum age, so their personal data is not kept forever.
+	// Disabled without a maximum age.
+	Retention RetentionConfig `yaml:"retention,omitempty"`
+
+	// MaxBodySize is the maximum size in bytes of the body of the API requests, 8 KB by default
+	MaxBodySize int64 `yaml:"maxBodySize,omitempty"`
+
+	// RegistrationQueueFile keeps the registrations that could not be saved in the database, to save them
+	// at the next start. "data/registration_queue.jsonl" by default.
+	RegistrationQueueFile string `yaml:"registrationQueueFile,omitempty"`
+
+	// StatusSecretFile holds the key signing the tokens to query the status of a registration.
+	// If empty a random key is used, and the tokens are not valid after a restart.
+	StatusSecretFile string `yaml:"statusSecretFile,omitempty"`
+
+	// ContentSecurityPolicy replaces the default policy sent with all responses, built for the assets of the pages
+	ContentSecurityPolicy string `yaml:"contentSecurityPolicy,omitempty"`
+
+	// AdminTokenFile holds the bearer token required by the admin endpoints below /api/admin/.
+	// Without it the admin endpoints are open in development, and disabled in the other environments.
+	AdminTokenFile string `yaml:"adminTokenFile,omitempty"`
+
+	// TrustedProxies are the reverse proxies in front of the server, as CIDR ranges (e.g. "10.0.0.0/8") or addresses.
+	// The address of the client is taken from their X-Forwarded-For and X-Real-IP headers, ignored from other peers.
+	TrustedProxies []string `yaml:"trustedProxies,omitempty"`
+
+	// AllowedOrigins are the origins (e.g. "https://dome-marketplace.github.io") of the pages allowed to call the API.
+	// The wildcard "*" allows any origin, but without credentials, and is only accepted in development.
+	AllowedOrigins []string `yaml:"allowedOrigins,omitempty"`
+
+	// KeyType is the type of the private key: "P-256" (the default), "Ed25519" or "secp256k1".
+	// When empty, a 64-byte key is taken as Ed25519 and anything else as P-256.
+	KeyType common.KeyType `yaml:"keyType,omitempty"`
+
+	// Powers granted in the LEARCredential issued to new users. If empty, DefaultPowers are granted.
+	Powers []PowerConfig `yaml:"powers,omitempty"`
+
+	// AdditionalClaims are added to the payload of the issued credentials besides the mandator, mandatee and power,
+	// e.g. {"department": "Sales"}
+	AdditionalClaims map[string]any `yaml:"additionalClaims,omitempty"`
+
+	// ExtraFields are the fields that the registration form may send in "extra", added to the claims of the credential.
+	// Any other extra field is rejected.
+	ExtraFields []ExtraFieldConfig `yaml:"extraFields,omitempty"`
+
+	// SecondaryKey is used to authenticate with the Verifier when it rejects the key above, while rotating the keys.
+	// The new key is configured above, and the previous one here until the Verifier trusts the new did:key.
+	SecondaryKey SigningKeyConfig `yaml:"secondaryKey,omitempty"`
+}
+
+// PrimaryKey returns the key used to authenticate with the Verifier
+func (c EnvConfig) PrimaryKey() SigningKeyConfig {
+	return SigningKeyConfig{
+		PrivateKeyFile:        c.PrivateKeyFile,
+		MachineCredentialFile: c.MachineCredentialFile,
+		MyDidkey:              c.MyDidkey,
+		KeyType:               c.KeyType,
+	}
+}
+
+// Prefix returns the base path in the form it prefixes the routes: with a leading slash and without a trailing one,
+// or "" when the site is served at the root
+func (c EnvConfig) Prefix() string {
+	p := strings.Trim(c.BasePath, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// OriginAllowed reports whether pages in the given origin can call the API
+func (c EnvConfig) OriginAllowed(origin string) bool {
+	return slices.Contains(c.AllowedOrigins, "*") || c.OriginListed(origin)
+}
+
+// OriginListed reports whether the origin is one of the allowed origins, not just matched by the wildcard.
+// Only the pages of these origins can call the API with credentials.
+func (c EnvConfig) OriginListed(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateAllowedOrigins rejects the wildcard origin outside development, as it would let any site call the API
+func (c EnvConfig) ValidateAllowedOrigins(runtime RuntimeEnv) error {
+	if runtime != Development && slices.Contains(c.AllowedOrigins, "*") {
+		return fmt.Errorf("allowedOrigins: the wildcard \"*\" is only accepted in development, list the origins instead")
+	}
+	return nil
+}
+
+// BotDetectionConfig controls the traps of the registration form. The registrations caught by them get a fake success.
+type BotDetectionConfig struct {
+	// HoneypotFields are the names of the hidden fields of the form, that people leave empty and bots fill.
+	// "website" by default.
+	HoneypotFields []string `yaml:"honeypotFields,omitempty"`
+	// MinFillTime rejects the forms submitted sooner after the page got its form token, faster than a person can.
+	// Zero disables the check.
+	MinFillTime time.Duration `yaml:"minFillTime,omitempty"`
+}
+
+// RegistrationIDConfig is the format of the registration ids: the prefix, the date as YYYYMMDD, the separator
+// and the random digits, e.g. "20260101-12345678" by default
+type RegistrationIDConfig struct {
+	Prefix string `yaml:"prefix,omitempty"`
+	// Separator goes between the date and the digits, "-" by default
+	Separator string `yaml:"separator,omitempty"`
+	// Digits is the number of random digits, 8 by default. Less than 6 makes collisions too likely.
+	Digits int `yaml:"digits,omitempty"`
+}
+
+// The character sets of the verification codes
+const (
+	// NumericCodes are made of the digits 0 to 9 (the default)
+	NumericCodes = "numeric"
+	// AlphanumericCodes are made of uppercase letters and digits, without the ones easily confused like O and 0
+	AlphanumericCodes = "alphanumeric"
+)
+
+// VerificationCodeConfig is the format of the codes sent to verify an email, 6 digits by default
+type VerificationCodeConfig struct {
+	// Length is the number of characters of the codes, 6 by default
+	Length int `yaml:"length,omitempty"`
+	// Charset is NumericCodes or AlphanumericCodes, numeric by default
+	Charset string `yaml:"charset,omitempty"`
+	// MaxAttempts is the number of wrong guesses of a code before it is invalidated and a new one must be requested,
+	// 5 by default
+	MaxAttempts int `yaml:"maxAttempts,omitempty"`
+	// FailureDelay slows down the replies to the wrong guesses, waiting the delay times the failed attempts so far.
+	// Zero does not wait.
+	FailureDelay time.Duration `yaml:"failureDelay,omitempty"`
+	// MaxCodesPerDay is the number of codes sent to each email in 24 hours, 10 by default. It caps the codes
+	// requested over many short windows of the rate limit of 3 codes every 3 minutes.
+	MaxCodesPerDay int `yaml:"maxCodesPerDay,omitempty"`
+	// Hashed keeps the emails and the codes hashed in the memory of the server or in Redis, instead of in plain
+	// text, so a dump of them does not reveal who is registering
+	Hashed bool `yaml:"hashed,omitempty"`
+	// HashKeyFile holds the key salting the hashes, with at least 32 characters. Without it a random key is used,
+	// so the codes sent do not survive a restart. It is required with Redis, to be shared by the replicas.
+	HashKeyFile string `yaml:"hashKeyFile,omitempty"`
+}
+
+// TLSConfig makes the server serve HTTPS with the certificate in the files.
+// Without it the server serves plain HTTP, for local development or behind a proxy terminating TLS.
+type TLSConfig struct {
+	// CertFile holds the PEM certificate chain, starting with the certificate of the server
+	CertFile string `yaml:"certFile,omitempty"`
+	KeyFile  string `yaml:"keyFile,omitempty"`
+}
+
+// Enabled reports whether the server serves HTTPS
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// Validate rejects a certificate without key or a key without certificate
+func (c TLSConfig) Validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("TLS needs both certFile and keyFile")
+	}
+	return nil
+}
+
+// CSRFConfig controls the protection of the API against cross-site request forgery
+type CSRFConfig struct {
+	// AllowLegacyHeader accepts requests without a CSRF token if they have the X-Requested-With header.
+	// It keeps old versions of the page working while they are replaced, and will be removed.
+	AllowLegacyHeader bool `yaml:"allowLegacyHeader,omitempty"`
+}
+
+// EndpointsConfig enables or disables API endpoints, keyed by their path below /api/ (e.g. "register").
+// Endpoints not present in the map are enabled.
+type EndpointsConfig map[string]bool
+
+// Enabled reports whether the named API endpoint should be served
+func (e EndpointsConfig) Enabled(name string) bool {
+	enabled, ok := e[name]
+	return !ok || enabled
+}
+
+// PowerConfig is a power granted in the issued LEARCredential, the capability to perform some actions on a function of a domain
+type PowerConfig struct {
+	Type     string   `yaml:"type"`
+	Domain   string   `yaml:"domain"`
+	Function string   `yaml:"function"`
+	Action   []string `yaml:"action"`
+}
+
+// DefaultPowers are the powers granted when none are configured
+var DefaultPowers = []PowerConfig{
+	{
+		Type:     "domain",
+		Domain:   "DOME",
+		Function: "Onboarding",
+		Action:   []string{"execute", "verify"},
+	},
+}
+
+// CredentialPowers returns the powers to grant in the issued credentials
+func (c EnvConfig) CredentialPowers() []PowerConfig {
+	if len(c.Powers) == 0 {
+		return DefaultPowers
+	}
+	return c.Powers
+}
+
+// ExtraFieldConfig is a field of the registration form, besides the standard ones, added to the claims of the credential
+type ExtraFieldConfig struct {
+	// Name of the field in the "extra" object of the registration
+	Name string `yaml:"name"`
+	// Label of the field in the registration form, the name by default
+	Label string `yaml:"label,omitempty"`
+	// Claim is the claim of the payload set to the value of the field, the name of the field by default
+	Claim string `yaml:"claim,omitempty"`
+	// Required rejects the registrations without the field
+	Required bool `yaml:"required,omitempty"`
+	// MaxLength is the maximum length in characters of the value, 100 by default
+	MaxLength int `yaml:"maxLength,omitempty"`
+}
+
+// DefaultExtraFieldMaxLength is the maximum length of the values of the extra fields without one configured
+const DefaultExtraFieldMaxLength = 100
+
+// ClaimName returns the claim of the payload set to the value of the field
+func (f ExtraFieldConfig) ClaimName() string {
+	if f.Claim == "" {
+		return f.Name
+	}
+	return f.Claim
+}
+
+// reservedClaims are the claims of the payload of the credential filled from the registration and the powers
+var reservedClaims = []string{"mandator", "mandatee", "power"}
+
+// ExtraField returns the configuration of the extra field with the given name, and whether it is accepted
+func (c EnvConfig) ExtraField(name string) (ExtraFieldConfig, bool) {
+	for _, f := range c.ExtraFields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return ExtraFieldConfig{}, false
+}
+
+// CredentialClaims returns the claims to add to the payload of the credential of a registration: the additional
+// claims, and the claims of the extra fields of the registration, which take precedence. Nil if there are none.
+func (c EnvConfig) CredentialClaims(extraFields map[string]string) map[string]any {
+	if len(c.AdditionalClaims) == 0 && len(extraFields) == 0 {
+		return nil
+	}
+	claims := make(map[string]any, len(c.AdditionalClaims)+len(extraFields))
+	maps.Copy(claims, c.AdditionalClaims)
+	for name, value := range extraFields {
+		// Fields no longer in the configuration are not added to the credentials issued from now on
+		if f, ok := c.ExtraField(name); ok {
+			claims[f.ClaimName()] = value
+		}
+	}
+	return claims
+}
+
+// ValidateClaims checks that the additional claims and the extra fields do not replace the claims filled from the
+// registration, and that each extra field has a name and its own claim
+func (c EnvConfig) ValidateClaims() error {
+	for name := range c.AdditionalClaims {
+		if name == "" || slices.Contains(reservedClaims, name) {
+			return fmt.Errorf("additional claim %q: the claim can not be empty or one of %v", name, reservedClaims)
+		}
+	}
+	names := make(map[string]bool)
+	claims := make(map[string]bool)
+	for i, f := range c.ExtraFields {
+		if strings.TrimSpace(f.Name) == "" {
+			return fmt.Errorf("extra field %d: the name is required", i+1)
+		}
+		if names[f.Name] {
+			return fmt.Errorf("extra field %q: defined more than once", f.Name)
+		}
+		names[f.Name] = true
+		claim := f.ClaimName()
+		if slices.Contains(reservedClaims, claim) || claims[claim] {
+			return fmt.Errorf("extra field %q: the claim %q is reserved or used by another field", f.Name, claim)
+		}
+		claims[claim] = true
+		if f.MaxLength < 0 {
+			return fmt.Errorf("extra field %q: negative maximum length", f.Name)
+		}
+	}
+	return nil
+}
+
+// ValidatePowers checks that each power is complete and that no function is granted twice in the same domain
+func ValidatePowers(powers []PowerConfig) error {
+	seen := make(map[string]bool)
+	for i, p := range powers {
+		if p.Type == "" || p.Domain == "" || p.Function == "" {
+			return fmt.Errorf("power %d: type, domain and function are required", i+1)
+		}
+		if len(p.Action) == 0 {
+			return fmt.Errorf("power %d (%s/%s): at least one action is required", i+1, p.Domain, p.Function)
+		}
+		for _, action := range p.Action {
+			if strings.TrimSpace(action) == "" {
+				return fmt.Errorf("power %d (%s/%s): empty action", i+1, p.Domain, p.Function)
+			}
+		}
+		key := p.Domain + "/" + p.Function
+		if seen[key] {
+			return fmt.Errorf("power %d: %s is granted more than once", i+1, key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
 
+// SigningKeyConfig is a private key with its did:key, and the LEARCredentialMachine issued to the did:key
+type SigningKeyConfig struct {
 	PrivateKeyFile        string         `yaml:"privateKeyFile,omitempty"`
 	MachineCredentialFile string         `yaml:"machineCredentialFile,omitempty"`
 	MyDidkey              string         `yaml:"mydidkey,omitempty"`
-	Verifier              VerifierConfig `yaml:"verifier"`
-	Issuer                IssuerConfig   `yaml:"issuer"`
-	Mail                  MailConfig     `yaml:"mail"`
+	KeyType               common.KeyType `yaml:"keyType,omitempty"`
+}
+
+// Enabled reports whether the key is configured
+func (c SigningKeyConfig) Enabled() bool {
+	return c.PrivateKeyFile != ""
+}
+
+// SigningKeyTypes are the types of private keys we can sign with
+var SigningKeyTypes = []common.KeyType{common.KeyTypeP256, common.KeyTypeEd25519, common.KeyTypeSecp256k1}
+
+// ValidateKeyType checks that the key type, if set, is one we can sign with
+func (c SigningKeyConfig) ValidateKeyType() error {
+	if c.KeyType != "" && !slices.Contains(SigningKeyTypes, c.KeyType) {
+		return fmt.Errorf("keyType: unsupported key type %q, expected one of %q", c.KeyType, SigningKeyTypes)
+	}
+	return nil
 }
 
 type VerifierConfig struct {
@@ -35,13 +447,318 @@ type VerifierConfig struct {
 
 type IssuerConfig struct {
 	CredentialIssuancePath string `yaml:"credentialIssuancePath,omitempty"`
+
+	// ProxyURL is the HTTP(S) proxy to call the Verifier and Issuer, e.g. "http://proxy.example.com:3128".
+	// If empty, the proxy is taken from the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables.
+	ProxyURL string `yaml:"proxyUrl,omitempty"`
+	// CABundleFile holds PEM certificates trusted to call the Verifier and Issuer, in addition to the system ones.
+	// It is needed when they use certificates of a private CA.
+	CABundleFile string `yaml:"caBundleFile,omitempty"`
+	// InsecureSkipVerify does not verify the certificates of the Verifier and Issuer, to test against staging
+	// endpoints with self-signed certificates. It is ignored in production.
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify,omitempty"`
+
+	// MaxAttempts is the number of calls to the Verifier and Issuer before giving up on transient errors.
+	// The Issuer is only called again when it did not process the request (429, 503 or no connection), so a credential
+	// is never issued twice. Zero or one means no retries.
+	MaxAttempts int `yaml:"maxAttempts,omitempty"`
+	// RetryBackoff is the wait before the first retry, doubled after each failed attempt
+	RetryBackoff time.Duration `yaml:"retryBackoff,omitempty"`
+
+	// OperationMode tells the Issuer to issue the credential synchronously ("S", the default) or asynchronously ("A").
+	// In asynchronous mode the Issuer posts the result to the callback endpoint of the server, at the api_url.
+	OperationMode string `yaml:"operationMode,omitempty"`
+	// Format of the issued credential: "jwt_vc_json" (the default) or "ldp_vc"
+	Format string `yaml:"format,omitempty"`
+	// Schema of the issued credential, "LEARCredentialEmployee" by default
+	Schema string `yaml:"schema,omitempty"`
 }
 
+// SkipTLSVerify reports whether the TLS certificates of a service are not verified, as requested by its
+// insecureSkipVerify flag. The flag is refused in production. Both skipping the verification and refusing it
+// are logged loudly, as they should never go unnoticed.
+func SkipTLSVerify(runtime RuntimeEnv, insecureSkipVerify bool, service string) bool {
+	if !insecureSkipVerify {
+		return false
+	}
+	if runtime == Production {
+		slog.Error("❌ insecureSkipVerify is not allowed in production, the TLS certificates are verified", "service", service)
+		return false
+	}
+	slog.Warn("⚠️ INSECURE: the TLS certificates are NOT verified, never use insecureSkipVerify with real data", "service", service, "runtime", runtime)
+	return true
+}
+
+// The operation modes of the issuance requests
+const (
+	// SyncOperationMode returns the issued credential in the response of the Issuer
+	SyncOperationMode = "S"
+	// AsyncOperationMode returns the issued credential later, in a request of the Issuer to the response URI
+	AsyncOperationMode = "A"
+)
+
+// The defaults of the credentials requested to the Issuer, when the configuration does not specify them
+const (
+	DefaultCredentialSchema        = "LEARCredentialEmployee"
+	DefaultCredentialOperationMode = SyncOperationMode
+	DefaultCredentialFormat        = "jwt_vc_json"
+)
+
+// The operation modes and credential formats supported by the Issuer
+var (
+	CredentialOperationModes = []string{SyncOperationMode, AsyncOperationMode}
+	CredentialFormats        = []string{"jwt_vc_json", "ldp_vc"}
+)
+
+// CredentialSchema returns the schema of the credentials to issue
+func (c IssuerConfig) CredentialSchema() string {
+	if c.Schema == "" {
+		return DefaultCredentialSchema
+	}
+	return c.Schema
+}
+
+// CredentialOperationMode returns the operation mode of the issuance requests
+func (c IssuerConfig) CredentialOperationMode() string {
+	if c.OperationMode == "" {
+		return DefaultCredentialOperationMode
+	}
+	return c.OperationMode
+}
+
+// Async reports whether the credentials are issued asynchronously
+func (c IssuerConfig) Async() bool {
+	return c.CredentialOperationMode() == AsyncOperationMode
+}
+
+// CredentialFormat returns the format of the credentials to issue
+func (c IssuerConfig) CredentialFormat() string {
+	if c.Format == "" {
+		return DefaultCredentialFormat
+	}
+	return c.Format
+}
+
+// ValidateCredentialRequest checks that the operation mode and format are supported by the Issuer
+func (c IssuerConfig) ValidateCredentialRequest() error {
+	if mode := c.CredentialOperationMode(); !slices.Contains(CredentialOperationModes, mode) {
+		return fmt.Errorf("operationMode: unsupported mode %q, expected one of %q", mode, CredentialOperationModes)
+	}
+	if format := c.CredentialFormat(); !slices.Contains(CredentialFormats, format) {
+		return fmt.Errorf("format: unsupported format %q, expected one of %q", format, CredentialFormats)
+	}
+	return nil
+}
+
+// IssuanceLimitConfig bounds the requests to the Verifier and Issuer in flight at once, so a spike of registrations
+// does not overwhelm them. The registrations above the limit wait, and are rejected when too many are waiting.
+type IssuanceLimitConfig struct {
+	// MaxInFlight is the maximum number of issuances at once. Zero does not limit them.
+	MaxInFlight int `yaml:"maxInFlight,omitempty"`
+	// MaxQueued is the maximum number of registrations waiting for an issuance, 100 by default
+	MaxQueued int `yaml:"maxQueued,omitempty"`
+	// QueueTimeout is how long a registration waits for an issuance, 10 seconds by default
+	QueueTimeout time.Duration `yaml:"queueTimeout,omitempty"`
+}
+
+// WebhookConfig is the endpoint receiving a POST with the JSON of each new registration
+type WebhookConfig struct {
+	URL string `yaml:"url,omitempty"`
+	// SecretFile holds the key signing the body of the requests, sent as "sha256=<hex HMAC>" in the
+	// X-Onboarding-Signature header. The requests are not signed without it.
+	SecretFile string `yaml:"secretFile,omitempty"`
+	// Timeout of each call, 10 seconds by default
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// DatabaseConfig locates the SQLite database storing the registrations
+type DatabaseConfig struct {
+	// DSN is the path of the file of the database, or a URI with its own parameters, "data/onboarding.db" by default
+	DSN string `yaml:"dsn,omitempty"`
+}
+
+// RedisConfig locates the Redis server keeping the rate limits and the verification codes
+type RedisConfig struct {
+	// Addr is the host and port of the server, e.g. "redis.example.com:6379". Redis is not used if empty.
+	Addr string `yaml:"addr,omitempty"`
+	// PasswordFile holds the password of the server, if it requires one
+	PasswordFile string `yaml:"passwordFile,omitempty"`
+	// DB is the number of the database, 0 by default
+	DB int `yaml:"db,omitempty"`
+	// KeyPrefix is added to all the keys, "onboarding:" by default, to share the server with other applications
+	KeyPrefix string `yaml:"keyPrefix,omitempty"`
+	// Timeout of each command, 2 seconds by default
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// TracingConfig locates the OpenTelemetry collector receiving the traces over OTLP/HTTP
+type TracingConfig struct {
+	// Endpoint is the URL of the collector, e.g. "http://otel-collector:4318". The traces are not exported if empty.
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// ServiceName identifies the server in the traces, "onboarding" by default
+	ServiceName string `yaml:"serviceName,omitempty"`
+}
+
+// OutboxConfig controls the delivery of the side effects of the registrations that were saved but not delivered,
+// because they failed or the server stopped
+type OutboxConfig struct {
+	// Interval between the checks for pending deliveries, 1 minute by default. The wait before retrying a delivery
+	// starts at the interval and doubles with each attempt.
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// MaxAttempts to deliver each item before giving up, 10 by default
+	MaxAttempts int `yaml:"maxAttempts,omitempty"`
+	// WelcomeEmailDelay schedules the welcome email this long after the registration is saved, e.g. to let the
+	// credential propagate, instead of sending it right away. It is sent by the checks of the outbox, so it may
+	// go out up to an interval later.
+	WelcomeEmailDelay time.Duration `yaml:"welcomeEmailDelay,omitempty"`
+}
+
+// IssuanceRetryConfig controls the worker retrying in the background the issuances that failed,
+// so they do not have to be reissued manually when the Issuer was down for a while
+type IssuanceRetryConfig struct {
+	// Disabled stops the worker, leaving the failed issuances to be reissued manually
+	Disabled bool `yaml:"disabled,omitempty"`
+	// Interval is the time between the checks for failed issuances, 10 minutes by default
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Cooldown is how long after a failed attempt the issuance is retried, 30 minutes by default
+	Cooldown time.Duration `yaml:"cooldown,omitempty"`
+	// MaxAttempts is the number of retries before leaving the issuance to be reissued manually, 5 by default
+	MaxAttempts int `yaml:"maxAttempts,omitempty"`
+}
+
+// RetentionConfig controls how long the registrations are kept, and the worker purging the older ones
+type RetentionConfig struct {
+	// MaxAge is how long after their creation the registrations are kept, e.g. "8760h" for a year.
+	// Zero keeps them forever.
+	MaxAge time.Duration `yaml:"maxAge,omitempty"`
+	// Interval is the time between the purges, 24 hours by default
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Anonymize clears the personal data of the old registrations instead of deleting them,
+	// so they still count in the statistics
+	Anonymize bool `yaml:"anonymize,omitempty"`
+	// PurgeUnissued also purges the old registrations whose credential was not issued. They are kept by default,
+	// so a failed issuance is not lost before someone reissues it.
+	PurgeUnissued bool `yaml:"purgeUnissued,omitempty"`
+}
+
+// Enabled reports whether the old registrations are purged
+func (c RetentionConfig) Enabled() bool {
+	return c.MaxAge > 0
+}
+
+// UnknownCountryPolicy decides what happens to a registration whose country code is not in common.Countries
+type UnknownCountryPolicy string
+
+const (
+	// RejectUnknownCountry fails the registration (the default)
+	RejectUnknownCountry UnknownCountryPolicy = "reject"
+	// FlagUnknownCountry accepts the registration but flags it for manual review
+	FlagUnknownCountry UnknownCountryPolicy = "flag"
+	// DefaultUnknownCountry replaces the country code with CountryConfig.DefaultCountry
+	DefaultUnknownCountry UnknownCountryPolicy = "default"
+)
+
+type CountryConfig struct {
+	UnknownPolicy  UnknownCountryPolicy `yaml:"unknownPolicy,omitempty"`
+	DefaultCountry string               `yaml:"defaultCountry,omitempty"`
+
+	// Allowed are the only country codes accepted in the registrations, e.g. the EU countries. Empty accepts all.
+	Allowed []string `yaml:"allowedCountries,omitempty"`
+	// Blocked are the country codes rejected in the registrations, even if they are allowed
+	Blocked []string `yaml:"blockedCountries,omitempty"`
+}
+
+// Accepts reports whether the registrations of the country are accepted by the allowed and blocked countries
+func (c CountryConfig) Accepts(code string) bool {
+	if slices.ContainsFunc(c.Blocked, func(blocked string) bool { return strings.EqualFold(blocked, code) }) {
+		return false
+	}
+	return len(c.Allowed) == 0 || slices.ContainsFunc(c.Allowed, func(allowed string) bool { return strings.EqualFold(allowed, code) })
+}
+
+// ValidateCountryLists checks that the allowed and blocked countries are in the list of supported countries
+func (c CountryConfig) ValidateCountryLists() error {
+	for _, list := range []struct {
+		name  string
+		codes []string
+	}{{"allowedCountries", c.Allowed}, {"blockedCountries", c.Blocked}} {
+		for _, code := range list.codes {
+			if !common.IsValidCountry(strings.ToUpper(code)) {
+				return fmt.Errorf("%s: unsupported country code %q", list.name, code)
+			}
+		}
+	}
+	return nil
+}
+
+// MailProvider selects how the emails are sent
+type MailProvider string
+
+const (
+	// SMTPMailProvider sends the emails with an SMTP server (the default)
+	SMTPMailProvider MailProvider = "smtp"
+	// SendGridMailProvider sends the emails with the SendGrid Web API
+	SendGridMailProvider MailProvider = "sendgrid"
+)
+
 type MailConfig struct {
 	OnboardTeamEmail []string `yaml:"onboard_team_email"`
 	IssuerTeamEmail  []string `yaml:"issuer_team_email"`
 	CCTeamEmail      []string `yaml:"cc_list_email"`
-	SMTP             SMTPConfig
+	// BCCAuditEmail receive a hidden copy of every email sent, for record-keeping.
+	// They are not listed in the headers, so the recipients do not see them.
+	BCCAuditEmail []string `yaml:"bcc_audit_email,omitempty"`
+
+	// IssuerErrorDigest collects the issuance errors notified within this window to send them in a single email.
+	// Zero sends an email for each error.
+	IssuerErrorDigest time.Duration `yaml:"issuerErrorDigest,omitempty"`
+
+	// Provider is "smtp" (the default) or "sendgrid"
+	Provider MailProvider `yaml:"provider,omitempty"`
+	// From is the sender of the emails. If empty, the SMTP username is used.
+	From string `yaml:"from,omitempty"`
+	// BounceAddress receives the delivery status notifications of the emails sent with SMTP, instead of the sender.
+	// Feed the messages it receives to the bounces command to record the undeliverable addresses.
+	BounceAddress string `yaml:"bounceAddress,omitempty"`
+
+	// DailyDigest is the summary of the registrations of each day, sent to the onboarding team
+	DailyDigest DailyDigestConfig `yaml:"dailyDigest,omitempty"`
+
+	SMTP     SMTPConfig
+	SendGrid SendGridConfig `yaml:"sendgrid"`
+}
+
+// DailyDigestConfig controls the daily email summarizing the registrations of the previous day
+type DailyDigestConfig struct {
+	// Enabled sends the digest from the server. It can also be sent with the digest command, e.g. from cron.
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Time is the local time of the day, as HH:MM, when the server sends the digest, "08:00" by default
+	Time string `yaml:"time,omitempty"`
+	// Recipients of the digest, the onboarding team by default
+	Recipients []string `yaml:"recipients,omitempty"`
+	// SkipEmpty does not send the digest of the days without registrations
+	SkipEmpty bool `yaml:"skipEmpty,omitempty"`
+}
+
+// ScheduledAt returns the hour and minute of the day when the digest is sent
+func (c DailyDigestConfig) ScheduledAt() (hour int, minute int, err error) {
+	at := c.Time
+	if at == "" {
+		at = "08:00"
+	}
+	t, err := time.Parse("15:04", at)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid time of the daily digest %q, expected HH:MM", c.Time)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// Sender returns the address the emails are sent from
+func (c MailConfig) Sender() string {
+	if c.From != "" {
+		return c.From
+	}
+	return c.SMTP.Username
 }
 
 type SMTPConfig struct {
@@ -51,4 +768,62 @@ type SMTPConfig struct {
 	TLS          bool   `json:"tls,omitempty" yaml:"tls"`
 	Username     string `json:"username,omitempty" yaml:"username"`
 	PasswordFile string `json:"passwordFile,omitempty" yaml:"passwordFile"`
+	// Pool keeps the connection open to send the next emails, instead of connecting and authenticating for each one
+	Pool bool `json:"pool,omitempty" yaml:"pool,omitempty"`
+	// PoolIdleTimeout is how long the pooled connection is reused after the last email, 1 minute by default.
+	// It must be shorter than the time the server waits before closing an idle connection.
+	PoolIdleTimeout time.Duration `json:"poolIdleTimeout,omitempty" yaml:"poolIdleTimeout,omitempty"`
+	// InsecureSkipVerify does not verify the certificate of the server, to test against staging servers with
+	// self-signed certificates. It is ignored in production.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty" yaml:"insecureSkipVerify,omitempty"`
+}
+
+type SendGridConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// APIKeyFile holds the API key, with permission to send emails
+	APIKeyFile string `yaml:"apiKeyFile"`
+	// Endpoint is the URL of the API to send emails, by default https://api.sendgrid.com/v3/mail/send
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// WebhookKey is the verification key of the signed Event Webhook. When set, SendGrid can report
+	// the delivery of the emails to /api/mail-events.
+	WebhookKey string `yaml:"webhookKey,omitempty"`
+}
+
+// redactedSecret replaces the secrets in the redacted configuration
+const redactedSecret = "REDACTED"
+
+// dsnPassword matches the password in the connection strings written as key=value pairs
+var dsnPassword = regexp.MustCompile(`(?i)(password\s*=\s*)('[^']*'|\S+)`)
+
+// Redacted returns a copy of the configuration without the secrets written inline, to show it for diagnostics.
+// The keys and passwords read from files are shown by the paths of the files, which are not read.
+func (c EnvConfig) Redacted() EnvConfig {
+	c.Verifier.URL = redactURL(c.Verifier.URL)
+	c.Verifier.TokenEndpoint = redactURL(c.Verifier.TokenEndpoint)
+	c.Issuer.ProxyURL = redactURL(c.Issuer.ProxyURL)
+	c.Webhook.URL = redactURL(c.Webhook.URL)
+	c.Mail.SendGrid.Endpoint = redactURL(c.Mail.SendGrid.Endpoint)
+	c.Tracing.Endpoint = redactURL(c.Tracing.Endpoint)
+	c.Database.DSN = redactDSN(c.Database.DSN)
+	return c
+}
+
+// redactURL hides the password of the user of the URL, if any
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redactedSecret)
+	}
+	return u.String()
+}
+
+// redactDSN hides the password of the connection string of the database, written as a URL or as key=value pairs
+func redactDSN(dsn string) string {
+	if strings.Contains(dsn, "://") {
+		return redactURL(dsn)
+	}
+	return dsnPassword.ReplaceAllString(dsn, "${1}"+redactedSecret)
 }
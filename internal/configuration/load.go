@@ -0,0 +1,79 @@
+package configuration
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Load reads the configuration file.
+// Relative paths inside the configuration are resolved relative to the directory of the configuration file,
+// so the result does not depend on the working directory of the process.
+func Load(path string) (*Config, error) {
+	configData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	var cfg Config
+	if err := yaml.Unmarshal(configData, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	cfg.resolvePaths(filepath.Dir(path))
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// validate checks the settings that must be rejected before any environment is used
+func (c *Config) validate() error {
+	for _, name := range slices.Sorted(maps.Keys(c.Environments)) {
+		env := c.Environments[name]
+		if err := env.PrimaryKey().ValidateKeyType(); err != nil {
+			return fmt.Errorf("environment %s: %w", name, err)
+		}
+		if err := env.SecondaryKey.ValidateKeyType(); err != nil {
+			return fmt.Errorf("environment %s: secondaryKey: %w", name, err)
+		}
+		// The name of the environment is its runtime
+		if err := env.ValidateAllowedOrigins(RuntimeEnv(name)); err != nil {
+			return fmt.Errorf("environment %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// resolvePaths makes the relative paths in the configuration relative to baseDir
+func (c *Config) resolvePaths(baseDir string) {
+	c.SrcDir = resolvePath(baseDir, c.SrcDir)
+	c.DestDir = resolvePath(baseDir, c.DestDir)
+
+	for name, env := range c.Environments {
+		env.PrivateKeyFile = resolvePath(baseDir, env.PrivateKeyFile)
+		env.MachineCredentialFile = resolvePath(baseDir, env.MachineCredentialFile)
+		env.SecondaryKey.PrivateKeyFile = resolvePath(baseDir, env.SecondaryKey.PrivateKeyFile)
+		env.SecondaryKey.MachineCredentialFile = resolvePath(baseDir, env.SecondaryKey.MachineCredentialFile)
+		env.Mail.SMTP.PasswordFile = resolvePath(baseDir, env.Mail.SMTP.PasswordFile)
+		env.Mail.SendGrid.APIKeyFile = resolvePath(baseDir, env.Mail.SendGrid.APIKeyFile)
+		env.StatusSecretFile = resolvePath(baseDir, env.StatusSecretFile)
+		env.AdminTokenFile = resolvePath(baseDir, env.AdminTokenFile)
+		env.RegistrationQueueFile = resolvePath(baseDir, env.RegistrationQueueFile)
+		env.Issuer.CABundleFile = resolvePath(baseDir, env.Issuer.CABundleFile)
+		env.TLS.CertFile = resolvePath(baseDir, env.TLS.CertFile)
+		env.TLS.KeyFile = resolvePath(baseDir, env.TLS.KeyFile)
+		c.Environments[name] = env
+	}
+}
+
+func resolvePath(baseDir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
@@ -0,0 +1,113 @@
+package configuration
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadResolvesRelativePaths(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	config := `
+dest_dir: "docs"
+src_dir: "/srv/onboarding/src"
+environments:
+  pro:
+    privateKeyFile: "keys/priv.txt"
+    machineCredentialFile: "keys/machine.txt"
+    secondaryKey:
+      privateKeyFile: "keys/old_priv.txt"
+      machineCredentialFile: "keys/old_machine.txt"
+    statusSecretFile: "secrets/status.txt"
+    adminTokenFile: "secrets/admin.txt"
+    registrationQueueFile: "data/queue.jsonl"
+    issuer:
+      caBundleFile: "certs/ca.pem"
+    tls:
+      certFile: "certs/server.pem"
+      keyFile: "certs/server.key"
+    mail:
+      smtp:
+        passwordFile: "secrets/smtp.txt"
+      sendgrid:
+        apiKeyFile: "secrets/sendgrid.txt"
+`
+	if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(configFile)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	checks := map[string][2]string{
+		"dest_dir":                           {cfg.DestDir, filepath.Join(dir, "docs")},
+		"src_dir":                            {cfg.SrcDir, "/srv/onboarding/src"},
+		"privateKeyFile":                     {cfg.Environments["pro"].PrivateKeyFile, filepath.Join(dir, "keys/priv.txt")},
+		"machineCredentialFile":              {cfg.Environments["pro"].MachineCredentialFile, filepath.Join(dir, "keys/machine.txt")},
+		"secondaryKey.privateKeyFile":        {cfg.Environments["pro"].SecondaryKey.PrivateKeyFile, filepath.Join(dir, "keys/old_priv.txt")},
+		"secondaryKey.machineCredentialFile": {cfg.Environments["pro"].SecondaryKey.MachineCredentialFile, filepath.Join(dir, "keys/old_machine.txt")},
+		"passwordFile":                       {cfg.Environments["pro"].Mail.SMTP.PasswordFile, filepath.Join(dir, "secrets/smtp.txt")},
+		"statusSecretFile":                   {cfg.Environments["pro"].StatusSecretFile, filepath.Join(dir, "secrets/status.txt")},
+		"adminTokenFile":                     {cfg.Environments["pro"].AdminTokenFile, filepath.Join(dir, "secrets/admin.txt")},
+		"registrationQueueFile":              {cfg.Environments["pro"].RegistrationQueueFile, filepath.Join(dir, "data/queue.jsonl")},
+		"apiKeyFile":                         {cfg.Environments["pro"].Mail.SendGrid.APIKeyFile, filepath.Join(dir, "secrets/sendgrid.txt")},
+		"caBundleFile":                       {cfg.Environments["pro"].Issuer.CABundleFile, filepath.Join(dir, "certs/ca.pem")},
+		"certFile":                           {cfg.Environments["pro"].TLS.CertFile, filepath.Join(dir, "certs/server.pem")},
+		"keyFile":                            {cfg.Environments["pro"].TLS.KeyFile, filepath.Join(dir, "certs/server.key")},
+	}
+	for field, c := range checks {
+		if c[0] != c[1] {
+			t.Errorf("%s: expected %q, got %q", field, c[1], c[0])
+		}
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatalf("expected an error for a missing configuration file")
+	}
+}
+
+func TestLoadRejectsUnsupportedKeyType(t *testing.T) {
+	tests := map[string]string{
+		"primary key":   "environments:\n  pro:\n    keyType: P-384\n",
+		"secondary key": "environments:\n  pro:\n    keyType: Ed25519\n    secondaryKey:\n      keyType: RSA\n",
+	}
+	for name, config := range tests {
+		t.Run(name, func(t *testing.T) {
+			configFile := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Load(configFile); err == nil {
+				t.Errorf("expected an error for the unsupported key type")
+			}
+		})
+	}
+}
+
+func TestLoadRejectsWildcardOriginOutsideDevelopment(t *testing.T) {
+	tests := map[string]struct {
+		config string
+		wantOK bool
+	}{
+		"development":    {config: "environments:\n  dev:\n    allowedOrigins: [\"*\"]\n", wantOK: true},
+		"preproduction":  {config: "environments:\n  pre:\n    allowedOrigins: [\"*\"]\n"},
+		"production":     {config: "environments:\n  pro:\n    allowedOrigins: [\"https://dome-marketplace.eu\", \"*\"]\n"},
+		"listed origins": {config: "environments:\n  pro:\n    allowedOrigins: [\"https://dome-marketplace.eu\"]\n", wantOK: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			configFile := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configFile, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Load(configFile); (err == nil) != tt.wantOK {
+				t.Errorf("expected accepted %v, got error: %v", tt.wantOK, err)
+			}
+		})
+	}
+}
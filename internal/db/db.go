@@ -1,13 +1,27 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"strings"
 	"time"
 
 	"github.com/hesusruiz/onboardng/internal/configuration"
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+var (
+	// ErrDuplicateEmail is returned when saving a registration with an email already registered
+	ErrDuplicateEmail = errors.New("the email is already registered")
+	// ErrDuplicateVatID is returned when saving a registration with a VAT ID already registered
+	ErrDuplicateVatID = errors.New("the VAT ID is already registered")
+	// ErrDuplicateRegistrationID is returned when saving a registration with the id of another one
+	ErrDuplicateRegistrationID = errors.New("the registration id is already used")
 )
 
 // Registration represents a user registration record in the database
@@ -25,38 +39,78 @@ type Registration struct {
 	IssuanceError   string    `json:"issuance_error,omitempty"`
 	NotifEmailAt    time.Time `json:"notif_email_at,omitempty"`
 	NotifEmailError string    `json:"notif_email_error,omitempty"`
+	ReviewNote      string    `json:"review_note,omitempty"`
+	Language        string    `json:"language,omitempty"`
+	CredentialID    string    `json:"credential_id,omitempty"`
+	IdempotencyKey  string    `json:"-"`
+	Status          string    `json:"status,omitempty"`
+	DeliveryStatus  string    `json:"delivery_status,omitempty"`
+	// IdempotencyFingerprint is the SHA-256 of the body of the request with the idempotency key, in hex
+	IdempotencyFingerprint string `json:"-"`
+	// ExtraFields are the fields of the registration form added to the claims of the credential by the configuration
+	ExtraFields map[string]string `json:"extra_fields,omitempty"`
 }
 
+// The status of the issuance of the credential of a registration
+const (
+	// StatusPending is the status while the credential is being issued
+	StatusPending = "pending"
+	// StatusIssued is the status when the Issuer issued the credential
+	StatusIssued = "issued"
+	// StatusFailed is the status when the Issuer failed, and the credential has to be issued manually
+	StatusFailed = "failed"
+)
+
+// The delivery status of the welcome email, as reported by the mail provider or the bounce messages
+const (
+	// DeliverySent is the status when the email was handed over to the mail provider
+	DeliverySent = "sent"
+	// DeliveryDelivered is the status when the server of the recipient accepted the email
+	DeliveryDelivered = "delivered"
+	// DeliveryDeferred is the status when the delivery failed temporarily and is being retried
+	DeliveryDeferred = "deferred"
+	// DeliveryBounced is the status when the email could not be delivered, and the address should be checked
+	DeliveryBounced = "bounced"
+)
+
+// connParams are the parameters of the connections to the database. Transactions take the write lock when they
+// begin, so a transaction reading a row it then updates can not race with another one. A connection waits for the
+// lock for up to 5 seconds instead of failing with SQLITE_BUSY.
+const connParams = "_txlock=immediate&_pragma=busy_timeout(5000)"
+
+// defaultPath is the database used when the configuration does not specify one
+const defaultPath = "data/onboarding.db"
+
 // Service provides database operations for registrations
 type Service struct {
 	conn    *sql.DB
 	runtime configuration.RuntimeEnv
 }
 
-func NewService(runtime configuration.RuntimeEnv) (*Service, error) {
-	dbConn, err := sql.Open("sqlite", "data/onboarding.db")
+// NewService opens the database of the configuration, by default in data/onboarding.db, creating it or migrating it
+// to the latest schema if needed
+func NewService(cfg configuration.DatabaseConfig, runtime configuration.RuntimeEnv) (*Service, error) {
+	path := cfg.DSN
+	if path == "" {
+		path = defaultPath
+	}
+	return Open(path, runtime)
+}
+
+// Open opens the database in the given file, creating it or migrating it to the latest schema if needed.
+// The path may be a URI with its own parameters, e.g. "file:/onboarding?vfs=memdb" for a database in memory
+// shared by all the connections.
+func Open(path string, runtime configuration.RuntimeEnv) (*Service, error) {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	dbConn, err := sql.Open("sqlite", path+separator+connParams)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create table if not exists
-	query := `
-	CREATE TABLE IF NOT EXISTS registrations (
-		registration_id TEXT UNIQUE,
-		email TEXT UNIQUE,
-		first_name TEXT,
-		last_name TEXT,
-		company_name TEXT,
-		country TEXT,
-		vat_id TEXT UNIQUE,
-		created_at DATETIME,
-		updated_at DATETIME,
-		issuance_at DATETIME,
-		issuance_error TEXT,
-		notif_email_at DATETIME,
-		notif_email_error TEXT
-	);`
-	if _, err := dbConn.Exec(query); err != nil {
+	if err := migrate(dbConn); err != nil {
 		dbConn.Close()
 		return nil, err
 	}
@@ -68,12 +122,25 @@ func (s *Service) Close() error {
 	return s.conn.Close()
 }
 
-func (s *Service) SaveRegistration(reg *Registration) error {
+// SaveRegistration is SaveRegistrationContext with the background context
+func (s *Service) SaveRegistration(reg *Registration, outbox ...*OutboxItem) error {
+	return s.SaveRegistrationContext(context.Background(), reg, outbox...)
+}
+
+// SaveRegistrationContext saves a new registration, adding the given items to the outbox in the same transaction
+// so their side effects happen if and only if the registration is saved
+func (s *Service) SaveRegistrationContext(ctx context.Context, reg *Registration, outbox ...*OutboxItem) error {
+	return s.withOutbox(ctx, outbox, func(q querier) error {
+		return s.saveRegistration(ctx, q, reg)
+	})
+}
+
+func (s *Service) saveRegistration(ctx context.Context, q querier, reg *Registration) error {
 	insertQuery := `
 	INSERT INTO registrations (
 		registration_id, email, first_name, last_name, company_name, country, vat_id,
-		created_at, updated_at, issuance_at, issuance_error, notif_email_at, notif_email_error
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+		created_at, updated_at, issuance_at, issuance_error, notif_email_at, notif_email_error, review_note, language, credential_id, idempotency_key, idempotency_fingerprint, status, delivery_status, extra_fields
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
 	now := time.Now()
 	reg.CreatedAt = now
@@ -82,44 +149,101 @@ func (s *Service) SaveRegistration(reg *Registration) error {
 	reg.NotifEmailAt = now
 	reg.IssuanceError = ""
 	reg.NotifEmailError = ""
+	reg.CredentialID = ""
+	reg.Status = StatusPending
+	reg.DeliveryStatus = ""
 
 	switch s.runtime {
 	case configuration.Development, configuration.Preproduction:
 		slog.Info("Saving registration in development or preproduction", "vat_id", reg.VatID, "email", reg.Email)
-		oldReg, err := s.GetRegistration(reg.VatID, reg.Email)
-		if err != nil && err != sql.ErrNoRows {
-			// A database error, we can not continue
-			return err
-		}
-
-		// If the registration already exists, we amend it reusing the old registration id
-		if oldReg != nil {
-			slog.Info("Registration already exists, amending", "vat_id", reg.VatID, "email", reg.Email)
-			return s.AmendRegistration(reg)
-		} else {
-			slog.Info("Registration does not exist, inserting", "vat_id", reg.VatID, "email", reg.Email)
-			// If the registration does not exist, we insert it
-			_, err := s.conn.Exec(insertQuery,
-				reg.RegistrationID, reg.Email, reg.FirstName, reg.LastName, reg.CompanyName, reg.Country, reg.VatID,
-				reg.CreatedAt, reg.UpdatedAt, reg.IssuanceAt, reg.IssuanceError, reg.NotifEmailAt, reg.NotifEmailError,
-			)
-			return err
-		}
+		// A registration with the same email or VAT ID is amended with the new one, keeping its creation time.
+		// The email or VAT ID can change, but not to those of a third registration.
+		query := insertQuery + `
+	ON CONFLICT(email) DO UPDATE SET ` + amendColumns + `
+	ON CONFLICT(vat_id) DO UPDATE SET ` + amendColumns + `
+	RETURNING created_at`
+		err := q.QueryRowContext(ctx, query,
+			reg.RegistrationID, reg.Email, reg.FirstName, reg.LastName, reg.CompanyName, reg.Country, reg.VatID,
+			reg.CreatedAt, reg.UpdatedAt, reg.IssuanceAt, reg.IssuanceError, reg.NotifEmailAt, reg.NotifEmailError, reg.ReviewNote, reg.Language, reg.CredentialID, reg.IdempotencyKey, reg.IdempotencyFingerprint, reg.Status, reg.DeliveryStatus, extraFieldsValue(reg.ExtraFields),
+		).Scan(&reg.CreatedAt)
+		return duplicateError(err)
 	case configuration.Production:
 		slog.Info("Saving registration in production", "vat_id", reg.VatID, "email", reg.Email)
 		// In production, we always insert the registration and fail if the vatID or email already exists
-		_, err := s.conn.Exec(insertQuery,
+		_, err := q.ExecContext(ctx, insertQuery,
 			reg.RegistrationID, reg.Email, reg.FirstName, reg.LastName, reg.CompanyName, reg.Country, reg.VatID,
-			reg.CreatedAt, reg.UpdatedAt, reg.IssuanceAt, reg.IssuanceError, reg.NotifEmailAt, reg.NotifEmailError,
+			reg.CreatedAt, reg.UpdatedAt, reg.IssuanceAt, reg.IssuanceError, reg.NotifEmailAt, reg.NotifEmailError, reg.ReviewNote, reg.Language, reg.CredentialID, reg.IdempotencyKey, reg.IdempotencyFingerprint, reg.Status, reg.DeliveryStatus, extraFieldsValue(reg.ExtraFields),
 		)
-		return err
+		return duplicateError(err)
 	}
 
 	// Should never happen, return an error
 	return fmt.Errorf("unknown runtime environment: %s", s.runtime)
 }
 
-func (s *Service) UpdateRegistrationStatus(reg *Registration) error {
+// amendColumns sets all the columns of an existing registration but created_at to those of the registration
+// being inserted, in the ON CONFLICT clauses of SaveRegistration
+const amendColumns = `
+		registration_id = excluded.registration_id,
+		email = excluded.email,
+		first_name = excluded.first_name,
+		last_name = excluded.last_name,
+		company_name = excluded.company_name,
+		country = excluded.country,
+		vat_id = excluded.vat_id,
+		updated_at = excluded.updated_at,
+		issuance_at = excluded.issuance_at,
+		issuance_error = excluded.issuance_error,
+		notif_email_at = excluded.notif_email_at,
+		notif_email_error = excluded.notif_email_error,
+		review_note = excluded.review_note,
+		language = excluded.language,
+		credential_id = excluded.credential_id,
+		idempotency_key = excluded.idempotency_key,
+		idempotency_fingerprint = excluded.idempotency_fingerprint,
+		status = excluded.status,
+		delivery_status = excluded.delivery_status,
+		extra_fields = excluded.extra_fields`
+
+// isUniqueViolation reports whether the error is caused by a UNIQUE constraint of the database
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+// duplicateError translates the violation of the UNIQUE constraint on the email, the VAT ID or the registration id
+// into ErrDuplicateEmail, ErrDuplicateVatID or ErrDuplicateRegistrationID, returning other errors unchanged
+func duplicateError(err error) error {
+	if !isUniqueViolation(err) {
+		return err
+	}
+
+	// SQLite names the column in the message, e.g. "UNIQUE constraint failed: registrations.email"
+	switch msg := err.Error(); {
+	case strings.Contains(msg, "registrations.email"):
+		return fmt.Errorf("%w: %w", ErrDuplicateEmail, err)
+	case strings.Contains(msg, "registrations.vat_id"):
+		return fmt.Errorf("%w: %w", ErrDuplicateVatID, err)
+	case strings.Contains(msg, "registrations.registration_id"):
+		return fmt.Errorf("%w: %w", ErrDuplicateRegistrationID, err)
+	}
+	return err
+}
+
+// UpdateRegistrationStatus is UpdateRegistrationStatusContext with the background context
+func (s *Service) UpdateRegistrationStatus(reg *Registration, outbox ...*OutboxItem) error {
+	return s.UpdateRegistrationStatusContext(context.Background(), reg, outbox...)
+}
+
+// UpdateRegistrationStatusContext records the status of the issuance and of the welcome email of a registration,
+// adding the given items to the outbox in the same transaction
+func (s *Service) UpdateRegistrationStatusContext(ctx context.Context, reg *Registration, outbox ...*OutboxItem) error {
+	return s.withOutbox(ctx, outbox, func(q querier) error {
+		return s.updateRegistrationStatus(ctx, q, reg)
+	})
+}
+
+func (s *Service) updateRegistrationStatus(ctx context.Context, q querier, reg *Registration) error {
 	reg.UpdatedAt = time.Now()
 	query := `
 	UPDATE registrations SET
@@ -127,16 +251,51 @@ func (s *Service) UpdateRegistrationStatus(reg *Registration) error {
 		issuance_at = ?,
 		issuance_error = ?,
 		notif_email_at = ?,
-		notif_email_error = ?
+		notif_email_error = ?,
+		credential_id = ?,
+		status = ?,
+		delivery_status = ?
 	WHERE registration_id = ? AND email = ?`
-	_, err := s.conn.Exec(query,
-		reg.UpdatedAt, reg.IssuanceAt, reg.IssuanceError, reg.NotifEmailAt, reg.NotifEmailError,
+	_, err := q.ExecContext(ctx, query,
+		reg.UpdatedAt, reg.IssuanceAt, reg.IssuanceError, reg.NotifEmailAt, reg.NotifEmailError, reg.CredentialID, reg.Status, reg.DeliveryStatus,
 		reg.RegistrationID, reg.Email,
 	)
 	return err
 }
 
+// UpdateDeliveryStatus is UpdateDeliveryStatusContext with the background context
+func (s *Service) UpdateDeliveryStatus(email string, status string) (int64, error) {
+	return s.UpdateDeliveryStatusContext(context.Background(), email, status)
+}
+
+// UpdateDeliveryStatusContext records the delivery status of the welcome email sent to an address, ignoring its case,
+// returning the number of registrations updated. A temporary failure reported late does not replace a final status.
+func (s *Service) UpdateDeliveryStatusContext(ctx context.Context, email string, status string) (int64, error) {
+	query := `
+	UPDATE registrations SET
+		updated_at = ?,
+		delivery_status = ?
+	WHERE lower(email) = lower(?)`
+	args := []any{time.Now(), status, email}
+	if status == DeliveryDeferred {
+		query += ` AND COALESCE(delivery_status, '') NOT IN (?, ?)`
+		args = append(args, DeliveryDelivered, DeliveryBounced)
+	}
+	result, err := s.conn.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// AmendRegistration is AmendRegistrationContext with the background context
 func (s *Service) AmendRegistration(reg *Registration) error {
+	return s.AmendRegistrationContext(context.Background(), reg)
+}
+
+// AmendRegistrationContext updates the registration with the email and VAT ID of reg, keeping its creation time,
+// which is read back into reg. It returns sql.ErrNoRows if there is no such registration.
+func (s *Service) AmendRegistrationContext(ctx context.Context, reg *Registration) error {
 	reg.UpdatedAt = time.Now()
 	query := `
 	UPDATE registrations SET
@@ -149,28 +308,130 @@ func (s *Service) AmendRegistration(reg *Registration) error {
 		issuance_at = ?,
 		issuance_error = ?,
 		notif_email_at = ?,
-		notif_email_error = ?
-	WHERE email = ? AND vat_id = ?`
-	_, err := s.conn.Exec(query,
+		notif_email_error = ?,
+		review_note = ?,
+		language = ?,
+		credential_id = ?,
+		idempotency_key = ?,
+		idempotency_fingerprint = ?,
+		status = ?,
+		delivery_status = ?,
+		extra_fields = ?
+	WHERE email = ? AND vat_id = ?
+	RETURNING created_at`
+	return s.conn.QueryRowContext(ctx, query,
 		reg.RegistrationID,
 		reg.FirstName, reg.LastName, reg.CompanyName, reg.Country,
 		reg.UpdatedAt,
 		reg.IssuanceAt, reg.IssuanceError, reg.NotifEmailAt, reg.NotifEmailError,
+		reg.ReviewNote, reg.Language, reg.CredentialID, reg.IdempotencyKey, reg.IdempotencyFingerprint, reg.Status, reg.DeliveryStatus, extraFieldsValue(reg.ExtraFields),
 		reg.Email, reg.VatID,
-	)
-	return err
+	).Scan(&reg.CreatedAt)
 }
 
-func (s *Service) GetRegistrations(limit, offset int) ([]Registration, error) {
+// RestoreRegistration is RestoreRegistrationContext with the background context
+func (s *Service) RestoreRegistration(reg *Registration) error {
+	return s.RestoreRegistrationContext(context.Background(), reg)
+}
+
+// RestoreRegistrationContext writes a registration with all its fields as they are, updating it if its id is already
+// in the database or inserting it otherwise. It is used to save the registrations queued while the database failed.
+func (s *Service) RestoreRegistrationContext(ctx context.Context, reg *Registration) error {
 	query := `
-	SELECT 
+	UPDATE registrations SET
+		email = ?,
+		first_name = ?,
+		last_name = ?,
+		company_name = ?,
+		country = ?,
+		vat_id = ?,
+		created_at = ?,
+		updated_at = ?,
+		issuance_at = ?,
+		issuance_error = ?,
+		notif_email_at = ?,
+		notif_email_error = ?,
+		review_note = ?,
+		language = ?,
+		credential_id = ?,
+		idempotency_key = ?,
+		idempotency_fingerprint = ?,
+		status = ?,
+		delivery_status = ?,
+		extra_fields = ?
+	WHERE registration_id = ?`
+	result, err := s.conn.ExecContext(ctx, query,
+		reg.Email, reg.FirstName, reg.LastName, reg.CompanyName, reg.Country, reg.VatID,
+		reg.CreatedAt, reg.UpdatedAt, reg.IssuanceAt, reg.IssuanceError, reg.NotifEmailAt, reg.NotifEmailError,
+		reg.ReviewNote, reg.Language, reg.CredentialID, reg.IdempotencyKey, reg.IdempotencyFingerprint, reg.Status, reg.DeliveryStatus, extraFieldsValue(reg.ExtraFields),
+		reg.RegistrationID,
+	)
+	if err != nil {
+		return duplicateError(err)
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated > 0 {
+		return err
+	}
+
+	insertQuery := `
+	INSERT INTO registrations (
 		registration_id, email, first_name, last_name, company_name, country, vat_id,
-		created_at, updated_at, issuance_at, issuance_error, notif_email_at, notif_email_error
-	FROM registrations
-	ORDER BY created_at DESC
-	LIMIT ? OFFSET ?`
+		created_at, updated_at, issuance_at, issuance_error, notif_email_at, notif_email_error, review_note, language, credential_id, idempotency_key, idempotency_fingerprint, status, delivery_status, extra_fields
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = s.conn.ExecContext(ctx, insertQuery,
+		reg.RegistrationID, reg.Email, reg.FirstName, reg.LastName, reg.CompanyName, reg.Country, reg.VatID,
+		reg.CreatedAt, reg.UpdatedAt, reg.IssuanceAt, reg.IssuanceError, reg.NotifEmailAt, reg.NotifEmailError, reg.ReviewNote, reg.Language, reg.CredentialID, reg.IdempotencyKey, reg.IdempotencyFingerprint, reg.Status, reg.DeliveryStatus, extraFieldsValue(reg.ExtraFields),
+	)
+	return duplicateError(err)
+}
+
+// registrationColumns are the columns read into a Registration by scanRegistration, in order.
+// Columns added by migrations may be NULL in old rows.
+const registrationColumns = `
+		registration_id, email, first_name, last_name, company_name, country, vat_id,
+		created_at, updated_at, issuance_at, issuance_error, notif_email_at, notif_email_error,
+		COALESCE(review_note, ''), COALESCE(language, ''), COALESCE(credential_id, ''), COALESCE(idempotency_key, ''),
+		COALESCE(idempotency_fingerprint, ''), COALESCE(status, ''), COALESCE(delivery_status, ''), extra_fields`
+
+// scanner is implemented by *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanRegistration reads a row selected with registrationColumns
+func scanRegistration(row scanner) (*Registration, error) {
+	var reg Registration
+	var extraFields sql.NullString
+	err := row.Scan(
+		&reg.RegistrationID, &reg.Email, &reg.FirstName, &reg.LastName, &reg.CompanyName, &reg.Country, &reg.VatID,
+		&reg.CreatedAt, &reg.UpdatedAt, &reg.IssuanceAt, &reg.IssuanceError, &reg.NotifEmailAt, &reg.NotifEmailError,
+		&reg.ReviewNote, &reg.Language, &reg.CredentialID, &reg.IdempotencyKey, &reg.IdempotencyFingerprint,
+		&reg.Status, &reg.DeliveryStatus, &extraFields,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if extraFields.String != "" {
+		if err := json.Unmarshal([]byte(extraFields.String), &reg.ExtraFields); err != nil {
+			return nil, fmt.Errorf("invalid extra fields of registration %s: %w", reg.RegistrationID, err)
+		}
+	}
+	return &reg, nil
+}
+
+// extraFieldsValue returns the extra fields of a registration as stored in the database, as JSON or NULL without them
+func extraFieldsValue(fields map[string]string) any {
+	if len(fields) == 0 {
+		return nil
+	}
+	// A map of strings always marshals
+	buf, _ := json.Marshal(fields)
+	return string(buf)
+}
 
-	rows, err := s.conn.Query(query, limit, offset)
+// queryRegistrations runs a query selecting registrationColumns and returns the registrations read
+func (s *Service) queryRegistrations(ctx context.Context, query string, args ...any) ([]Registration, error) {
+	rows, err := s.conn.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -178,15 +439,11 @@ func (s *Service) GetRegistrations(limit, offset int) ([]Registration, error) {
 
 	var regs []Registration
 	for rows.Next() {
-		var reg Registration
-		err := rows.Scan(
-			&reg.RegistrationID, &reg.Email, &reg.FirstName, &reg.LastName, &reg.CompanyName, &reg.Country, &reg.VatID,
-			&reg.CreatedAt, &reg.UpdatedAt, &reg.IssuanceAt, &reg.IssuanceError, &reg.NotifEmailAt, &reg.NotifEmailError,
-		)
+		reg, err := scanRegistration(rows)
 		if err != nil {
 			return nil, err
 		}
-		regs = append(regs, reg)
+		regs = append(regs, *reg)
 	}
 
 	if err = rows.Err(); err != nil {
@@ -196,21 +453,105 @@ func (s *Service) GetRegistrations(limit, offset int) ([]Registration, error) {
 	return regs, nil
 }
 
+// GetRegistrations is GetRegistrationsContext with the background context
+func (s *Service) GetRegistrations(limit, offset int) ([]Registration, error) {
+	return s.GetRegistrationsContext(context.Background(), limit, offset)
+}
+
+// GetRegistrationsContext returns a page of all the registrations, the most recent first
+func (s *Service) GetRegistrationsContext(ctx context.Context, limit, offset int) ([]Registration, error) {
+	return s.ListRegistrationsContext(ctx, RegistrationFilter{}, limit, offset)
+}
+
+// GetRegistration is GetRegistrationContext with the background context
 func (s *Service) GetRegistration(vatID string, email string) (*Registration, error) {
-	query := `
-	SELECT 
-		registration_id, email, first_name, last_name, company_name, country, vat_id,
-		created_at, updated_at, issuance_at, issuance_error, notif_email_at, notif_email_error
+	return s.GetRegistrationContext(context.Background(), vatID, email)
+}
+
+func (s *Service) GetRegistrationContext(ctx context.Context, vatID string, email string) (*Registration, error) {
+	query := `SELECT ` + registrationColumns + `
 	FROM registrations
 	WHERE vat_id = ? AND email = ?`
 
-	var reg Registration
-	err := s.conn.QueryRow(query, vatID, email).Scan(
-		&reg.RegistrationID, &reg.Email, &reg.FirstName, &reg.LastName, &reg.CompanyName, &reg.Country, &reg.VatID,
-		&reg.CreatedAt, &reg.UpdatedAt, &reg.IssuanceAt, &reg.IssuanceError, &reg.NotifEmailAt, &reg.NotifEmailError,
+	return scanRegistration(s.conn.QueryRowContext(ctx, query, vatID, email))
+}
+
+// GetRegistrationByEmail is GetRegistrationByEmailContext with the background context
+func (s *Service) GetRegistrationByEmail(email string) (*Registration, error) {
+	return s.GetRegistrationByEmailContext(context.Background(), email)
+}
+
+// GetRegistrationByEmailContext returns the most recent registration with the given email, ignoring its case
+func (s *Service) GetRegistrationByEmailContext(ctx context.Context, email string) (*Registration, error) {
+	query := `SELECT ` + registrationColumns + `
+	FROM registrations
+	WHERE lower(email) = lower(?)
+	ORDER BY created_at DESC
+	LIMIT 1`
+
+	return scanRegistration(s.conn.QueryRowContext(ctx, query, email))
+}
+
+// GetRegistrationByID is GetRegistrationByIDContext with the background context
+func (s *Service) GetRegistrationByID(registrationID string) (*Registration, error) {
+	return s.GetRegistrationByIDContext(context.Background(), registrationID)
+}
+
+// GetRegistrationByIDContext returns the registration with the given registration id
+func (s *Service) GetRegistrationByIDContext(ctx context.Context, registrationID string) (*Registration, error) {
+	query := `SELECT ` + registrationColumns + `
+	FROM registrations
+	WHERE registration_id = ?`
+
+	return scanRegistration(s.conn.QueryRowContext(ctx, query, registrationID))
+}
+
+// GetRegistrationByIdempotencyKey is GetRegistrationByIdempotencyKeyContext with the background context
+func (s *Service) GetRegistrationByIdempotencyKey(key string) (*Registration, error) {
+	return s.GetRegistrationByIdempotencyKeyContext(context.Background(), key)
+}
+
+// GetRegistrationByIdempotencyKeyContext returns the most recent registration created with the given idempotency key
+func (s *Service) GetRegistrationByIdempotencyKeyContext(ctx context.Context, key string) (*Registration, error) {
+	query := `SELECT ` + registrationColumns + `
+	FROM registrations
+	WHERE idempotency_key = ?
+	ORDER BY created_at DESC
+	LIMIT 1`
+
+	return scanRegistration(s.conn.QueryRowContext(ctx, query, key))
+}
+
+// BotAttempt is a registration rejected because the honeypot field was filled
+type BotAttempt struct {
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SaveBotAttempt is SaveBotAttemptContext with the background context
+func (s *Service) SaveBotAttempt(attempt *BotAttempt) error {
+	return s.SaveBotAttemptContext(context.Background(), attempt)
+}
+
+// SaveBotAttemptContext records a bot attempt, so operators can follow the volume of spam
+func (s *Service) SaveBotAttemptContext(ctx context.Context, attempt *BotAttempt) error {
+	attempt.CreatedAt = time.Now()
+	_, err := s.conn.ExecContext(ctx, `INSERT INTO bot_attempts (created_at, ip, user_agent, email) VALUES (?, ?, ?, ?)`,
+		attempt.CreatedAt, attempt.IP, attempt.UserAgent, attempt.Email,
 	)
-	if err != nil {
-		return nil, err
-	}
-	return &reg, nil
+	return err
+}
+
+// CountBotAttempts is CountBotAttemptsContext with the background context
+func (s *Service) CountBotAttempts(since time.Time) (int, error) {
+	return s.CountBotAttemptsContext(context.Background(), since)
+}
+
+// CountBotAttemptsContext returns the number of bot attempts recorded since the given time
+func (s *Service) CountBotAttemptsContext(ctx context.Context, since time.Time) (int, error) {
+	var count int
+	err := s.conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM bot_attempts WHERE created_at >= ?`, since).Scan(&count)
+	return count, err
 }
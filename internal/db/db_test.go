@@ -0,0 +1,499 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"maps"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+// oldSchema is the registrations table as created before the migrations existed
+const oldSchema = `
+CREATE TABLE registrations (
+	registration_id TEXT UNIQUE,
+	email TEXT UNIQUE,
+	first_name TEXT,
+	last_name TEXT,
+	company_name TEXT,
+	country TEXT,
+	vat_id TEXT UNIQUE,
+	created_at DATETIME,
+	updated_at DATETIME,
+	issuance_at DATETIME,
+	issuance_error TEXT,
+	notif_email_at DATETIME,
+	notif_email_error TEXT
+);`
+
+// newTestService returns a service on a fresh database in a temporary directory
+func newTestService(t *testing.T, runtime configuration.RuntimeEnv) *Service {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "test.db"), runtime)
+	if err != nil {
+		t.Fatalf("failed to create the database: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func columns(t *testing.T, conn *sql.DB, table string) map[string]bool {
+	t.Helper()
+	rows, err := conn.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	cols := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		cols[name] = true
+	}
+	return cols
+}
+
+func TestOpenInMemory(t *testing.T) {
+	s, err := Open("file:/"+t.Name()+"?vfs=memdb", configuration.Development)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// All the connections of the pool see the same database
+	s.conn.SetMaxOpenConns(4)
+	if err := s.SaveRegistration(&Registration{RegistrationID: "reg-1", Email: "a@example.com", VatID: "ES1", Country: "ES"}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.GetRegistrationByID("reg-1"); err != nil {
+				t.Errorf("expected the registration in all the connections, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMigrateOldSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+
+	// Create a database with the old schema and an existing registration
+	old, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Exec(oldSchema); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	_, err = old.Exec(`INSERT INTO registrations VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		"reg-1", "john@example.com", "John", "Doe", "ACME", "ES", "B12345678", now, now, now, "", now, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+
+	// Opening it with the service migrates it to the latest version
+	s, err := Open(path, configuration.Development)
+	if err != nil {
+		t.Fatalf("failed to migrate the database: %v", err)
+	}
+	defer s.Close()
+
+	version, err := schemaVersion(s.conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != latestSchemaVersion() {
+		t.Errorf("expected schema version %d, got %d", latestSchemaVersion(), version)
+	}
+	for _, col := range []string{"review_note", "language", "credential_id", "delivery_status"} {
+		if !columns(t, s.conn, "registrations")[col] {
+			t.Errorf("expected column %s to be added", col)
+		}
+	}
+
+	// The existing registration is readable and can be amended with the new columns
+	reg, err := s.GetRegistration("B12345678", "john@example.com")
+	if err != nil {
+		t.Fatalf("failed to read the old registration: %v", err)
+	}
+	if reg.RegistrationID != "reg-1" || reg.Language != "" || reg.CredentialID != "" {
+		t.Errorf("unexpected registration %+v", reg)
+	}
+
+	reg.Language = "es"
+	reg.CredentialID = "cred-1"
+	if err := s.AmendRegistration(reg); err != nil {
+		t.Fatalf("failed to amend the old registration: %v", err)
+	}
+	reg, err = s.GetRegistration("B12345678", "john@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.Language != "es" || reg.CredentialID != "cred-1" {
+		t.Errorf("the new columns were not saved: %+v", reg)
+	}
+
+	// The existing registrations are in the full-text index
+	if found, err := s.SearchRegistrations("john@example", 10); err != nil || len(found) != 1 {
+		t.Errorf("expected the old registration to be found, got %+v: %v", found, err)
+	}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "partial.db")
+
+	// A database that already has some of the columns of the second migration, but no schema_version
+	partial, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := partial.Exec(oldSchema); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := partial.Exec(`ALTER TABLE registrations ADD COLUMN review_note TEXT`); err != nil {
+		t.Fatal(err)
+	}
+	partial.Close()
+
+	// Migrating twice must work
+	for range 2 {
+		s, err := Open(path, configuration.Development)
+		if err != nil {
+			t.Fatalf("failed to migrate the database: %v", err)
+		}
+		version, err := schemaVersion(s.conn)
+		s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != latestSchemaVersion() {
+			t.Errorf("expected schema version %d, got %d", latestSchemaVersion(), version)
+		}
+	}
+}
+
+func TestSaveAndGetRegistration(t *testing.T) {
+	s := newTestService(t, configuration.Production)
+
+	reg := &Registration{
+		RegistrationID: "reg-1",
+		Email:          "john@example.com",
+		FirstName:      "John",
+		LastName:       "Doe",
+		CompanyName:    "ACME",
+		Country:        "FR",
+		VatID:          "FR12345678901",
+		ReviewNote:     "check the country",
+		Language:       "fr",
+		ExtraFields:    map[string]string{"department": "Sales"},
+	}
+	if err := s.SaveRegistration(reg); err != nil {
+		t.Fatalf("SaveRegistration failed: %v", err)
+	}
+
+	reg.CredentialID = "cred-1"
+	if err := s.UpdateRegistrationStatus(reg); err != nil {
+		t.Fatalf("UpdateRegistrationStatus failed: %v", err)
+	}
+
+	got, err := s.GetRegistration(reg.VatID, reg.Email)
+	if err != nil {
+		t.Fatalf("GetRegistration failed: %v", err)
+	}
+	if got.ReviewNote != reg.ReviewNote || got.Language != reg.Language || got.CredentialID != reg.CredentialID {
+		t.Errorf("expected %+v, got %+v", reg, got)
+	}
+	if !maps.Equal(got.ExtraFields, reg.ExtraFields) {
+		t.Errorf("expected the extra fields %v, got %v", reg.ExtraFields, got.ExtraFields)
+	}
+
+	got, err = s.GetRegistrationByEmail("John@Example.com")
+	if err != nil {
+		t.Fatalf("GetRegistrationByEmail failed: %v", err)
+	}
+	if got.RegistrationID != reg.RegistrationID {
+		t.Errorf("expected registration %s, got %s", reg.RegistrationID, got.RegistrationID)
+	}
+
+	// In production, a second registration with the same VAT ID is rejected
+	if err := s.SaveRegistration(&Registration{RegistrationID: "reg-2", Email: "jane@example.com", VatID: reg.VatID}); err == nil {
+		t.Errorf("expected a duplicate VAT ID to be rejected in production")
+	}
+}
+
+func TestSaveRegistrationAmends(t *testing.T) {
+	s := newTestService(t, configuration.Development)
+
+	first := &Registration{RegistrationID: "reg-1", Email: "john@example.com", VatID: "FR12345678901", CompanyName: "ACME"}
+	if err := s.SaveRegistration(first); err != nil {
+		t.Fatalf("SaveRegistration failed: %v", err)
+	}
+	other := &Registration{RegistrationID: "reg-other", Email: "jane@example.com", VatID: "ES12345678", CompanyName: "Globex"}
+	if err := s.SaveRegistration(other); err != nil {
+		t.Fatalf("SaveRegistration failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		reg     Registration
+		wantErr error
+	}{
+		{name: "same email and VAT ID", reg: Registration{RegistrationID: "reg-2", Email: "john@example.com", VatID: "FR12345678901", CompanyName: "ACME Corp"}},
+		{name: "new VAT ID", reg: Registration{RegistrationID: "reg-3", Email: "john@example.com", VatID: "FR98765432109", CompanyName: "ACME"}},
+		{name: "new email", reg: Registration{RegistrationID: "reg-4", Email: "john.doe@example.com", VatID: "FR98765432109", CompanyName: "ACME"}},
+		{name: "VAT ID of another registration", reg: Registration{RegistrationID: "reg-5", Email: "john.doe@example.com", VatID: other.VatID}, wantErr: ErrDuplicateVatID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := tt.reg
+			err := s.SaveRegistration(&reg)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			if !reg.CreatedAt.Equal(first.CreatedAt) {
+				t.Errorf("expected the creation time %v to be kept, got %v", first.CreatedAt, reg.CreatedAt)
+			}
+			got, err := s.GetRegistration(reg.VatID, reg.Email)
+			if err != nil {
+				t.Fatalf("GetRegistration failed: %v", err)
+			}
+			if got.RegistrationID != reg.RegistrationID || got.CompanyName != reg.CompanyName || !got.CreatedAt.Equal(first.CreatedAt) {
+				t.Errorf("expected the registration to be amended to %+v, got %+v", reg, got)
+			}
+			if all, err := s.GetRegistrations(10, 0); err != nil || len(all) != 2 {
+				t.Errorf("expected 2 registrations, got %d: %v", len(all), err)
+			}
+		})
+	}
+}
+
+func TestAmendRegistrationKeepsCreatedAt(t *testing.T) {
+	s := newTestService(t, configuration.Production)
+
+	reg := &Registration{RegistrationID: "reg-1", Email: "john@example.com", VatID: "FR12345678901", CompanyName: "ACME"}
+	if err := s.SaveRegistration(reg); err != nil {
+		t.Fatalf("SaveRegistration failed: %v", err)
+	}
+	createdAt := reg.CreatedAt
+
+	amended := *reg
+	amended.CompanyName = "ACME Corp"
+	amended.CreatedAt = time.Now().Add(time.Hour)
+	if err := s.AmendRegistration(&amended); err != nil {
+		t.Fatalf("AmendRegistration failed: %v", err)
+	}
+	if !amended.CreatedAt.Equal(createdAt) {
+		t.Errorf("expected the stored creation time %v, got %v", createdAt, amended.CreatedAt)
+	}
+
+	got, err := s.GetRegistrationByID(reg.RegistrationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.CreatedAt.Equal(createdAt) || got.CompanyName != amended.CompanyName {
+		t.Errorf("expected the registration amended keeping its creation time %v, got %+v", createdAt, got)
+	}
+	if !got.UpdatedAt.After(createdAt) {
+		t.Errorf("expected the update time %v to be after the creation time %v", got.UpdatedAt, createdAt)
+	}
+
+	missing := &Registration{Email: "jane@example.com", VatID: "ES12345678"}
+	if err := s.AmendRegistration(missing); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows amending a missing registration, got %v", err)
+	}
+}
+
+func TestSaveRegistrationConcurrentAmend(t *testing.T) {
+	s := newTestService(t, configuration.Development)
+
+	for range 20 {
+		regs := []*Registration{
+			{RegistrationID: "reg-1", Email: "john@example.com", VatID: "FR12345678901", CompanyName: "ACME"},
+			{RegistrationID: "reg-2", Email: "john@example.com", VatID: "FR12345678901", CompanyName: "ACME Corp"},
+		}
+
+		// Both registrations are saved at the same time, one is inserted or amended and the other amends it
+		start := make(chan struct{})
+		errs := make(chan error, len(regs))
+		for _, reg := range regs {
+			go func() {
+				<-start
+				errs <- s.SaveRegistration(reg)
+			}()
+		}
+		close(start)
+		for range regs {
+			if err := <-errs; err != nil {
+				t.Fatalf("SaveRegistration failed: %v", err)
+			}
+		}
+
+		all, err := s.GetRegistrations(10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 1 {
+			t.Fatalf("expected a single registration, got %d", len(all))
+		}
+		// The registration is the one saved last, with all its fields
+		got := all[0]
+		if !slices.ContainsFunc(regs, func(reg *Registration) bool {
+			return got.RegistrationID == reg.RegistrationID && got.CompanyName == reg.CompanyName
+		}) {
+			t.Errorf("expected one of the registrations saved, got %s of %s", got.RegistrationID, got.CompanyName)
+		}
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	s := newTestService(t, configuration.Development)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	reg := &Registration{RegistrationID: "reg-1", Email: "john@example.com", VatID: "FR12345678901"}
+	if err := s.SaveRegistrationContext(ctx, reg); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the save to be cancelled, got %v", err)
+	}
+	if _, err := s.GetRegistrationByIDContext(ctx, reg.RegistrationID); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the query to be cancelled, got %v", err)
+	}
+
+	// Nothing was saved
+	if _, err := s.GetRegistrationByID(reg.RegistrationID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected no registration, got %v", err)
+	}
+}
+
+func TestSaveBotAttempt(t *testing.T) {
+	s := newTestService(t, configuration.Development)
+
+	start := time.Now().Add(-time.Second)
+	for _, email := range []string{"bot1@example.com", "bot2@example.com"} {
+		if err := s.SaveBotAttempt(&BotAttempt{IP: "192.0.2.1", UserAgent: "curl/8.0", Email: email}); err != nil {
+			t.Fatalf("SaveBotAttempt failed: %v", err)
+		}
+	}
+
+	count, err := s.CountBotAttempts(start)
+	if err != nil {
+		t.Fatalf("CountBotAttempts failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 bot attempts, got %d", count)
+	}
+
+	count, err = s.CountBotAttempts(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expected no bot attempts in the future, got %d", count)
+	}
+}
+
+func TestSaveRegistrationDuplicateInProduction(t *testing.T) {
+	tests := []struct {
+		name    string
+		email   string
+		vatID   string
+		wantErr error
+	}{
+		{name: "same email", email: "john@example.com", vatID: "ES87654321", wantErr: ErrDuplicateEmail},
+		{name: "same VAT ID", email: "jane@example.com", vatID: "ES12345678", wantErr: ErrDuplicateVatID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, configuration.Production)
+			if err := s.SaveRegistration(&Registration{RegistrationID: "reg-1", Email: "john@example.com", VatID: "ES12345678"}); err != nil {
+				t.Fatal(err)
+			}
+
+			err := s.SaveRegistration(&Registration{RegistrationID: "reg-2", Email: tt.email, VatID: tt.vatID})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if !isUniqueViolation(err) {
+				t.Errorf("expected the original unique violation to be wrapped, got %v", err)
+			}
+		})
+	}
+}
+
+func TestIsUniqueViolation(t *testing.T) {
+	s := newTestService(t, configuration.Development)
+
+	if isUniqueViolation(nil) || isUniqueViolation(errors.New("UNIQUE constraint failed")) {
+		t.Errorf("expected only sqlite errors to be unique violations")
+	}
+
+	_, err := s.conn.Exec(`SELECT * FROM missing_table`)
+	if err == nil || isUniqueViolation(err) {
+		t.Errorf("expected a missing table not to be a unique violation, got %v", err)
+	}
+}
+
+func TestUpdateDeliveryStatus(t *testing.T) {
+	s := newTestService(t, configuration.Development)
+
+	reg := &Registration{RegistrationID: "reg-1", Email: "john@example.com", VatID: "B12345678"}
+	if err := s.SaveRegistration(reg); err != nil {
+		t.Fatal(err)
+	}
+	reg.DeliveryStatus = DeliverySent
+	if err := s.UpdateRegistrationStatus(reg); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		email       string
+		status      string
+		wantUpdated int64
+		want        string
+	}{
+		{email: "john@example.com", status: DeliveryDeferred, wantUpdated: 1, want: DeliveryDeferred},
+		{email: "John@Example.com", status: DeliveryBounced, wantUpdated: 1, want: DeliveryBounced},
+		// A late temporary failure does not replace the bounce
+		{email: "john@example.com", status: DeliveryDeferred, wantUpdated: 0, want: DeliveryBounced},
+		{email: "other@example.com", status: DeliveryDelivered, wantUpdated: 0, want: DeliveryBounced},
+	}
+
+	for _, step := range steps {
+		updated, err := s.UpdateDeliveryStatus(step.email, step.status)
+		if err != nil {
+			t.Fatalf("UpdateDeliveryStatus failed: %v", err)
+		}
+		if updated != step.wantUpdated {
+			t.Errorf("%s %s: expected %d registrations updated, got %d", step.email, step.status, step.wantUpdated, updated)
+		}
+
+		got, err := s.GetRegistrationByID("reg-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.DeliveryStatus != step.want {
+			t.Errorf("%s %s: expected delivery status %q, got %q", step.email, step.status, step.want, got.DeliveryStatus)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RegistrationFilter selects the registrations listed by ListRegistrations and counted by
+// CountMatchingRegistrations. An empty field does not filter.
+type RegistrationFilter struct {
+	Status  string
+	Country string
+	// From and To limit the creation time of the registrations, From included and To excluded
+	From time.Time
+	To   time.Time
+
+	// Sort is the column the list is ordered by, one of SortColumns, created_at by default. The count ignores it.
+	Sort string
+	// Ascending orders the list from the lowest value of the column, instead of the highest
+	Ascending bool
+}
+
+// SortColumns are the columns the registrations can be listed by
+var SortColumns = []string{"created_at", "updated_at", "company_name", "country", "status", "email", "vat_id", "last_name"}
+
+// ErrInvalidSort is returned when listing the registrations by a column not in SortColumns
+var ErrInvalidSort = errors.New("invalid sort column")
+
+// sortExpressions are the expressions ordering by each of SortColumns. Only these are written in the query,
+// never the column of the filter. The texts are ordered ignoring their case.
+var sortExpressions = map[string]string{
+	"created_at":   "created_at",
+	"updated_at":   "updated_at",
+	"company_name": "lower(company_name)",
+	"country":      "country",
+	"status":       "status",
+	"email":        "lower(email)",
+	"vat_id":       "vat_id",
+	"last_name":    "lower(last_name)",
+}
+
+// where returns the condition selecting the registrations of the filter and its arguments.
+// The page and the count use it, so they are consistent.
+func (f RegistrationFilter) where() (string, []any) {
+	var conditions []string
+	var args []any
+	if f.Status != "" {
+		conditions = append(conditions, "status = ?")
+		args = append(args, f.Status)
+	}
+	if f.Country != "" {
+		conditions = append(conditions, "country = ?")
+		args = append(args, f.Country)
+	}
+	if !f.From.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, f.From)
+	}
+	if !f.To.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, f.To)
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// orderBy returns the ordering of the list of the filter. The registrations with the same value are ordered the most
+// recent first, and then by id, so the pages do not overlap.
+func (f RegistrationFilter) orderBy() (string, error) {
+	column := f.Sort
+	if column == "" {
+		column = "created_at"
+	}
+	expression, ok := sortExpressions[column]
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrInvalidSort, f.Sort)
+	}
+	direction := " DESC"
+	if f.Ascending {
+		direction = " ASC"
+	}
+	return " ORDER BY " + expression + direction + ", created_at DESC, registration_id", nil
+}
+
+// ListRegistrations is ListRegistrationsContext with the background context
+func (s *Service) ListRegistrations(f RegistrationFilter, limit, offset int) ([]Registration, error) {
+	return s.ListRegistrationsContext(context.Background(), f, limit, offset)
+}
+
+// ListRegistrationsContext returns a page of the registrations of the filter, in its order, the most recent first
+// by default. It returns ErrInvalidSort if the filter sorts by a column not in SortColumns.
+func (s *Service) ListRegistrationsContext(ctx context.Context, f RegistrationFilter, limit, offset int) ([]Registration, error) {
+	orderBy, err := f.orderBy()
+	if err != nil {
+		return nil, err
+	}
+	where, args := f.where()
+	query := `SELECT ` + registrationColumns + `
+	FROM registrations` + where + orderBy + `
+	LIMIT ? OFFSET ?`
+
+	return s.queryRegistrations(ctx, query, append(args, limit, offset)...)
+}
+
+// CountMatchingRegistrations is CountMatchingRegistrationsContext with the background context
+func (s *Service) CountMatchingRegistrations(f RegistrationFilter) (int, error) {
+	return s.CountMatchingRegistrationsContext(context.Background(), f)
+}
+
+// CountMatchingRegistrationsContext returns the number of registrations of the filter, to know the number of pages
+func (s *Service) CountMatchingRegistrationsContext(ctx context.Context, f RegistrationFilter) (int, error) {
+	where, args := f.where()
+	var count int
+	err := s.conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM registrations`+where, args...).Scan(&count)
+	return count, err
+}
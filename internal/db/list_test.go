@@ -0,0 +1,144 @@
+package db
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func TestListAndCountRegistrations(t *testing.T) {
+	s := newTestService(t, configuration.Production)
+
+	for _, r := range []Registration{
+		{RegistrationID: "reg-1", Email: "a@example.com", VatID: "ES1", Country: "ES", Status: StatusIssued},
+		{RegistrationID: "reg-2", Email: "b@example.com", VatID: "ES2", Country: "ES", Status: StatusFailed},
+		{RegistrationID: "reg-3", Email: "c@example.com", VatID: "ES3", Country: "ES", Status: StatusIssued},
+		{RegistrationID: "reg-4", Email: "d@example.com", VatID: "FR1", Country: "FR", Status: StatusIssued},
+	} {
+		reg := r
+		if err := s.SaveRegistration(&reg); err != nil {
+			t.Fatal(err)
+		}
+		reg.Status = r.Status
+		if err := s.UpdateRegistrationStatus(&reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		filter    RegistrationFilter
+		wantCount int
+	}{
+		{name: "all", wantCount: 4},
+		{name: "by status", filter: RegistrationFilter{Status: StatusIssued}, wantCount: 3},
+		{name: "by country", filter: RegistrationFilter{Country: "ES"}, wantCount: 3},
+		{name: "by status and country", filter: RegistrationFilter{Status: StatusIssued, Country: "ES"}, wantCount: 2},
+		{name: "no match", filter: RegistrationFilter{Country: "DE"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			count, err := s.CountMatchingRegistrations(tt.filter)
+			if err != nil {
+				t.Fatalf("CountMatchingRegistrations failed: %v", err)
+			}
+			if count != tt.wantCount {
+				t.Errorf("expected %d registrations, got %d", tt.wantCount, count)
+			}
+
+			// The pages of two registrations list all the registrations counted
+			var listed []Registration
+			for offset := 0; offset < count+2; offset += 2 {
+				page, err := s.ListRegistrations(tt.filter, 2, offset)
+				if err != nil {
+					t.Fatalf("ListRegistrations failed: %v", err)
+				}
+				listed = append(listed, page...)
+			}
+			if len(listed) != count {
+				t.Fatalf("expected %d registrations listed, got %d", count, len(listed))
+			}
+			for _, reg := range listed {
+				if (tt.filter.Status != "" && reg.Status != tt.filter.Status) || (tt.filter.Country != "" && reg.Country != tt.filter.Country) {
+					t.Errorf("registration %s does not match the filter %+v", reg.RegistrationID, tt.filter)
+				}
+			}
+		})
+	}
+}
+
+func TestListRegistrationsDatesAndSort(t *testing.T) {
+	s := newTestService(t, configuration.Production)
+
+	day := func(d int) time.Time { return time.Date(2025, 3, d, 12, 0, 0, 0, time.UTC) }
+	for _, r := range []struct {
+		reg       Registration
+		createdAt time.Time
+	}{
+		{reg: Registration{RegistrationID: "reg-1", Email: "a@example.com", VatID: "ES1", Country: "ES", CompanyName: "beta", Status: StatusIssued}, createdAt: day(1)},
+		{reg: Registration{RegistrationID: "reg-2", Email: "b@example.com", VatID: "ES2", Country: "FR", CompanyName: "Alpha", Status: StatusFailed}, createdAt: day(2)},
+		{reg: Registration{RegistrationID: "reg-3", Email: "c@example.com", VatID: "ES3", Country: "DE", CompanyName: "gamma", Status: StatusFailed}, createdAt: day(3)},
+		{reg: Registration{RegistrationID: "reg-4", Email: "d@example.com", VatID: "FR1", Country: "ES", CompanyName: "Delta", Status: StatusIssued}, createdAt: day(4)},
+	} {
+		reg := r.reg
+		if err := s.SaveRegistration(&reg); err != nil {
+			t.Fatal(err)
+		}
+		reg.Status = r.reg.Status
+		if err := s.UpdateRegistrationStatus(&reg); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.conn.Exec(`UPDATE registrations SET created_at = ? WHERE registration_id = ?`, r.createdAt, reg.RegistrationID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter RegistrationFilter
+		want   []string
+	}{
+		{name: "most recent first", want: []string{"reg-4", "reg-3", "reg-2", "reg-1"}},
+		{name: "oldest first", filter: RegistrationFilter{Ascending: true}, want: []string{"reg-1", "reg-2", "reg-3", "reg-4"}},
+		{name: "from a day", filter: RegistrationFilter{From: day(2)}, want: []string{"reg-4", "reg-3", "reg-2"}},
+		{name: "until a day", filter: RegistrationFilter{To: day(3)}, want: []string{"reg-2", "reg-1"}},
+		{name: "range", filter: RegistrationFilter{From: day(2), To: day(4)}, want: []string{"reg-3", "reg-2"}},
+		{name: "failed in range by company", filter: RegistrationFilter{Status: StatusFailed, From: day(1), Sort: "company_name", Ascending: true}, want: []string{"reg-2", "reg-3"}},
+		{name: "by company ignoring case", filter: RegistrationFilter{Sort: "company_name", Ascending: true}, want: []string{"reg-2", "reg-1", "reg-4", "reg-3"}},
+		{name: "by company descending", filter: RegistrationFilter{Sort: "company_name"}, want: []string{"reg-3", "reg-4", "reg-1", "reg-2"}},
+		{name: "by country then most recent", filter: RegistrationFilter{Sort: "country", Ascending: true}, want: []string{"reg-3", "reg-4", "reg-1", "reg-2"}},
+		{name: "by status", filter: RegistrationFilter{Sort: "status", Ascending: true}, want: []string{"reg-3", "reg-2", "reg-4", "reg-1"}},
+		{name: "by VAT ID", filter: RegistrationFilter{Sort: "vat_id"}, want: []string{"reg-4", "reg-3", "reg-2", "reg-1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			regs, err := s.ListRegistrations(tt.filter, 10, 0)
+			if err != nil {
+				t.Fatalf("ListRegistrations failed: %v", err)
+			}
+			var got []string
+			for _, reg := range regs {
+				got = append(got, reg.RegistrationID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+
+			count, err := s.CountMatchingRegistrations(tt.filter)
+			if err != nil || count != len(tt.want) {
+				t.Errorf("expected a count of %d, got %d: %v", len(tt.want), count, err)
+			}
+		})
+	}
+
+	for _, sort := range []string{"password", "created_at; DROP TABLE registrations", "1"} {
+		if _, err := s.ListRegistrations(RegistrationFilter{Sort: sort}, 10, 0); !errors.Is(err, ErrInvalidSort) {
+			t.Errorf("sort %q: expected ErrInvalidSort, got %v", sort, err)
+		}
+	}
+}
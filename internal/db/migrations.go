@@ -0,0 +1,287 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+// migration is a step in the evolution of the database schema.
+// Migrations must be idempotent, because databases created before the schema_version table existed
+// may already have some of the changes applied.
+type migration struct {
+	version     int
+	description string
+	apply       func(tx *sql.Tx) error
+}
+
+// migrations are applied in order at startup to bring the database to the latest schema version.
+// Never modify a migration once released; add a new one at the end instead.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create the registrations table",
+		apply: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS registrations (
+				registration_id TEXT UNIQUE,
+				email TEXT UNIQUE,
+				first_name TEXT,
+				last_name TEXT,
+				company_name TEXT,
+				country TEXT,
+				vat_id TEXT UNIQUE,
+				created_at DATETIME,
+				updated_at DATETIME,
+				issuance_at DATETIME,
+				issuance_error TEXT,
+				notif_email_at DATETIME,
+				notif_email_error TEXT
+			);`)
+			return err
+		},
+	},
+	{
+		version:     2,
+		description: "add review note, language and credential id to registrations",
+		apply: func(tx *sql.Tx) error {
+			for _, column := range []string{"review_note", "language", "credential_id"} {
+				if err := addColumnIfMissing(tx, "registrations", column, "TEXT"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version:     3,
+		description: "create the bot_attempts table",
+		apply: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS bot_attempts (
+				created_at DATETIME,
+				ip TEXT,
+				user_agent TEXT,
+				email TEXT
+			);`)
+			return err
+		},
+	},
+	{
+		version:     4,
+		description: "add the idempotency key to registrations",
+		apply: func(tx *sql.Tx) error {
+			if err := addColumnIfMissing(tx, "registrations", "idempotency_key", "TEXT"); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`CREATE INDEX IF NOT EXISTS registrations_idempotency_key ON registrations (idempotency_key)`)
+			return err
+		},
+	},
+	{
+		version:     5,
+		description: "add the issuance status to registrations",
+		apply: func(tx *sql.Tx) error {
+			if err := addColumnIfMissing(tx, "registrations", "status", "TEXT"); err != nil {
+				return err
+			}
+			// Registrations before this migration were processed to completion
+			_, err := tx.Exec(`UPDATE registrations SET status = CASE WHEN COALESCE(issuance_error, '') = '' THEN ? ELSE ? END
+				WHERE status IS NULL`, StatusIssued, StatusFailed)
+			return err
+		},
+	},
+	{
+		version:     6,
+		description: "add the delivery status of the welcome email to registrations",
+		apply: func(tx *sql.Tx) error {
+			return addColumnIfMissing(tx, "registrations", "delivery_status", "TEXT")
+		},
+	},
+	{
+		version:     7,
+		description: "add the number of retries of the issuance to registrations",
+		apply: func(tx *sql.Tx) error {
+			return addColumnIfMissing(tx, "registrations", "issuance_retries", "INTEGER")
+		},
+	},
+	{
+		version:     8,
+		description: "create the full-text index of the registrations",
+		apply: func(tx *sql.Tx) error {
+			for _, stmt := range []string{
+				// The trigram tokenizer matches any part of a word, not only the whole words
+				`CREATE VIRTUAL TABLE IF NOT EXISTS registrations_fts USING fts5(
+					registration_id UNINDEXED, company_name, email, first_name, last_name, vat_id,
+					tokenize = 'trigram'
+				)`,
+				`CREATE TRIGGER IF NOT EXISTS registrations_fts_insert AFTER INSERT ON registrations BEGIN
+					INSERT INTO registrations_fts (` + searchColumns + `)
+					VALUES (new.registration_id, new.company_name, new.email, new.first_name, new.last_name, new.vat_id);
+				END`,
+				`CREATE TRIGGER IF NOT EXISTS registrations_fts_delete AFTER DELETE ON registrations BEGIN
+					DELETE FROM registrations_fts WHERE registration_id = old.registration_id;
+				END`,
+				`CREATE TRIGGER IF NOT EXISTS registrations_fts_update
+				AFTER UPDATE OF registration_id, company_name, email, first_name, last_name, vat_id ON registrations BEGIN
+					DELETE FROM registrations_fts WHERE registration_id = old.registration_id;
+					INSERT INTO registrations_fts (` + searchColumns + `)
+					VALUES (new.registration_id, new.company_name, new.email, new.first_name, new.last_name, new.vat_id);
+				END`,
+				`DELETE FROM registrations_fts`,
+				`INSERT INTO registrations_fts (` + searchColumns + `) SELECT ` + searchColumns + ` FROM registrations`,
+			} {
+				if _, err := tx.Exec(stmt); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version:     9,
+		description: "add the last request sent to the Issuer to registrations",
+		apply: func(tx *sql.Tx) error {
+			return addColumnIfMissing(tx, "registrations", "issuance_payload", "TEXT")
+		},
+	},
+	{
+		version:     10,
+		description: "create the outbox table",
+		apply: func(tx *sql.Tx) error {
+			for _, stmt := range []string{
+				`CREATE TABLE IF NOT EXISTS outbox (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					kind TEXT NOT NULL,
+					registration_id TEXT NOT NULL,
+					payload TEXT NOT NULL,
+					status TEXT NOT NULL,
+					attempts INTEGER NOT NULL,
+					last_error TEXT NOT NULL,
+					created_at DATETIME NOT NULL,
+					next_attempt_at DATETIME NOT NULL,
+					done_at DATETIME NOT NULL
+				)`,
+				`CREATE INDEX IF NOT EXISTS outbox_pending ON outbox (status, next_attempt_at)`,
+			} {
+				if _, err := tx.Exec(stmt); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version:     11,
+		description: "add the last response of the Issuer to registrations",
+		apply: func(tx *sql.Tx) error {
+			for _, column := range [][2]string{
+				{"issuer_status", "INTEGER"},
+				{"issuer_response", "TEXT"},
+				{"issuer_duration_ms", "INTEGER"},
+			} {
+				if err := addColumnIfMissing(tx, "registrations", column[0], column[1]); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version:     12,
+		description: "add the extra fields of the registration form to registrations",
+		apply: func(tx *sql.Tx) error {
+			return addColumnIfMissing(tx, "registrations", "extra_fields", "TEXT")
+		},
+	},
+	{
+		version:     13,
+		description: "add the fingerprint of the request with the idempotency key to registrations",
+		apply: func(tx *sql.Tx) error {
+			return addColumnIfMissing(tx, "registrations", "idempotency_fingerprint", "TEXT")
+		},
+	},
+}
+
+// latestSchemaVersion is the version of the schema after applying all migrations
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// migrate applies in order the migrations not yet applied to the database, each one in its own transaction
+func migrate(conn *sql.DB) error {
+	for _, m := range migrations {
+		applied, err := applyMigration(conn, m)
+		if err != nil {
+			return err
+		}
+		if applied {
+			slog.Info("Applied database migration", "version", m.version, "description", m.description)
+		}
+	}
+	return nil
+}
+
+// applyMigration applies the migration if the database is in an older version, reporting whether it was applied.
+// The version is checked in the transaction applying the migration, so the servers starting at once with the same
+// database apply it only once.
+func applyMigration(conn *sql.DB, m migration) (bool, error) {
+	tx, err := conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`); err != nil {
+		return false, err
+	}
+	current, err := schemaVersion(tx)
+	if err != nil || m.version <= current {
+		return false, err
+	}
+
+	if err := m.apply(tx); err != nil {
+		return false, fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+	}
+	if _, err := tx.Exec(`DELETE FROM schema_version`); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_version (version) VALUES (?)`, m.version); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// schemaVersion returns the version of the schema of the database, zero if no migration was applied
+func schemaVersion(q interface {
+	QueryRow(query string, args ...any) *sql.Row
+}) (int, error) {
+	var version int
+	err := q.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// addColumnIfMissing adds a column to an existing table, doing nothing if the column is already there
+func addColumnIfMissing(tx *sql.Tx, table, column, columnType string) error {
+	rows, err := tx.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, columnType))
+	return err
+}
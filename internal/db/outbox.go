@@ -0,0 +1,176 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// The outbox keeps the side effects of the changes to the registrations, like sending the welcome email or
+// calling the webhook. The items are added in the same transaction as the change, and removed from the pending
+// ones only when delivered, so they are delivered at least once even if the process dies in between.
+
+// The kinds of the items of the outbox
+const (
+	// OutboxWelcomeEmail sends the welcome email of a registration, with the credential offer in the payload
+	OutboxWelcomeEmail = "welcome_email"
+	// OutboxWebhook posts the payload to the webhook of the configuration
+	OutboxWebhook = "webhook"
+)
+
+// The status of the items of the outbox
+const (
+	// OutboxPending is the status of the items not delivered yet
+	OutboxPending = "pending"
+	// OutboxDone is the status of the items delivered
+	OutboxDone = "done"
+	// OutboxFailed is the status of the items that could not be delivered after all the attempts
+	OutboxFailed = "failed"
+)
+
+// OutboxItem is a side effect of a change to a registration, to be delivered after the change is saved
+type OutboxItem struct {
+	ID             int64     `json:"id"`
+	Kind           string    `json:"kind"`
+	RegistrationID string    `json:"registration_id"`
+	Payload        string    `json:"payload,omitempty"`
+	Status         string    `json:"status"`
+	Attempts       int       `json:"attempts"`
+	LastError      string    `json:"last_error,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	NextAttemptAt  time.Time `json:"next_attempt_at"`
+	DoneAt         time.Time `json:"done_at,omitempty"`
+}
+
+// querier is implemented by *sql.DB and *sql.Tx, to run the same queries in a transaction or not
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// withOutbox runs fn and adds the items to the outbox in the same transaction.
+// Without items, fn runs outside a transaction.
+func (s *Service) withOutbox(ctx context.Context, items []*OutboxItem, fn func(q querier) error) error {
+	if len(items) == 0 {
+		return fn(s.conn)
+	}
+
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, item := range items {
+		if err := addOutboxItem(ctx, tx, item); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to add %s to the outbox: %w", item.Kind, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// addOutboxItem inserts a pending item in the outbox, to be delivered at its next attempt time or else as soon as
+// possible. It sets the id of the item.
+func addOutboxItem(ctx context.Context, q querier, item *OutboxItem) error {
+	item.Status = OutboxPending
+	item.Attempts = 0
+	item.LastError = ""
+	item.CreatedAt = time.Now()
+	if item.NextAttemptAt.IsZero() {
+		item.NextAttemptAt = item.CreatedAt
+	}
+	item.DoneAt = time.Time{}
+
+	return q.QueryRowContext(ctx, `INSERT INTO outbox (kind, registration_id, payload, status, attempts, last_error, created_at, next_attempt_at, done_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		item.Kind, item.RegistrationID, item.Payload, item.Status, item.Attempts, item.LastError, item.CreatedAt, item.NextAttemptAt, item.DoneAt,
+	).Scan(&item.ID)
+}
+
+// outboxColumns are the columns read into an OutboxItem by scanOutboxItem, in order
+const outboxColumns = `id, kind, registration_id, payload, status, attempts, last_error, created_at, next_attempt_at, done_at`
+
+// scanOutboxItem reads a row selected with outboxColumns
+func scanOutboxItem(row scanner) (*OutboxItem, error) {
+	var item OutboxItem
+	err := row.Scan(&item.ID, &item.Kind, &item.RegistrationID, &item.Payload, &item.Status, &item.Attempts,
+		&item.LastError, &item.CreatedAt, &item.NextAttemptAt, &item.DoneAt)
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// GetPendingOutboxItems is GetPendingOutboxItemsContext with the background context
+func (s *Service) GetPendingOutboxItems(before time.Time, limit int) ([]OutboxItem, error) {
+	return s.GetPendingOutboxItemsContext(context.Background(), before, limit)
+}
+
+// GetPendingOutboxItemsContext returns the pending items of the outbox whose next attempt is due at the given time,
+// oldest first and at most limit of them
+func (s *Service) GetPendingOutboxItemsContext(ctx context.Context, before time.Time, limit int) ([]OutboxItem, error) {
+	rows, err := s.conn.QueryContext(ctx, `SELECT `+outboxColumns+` FROM outbox
+		WHERE status = ? AND next_attempt_at <= ?
+		ORDER BY id
+		LIMIT ?`, OutboxPending, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []OutboxItem
+	for rows.Next() {
+		item, err := scanOutboxItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *item)
+	}
+	return items, rows.Err()
+}
+
+// GetOutboxItem is GetOutboxItemContext with the background context
+func (s *Service) GetOutboxItem(id int64) (*OutboxItem, error) {
+	return s.GetOutboxItemContext(context.Background(), id)
+}
+
+// GetOutboxItemContext returns the item of the outbox with the given id
+func (s *Service) GetOutboxItemContext(ctx context.Context, id int64) (*OutboxItem, error) {
+	return scanOutboxItem(s.conn.QueryRowContext(ctx, `SELECT `+outboxColumns+` FROM outbox WHERE id = ?`, id))
+}
+
+// CompleteOutboxItem is CompleteOutboxItemContext with the background context
+func (s *Service) CompleteOutboxItem(id int64) error {
+	return s.CompleteOutboxItemContext(context.Background(), id)
+}
+
+// CompleteOutboxItemContext records that an item of the outbox was delivered
+func (s *Service) CompleteOutboxItemContext(ctx context.Context, id int64) error {
+	_, err := s.conn.ExecContext(ctx, `UPDATE outbox SET status = ?, attempts = attempts + 1, last_error = '', done_at = ?
+		WHERE id = ?`, OutboxDone, time.Now(), id)
+	return err
+}
+
+// RetryOutboxItem is RetryOutboxItemContext with the background context
+func (s *Service) RetryOutboxItem(id int64, lastError string, next time.Time, maxAttempts int) (string, error) {
+	return s.RetryOutboxItemContext(context.Background(), id, lastError, next, maxAttempts)
+}
+
+// RetryOutboxItemContext records a failed delivery of an item of the outbox, to be attempted again at the next time.
+// After maxAttempts deliveries the item is failed instead. It returns the new status of the item.
+func (s *Service) RetryOutboxItemContext(ctx context.Context, id int64, lastError string, next time.Time, maxAttempts int) (string, error) {
+	var status string
+	err := s.conn.QueryRowContext(ctx, `UPDATE outbox SET
+			attempts = attempts + 1,
+			last_error = ?,
+			next_attempt_at = ?,
+			status = CASE WHEN attempts + 1 >= ? THEN ? ELSE status END
+		WHERE id = ? RETURNING status`,
+		lastError, next, maxAttempts, OutboxFailed, id,
+	).Scan(&status)
+	return status, err
+}
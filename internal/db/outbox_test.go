@@ -0,0 +1,95 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func TestOutboxSavedWithRegistration(t *testing.T) {
+	s := newTestService(t, configuration.Production)
+
+	reg := &Registration{RegistrationID: "reg-1", Email: "jane@example.com", VatID: "ES1"}
+	created := &OutboxItem{Kind: OutboxWebhook, RegistrationID: reg.RegistrationID, Payload: `{"event": "registration.created"}`}
+	if err := s.SaveRegistration(reg, created); err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == 0 || created.Status != OutboxPending {
+		t.Fatalf("expected the item to be saved as pending, got %+v", created)
+	}
+
+	reg.Status = StatusIssued
+	welcome := &OutboxItem{Kind: OutboxWelcomeEmail, RegistrationID: reg.RegistrationID, Payload: `{}`, NextAttemptAt: time.Now().Add(time.Hour)}
+	if err := s.UpdateRegistrationStatus(reg, welcome); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the items due are pending delivery
+	items, err := s.GetPendingOutboxItems(time.Now(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].ID != created.ID || items[0].Payload != created.Payload {
+		t.Fatalf("expected the webhook item pending, got %+v", items)
+	}
+	if items, _ := s.GetPendingOutboxItems(time.Now().Add(2*time.Hour), 10); len(items) != 2 {
+		t.Fatalf("expected both items pending later, got %+v", items)
+	}
+
+	// A registration that is not saved does not add its items
+	duplicate := &Registration{RegistrationID: "reg-2", Email: "jane@example.com", VatID: "ES2"}
+	orphan := &OutboxItem{Kind: OutboxWebhook, RegistrationID: duplicate.RegistrationID, Payload: `{}`}
+	if err := s.SaveRegistration(duplicate, orphan); !errors.Is(err, ErrDuplicateEmail) {
+		t.Fatalf("expected ErrDuplicateEmail, got %v", err)
+	}
+	var count int
+	if err := s.conn.QueryRow(`SELECT COUNT(*) FROM outbox`).Scan(&count); err != nil || count != 2 {
+		t.Fatalf("expected 2 items in the outbox, got %d: %v", count, err)
+	}
+}
+
+func TestOutboxDelivery(t *testing.T) {
+	s := newTestService(t, configuration.Production)
+
+	reg := &Registration{RegistrationID: "reg-1", Email: "jane@example.com", VatID: "ES1"}
+	done := &OutboxItem{Kind: OutboxWebhook, RegistrationID: reg.RegistrationID, Payload: `{}`}
+	retried := &OutboxItem{Kind: OutboxWelcomeEmail, RegistrationID: reg.RegistrationID, Payload: `{}`}
+	if err := s.SaveRegistration(reg, done, retried); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.CompleteOutboxItem(done.ID); err != nil {
+		t.Fatal(err)
+	}
+	item, err := s.GetOutboxItem(done.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Status != OutboxDone || item.Attempts != 1 || item.DoneAt.IsZero() {
+		t.Errorf("expected the item to be done, got %+v", item)
+	}
+
+	next := time.Now().Add(time.Minute)
+	status, err := s.RetryOutboxItem(retried.ID, "connection refused", next, 2)
+	if err != nil || status != OutboxPending {
+		t.Fatalf("expected the item to stay pending, got %q: %v", status, err)
+	}
+	if items, _ := s.GetPendingOutboxItems(time.Now(), 10); len(items) != 0 {
+		t.Errorf("expected no items due before the next attempt, got %+v", items)
+	}
+	items, _ := s.GetPendingOutboxItems(next, 10)
+	if len(items) != 1 || items[0].Attempts != 1 || items[0].LastError != "connection refused" {
+		t.Fatalf("expected the item due at the next attempt, got %+v", items)
+	}
+
+	// The last attempt fails the item
+	status, err = s.RetryOutboxItem(retried.ID, "connection refused", next, 2)
+	if err != nil || status != OutboxFailed {
+		t.Fatalf("expected the item to fail, got %q: %v", status, err)
+	}
+	if items, _ := s.GetPendingOutboxItems(next.Add(time.Hour), 10); len(items) != 0 {
+		t.Errorf("expected no items pending, got %+v", items)
+	}
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// SaveIssuancePayload is SaveIssuancePayloadContext with the background context
+func (s *Service) SaveIssuancePayload(registrationID string, payload string) error {
+	return s.SaveIssuancePayloadContext(context.Background(), registrationID, payload)
+}
+
+// SaveIssuancePayloadContext records the request sent to the Issuer for a registration, replacing the previous one.
+// It returns sql.ErrNoRows if there is no such registration.
+func (s *Service) SaveIssuancePayloadContext(ctx context.Context, registrationID string, payload string) error {
+	result, err := s.conn.ExecContext(ctx, `UPDATE registrations SET issuance_payload = ? WHERE registration_id = ?`,
+		payload, registrationID)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetIssuancePayload is GetIssuancePayloadContext with the background context
+func (s *Service) GetIssuancePayload(registrationID string) (string, error) {
+	return s.GetIssuancePayloadContext(context.Background(), registrationID)
+}
+
+// GetIssuancePayloadContext returns the last request sent to the Issuer for a registration, empty if none was sent.
+// It returns sql.ErrNoRows if there is no such registration.
+func (s *Service) GetIssuancePayloadContext(ctx context.Context, registrationID string) (string, error) {
+	var payload string
+	err := s.conn.QueryRowContext(ctx, `SELECT COALESCE(issuance_payload, '') FROM registrations WHERE registration_id = ?`,
+		registrationID).Scan(&payload)
+	return payload, err
+}
+
+// maxIssuerResponseSize limits how much of the body of the response of the Issuer is saved
+const maxIssuerResponseSize = 4096
+
+// IssuerResponse is the last reply of the Issuer to the issuance request of a registration
+type IssuerResponse struct {
+	StatusCode int    `json:"status_code"`
+	Body       string `json:"body"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// SaveIssuerResponse is SaveIssuerResponseContext with the background context
+func (s *Service) SaveIssuerResponse(registrationID string, resp *IssuerResponse) error {
+	return s.SaveIssuerResponseContext(context.Background(), registrationID, resp)
+}
+
+// SaveIssuerResponseContext records the reply of the Issuer to the issuance request of a registration,
+// replacing the previous one. Only the beginning of a long body is saved.
+// It returns sql.ErrNoRows if there is no such registration.
+func (s *Service) SaveIssuerResponseContext(ctx context.Context, registrationID string, resp *IssuerResponse) error {
+	body := resp.Body
+	if len(body) > maxIssuerResponseSize {
+		body = strings.ToValidUTF8(body[:maxIssuerResponseSize], "")
+	}
+	result, err := s.conn.ExecContext(ctx,
+		`UPDATE registrations SET issuer_status = ?, issuer_response = ?, issuer_duration_ms = ? WHERE registration_id = ?`,
+		resp.StatusCode, body, resp.DurationMs, registrationID)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetIssuerResponse is GetIssuerResponseContext with the background context
+func (s *Service) GetIssuerResponse(registrationID string) (*IssuerResponse, error) {
+	return s.GetIssuerResponseContext(context.Background(), registrationID)
+}
+
+// GetIssuerResponseContext returns the last reply of the Issuer for a registration, nil if the Issuer did not reply.
+// It returns sql.ErrNoRows if there is no such registration.
+func (s *Service) GetIssuerResponseContext(ctx context.Context, registrationID string) (*IssuerResponse, error) {
+	var status, durationMs sql.NullInt64
+	var body sql.NullString
+	err := s.conn.QueryRowContext(ctx,
+		`SELECT issuer_status, issuer_response, issuer_duration_ms FROM registrations WHERE registration_id = ?`,
+		registrationID).Scan(&status, &body, &durationMs)
+	if err != nil {
+		return nil, err
+	}
+	if !status.Valid {
+		return nil, nil
+	}
+	return &IssuerResponse{StatusCode: int(status.Int64), Body: body.String, DurationMs: durationMs.Int64}, nil
+}
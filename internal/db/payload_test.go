@@ -0,0 +1,76 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func TestIssuancePayload(t *testing.T) {
+	s := newTestService(t, configuration.Production)
+
+	reg := &Registration{RegistrationID: "reg-1", Email: "john@example.com", VatID: "ES12345678"}
+	if err := s.SaveRegistration(reg); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload, err := s.GetIssuancePayload(reg.RegistrationID); err != nil || payload != "" {
+		t.Fatalf("expected no payload before the issuance, got %q: %v", payload, err)
+	}
+
+	for _, want := range []string{`{"attempt": 1}`, `{"attempt": 2}`} {
+		if err := s.SaveIssuancePayload(reg.RegistrationID, want); err != nil {
+			t.Fatalf("SaveIssuancePayload failed: %v", err)
+		}
+		if got, err := s.GetIssuancePayload(reg.RegistrationID); err != nil || got != want {
+			t.Errorf("expected the last payload %q, got %q: %v", want, got, err)
+		}
+	}
+
+	if err := s.SaveIssuancePayload("missing", "{}"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows for a missing registration, got %v", err)
+	}
+	if _, err := s.GetIssuancePayload("missing"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows for a missing registration, got %v", err)
+	}
+}
+
+func TestIssuerResponse(t *testing.T) {
+	s := newTestService(t, configuration.Production)
+
+	reg := &Registration{RegistrationID: "reg-1", Email: "john@example.com", VatID: "ES12345678"}
+	if err := s.SaveRegistration(reg); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp, err := s.GetIssuerResponse(reg.RegistrationID); err != nil || resp != nil {
+		t.Fatalf("expected no response before the issuance, got %+v: %v", resp, err)
+	}
+
+	want := &IssuerResponse{StatusCode: 503, Body: `{"error": "unavailable"}`, DurationMs: 1500}
+	if err := s.SaveIssuerResponse(reg.RegistrationID, want); err != nil {
+		t.Fatalf("SaveIssuerResponse failed: %v", err)
+	}
+	if got, err := s.GetIssuerResponse(reg.RegistrationID); err != nil || *got != *want {
+		t.Errorf("expected %+v, got %+v: %v", want, got, err)
+	}
+
+	// Only the beginning of a long body is kept
+	long := &IssuerResponse{StatusCode: 200, Body: strings.Repeat("x", 2*maxIssuerResponseSize)}
+	if err := s.SaveIssuerResponse(reg.RegistrationID, long); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.GetIssuerResponse(reg.RegistrationID); err != nil || got.StatusCode != 200 || len(got.Body) != maxIssuerResponseSize {
+		t.Errorf("expected the body truncated to %d bytes, got %+v: %v", maxIssuerResponseSize, got, err)
+	}
+
+	if err := s.SaveIssuerResponse("missing", want); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows for a missing registration, got %v", err)
+	}
+	if _, err := s.GetIssuerResponse("missing"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows for a missing registration, got %v", err)
+	}
+}
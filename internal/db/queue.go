@@ -0,0 +1,161 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Queue is an append-only file keeping the registrations that could not be written to the database,
+// so they are not lost and can be saved when the database works again. Each line is a registration in JSON,
+// and a registration appended again replaces the previous versions.
+type Queue struct {
+	path string
+	mu   sync.Mutex
+}
+
+// queuedRegistration is a line of the queue file. The idempotency key and fingerprint are not in the JSON
+// of a Registration.
+type queuedRegistration struct {
+	Registration           *Registration `json:"registration"`
+	IdempotencyKey         string        `json:"idempotency_key,omitempty"`
+	IdempotencyFingerprint string        `json:"idempotency_fingerprint,omitempty"`
+}
+
+// newQueuedRegistration returns the line of the queue file of the registration
+func newQueuedRegistration(reg *Registration) queuedRegistration {
+	return queuedRegistration{
+		Registration:           reg,
+		IdempotencyKey:         reg.IdempotencyKey,
+		IdempotencyFingerprint: reg.IdempotencyFingerprint,
+	}
+}
+
+// NewQueue returns the queue stored in the given file, which is created when the first registration is queued
+func NewQueue(path string) *Queue {
+	return &Queue{path: path}
+}
+
+// Append adds the current state of the registration to the queue, and waits until it is on disk
+func (q *Queue) Append(reg *Registration) error {
+	line, err := json.Marshal(newQueuedRegistration(reg))
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	f, err := os.OpenFile(q.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open the registration queue: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to queue the registration: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to queue the registration: %w", err)
+	}
+	return f.Close()
+}
+
+// Replay saves the queued registrations in the database, returning how many were saved.
+// The registrations that can not be saved stay in the queue, and their errors are returned.
+func (q *Queue) Replay(s Registrar) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	regs, err := q.read()
+	if err != nil || len(regs) == 0 {
+		return 0, err
+	}
+
+	var failed []*Registration
+	var errs []error
+	for _, reg := range regs {
+		if err := s.RestoreRegistrationContext(context.Background(), reg); err != nil {
+			failed = append(failed, reg)
+			errs = append(errs, fmt.Errorf("registration %s: %w", reg.RegistrationID, err))
+		}
+	}
+
+	if err := q.rewrite(failed); err != nil {
+		errs = append(errs, err)
+	}
+	return len(regs) - len(failed), errors.Join(errs...)
+}
+
+// read returns the latest version of each queued registration, in the order they were first queued
+func (q *Queue) read() ([]*Registration, error) {
+	f, err := os.Open(q.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the registration queue: %w", err)
+	}
+	defer f.Close()
+
+	var regs []*Registration
+	index := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var queued queuedRegistration
+		if err := json.Unmarshal(scanner.Bytes(), &queued); err != nil || queued.Registration == nil {
+			// A line cut by a crash while appending, the previous versions of the registration are kept
+			continue
+		}
+		reg := queued.Registration
+		reg.IdempotencyKey = queued.IdempotencyKey
+		reg.IdempotencyFingerprint = queued.IdempotencyFingerprint
+
+		if i, ok := index[reg.RegistrationID]; ok {
+			regs[i] = reg
+		} else {
+			index[reg.RegistrationID] = len(regs)
+			regs = append(regs, reg)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the registration queue: %w", err)
+	}
+	return regs, nil
+}
+
+// rewrite replaces the queue with the given registrations, removing the file if there are none
+func (q *Queue) rewrite(regs []*Registration) error {
+	if len(regs) == 0 {
+		if err := os.Remove(q.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove the registration queue: %w", err)
+		}
+		return nil
+	}
+
+	tmp := q.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite the registration queue: %w", err)
+	}
+	enc := json.NewEncoder(f)
+	for _, reg := range regs {
+		if err := enc.Encode(newQueuedRegistration(reg)); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to rewrite the registration queue: %w", err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to rewrite the registration queue: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to rewrite the registration queue: %w", err)
+	}
+	return os.Rename(tmp, q.path)
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func TestQueueReplay(t *testing.T) {
+	s := newTestService(t, configuration.Production)
+	q := NewQueue(filepath.Join(t.TempDir(), "queue.jsonl"))
+
+	reg := &Registration{RegistrationID: "reg-1", Email: "a@example.com", VatID: "ES1", Country: "ES", Status: StatusPending, IdempotencyKey: "key-1", IdempotencyFingerprint: "ab12"}
+	if err := q.Append(reg); err != nil {
+		t.Fatal(err)
+	}
+	reg.Status = StatusIssued
+	reg.CredentialID = "cred-1"
+	if err := q.Append(reg); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, err := q.Replay(s)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if replayed != 1 {
+		t.Errorf("expected 1 registration replayed, got %d", replayed)
+	}
+
+	saved, err := s.GetRegistrationByID("reg-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Status != StatusIssued || saved.CredentialID != "cred-1" || saved.IdempotencyKey != "key-1" || saved.IdempotencyFingerprint != "ab12" {
+		t.Errorf("expected the latest version of the registration, got %+v", saved)
+	}
+	if _, err := os.Stat(q.path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the queue file to be removed, got %v", err)
+	}
+
+	// Replaying again updates the same registration instead of failing
+	reg.Status = StatusFailed
+	if err := q.Append(reg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Replay(s); err != nil {
+		t.Fatalf("second Replay failed: %v", err)
+	}
+	saved, err = s.GetRegistrationByID("reg-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Status != StatusFailed {
+		t.Errorf("expected status %q, got %q", StatusFailed, saved.Status)
+	}
+}
+
+func TestQueueReplayKeepsFailedRegistrations(t *testing.T) {
+	s := newTestService(t, configuration.Production)
+	q := NewQueue(filepath.Join(t.TempDir(), "queue.jsonl"))
+
+	existing := &Registration{RegistrationID: "reg-1", Email: "a@example.com", VatID: "ES1"}
+	if err := s.SaveRegistration(existing); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same email under another id violates the unique constraint
+	for _, reg := range []*Registration{
+		{RegistrationID: "reg-2", Email: "a@example.com", VatID: "ES2"},
+		{RegistrationID: "reg-3", Email: "c@example.com", VatID: "ES3"},
+	} {
+		if err := q.Append(reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replayed, err := q.Replay(s)
+	if !errors.Is(err, ErrDuplicateEmail) {
+		t.Fatalf("expected ErrDuplicateEmail, got %v", err)
+	}
+	if replayed != 1 {
+		t.Errorf("expected 1 registration replayed, got %d", replayed)
+	}
+
+	remaining, err := q.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 1 || remaining[0].RegistrationID != "reg-2" {
+		t.Errorf("expected only reg-2 to stay in the queue, got %v", remaining)
+	}
+}
@@ -0,0 +1,51 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Registrar stores the registrations and the data about them used by the server. It is implemented by Service,
+// on SQLite, and lets the server run on other storage.
+type Registrar interface {
+	SaveRegistrationContext(ctx context.Context, reg *Registration, outbox ...*OutboxItem) error
+	UpdateRegistrationStatusContext(ctx context.Context, reg *Registration, outbox ...*OutboxItem) error
+	UpdateDeliveryStatusContext(ctx context.Context, email string, status string) (int64, error)
+	AmendRegistrationContext(ctx context.Context, reg *Registration) error
+	RestoreRegistrationContext(ctx context.Context, reg *Registration) error
+
+	GetRegistrationsContext(ctx context.Context, limit, offset int) ([]Registration, error)
+	GetRegistrationContext(ctx context.Context, vatID string, email string) (*Registration, error)
+	GetRegistrationByEmailContext(ctx context.Context, email string) (*Registration, error)
+	GetRegistrationByIDContext(ctx context.Context, registrationID string) (*Registration, error)
+	GetRegistrationByIdempotencyKeyContext(ctx context.Context, key string) (*Registration, error)
+	ListRegistrationsContext(ctx context.Context, f RegistrationFilter, limit, offset int) ([]Registration, error)
+	CountMatchingRegistrationsContext(ctx context.Context, f RegistrationFilter) (int, error)
+	SearchRegistrationsContext(ctx context.Context, term string, limit int) ([]Registration, error)
+
+	CountRegistrationsContext(ctx context.Context, r StatsRange) (RegistrationCounts, error)
+	CountRegistrationsByCountryContext(ctx context.Context, r StatsRange) (map[string]int, error)
+	CountRegistrationsByDayContext(ctx context.Context, r StatsRange) (map[string]int, error)
+	GetRegistrationsCreatedContext(ctx context.Context, r StatsRange) ([]Registration, error)
+
+	SaveIssuancePayloadContext(ctx context.Context, registrationID string, payload string) error
+	GetIssuancePayloadContext(ctx context.Context, registrationID string) (string, error)
+	SaveIssuerResponseContext(ctx context.Context, registrationID string, resp *IssuerResponse) error
+	GetIssuerResponseContext(ctx context.Context, registrationID string) (*IssuerResponse, error)
+	GetFailedIssuancesContext(ctx context.Context, before time.Time, maxRetries int, limit int) ([]Registration, error)
+	AddIssuanceRetryContext(ctx context.Context, registrationID string) (int, error)
+	EndIssuanceRetriesContext(ctx context.Context, registrationID string, maxRetries int) error
+	PurgeRegistrationsContext(ctx context.Context, opts PurgeOptions) (int64, error)
+
+	SaveBotAttemptContext(ctx context.Context, attempt *BotAttempt) error
+	CountBotAttemptsContext(ctx context.Context, since time.Time) (int, error)
+
+	GetPendingOutboxItemsContext(ctx context.Context, before time.Time, limit int) ([]OutboxItem, error)
+	GetOutboxItemContext(ctx context.Context, id int64) (*OutboxItem, error)
+	CompleteOutboxItemContext(ctx context.Context, id int64) error
+	RetryOutboxItemContext(ctx context.Context, id int64, lastError string, next time.Time, maxAttempts int) (string, error)
+
+	Close() error
+}
+
+var _ Registrar = (*Service)(nil)
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+// PurgeOptions selects the registrations removed by PurgeRegistrations, and how
+type PurgeOptions struct {
+	// Before purges the registrations created before this time
+	Before time.Time
+	// Anonymize clears the personal data of the registrations instead of deleting them
+	Anonymize bool
+	// IncludeUnissued also purges the registrations whose credential was not issued, kept otherwise
+	IncludeUnissued bool
+}
+
+// NewPurgeOptions returns the options to purge the registrations older than the retention of the configuration
+func NewPurgeOptions(cfg configuration.RetentionConfig, now time.Time) PurgeOptions {
+	return PurgeOptions{
+		Before:          now.Add(-cfg.MaxAge),
+		Anonymize:       cfg.Anonymize,
+		IncludeUnissued: cfg.PurgeUnissued,
+	}
+}
+
+// anonymizedEmail replaces the email of the anonymized registrations. It is unique for each registration,
+// as the email column, and tells the anonymized registrations apart.
+const anonymizedEmail = `registration_id || '@anonymized.invalid'`
+
+// PurgeRegistrations is PurgeRegistrationsContext with the background context
+func (s *Service) PurgeRegistrations(opts PurgeOptions) (int64, error) {
+	return s.PurgeRegistrationsContext(context.Background(), opts)
+}
+
+// PurgeRegistrationsContext deletes or anonymizes the registrations created before opts.Before, returning how many
+// were purged. Their items in the outbox are deleted too, as they carry the same personal data.
+// The anonymized registrations keep their id, country, dates and status, and are not purged again.
+func (s *Service) PurgeRegistrationsContext(ctx context.Context, opts PurgeOptions) (int64, error) {
+	where := `created_at < ?`
+	args := []any{opts.Before}
+	if !opts.IncludeUnissued {
+		where += ` AND status = ?`
+		args = append(args, StatusIssued)
+	}
+	if opts.Anonymize {
+		where += ` AND email != ` + anonymizedEmail
+	}
+
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM outbox WHERE registration_id IN (SELECT registration_id FROM registrations WHERE `+where+`)`, args...); err != nil {
+		return 0, err
+	}
+
+	query := `DELETE FROM registrations WHERE ` + where
+	if opts.Anonymize {
+		query = `UPDATE registrations SET
+			email = ` + anonymizedEmail + `, vat_id = 'anonymized-' || registration_id,
+			first_name = '', last_name = '', company_name = '', review_note = '', idempotency_key = NULL, idempotency_fingerprint = NULL,
+			notif_email_error = '', extra_fields = NULL, issuance_payload = NULL, issuer_response = NULL
+		WHERE ` + where
+	}
+	result, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return purged, tx.Commit()
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+// seedPurgeRegistrations saves old and new registrations, issued or not, each with an item in the outbox
+func seedPurgeRegistrations(t *testing.T, s *Service, now time.Time) {
+	t.Helper()
+	old := now.AddDate(-2, 0, 0)
+	registrations := []struct {
+		reg       Registration
+		createdAt time.Time
+	}{
+		{Registration{RegistrationID: "old-issued", Email: "a@example.com", FirstName: "Ann", VatID: "ES1", Country: "ES", Status: StatusIssued}, old},
+		{Registration{RegistrationID: "old-failed", Email: "b@example.com", FirstName: "Bob", VatID: "ES2", Country: "ES", Status: StatusFailed}, old},
+		{Registration{RegistrationID: "old-pending", Email: "c@example.com", FirstName: "Cid", VatID: "FR1", Country: "FR", Status: StatusPending}, old},
+		{Registration{RegistrationID: "new-issued", Email: "d@example.com", FirstName: "Dan", VatID: "DE1", Country: "DE", Status: StatusIssued}, now.AddDate(0, -1, 0)},
+	}
+	for _, r := range registrations {
+		reg := r.reg
+		item := &OutboxItem{Kind: OutboxWebhook, RegistrationID: reg.RegistrationID, Payload: `{"email": "` + reg.Email + `"}`}
+		if err := s.SaveRegistration(&reg, item); err != nil {
+			t.Fatal(err)
+		}
+		reg.Status = r.reg.Status
+		if err := s.UpdateRegistrationStatus(&reg); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SaveIssuancePayload(reg.RegistrationID, `{"email": "`+reg.Email+`"}`); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.conn.Exec(`UPDATE registrations SET created_at = ? WHERE registration_id = ?`, r.createdAt, reg.RegistrationID); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// outboxRegistrations returns the registrations with items in the outbox
+func outboxRegistrations(t *testing.T, s *Service) []string {
+	t.Helper()
+	rows, err := s.conn.Query(`SELECT registration_id FROM outbox ORDER BY registration_id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestPurgeRegistrations(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.Local)
+	retention := configuration.RetentionConfig{MaxAge: 365 * 24 * time.Hour}
+
+	tests := []struct {
+		name          string
+		purgeUnissued bool
+		wantPurged    []string
+		wantKept      []string
+	}{
+		{
+			name:       "issued only",
+			wantPurged: []string{"old-issued"},
+			wantKept:   []string{"new-issued", "old-failed", "old-pending"},
+		},
+		{
+			name:          "with unissued",
+			purgeUnissued: true,
+			wantPurged:    []string{"old-failed", "old-issued", "old-pending"},
+			wantKept:      []string{"new-issued"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, configuration.Production)
+			seedPurgeRegistrations(t, s, now)
+
+			cfg := retention
+			cfg.PurgeUnissued = tt.purgeUnissued
+			purged, err := s.PurgeRegistrations(NewPurgeOptions(cfg, now))
+			if err != nil {
+				t.Fatalf("PurgeRegistrations failed: %v", err)
+			}
+			if purged != int64(len(tt.wantPurged)) {
+				t.Errorf("expected %d registrations purged, got %d", len(tt.wantPurged), purged)
+			}
+
+			for _, id := range tt.wantPurged {
+				if _, err := s.GetRegistrationByID(id); !errors.Is(err, sql.ErrNoRows) {
+					t.Errorf("expected %s to be deleted, got %v", id, err)
+				}
+			}
+			for _, id := range tt.wantKept {
+				if _, err := s.GetRegistrationByID(id); err != nil {
+					t.Errorf("expected %s to be kept, got %v", id, err)
+				}
+			}
+			if got := outboxRegistrations(t, s); !slices.Equal(got, tt.wantKept) {
+				t.Errorf("expected the outbox items of %v to be kept, got %v", tt.wantKept, got)
+			}
+		})
+	}
+}
+
+func TestPurgeRegistrationsAnonymize(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.Local)
+	s := newTestService(t, configuration.Production)
+	seedPurgeRegistrations(t, s, now)
+
+	opts := NewPurgeOptions(configuration.RetentionConfig{MaxAge: 365 * 24 * time.Hour, Anonymize: true}, now)
+	purged, err := s.PurgeRegistrations(opts)
+	if err != nil {
+		t.Fatalf("PurgeRegistrations failed: %v", err)
+	}
+	if purged != 1 {
+		t.Errorf("expected 1 registration anonymized, got %d", purged)
+	}
+
+	reg, err := s.GetRegistrationByID("old-issued")
+	if err != nil {
+		t.Fatalf("expected the anonymized registration to be kept: %v", err)
+	}
+	if reg.Email == "a@example.com" || reg.VatID == "ES1" || reg.FirstName != "" {
+		t.Errorf("expected the personal data to be cleared, got %+v", reg)
+	}
+	if reg.Country != "ES" || reg.Status != StatusIssued {
+		t.Errorf("expected the country and status to be kept, got %q and %q", reg.Country, reg.Status)
+	}
+	if payload, err := s.GetIssuancePayload("old-issued"); err != nil || payload != "" {
+		t.Errorf("expected the issuance payload to be cleared, got %q and %v", payload, err)
+	}
+	if _, err := s.GetRegistrationByEmail("a@example.com"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected the email to be free, got %v", err)
+	}
+	if counts, err := s.CountRegistrations(StatsRange{}); err != nil || counts.Total != 4 {
+		t.Errorf("expected the anonymized registration in the statistics, got %+v and %v", counts, err)
+	}
+
+	// The anonymized registrations are not purged again
+	if purged, err := s.PurgeRegistrations(opts); err != nil || purged != 0 {
+		t.Errorf("expected nothing to purge again, got %d and %v", purged, err)
+	}
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// GetFailedIssuances is GetFailedIssuancesContext with the background context
+func (s *Service) GetFailedIssuances(before time.Time, maxRetries int, limit int) ([]Registration, error) {
+	return s.GetFailedIssuancesContext(context.Background(), before, maxRetries, limit)
+}
+
+// GetFailedIssuancesContext returns the registrations whose issuance failed before the given time and was retried
+// less than maxRetries times, oldest first and at most limit of them
+func (s *Service) GetFailedIssuancesContext(ctx context.Context, before time.Time, maxRetries int, limit int) ([]Registration, error) {
+	query := `SELECT ` + registrationColumns + `
+	FROM registrations
+	WHERE status = ? AND COALESCE(issuance_error, '') != '' AND issuance_at <= ? AND COALESCE(issuance_retries, 0) < ?
+	ORDER BY issuance_at
+	LIMIT ?`
+
+	return s.queryRegistrations(ctx, query, StatusFailed, before, maxRetries, limit)
+}
+
+// AddIssuanceRetry is AddIssuanceRetryContext with the background context
+func (s *Service) AddIssuanceRetry(registrationID string) (int, error) {
+	return s.AddIssuanceRetryContext(context.Background(), registrationID)
+}
+
+// AddIssuanceRetryContext counts a new retry of the issuance of a registration, returning the number of retries so far
+func (s *Service) AddIssuanceRetryContext(ctx context.Context, registrationID string) (int, error) {
+	var retries int
+	err := s.conn.QueryRowContext(ctx, `UPDATE registrations SET issuance_retries = COALESCE(issuance_retries, 0) + 1
+		WHERE registration_id = ? RETURNING issuance_retries`, registrationID).Scan(&retries)
+	return retries, err
+}
+
+// EndIssuanceRetries is EndIssuanceRetriesContext with the background context
+func (s *Service) EndIssuanceRetries(registrationID string, maxRetries int) error {
+	return s.EndIssuanceRetriesContext(context.Background(), registrationID, maxRetries)
+}
+
+// EndIssuanceRetriesContext counts the issuance of a registration as retried maxRetries times, so it is not returned
+// by GetFailedIssuances anymore. It is used when retrying would fail again, and the credential has to be reissued
+// manually.
+func (s *Service) EndIssuanceRetriesContext(ctx context.Context, registrationID string, maxRetries int) error {
+	_, err := s.conn.ExecContext(ctx, `UPDATE registrations SET issuance_retries = ?
+		WHERE registration_id = ? AND COALESCE(issuance_retries, 0) < ?`, maxRetries, registrationID, maxRetries)
+	return err
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"context"
+	"strings"
+	"unicode/utf8"
+)
+
+// searchColumns are the columns of the full-text index of the registrations, created by the migrations
+const searchColumns = `registration_id, company_name, email, first_name, last_name, vat_id`
+
+// minSearchWordLength is the length of the shortest word found with the full-text index, made of trigrams
+const minSearchWordLength = 3
+
+// SearchRegistrations is SearchRegistrationsContext with the background context
+func (s *Service) SearchRegistrations(term string, limit int) ([]Registration, error) {
+	return s.SearchRegistrationsContext(context.Background(), term, limit)
+}
+
+// SearchRegistrationsContext returns at most limit registrations with all the words of the term in their company name,
+// email, first name, last name or VAT ID, ignoring case. The words can be any part of the values, e.g. "acm" finds
+// "ACME Corp". The best matches are returned first.
+func (s *Service) SearchRegistrationsContext(ctx context.Context, term string, limit int) ([]Registration, error) {
+	words := strings.Fields(term)
+	if len(words) == 0 {
+		return nil, nil
+	}
+
+	// The full-text index can not find words shorter than a trigram, which are searched scanning the table
+	for _, word := range words {
+		if utf8.RuneCountInString(word) < minSearchWordLength {
+			return s.searchRegistrationsLike(ctx, words, limit)
+		}
+	}
+
+	// Each word is quoted, so the characters with a meaning in the FTS5 query syntax are searched as they are
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+
+	query := `SELECT ` + registrationColumns + `
+	FROM registrations JOIN (
+		SELECT registration_id, bm25(registrations_fts) AS rank FROM registrations_fts WHERE registrations_fts MATCH ?
+	) AS matches USING (registration_id)
+	ORDER BY matches.rank, created_at DESC
+	LIMIT ?`
+	return s.queryRegistrations(ctx, query, strings.Join(quoted, " "), limit)
+}
+
+// searchRegistrationsLike returns at most limit registrations with all the words in the searched columns, the
+// most recent first
+func (s *Service) searchRegistrationsLike(ctx context.Context, words []string, limit int) ([]Registration, error) {
+	var conditions []string
+	var args []any
+	for _, word := range words {
+		conditions = append(conditions, `(company_name LIKE ? ESCAPE '\' OR email LIKE ? ESCAPE '\'
+		OR first_name LIKE ? ESCAPE '\' OR last_name LIKE ? ESCAPE '\' OR vat_id LIKE ? ESCAPE '\')`)
+		pattern := "%" + likeEscaper.Replace(word) + "%"
+		args = append(args, pattern, pattern, pattern, pattern, pattern)
+	}
+
+	query := `SELECT ` + registrationColumns + `
+	FROM registrations
+	WHERE ` + strings.Join(conditions, " AND ") + `
+	ORDER BY created_at DESC
+	LIMIT ?`
+	return s.queryRegistrations(ctx, query, append(args, limit)...)
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern, with \ as the escape character
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
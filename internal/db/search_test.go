@@ -0,0 +1,76 @@
+package db
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func TestSearchRegistrations(t *testing.T) {
+	s := newTestService(t, configuration.Development)
+
+	for _, reg := range []Registration{
+		{RegistrationID: "reg-1", Email: "info@acme.com", FirstName: "John", LastName: "Doe", CompanyName: "ACME", VatID: "ES12345678"},
+		{RegistrationID: "reg-2", Email: "jane@example.com", FirstName: "Jane", LastName: "Smith", CompanyName: "ACME Spain", VatID: "ES87654321"},
+		{RegistrationID: "reg-3", Email: "jean@globex.fr", FirstName: "Jean", LastName: "Dupont", CompanyName: "Globex", VatID: "FR12345678901"},
+	} {
+		if err := s.SaveRegistration(&reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		term string
+		want []string
+	}{
+		{name: "part of the company name", term: "acm", want: []string{"reg-1", "reg-2"}},
+		{name: "ignoring case", term: "GLOBEX", want: []string{"reg-3"}},
+		{name: "part of the VAT ID", term: "2345678", want: []string{"reg-1", "reg-3"}},
+		{name: "email", term: "jane@example", want: []string{"reg-2"}},
+		{name: "all the words", term: "acme smith", want: []string{"reg-2"}},
+		{name: "short word", term: "Do", want: []string{"reg-1"}},
+		{name: "LIKE wildcards", term: "%", want: nil},
+		{name: "FTS5 syntax", term: `acme" OR "globex`, want: nil},
+		{name: "empty", term: "  ", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			regs, err := s.SearchRegistrations(tt.term, 10)
+			if err != nil {
+				t.Fatalf("SearchRegistrations failed: %v", err)
+			}
+			var got []string
+			for _, reg := range regs {
+				got = append(got, reg.RegistrationID)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	// The registration matching in more fields is the best match
+	regs, err := s.SearchRegistrations("acme", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(regs) != 1 || regs[0].RegistrationID != "reg-1" {
+		t.Errorf("expected reg-1 as the best match, got %+v", regs)
+	}
+
+	// The index follows the changes of the registrations
+	amended := Registration{RegistrationID: "reg-4", Email: "jean@globex.fr", CompanyName: "Initech", VatID: "FR12345678901"}
+	if err := s.SaveRegistration(&amended); err != nil {
+		t.Fatal(err)
+	}
+	if regs, err := s.SearchRegistrations("globex", 10); err != nil || len(regs) != 1 || regs[0].CompanyName != "Initech" {
+		t.Errorf("expected the amended registration, got %+v: %v", regs, err)
+	}
+	if regs, err := s.SearchRegistrations("dupont", 10); err != nil || len(regs) != 0 {
+		t.Errorf("expected the old name not to be found, got %+v: %v", regs, err)
+	}
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// StatsRange limits the statistics to the registrations created in [From, To). A zero time leaves that end open.
+type StatsRange struct {
+	From time.Time
+	To   time.Time
+}
+
+// where returns the condition on the creation time of the registrations and its arguments
+func (r StatsRange) where() (string, []any) {
+	var conditions []string
+	var args []any
+	if !r.From.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, r.From)
+	}
+	if !r.To.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, r.To)
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// RegistrationCounts are the number of registrations in each outcome of the onboarding
+type RegistrationCounts struct {
+	Total  int `json:"total"`
+	Issued int `json:"issued"`
+	Failed int `json:"failed"`
+	// EmailErrors are the registrations whose welcome email could not be sent or bounced
+	EmailErrors int `json:"email_errors"`
+}
+
+// CountRegistrations is CountRegistrationsContext with the background context
+func (s *Service) CountRegistrations(r StatsRange) (RegistrationCounts, error) {
+	return s.CountRegistrationsContext(context.Background(), r)
+}
+
+// CountRegistrationsContext returns the number of registrations in the range, by outcome
+func (s *Service) CountRegistrationsContext(ctx context.Context, r StatsRange) (RegistrationCounts, error) {
+	where, args := r.where()
+	query := `SELECT
+		COUNT(*),
+		COUNT(CASE WHEN status = ? THEN 1 END),
+		COUNT(CASE WHEN status = ? THEN 1 END),
+		COUNT(CASE WHEN COALESCE(notif_email_error, '') <> '' OR delivery_status = ? THEN 1 END)
+	FROM registrations` + where
+
+	var counts RegistrationCounts
+	err := s.conn.QueryRowContext(ctx, query, append([]any{StatusIssued, StatusFailed, DeliveryBounced}, args...)...).Scan(
+		&counts.Total, &counts.Issued, &counts.Failed, &counts.EmailErrors,
+	)
+	return counts, err
+}
+
+// CountRegistrationsByCountry is CountRegistrationsByCountryContext with the background context
+func (s *Service) CountRegistrationsByCountry(r StatsRange) (map[string]int, error) {
+	return s.CountRegistrationsByCountryContext(context.Background(), r)
+}
+
+// CountRegistrationsByCountryContext returns the number of registrations in the range for each country code
+func (s *Service) CountRegistrationsByCountryContext(ctx context.Context, r StatsRange) (map[string]int, error) {
+	where, args := r.where()
+	return s.countBy(ctx, `SELECT COALESCE(country, ''), COUNT(*) FROM registrations`+where+` GROUP BY 1`, args)
+}
+
+// CountRegistrationsByDay is CountRegistrationsByDayContext with the background context
+func (s *Service) CountRegistrationsByDay(r StatsRange) (map[string]int, error) {
+	return s.CountRegistrationsByDayContext(context.Background(), r)
+}
+
+// CountRegistrationsByDayContext returns the number of registrations in the range for each day, as YYYY-MM-DD
+func (s *Service) CountRegistrationsByDayContext(ctx context.Context, r StatsRange) (map[string]int, error) {
+	where, args := r.where()
+	// The times are stored as text starting with the date
+	return s.countBy(ctx, `SELECT substr(created_at, 1, 10), COUNT(*) FROM registrations`+where+` GROUP BY 1`, args)
+}
+
+// countBy runs a query returning a key and a count in each row
+func (s *Service) countBy(ctx context.Context, query string, args []any) (map[string]int, error) {
+	rows, err := s.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var key string
+		var count int
+		if err := rows.Scan(&key, &count); err != nil {
+			return nil, err
+		}
+		counts[key] = count
+	}
+	return counts, rows.Err()
+}
+
+// GetRegistrationsCreated is GetRegistrationsCreatedContext with the background context
+func (s *Service) GetRegistrationsCreated(r StatsRange) ([]Registration, error) {
+	return s.GetRegistrationsCreatedContext(context.Background(), r)
+}
+
+// GetRegistrationsCreatedContext returns the registrations created in the range, oldest first
+func (s *Service) GetRegistrationsCreatedContext(ctx context.Context, r StatsRange) ([]Registration, error) {
+	where, args := r.where()
+	return s.queryRegistrations(ctx, `SELECT `+registrationColumns+` FROM registrations`+where+` ORDER BY created_at`, args...)
+}
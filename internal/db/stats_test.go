@@ -0,0 +1,89 @@
+package db
+
+import (
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func TestRegistrationStats(t *testing.T) {
+	s := newTestService(t, configuration.Production)
+
+	midnight := func(d int) time.Time { return time.Date(2026, 3, d, 0, 0, 0, 0, time.Local) }
+	day := func(d int) time.Time { return midnight(d).Add(10 * time.Hour) }
+	registrations := []struct {
+		reg       Registration
+		createdAt time.Time
+	}{
+		{Registration{RegistrationID: "reg-1", Email: "a@example.com", VatID: "ES1", Country: "ES", Status: StatusIssued, DeliveryStatus: DeliveryDelivered}, day(1)},
+		{Registration{RegistrationID: "reg-2", Email: "b@example.com", VatID: "ES2", Country: "ES", Status: StatusFailed}, day(1)},
+		{Registration{RegistrationID: "reg-3", Email: "c@example.com", VatID: "FR1", Country: "FR", Status: StatusIssued, NotifEmailError: "connection refused"}, day(2)},
+		{Registration{RegistrationID: "reg-4", Email: "d@example.com", VatID: "DE1", Country: "DE", Status: StatusIssued, DeliveryStatus: DeliveryBounced}, day(3)},
+		{Registration{RegistrationID: "reg-5", Email: "e@example.com", VatID: "DE2", Country: "DE"}, day(3)},
+	}
+	for _, r := range registrations {
+		reg := r.reg
+		if err := s.SaveRegistration(&reg); err != nil {
+			t.Fatal(err)
+		}
+		reg.Status, reg.DeliveryStatus, reg.NotifEmailError = r.reg.Status, r.reg.DeliveryStatus, r.reg.NotifEmailError
+		if err := s.UpdateRegistrationStatus(&reg); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.conn.Exec(`UPDATE registrations SET created_at = ? WHERE registration_id = ?`, r.createdAt, reg.RegistrationID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		r             StatsRange
+		wantCounts    RegistrationCounts
+		wantByCountry map[string]int
+		wantByDay     map[string]int
+	}{
+		{
+			name:          "all",
+			wantCounts:    RegistrationCounts{Total: 5, Issued: 3, Failed: 1, EmailErrors: 2},
+			wantByCountry: map[string]int{"ES": 2, "FR": 1, "DE": 2},
+			wantByDay:     map[string]int{"2026-03-01": 2, "2026-03-02": 1, "2026-03-03": 2},
+		},
+		{
+			name:          "range",
+			r:             StatsRange{From: midnight(2), To: midnight(3)},
+			wantCounts:    RegistrationCounts{Total: 1, Issued: 1, EmailErrors: 1},
+			wantByCountry: map[string]int{"FR": 1},
+			wantByDay:     map[string]int{"2026-03-02": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counts, err := s.CountRegistrations(tt.r)
+			if err != nil {
+				t.Fatalf("CountRegistrations failed: %v", err)
+			}
+			if counts != tt.wantCounts {
+				t.Errorf("expected counts %+v, got %+v", tt.wantCounts, counts)
+			}
+
+			byCountry, err := s.CountRegistrationsByCountry(tt.r)
+			if err != nil {
+				t.Fatalf("CountRegistrationsByCountry failed: %v", err)
+			}
+			if !maps.Equal(byCountry, tt.wantByCountry) {
+				t.Errorf("expected by country %v, got %v", tt.wantByCountry, byCountry)
+			}
+
+			byDay, err := s.CountRegistrationsByDay(tt.r)
+			if err != nil {
+				t.Fatalf("CountRegistrationsByDay failed: %v", err)
+			}
+			if !maps.Equal(byDay, tt.wantByDay) {
+				t.Errorf("expected by day %v, got %v", tt.wantByDay, byDay)
+			}
+		})
+	}
+}
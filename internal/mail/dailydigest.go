@@ -0,0 +1,68 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+// SendDailyDigest sends the summary of the registrations created on the day of the given time: the number of
+// registrations by outcome and the new companies. It reports whether the digest was sent, as the days without
+// registrations are skipped when configured. Nothing is sent when sending emails is disabled.
+func (s *Service) SendDailyDigest(dbService db.Registrar, day time.Time) (bool, error) {
+	if s == nil || s.transport == nil {
+		return false, nil
+	}
+	recipients := s.dailyDigest.Recipients
+	if len(recipients) == 0 {
+		recipients = s.onboardTeamEmail
+	}
+	if len(recipients) == 0 {
+		return false, fmt.Errorf("%w: no recipients for the daily digest", ErrNoRecipients)
+	}
+
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	r := db.StatsRange{From: start, To: start.AddDate(0, 0, 1)}
+
+	counts, err := dbService.CountRegistrationsContext(context.Background(), r)
+	if err != nil {
+		return false, fmt.Errorf("failed to count the registrations: %w", err)
+	}
+	if counts.Total == 0 && s.dailyDigest.SkipEmpty {
+		return false, nil
+	}
+	regs, err := dbService.GetRegistrationsCreatedContext(context.Background(), r)
+	if err != nil {
+		return false, fmt.Errorf("failed to read the registrations: %w", err)
+	}
+
+	body, err := s.renderDailyDigest(s.currentTemplates(), start, counts, regs)
+	if err != nil {
+		return false, err
+	}
+
+	subject := fmt.Sprintf("DOME: Onboarding summary of %s (%d registrations)", start.Format(time.DateOnly), counts.Total)
+	if err := s.transport.Send(s.from, recipients, subject, nil, body, ""); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// renderDailyDigest executes the template of the daily digest, returning the HTML body
+func (s *Service) renderDailyDigest(templates *emailTemplates, day time.Time, counts db.RegistrationCounts, regs []db.Registration) (string, error) {
+	data := map[string]any{
+		"Day":           day.Format(time.DateOnly),
+		"Counts":        counts,
+		"Registrations": regs,
+		"Runtime":       s.runtime,
+	}
+
+	var body bytes.Buffer
+	if err := templates.dailyDigest.ExecuteTemplate(&body, "content", data); err != nil {
+		return "", fmt.Errorf("failed to execute email template: %w", err)
+	}
+	return body.String(), nil
+}
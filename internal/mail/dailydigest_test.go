@@ -0,0 +1,73 @@
+package mail
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+func TestSendDailyDigest(t *testing.T) {
+	mailService, mockServer := newTestMailService(t, testTemplates)
+
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Production)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+
+	for _, reg := range []*db.Registration{
+		{RegistrationID: "reg-1", Email: "a@example.com", VatID: "ES1", CompanyName: "ACME"},
+		{RegistrationID: "reg-2", Email: "b@example.com", VatID: "ES2", CompanyName: "Globex"},
+	} {
+		if err := dbService.SaveRegistration(reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The digest goes to the onboarding team by default
+	sent, err := mailService.SendDailyDigest(dbService, time.Now())
+	if err != nil || !sent {
+		t.Fatalf("expected the digest to be sent, got %v: %v", sent, err)
+	}
+	if rcpts := receiveRecipients(t, mockServer); !slices.Equal(rcpts, []string{"onboarding@example.com"}) {
+		t.Errorf("expected the digest to be sent to the onboarding team, got %v", rcpts)
+	}
+	msg := receiveEmail(t, mockServer)
+	for _, want := range []string{time.Now().Format(time.DateOnly) + ": 2 registrations", "ACME", "Globex"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("expected the digest to contain %q, got: %s", want, msg)
+		}
+	}
+
+	// A day without registrations is sent unless configured otherwise
+	mailService.dailyDigest = configuration.DailyDigestConfig{Recipients: []string{"digest@example.com"}}
+	yesterday := time.Now().AddDate(0, 0, -1)
+	sent, err = mailService.SendDailyDigest(dbService, yesterday)
+	if err != nil || !sent {
+		t.Fatalf("expected the empty digest to be sent, got %v: %v", sent, err)
+	}
+	if rcpts := receiveRecipients(t, mockServer); !slices.Equal(rcpts, []string{"digest@example.com"}) {
+		t.Errorf("expected the digest to be sent to the configured recipients, got %v", rcpts)
+	}
+	if msg := receiveEmail(t, mockServer); !strings.Contains(msg, "0 registrations") {
+		t.Errorf("expected an empty digest, got: %s", msg)
+	}
+
+	mailService.dailyDigest.SkipEmpty = true
+	sent, err = mailService.SendDailyDigest(dbService, yesterday)
+	if err != nil || sent {
+		t.Fatalf("expected the empty digest to be skipped, got %v: %v", sent, err)
+	}
+}
+
+func TestDailyDigestInvalidTime(t *testing.T) {
+	cfg := configuration.MailConfig{DailyDigest: configuration.DailyDigestConfig{Enabled: true, Time: "8am"}}
+	if _, err := NewMailService(configuration.Development, cfg, testTemplates); err == nil {
+		t.Errorf("expected an invalid time of the daily digest to be rejected")
+	}
+}
@@ -0,0 +1,117 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+// ErrNotDSN is returned when parsing a message that is not a delivery status notification
+var ErrNotDSN = errors.New("the message is not a delivery status notification")
+
+// DeliveryEvent is a change in the delivery of an email to a recipient, reported by the mail provider or by a bounce message
+type DeliveryEvent struct {
+	Recipient string
+	// Status is one of the db.Delivery* statuses
+	Status string
+	// Reason is the explanation of the failure, if any
+	Reason string
+}
+
+// dsnActions maps the actions of a delivery status notification (RFC 3464) to the delivery status
+var dsnActions = map[string]string{
+	"failed":    db.DeliveryBounced,
+	"delayed":   db.DeliveryDeferred,
+	"delivered": db.DeliveryDelivered,
+	"relayed":   db.DeliveryDelivered,
+	"expanded":  db.DeliveryDelivered,
+}
+
+// ParseDSN reads a delivery status notification (RFC 3464), the bounce message sent back by mail servers,
+// and returns the delivery events of its recipients
+func ParseDSN(r io.Reader) ([]DeliveryEvent, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message: %w", err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || !strings.EqualFold(params["report-type"], "delivery-status") {
+		return nil, ErrNotDSN
+	}
+
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return nil, ErrNotDSN
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid message: %w", err)
+		}
+
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if partType != "message/delivery-status" {
+			continue
+		}
+
+		status, err := io.ReadAll(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delivery status: %w", err)
+		}
+		return parseDeliveryStatus(status)
+	}
+}
+
+// parseDeliveryStatus parses the fields of a message/delivery-status part: a group of fields about the message,
+// followed by a group for each recipient, separated by blank lines
+func parseDeliveryStatus(status []byte) ([]DeliveryEvent, error) {
+	status = bytes.ReplaceAll(status, []byte("\r\n"), []byte("\n"))
+	groups := bytes.Split(bytes.TrimSpace(status), []byte("\n\n"))
+	if len(groups) < 2 {
+		return nil, fmt.Errorf("invalid delivery status: no recipients")
+	}
+
+	var events []DeliveryEvent
+	for _, group := range groups[1:] {
+		fields, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(append(group, '\n', '\n')))).ReadMIMEHeader()
+		if err != nil {
+			return nil, fmt.Errorf("invalid delivery status: %w", err)
+		}
+
+		recipient := dsnValue(fields.Get("Final-Recipient"))
+		if recipient == "" {
+			recipient = dsnValue(fields.Get("Original-Recipient"))
+		}
+		deliveryStatus, ok := dsnActions[strings.ToLower(strings.TrimSpace(fields.Get("Action")))]
+		if recipient == "" || !ok {
+			continue
+		}
+
+		reason := strings.TrimSpace(fields.Get("Status"))
+		if diagnostic := dsnValue(fields.Get("Diagnostic-Code")); diagnostic != "" {
+			reason = strings.TrimSpace(reason + " " + diagnostic)
+		}
+
+		events = append(events, DeliveryEvent{Recipient: recipient, Status: deliveryStatus, Reason: reason})
+	}
+
+	return events, nil
+}
+
+// dsnValue removes the type from a typed field of a DSN, like "rfc822; john@example.com" or "smtp; 550 unknown user"
+func dsnValue(field string) string {
+	if _, value, ok := strings.Cut(field, ";"); ok {
+		return strings.TrimSpace(value)
+	}
+	return strings.TrimSpace(field)
+}
@@ -0,0 +1,68 @@
+package mail
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+const bounceMessage = "From: MAILER-DAEMON@mx.example.com\r\n" +
+	"To: bounces@dome-marketplace.eu\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=\"BOUNDARY\"\r\n" +
+	"\r\n" +
+	"--BOUNDARY\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"I'm sorry to have to inform you that your message could not be delivered.\r\n" +
+	"--BOUNDARY\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.example.com\r\n" +
+	"Arrival-Date: Mon, 12 Oct 2026 10:00:00 +0200\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; john@example.com\r\n" +
+	"Original-Recipient: rfc822; john@example.com\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 User unknown\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; jane@example.com\r\n" +
+	"Action: delayed\r\n" +
+	"Status: 4.4.1\r\n" +
+	"\r\n" +
+	"--BOUNDARY\r\n" +
+	"Content-Type: text/rfc822-headers\r\n" +
+	"\r\n" +
+	"Subject: Welcome to DOME Marketplace!\r\n" +
+	"--BOUNDARY--\r\n"
+
+func TestParseDSN(t *testing.T) {
+	events, err := ParseDSN(strings.NewReader(bounceMessage))
+	if err != nil {
+		t.Fatalf("ParseDSN failed: %v", err)
+	}
+
+	want := []DeliveryEvent{
+		{Recipient: "john@example.com", Status: db.DeliveryBounced, Reason: "5.1.1 550 5.1.1 User unknown"},
+		{Recipient: "jane@example.com", Status: db.DeliveryDeferred, Reason: "4.4.1"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events, got %+v", len(want), events)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("event %d: expected %+v, got %+v", i, want[i], events[i])
+		}
+	}
+}
+
+func TestParseDSNNotABounce(t *testing.T) {
+	autoReply := "From: john@example.com\r\nSubject: Out of office\r\nContent-Type: text/plain\r\n\r\nI am on holidays.\r\n"
+	if _, err := ParseDSN(strings.NewReader(autoReply)); !errors.Is(err, ErrNotDSN) {
+		t.Fatalf("expected ErrNotDSN, got %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package mail
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+// issuerError is an issuance error waiting to be notified
+type issuerError struct {
+	reg       db.Registration
+	payload   string
+	errorMsg  string
+	requestID string
+}
+
+// issuerErrorDigest collects the issuance errors notified within a window, so a burst of failures of the Issuer
+// reaches the issuer team as a single email instead of a flood of them
+type issuerErrorDigest struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	pending []issuerError
+	timer   *time.Timer
+}
+
+// newIssuerErrorDigest returns a digest collecting the errors of the window, or nil if the window is not positive
+func newIssuerErrorDigest(window time.Duration) *issuerErrorDigest {
+	if window <= 0 {
+		return nil
+	}
+	return &issuerErrorDigest{window: window}
+}
+
+// add keeps the error until the window ends, when flush is called. The window starts with the first error.
+func (d *issuerErrorDigest) add(e issuerError, flush func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.pending = append(d.pending, e)
+	if d.timer == nil {
+		d.timer = time.AfterFunc(d.window, flush)
+	}
+}
+
+// take returns the errors collected, starting a new window
+func (d *issuerErrorDigest) take() []issuerError {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	pending := d.pending
+	d.pending = nil
+	return pending
+}
+
+// flushIssuerErrors sends the errors collected in the digest, logging the failure as there is nobody to return it to
+func (s *Service) flushIssuerErrors() {
+	if err := s.FlushIssuerErrors(); err != nil {
+		slog.Error("❌ Error sending the digest of issuer errors", "error", err)
+	}
+}
+
+// FlushIssuerErrors sends now the issuance errors waiting for the digest window to end.
+// It is called when the server stops, so they are not lost.
+func (s *Service) FlushIssuerErrors() error {
+	if s == nil || s.digest == nil {
+		return nil
+	}
+	pending := s.digest.take()
+	if len(pending) == 0 {
+		return nil
+	}
+	return s.sendIssuerErrors(pending)
+}
+
+// issuerErrorThread returns the headers placing the notifications of issuance errors of a day in the same conversation.
+// The messages refer to a thread id made of the day and the environment, so mail clients group them.
+func (s *Service) issuerErrorThread(day time.Time) map[string]string {
+	domain := "dome-marketplace.eu"
+	if _, d, ok := strings.Cut(s.from, "@"); ok && d != "" {
+		domain = strings.TrimSuffix(d, ">")
+	}
+	thread := "<issuer-errors." + day.Format("20060102") + "." + string(s.runtime) + "@" + domain + ">"
+	return map[string]string{
+		"In-Reply-To": thread,
+		"References":  thread,
+	}
+}
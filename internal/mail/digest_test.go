@@ -0,0 +1,93 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+func TestSendIssuerErrorThreading(t *testing.T) {
+	mailService, mockServer := newTestMailService(t, testTemplates)
+
+	thread := "<issuer-errors." + time.Now().Format("20060102") + ".dev@example.com>"
+	for _, id := range []string{"reg-1", "reg-2"} {
+		if err := mailService.SendIssuerError(&db.Registration{RegistrationID: id}, "{}", "issuer unavailable", ""); err != nil {
+			t.Fatalf("SendIssuerError failed: %v", err)
+		}
+
+		// Every notification has the same subject and refers to the thread of the day
+		receiveRecipients(t, mockServer)
+		msg := receiveEmail(t, mockServer)
+		for _, want := range []string{"Subject: " + issuerErrorSubject, "In-Reply-To: " + thread, "References: " + thread, "Error for " + id} {
+			if !strings.Contains(msg, want) {
+				t.Errorf("expected the email to contain %q, got: %s", want, msg)
+			}
+		}
+	}
+}
+
+func TestSendIssuerErrorDigest(t *testing.T) {
+	mailService, mockServer := newTestMailService(t, testTemplates)
+	mailService.digest = newIssuerErrorDigest(100 * time.Millisecond)
+
+	ids := []string{"reg-1", "reg-2", "reg-3"}
+	for _, id := range ids {
+		if err := mailService.SendIssuerError(&db.Registration{RegistrationID: id}, "{}", "issuer unavailable", ""); err != nil {
+			t.Fatalf("SendIssuerError failed: %v", err)
+		}
+	}
+
+	// A single email with all the errors is sent when the window ends
+	msg := receiveEmail(t, mockServer)
+	for _, id := range ids {
+		if !strings.Contains(msg, "Error for "+id) {
+			t.Errorf("expected the digest to contain %q, got: %s", id, msg)
+		}
+	}
+	if !strings.Contains(msg, "3 registrations failed") {
+		t.Errorf("expected the digest to count the errors, got: %s", msg)
+	}
+	select {
+	case extra := <-mockServer.Received:
+		t.Errorf("expected a single email, got another one: %s", extra)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestFlushIssuerErrors(t *testing.T) {
+	mailService, mockServer := newTestMailService(t, testTemplates)
+	mailService.digest = newIssuerErrorDigest(time.Hour)
+
+	if err := mailService.SendIssuerError(&db.Registration{RegistrationID: "reg-1"}, "{}", "issuer unavailable", ""); err != nil {
+		t.Fatalf("SendIssuerError failed: %v", err)
+	}
+
+	// The errors waiting for the window are sent when the server stops
+	if err := mailService.FlushIssuerErrors(); err != nil {
+		t.Fatalf("FlushIssuerErrors failed: %v", err)
+	}
+	if msg := receiveEmail(t, mockServer); !strings.Contains(msg, "Error for reg-1") {
+		t.Errorf("expected the pending error to be sent, got: %s", msg)
+	}
+
+	// Nothing is left to send
+	if err := mailService.FlushIssuerErrors(); err != nil {
+		t.Fatalf("FlushIssuerErrors failed: %v", err)
+	}
+}
+
+func TestExtraHeadersRejectsLineBreaks(t *testing.T) {
+	if _, err := extraHeaders(map[string]string{"References": "<a@example.com>\r\nBcc: attacker@example.com"}); err == nil {
+		t.Errorf("expected a header with a line break to be rejected")
+	}
+
+	got, err := extraHeaders(map[string]string{"References": "<a@example.com>", "In-Reply-To": "<a@example.com>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "In-Reply-To: <a@example.com>\nReferences: <a@example.com>\n"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
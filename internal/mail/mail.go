@@ -2,19 +2,27 @@ package mail
 
 import (
 	"bytes"
-	"crypto/tls"
+	"errors"
 	"fmt"
 	"html/template"
-	"net/smtp"
-	"os"
+	"io"
+	"io/fs"
+	"log/slog"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/hesusruiz/onboardng/common"
 	"github.com/hesusruiz/onboardng/internal/configuration"
 	"github.com/hesusruiz/onboardng/internal/db"
+	"github.com/hesusruiz/onboardng/internal/qrcode"
 )
 
+// ErrNoRecipients is returned when sending an email whose recipients are not in the configuration
+var ErrNoRecipients = errors.New("no recipients configured")
+
 type MailSender interface {
-	SendWelcomeEmail(reg *db.Registration) error
+	SendWelcomeEmail(reg *db.Registration, offerURI string) error
 }
 
 type Service struct {
@@ -22,37 +30,129 @@ type Service struct {
 	onboardTeamEmail []string
 	issuerTeamEmail  []string
 	ccTeamEmail      []string
-	smtpConfig       configuration.SMTPConfig
-	password         string
+	from             string
+	// transport is nil when sending emails is disabled
+	transport MailTransport
+	// templates are replaced by ReloadTemplates while the emails are being sent, so they are read with currentTemplates
+	templatesMu sync.RWMutex
+	templates   *emailTemplates
+	// dailyDigest is the configuration of the summary of the registrations of each day
+	dailyDigest configuration.DailyDigestConfig
+	// digest collects the issuance errors to notify them together, nil to notify each one when it happens
+	digest *issuerErrorDigest
+	// templatesFS is where the templates were parsed from, parsed again to preview their changes
+	templatesFS fs.FS
 }
 
-func NewMailService(runtime configuration.RuntimeEnv, cfg configuration.MailConfig) (*Service, error) {
-	if !cfg.SMTP.Enabled {
-		return &Service{runtime: runtime, smtpConfig: cfg.SMTP}, nil
+// NewMailService creates the mail service, parsing the email templates found in the root of the templates filesystem.
+// The emails are sent with the provider selected in the configuration.
+func NewMailService(runtime configuration.RuntimeEnv, cfg configuration.MailConfig, templates fs.FS) (*Service, error) {
+	parsed, err := parseTemplates(templates)
+	if err != nil {
+		return nil, err
 	}
 
-	passwordBytes, err := os.ReadFile(cfg.SMTP.PasswordFile)
+	transport, err := newTransport(runtime, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read SMTP password file: %w", err)
+		return nil, err
+	}
+
+	if cfg.DailyDigest.Enabled {
+		if _, _, err := cfg.DailyDigest.ScheduledAt(); err != nil {
+			return nil, err
+		}
+	}
+
+	if transport == nil {
+		return &Service{runtime: runtime, templates: parsed, templatesFS: templates}, nil
+	}
+
+	if len(cfg.OnboardTeamEmail) == 0 {
+		slog.Warn("⚠️ No onboarding team email configured, the welcome emails can not be sent")
+	}
+	if len(cfg.IssuerTeamEmail) == 0 {
+		slog.Warn("⚠️ No issuer team email configured, the issuance errors can not be notified")
 	}
-	password := strings.TrimSpace(string(passwordBytes))
 
 	return &Service{
 		runtime:          runtime,
 		onboardTeamEmail: cfg.OnboardTeamEmail,
 		issuerTeamEmail:  cfg.IssuerTeamEmail,
 		ccTeamEmail:      cfg.CCTeamEmail,
-		smtpConfig:       cfg.SMTP,
-		password:         password,
+		from:             cfg.Sender(),
+		transport:        transport,
+		templates:        parsed,
+		templatesFS:      templates,
+		digest:           newIssuerErrorDigest(cfg.IssuerErrorDigest),
+		dailyDigest:      cfg.DailyDigest,
 	}, nil
 }
 
-func (s *Service) SendWelcomeEmail(reg *db.Registration) error {
-	if !s.smtpConfig.Enabled {
+// Close ends the connection kept open by the transport to send the next emails, if any.
+// It is called when the server stops, after the last email was sent.
+func (s *Service) Close() error {
+	if s == nil {
 		return nil
 	}
+	if closer, ok := s.transport.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// welcomeSubjects is the subject of the welcome email for each language
+var welcomeSubjects = map[string]string{
+	"en": "Welcome to DOME Marketplace!",
+	"es": "¡Bienvenido a DOME Marketplace!",
+	"fr": "Bienvenue sur DOME Marketplace !",
+	"de": "Willkommen bei DOME Marketplace!",
+	"it": "Benvenuto su DOME Marketplace!",
+}
+
+// credentialOfferQRContentID identifies the inline image with the QR code of the credential offer in the welcome email
+const credentialOfferQRContentID = "credential-offer-qr@dome-marketplace.eu"
+
+// credentialOfferQRScale is the size in pixels of each module of the QR code
+const credentialOfferQRScale = 4
+
+// SendWelcomeEmail sends the welcome email to the user. When the Issuer returned a credential offer,
+// the email includes the link to import the credential in a wallet and its QR code as an inline image.
+// Nothing is sent when sending emails is disabled.
+func (s *Service) SendWelcomeEmail(reg *db.Registration, offerURI string) error {
+	if s == nil || s.transport == nil {
+		return nil
+	}
+	// The email tells the user how to contact the onboarding team
+	if len(s.onboardTeamEmail) == 0 {
+		return fmt.Errorf("%w: the welcome email needs the onboarding team email", ErrNoRecipients)
+	}
+
+	body, images, err := s.renderWelcome(s.currentTemplates(), reg, offerURI, s.onboardTeamEmail[0])
+	if err != nil {
+		return err
+	}
+
+	to := append([]string{reg.Email}, s.ccTeamEmail...)
+	subject := welcomeSubject(common.ResolveLanguage(reg.Language, reg.Country))
+
+	return s.transport.Send(s.from, to, subject, nil, body, "", images...)
+}
+
+// welcomeSubject returns the subject of the welcome email in the language, falling back to English
+func welcomeSubject(lang string) string {
+	if subject, ok := welcomeSubjects[lang]; ok {
+		return subject
+	}
+	return welcomeSubjects[common.DefaultLanguage]
+}
+
+// renderWelcome executes the welcome template in the language of the registration, returning the HTML body
+// and the inline images it references
+func (s *Service) renderWelcome(templates *emailTemplates, reg *db.Registration, offerURI string, onboardTeamEmail string) (string, []InlineImage, error) {
+	lang := common.ResolveLanguage(reg.Language, reg.Country)
 
 	data := map[string]any{
+		"Language":         lang,
 		"RegistrationID":   reg.RegistrationID,
 		"Email":            reg.Email,
 		"FirstName":        reg.FirstName,
@@ -61,169 +161,128 @@ func (s *Service) SendWelcomeEmail(reg *db.Registration) error {
 		"Country":          reg.Country,
 		"VatID":            reg.VatID,
 		"Runtime":          s.runtime,
-		"OnboardTeamEmail": s.onboardTeamEmail[0],
+		"OnboardTeamEmail": onboardTeamEmail,
 	}
 
-	tmpl, err := template.ParseFiles("src/email/email_welcome.html")
-	if err != nil {
-		return fmt.Errorf("failed to parse email template: %w", err)
+	var images []InlineImage
+	if offerURI != "" {
+		// The link was validated when extracted from the response of the Issuer, and its scheme is not one
+		// of the few accepted by the template engine
+		data["CredentialOfferURI"] = template.URL(offerURI)
+
+		qr, err := credentialOfferQR(offerURI)
+		if err != nil {
+			// The link is enough to import the credential
+			slog.Warn("⚠️ Could not generate the QR code of the credential offer", "registration_id", reg.RegistrationID, "error", err)
+		} else {
+			data["CredentialOfferQR"] = credentialOfferQRContentID
+			images = append(images, InlineImage{
+				ContentID:   credentialOfferQRContentID,
+				Filename:    "credential-offer.png",
+				ContentType: "image/png",
+				Data:        qr,
+			})
+		}
 	}
 
 	var body bytes.Buffer
-	if err := tmpl.ExecuteTemplate(&body, "content", data); err != nil {
-		return fmt.Errorf("failed to execute email template: %w", err)
+	if err := templates.welcomeFor(lang).ExecuteTemplate(&body, "content", data); err != nil {
+		return "", nil, fmt.Errorf("failed to execute email template: %w", err)
 	}
+	return body.String(), images, nil
+}
 
-	from := s.smtpConfig.Username
-	to := append([]string{reg.Email}, s.ccTeamEmail...)
-	subject := "Welcome to DOME Marketplace!"
-	mime := "MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n"
-	msg := []byte("From: " + from + "\n" +
-		"To: " + strings.Join(to, ", ") + "\n" +
-		"Subject: " + subject + "\n" +
-		mime + body.String())
-
-	addr := fmt.Sprintf("%s:%d", s.smtpConfig.Host, s.smtpConfig.Port)
-	auth := smtp.PlainAuth("", s.smtpConfig.Username, s.password, s.smtpConfig.Host)
-
-	if s.smtpConfig.TLS && s.smtpConfig.Port == 465 {
-		tlsConfig := &tls.Config{
-			InsecureSkipVerify: false,
-			ServerName:         s.smtpConfig.Host,
-		}
+// verificationCodeSubject is the subject of the email with the code to verify the email of the user
+const verificationCodeSubject = "Your DOME Marketplace verification code"
 
-		conn, err := tls.Dial("tcp", addr, tlsConfig)
-		if err != nil {
-			return fmt.Errorf("failed to dial TLS: %w", err)
-		}
-		defer conn.Close()
+// SendVerificationCode sends to the user the code to verify the email before registering.
+// Nothing is sent when sending emails is disabled.
+func (s *Service) SendVerificationCode(email string, code string) error {
+	if s == nil || s.transport == nil {
+		return nil
+	}
 
-		c, err := smtp.NewClient(conn, s.smtpConfig.Host)
-		if err != nil {
-			return fmt.Errorf("failed to create SMTP client: %w", err)
-		}
-		defer c.Quit()
+	body, err := s.renderVerificationCode(s.currentTemplates(), code)
+	if err != nil {
+		return err
+	}
+	return s.transport.Send(s.from, []string{email}, verificationCodeSubject, nil, body, "")
+}
 
-		if err = c.Auth(auth); err != nil {
-			return fmt.Errorf("failed to authenticate: %w", err)
-		}
+// renderVerificationCode executes the template of the email with the verification code, returning the HTML body
+func (s *Service) renderVerificationCode(templates *emailTemplates, code string) (string, error) {
+	data := map[string]any{
+		"Code":    code,
+		"Runtime": s.runtime,
+	}
 
-		if err = c.Mail(from); err != nil {
-			return fmt.Errorf("failed to set sender: %w", err)
-		}
+	var body bytes.Buffer
+	if err := templates.verificationCode.ExecuteTemplate(&body, "content", data); err != nil {
+		return "", fmt.Errorf("failed to execute email template: %w", err)
+	}
+	return body.String(), nil
+}
 
-		for _, addr := range to {
-			if err = c.Rcpt(addr); err != nil {
-				return fmt.Errorf("failed to add recipient: %w", err)
-			}
-		}
+// issuerErrorSubject is the same for all the notifications of issuance errors, so mail clients thread them
+const issuerErrorSubject = "DOME: Error in Credential Issuer during customer registration"
 
-		w, err := c.Data()
-		if err != nil {
-			return fmt.Errorf("failed to open data writer: %w", err)
-		}
+// SendIssuerError notifies the issuer team that a credential could not be issued, with the payload to issue it manually.
+// The request id correlates the email with the logs of the registration request.
+// The notifications of a day are threaded together, and when a digest window is configured the errors within it
+// are sent later in a single email. Nothing is sent when sending emails is disabled.
+func (s *Service) SendIssuerError(reg *db.Registration, payload string, errorMsg string, requestID string) error {
+	if s == nil || s.transport == nil {
+		return nil
+	}
+	if len(s.issuerTeamEmail) == 0 {
+		return fmt.Errorf("%w: no issuer team email to notify the error", ErrNoRecipients)
+	}
 
-		_, err = w.Write(msg)
-		if err != nil {
-			return fmt.Errorf("failed to write message: %w", err)
-		}
+	issErr := issuerError{reg: *reg, payload: payload, errorMsg: errorMsg, requestID: requestID}
+	if s.digest != nil {
+		s.digest.add(issErr, s.flushIssuerErrors)
+		return nil
+	}
+	return s.sendIssuerErrors([]issuerError{issErr})
+}
 
-		err = w.Close()
+// sendIssuerErrors sends the notification of one or more issuance errors in a single email
+func (s *Service) sendIssuerErrors(errs []issuerError) error {
+	var body strings.Builder
+	if len(errs) > 1 {
+		fmt.Fprintf(&body, "<p>%d registrations failed to issue their credential.</p>\n", len(errs))
+	}
+	for _, e := range errs {
+		rendered, err := s.renderIssuerError(s.currentTemplates(), &e.reg, e.payload, e.errorMsg, e.requestID)
 		if err != nil {
-			return fmt.Errorf("failed to close data writer: %w", err)
+			return err
 		}
-
-		return nil
+		body.WriteString(rendered)
 	}
 
-	return smtp.SendMail(addr, auth, from, to, msg)
+	return s.transport.Send(s.from, s.issuerTeamEmail, issuerErrorSubject, s.issuerErrorThread(time.Now()), body.String(), "")
 }
 
-func (s *Service) SendIssuerError(reg *db.Registration, payload string, errorMsg string) error {
-	if !s.smtpConfig.Enabled {
-		return nil
-	}
-
+// renderIssuerError executes the template of the notification of an issuance error, returning the HTML body
+func (s *Service) renderIssuerError(templates *emailTemplates, reg *db.Registration, payload string, errorMsg string, requestID string) (string, error) {
 	data := map[string]any{
 		"FirstName":      reg.FirstName,
 		"CompanyName":    reg.CompanyName,
 		"RegistrationID": reg.RegistrationID,
 		"Payload":        payload,
 		"ErrorMsg":       errorMsg,
+		"RequestID":      requestID,
 		"Runtime":        s.runtime,
 	}
 
-	tmpl, err := template.ParseFiles("src/email/issuer_error.html")
-	if err != nil {
-		return fmt.Errorf("failed to parse email template: %w", err)
-	}
-
 	var body bytes.Buffer
-	if err := tmpl.ExecuteTemplate(&body, "content", data); err != nil {
-		return fmt.Errorf("failed to execute email template: %w", err)
-	}
-
-	from := s.smtpConfig.Username
-	to := s.issuerTeamEmail
-	subject := "DOME: Error in Credential Issuer during customer registration"
-	mime := "MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n"
-	msg := []byte("From: " + from + "\n" +
-		"To: " + strings.Join(to, ", ") + "\n" +
-		"Subject: " + subject + "\n" +
-		mime + body.String())
-
-	addr := fmt.Sprintf("%s:%d", s.smtpConfig.Host, s.smtpConfig.Port)
-	auth := smtp.PlainAuth("", s.smtpConfig.Username, s.password, s.smtpConfig.Host)
-
-	if s.smtpConfig.TLS && s.smtpConfig.Port == 465 {
-		tlsConfig := &tls.Config{
-			InsecureSkipVerify: false,
-			ServerName:         s.smtpConfig.Host,
-		}
-
-		conn, err := tls.Dial("tcp", addr, tlsConfig)
-		if err != nil {
-			return fmt.Errorf("failed to dial TLS: %w", err)
-		}
-		defer conn.Close()
-
-		c, err := smtp.NewClient(conn, s.smtpConfig.Host)
-		if err != nil {
-			return fmt.Errorf("failed to create SMTP client: %w", err)
-		}
-		defer c.Quit()
-
-		if err = c.Auth(auth); err != nil {
-			return fmt.Errorf("failed to authenticate: %w", err)
-		}
-
-		if err = c.Mail(from); err != nil {
-			return fmt.Errorf("failed to set sender: %w", err)
-		}
-
-		for _, addr := range to {
-			if err = c.Rcpt(addr); err != nil {
-				return fmt.Errorf("failed to add recipient: %w", err)
-			}
-		}
-
-		w, err := c.Data()
-		if err != nil {
-			return fmt.Errorf("failed to open data writer: %w", err)
-		}
-
-		_, err = w.Write(msg)
-		if err != nil {
-			return fmt.Errorf("failed to write message: %w", err)
-		}
-
-		err = w.Close()
-		if err != nil {
-			return fmt.Errorf("failed to close data writer: %w", err)
-		}
-
-		return nil
+	if err := templates.issuerError.ExecuteTemplate(&body, "content", data); err != nil {
+		return "", fmt.Errorf("failed to execute email template: %w", err)
 	}
+	return body.String(), nil
+}
 
-	return smtp.SendMail(addr, auth, from, to, msg)
+// credentialOfferQR renders the QR code of the credential offer link as a PNG image
+func credentialOfferQR(offerURI string) ([]byte, error) {
+	return qrcode.PNG(offerURI, credentialOfferQRScale)
 }
@@ -1,198 +1,556 @@
 package mail
 
 import (
-	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
+	"io/fs"
+	"math/big"
 	"net"
-	"net/textproto"
 	"os"
-	"path/filepath"
-	"runtime"
+	"slices"
 	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/hesusruiz/onboardng/internal/configuration"
 	"github.com/hesusruiz/onboardng/internal/db"
+	"github.com/hesusruiz/onboardng/internal/mail/mailtest"
 )
 
-// mockSMTPServer is a very simple SMTP server for testing
-type mockSMTPServer struct {
-	addr     string
-	listener net.Listener
-	quit     chan struct{}
-	received chan string
+// emailTemplatesDir holds the real email templates, relative to this package
+const emailTemplatesDir = "../../src/email"
+
+// testTemplates is a minimal set of email templates for the tests not concerned with the real content
+var testTemplates = fstest.MapFS{
+	"email_welcome.html": &fstest.MapFile{
+		Data: []byte(`{{define "content"}}Hello, {{.FirstName}}! {{.CompanyName}} {{.RegistrationID}} ({{.Language}}){{end}}`),
+	},
+	"email_welcome.fr.html": &fstest.MapFile{
+		Data: []byte(`{{define "content"}}Bonjour, {{.FirstName}} ! ({{.Language}}){{end}}`),
+	},
+	"issuer_error.html": &fstest.MapFile{
+		Data: []byte(`{{define "content"}}Error for {{.RegistrationID}}: {{.ErrorMsg}}{{end}}`),
+	},
+	"daily_digest.html": &fstest.MapFile{
+		Data: []byte(`{{define "content"}}{{.Day}}: {{.Counts.Total}} registrations{{range .Registrations}}, {{.CompanyName}}{{end}}{{end}}`),
+	},
+	"verification_code.html": &fstest.MapFile{
+		Data: []byte(`{{define "content"}}Your code is {{.Code}}{{end}}`),
+	},
 }
 
-func newMockSMTPServer(addr string) (*mockSMTPServer, error) {
-	l, err := net.Listen("tcp", addr)
+// newTestMailService starts a mock SMTP server and returns a mail service sending to it,
+// using the email templates in the given filesystem
+func newTestMailService(t *testing.T, templates fs.FS) (*Service, *mailtest.SMTPServer) {
+	t.Helper()
+
+	mockServer := mailtest.StartSMTPServer(t)
+
+	mailCfg := configuration.MailConfig{
+		OnboardTeamEmail: []string{"onboarding@example.com"},
+		IssuerTeamEmail:  []string{"issuer@example.com"},
+		SMTP:             mockServer.Config(t),
+	}
+
+	// Initialize Mail Service
+	mailService, err := NewMailService(configuration.Development, mailCfg, templates)
 	if err != nil {
-		return nil, err
+		t.Fatalf("failed to create mail service: %v", err)
 	}
-	return &mockSMTPServer{
-		addr:     l.Addr().String(),
-		listener: l,
-		quit:     make(chan struct{}),
-		received: make(chan string, 1),
-	}, nil
+
+	return mailService, mockServer
 }
 
-func (s *mockSMTPServer) start() {
-	go func() {
-		for {
-			conn, err := s.listener.Accept()
-			if err != nil {
-				select {
-				case <-s.quit:
-					return
-				default:
-					continue
-				}
+// receiveEmail waits for the mock SMTP server to receive a message
+func receiveEmail(t *testing.T, mockServer *mailtest.SMTPServer) string {
+	t.Helper()
+	select {
+	case msg := <-mockServer.Received:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for email")
+	}
+	return ""
+}
+
+// receiveRecipients waits for the mock SMTP server to receive the recipients of a message
+func receiveRecipients(t *testing.T, mockServer *mailtest.SMTPServer) []string {
+	t.Helper()
+	select {
+	case rcpts := <-mockServer.Recipients:
+		return rcpts
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for recipients")
+	}
+	return nil
+}
+
+func TestSendWelcomeEmail(t *testing.T) {
+	mailService, mockServer := newTestMailService(t, testTemplates)
+
+	// Mock registration data
+	reg := &db.Registration{
+		FirstName:      "John",
+		CompanyName:    "Acme Corp",
+		RegistrationID: "20260222-12345678",
+		Email:          "recipient@example.com",
+	}
+
+	// Send email
+	err := mailService.SendWelcomeEmail(reg, "")
+	if err != nil {
+		t.Fatalf("SendWelcomeEmail failed: %v", err)
+	}
+
+	// Verify received email
+	msg := receiveEmail(t, mockServer)
+	if !strings.Contains(msg, "Hello, John") {
+		t.Errorf("expected email to contain 'Hello, John', got: %s", msg)
+	}
+	if !strings.Contains(msg, "Acme Corp") {
+		t.Errorf("expected email to contain 'Acme Corp', got: %s", msg)
+	}
+	if !strings.Contains(msg, "20260222-12345678") {
+		t.Errorf("expected email to contain registration ID, got: %s", msg)
+	}
+}
+
+func TestSendWelcomeEmailLocalized(t *testing.T) {
+	tests := []struct {
+		name        string
+		country     string
+		language    string
+		wantText    string
+		wantSubject string
+	}{
+		{
+			name:        "french country renders the french template",
+			country:     "FR",
+			wantText:    "Bonjour, Jean",
+			wantSubject: welcomeSubjects["fr"],
+		},
+		{
+			name:        "explicit language overrides the country",
+			country:     "FR",
+			language:    "es",
+			wantText:    "Hola, Jean",
+			wantSubject: welcomeSubjects["es"],
+		},
+		{
+			name:        "country without localization falls back to english",
+			country:     "SE",
+			wantText:    "Hello, Jean",
+			wantSubject: welcomeSubjects["en"],
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mailService, mockServer := newTestMailService(t, os.DirFS(emailTemplatesDir))
+
+			reg := &db.Registration{
+				FirstName:      "Jean",
+				CompanyName:    "Acme SARL",
+				RegistrationID: "20260222-12345678",
+				Email:          "recipient@example.com",
+				Country:        tt.country,
+				Language:       tt.language,
+			}
+
+			if err := mailService.SendWelcomeEmail(reg, ""); err != nil {
+				t.Fatalf("SendWelcomeEmail failed: %v", err)
 			}
-			go s.handle(conn)
+
+			msg := receiveEmail(t, mockServer)
+			if !strings.Contains(msg, tt.wantText) {
+				t.Errorf("expected email to contain %q, got: %s", tt.wantText, msg)
+			}
+			if !strings.Contains(msg, "Subject: "+tt.wantSubject) {
+				t.Errorf("expected subject %q, got: %s", tt.wantSubject, msg)
+			}
+		})
+	}
+}
+
+func TestNewMailServiceTemplates(t *testing.T) {
+	mailCfg := configuration.MailConfig{}
+
+	t.Run("missing welcome template fails at construction", func(t *testing.T) {
+		templates := fstest.MapFS{"issuer_error.html": testTemplates["issuer_error.html"]}
+		if _, err := NewMailService(configuration.Development, mailCfg, templates); err == nil {
+			t.Fatalf("expected an error for a missing welcome template")
+		}
+	})
+
+	t.Run("localized templates fall back to english", func(t *testing.T) {
+		mailService, err := NewMailService(configuration.Development, mailCfg, testTemplates)
+		if err != nil {
+			t.Fatalf("failed to create mail service: %v", err)
 		}
-	}()
+		if mailService.templates.welcomeFor("fr") == mailService.templates.welcomeFor("en") {
+			t.Errorf("expected a dedicated french template")
+		}
+		if mailService.templates.welcomeFor("de") != mailService.templates.welcomeFor("en") {
+			t.Errorf("expected the german template to fall back to english")
+		}
+	})
+
+	t.Run("real templates parse", func(t *testing.T) {
+		if _, err := NewMailService(configuration.Development, mailCfg, os.DirFS(emailTemplatesDir)); err != nil {
+			t.Fatalf("failed to parse the email templates: %v", err)
+		}
+	})
 }
 
-func (s *mockSMTPServer) stop() {
-	close(s.quit)
-	if s.listener != nil {
-		s.listener.Close()
+func TestReloadTemplates(t *testing.T) {
+	templates := fstest.MapFS{}
+	for name, file := range testTemplates {
+		templates[name] = &fstest.MapFile{Data: file.Data}
+	}
+	mailService, mockServer := newTestMailService(t, templates)
+	reg := &db.Registration{FirstName: "John", Email: "recipient@example.com"}
+
+	templates["email_welcome.html"] = &fstest.MapFile{Data: []byte(`{{define "content"}}Welcome aboard, {{.FirstName}}!{{end}}`)}
+	if err := mailService.ReloadTemplates(); err != nil {
+		t.Fatalf("ReloadTemplates failed: %v", err)
+	}
+	if err := mailService.SendWelcomeEmail(reg, ""); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveEmail(t, mockServer); !strings.Contains(msg, "Welcome aboard, John!") {
+		t.Errorf("expected the reloaded template to be sent, got: %s", msg)
+	}
+
+	// A broken template keeps the previous ones
+	templates["email_welcome.html"] = &fstest.MapFile{Data: []byte(`{{define "content"}}{{if}}{{end}}`)}
+	if err := mailService.ReloadTemplates(); err == nil {
+		t.Fatalf("expected an error for the broken template")
+	}
+	if err := mailService.SendWelcomeEmail(reg, ""); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveEmail(t, mockServer); !strings.Contains(msg, "Welcome aboard, John!") {
+		t.Errorf("expected the previous template to be sent, got: %s", msg)
 	}
 }
 
-func (s *mockSMTPServer) handle(conn net.Conn) {
-	defer conn.Close()
-	reader := bufio.NewReader(conn)
-	tp := textproto.NewReader(reader)
+func TestSendIssuerErrorIncludesRequestID(t *testing.T) {
+	mailService, mockServer := newTestMailService(t, os.DirFS(emailTemplatesDir))
 
-	conn.Write([]byte("220 Welcome to Mock SMTP\r\n"))
+	reg := &db.Registration{
+		FirstName:      "John",
+		CompanyName:    "Acme Corp",
+		RegistrationID: "20260222-12345678",
+	}
+	if err := mailService.SendIssuerError(reg, `{"mandator": {}}`, "issuer unavailable", "4f3c2a1b0e9d8c7b6a5f4e3d"); err != nil {
+		t.Fatalf("SendIssuerError failed: %v", err)
+	}
 
-	for {
-		line, err := tp.ReadLine()
-		if err != nil {
-			return
+	msg := receiveEmail(t, mockServer)
+	for _, want := range []string{"20260222-12345678", "4f3c2a1b0e9d8c7b6a5f4e3d", "issuer@example.com"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("expected the email to contain %q, got: %s", want, msg)
 		}
+	}
+}
+
+func TestSendVerificationCode(t *testing.T) {
+	mailService, mockServer := newTestMailService(t, os.DirFS(emailTemplatesDir))
 
-		fields := strings.Fields(line)
-		if len(fields) == 0 {
-			continue
+	if err := mailService.SendVerificationCode("john@example.com", "482913"); err != nil {
+		t.Fatalf("SendVerificationCode failed: %v", err)
+	}
+
+	// Only the user receives the code
+	if rcpts := receiveRecipients(t, mockServer); !slices.Equal(rcpts, []string{"john@example.com"}) {
+		t.Errorf("expected the code to be sent only to the user, got %v", rcpts)
+	}
+	msg := receiveEmail(t, mockServer)
+	for _, want := range []string{"Subject: " + verificationCodeSubject, "482913"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("expected the email to contain %q, got: %s", want, msg)
 		}
-		cmd := strings.ToUpper(fields[0])
-		switch cmd {
-		case "HELO", "EHLO":
-			conn.Write([]byte("250-Hello\r\n250-AUTH PLAIN\r\n250 OK\r\n"))
-		case "AUTH":
-			conn.Write([]byte("235 Authentication succeeded\r\n"))
-		case "MAIL":
-			conn.Write([]byte("250 OK\r\n"))
-		case "RCPT":
-			conn.Write([]byte("250 OK\r\n"))
-		case "DATA":
-			conn.Write([]byte("354 Start mail input; end with <CRLF>.<CRLF>\r\n"))
-			var message strings.Builder
-			for {
-				line, err := tp.ReadLine()
-				if err != nil || line == "." {
-					break
+	}
+}
+
+func TestSendWelcomeEmailWithCredentialOffer(t *testing.T) {
+	const offerURI = "openid-credential-offer://?credential_offer_uri=https%3A%2F%2Fissuer.example.com%2Foffer%2F1"
+
+	tests := []struct {
+		name     string
+		offerURI string
+		want     []string
+		notWant  []string
+	}{
+		{
+			name:     "offer link and QR code",
+			offerURI: offerURI,
+			want: []string{
+				"Content-Type: multipart/related",
+				`href="` + offerURI + `"`,
+				`src="cid:` + credentialOfferQRContentID + `"`,
+				"Content-ID: <" + credentialOfferQRContentID + ">",
+				"Content-Type: image/png",
+			},
+		},
+		{
+			name:    "no offer",
+			want:    []string{"Content-Type: text/html"},
+			notWant: []string{"multipart/related", "openid-credential-offer", "cid:"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mailService, mockServer := newTestMailService(t, os.DirFS(emailTemplatesDir))
+
+			reg := &db.Registration{
+				FirstName:      "John",
+				CompanyName:    "Acme Corp",
+				RegistrationID: "20260222-12345678",
+				Email:          "recipient@example.com",
+			}
+			if err := mailService.SendWelcomeEmail(reg, tt.offerURI); err != nil {
+				t.Fatalf("SendWelcomeEmail failed: %v", err)
+			}
+
+			msg := receiveEmail(t, mockServer)
+			for _, want := range tt.want {
+				if !strings.Contains(msg, want) {
+					t.Errorf("expected the email to contain %q, got: %s", want, msg)
 				}
-				message.WriteString(line + "\n")
-			}
-			s.received <- message.String()
-			conn.Write([]byte("250 OK\r\n"))
-		case "QUIT":
-			conn.Write([]byte("221 Bye\r\n"))
-			return
-		default:
-			conn.Write([]byte("500 Unknown command\r\n"))
-		}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(msg, notWant) {
+					t.Errorf("expected the email not to contain %q, got: %s", notWant, msg)
+				}
+			}
+		})
 	}
 }
 
-func TestSendWelcomeEmail(t *testing.T) {
-	// Change to project root to find templates
-	_, filename, _, _ := runtime.Caller(0)
-	dir := filepath.Join(filepath.Dir(filename), "../..")
-	err := os.Chdir(dir)
+// newTestTLSConfigs returns the TLS configuration of a server with a self-signed certificate for 127.0.0.1,
+// and the one of a client trusting it
+func newTestTLSConfigs(t *testing.T) (server *tls.Config, client *tls.Config) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		t.Fatalf("failed to change directory to root: %v", err)
+		t.Fatal(err)
 	}
-
-	// Start mock SMTP server
-	mockServer, err := newMockSMTPServer("127.0.0.1:0")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mock smtp"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
 	if err != nil {
-		t.Fatalf("failed to start mock SMTP server: %v", err)
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
 	}
-	mockServer.start()
-	defer mockServer.stop()
 
-	// Get server host and port
-	host, portStr, _ := net.SplitHostPort(mockServer.addr)
-	var port int
-	fmt.Sscanf(portStr, "%d", &port)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	return server, client
+}
+
+func TestSMTPTransportAuditBCC(t *testing.T) {
+	serverTLS, clientTLS := newTestTLSConfigs(t)
+
+	tests := []struct {
+		name        string
+		implicitTLS bool
+	}{
+		{name: "plaintext"},
+		{name: "implicit TLS", implicitTLS: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var listenTLS *tls.Config
+			if tt.implicitTLS {
+				listenTLS = serverTLS
+			}
+			mockServer, err := mailtest.NewSMTPServer("127.0.0.1:0", listenTLS)
+			if err != nil {
+				t.Fatalf("failed to start mock SMTP server: %v", err)
+			}
+			mockServer.Start()
+			t.Cleanup(mockServer.Stop)
+
+			host, portStr, _ := net.SplitHostPort(mockServer.Addr)
+			var port int
+			fmt.Sscanf(portStr, "%d", &port)
+
+			transport := &smtpTransport{
+				config:      configuration.SMTPConfig{Host: host, Port: port, Username: "test@example.com"},
+				password:    "testpassword",
+				bcc:         []string{"audit@example.com", "recipient@example.com"},
+				implicitTLS: tt.implicitTLS,
+				tlsConfig:   clientTLS,
+			}
+
+			err = transport.Send("test@example.com", []string{"recipient@example.com", "cc@example.com"}, "Welcome", nil, "<p>Hello</p>", "")
+			if err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+
+			// The audit address is a recipient, once, but it is not in the message
+			rcpts := receiveRecipients(t, mockServer)
+			want := []string{"recipient@example.com", "cc@example.com", "audit@example.com"}
+			if !slices.Equal(rcpts, want) {
+				t.Errorf("expected recipients %v, got %v", want, rcpts)
+			}
+			msg := receiveEmail(t, mockServer)
+			if strings.Contains(msg, "audit@example.com") || strings.Contains(strings.ToLower(msg), "bcc:") {
+				t.Errorf("expected the audit address to be hidden, got: %s", msg)
+			}
+			if !strings.Contains(msg, "To: recipient@example.com, cc@example.com") {
+				t.Errorf("expected the visible recipients in the message, got: %s", msg)
+			}
+		})
+	}
+}
 
-	// Create temporary password file
-	tmpFile, err := os.CreateTemp("", "smtppassword")
+func TestSMTPTransportInsecureSkipVerify(t *testing.T) {
+	serverTLS, _ := newTestTLSConfigs(t)
+	mockServer, err := mailtest.NewSMTPServer("127.0.0.1:0", serverTLS)
 	if err != nil {
-		t.Fatalf("failed to create temp file: %v", err)
+		t.Fatalf("failed to start mock SMTP server: %v", err)
 	}
-	defer os.Remove(tmpFile.Name())
-	tmpFile.WriteString("testpassword")
-	tmpFile.Close()
+	mockServer.Start()
+	t.Cleanup(mockServer.Stop)
 
-	// SMTP config
-	cfg := configuration.SMTPConfig{
-		Enabled:      true,
-		Host:         host,
-		Port:         port,
-		TLS:          false, // Use normal SMTP for simple test
-		Username:     "test@example.com",
-		PasswordFile: tmpFile.Name(),
+	tests := []struct {
+		runtime configuration.RuntimeEnv
+		wantErr bool
+	}{
+		{runtime: configuration.Development},
+		{runtime: configuration.Preproduction},
+		// The self-signed certificate is rejected in production, even with the flag
+		{runtime: configuration.Production, wantErr: true},
 	}
 
-	mailCfg := configuration.MailConfig{
-		SMTP: cfg,
+	for _, tt := range tests {
+		t.Run(string(tt.runtime), func(t *testing.T) {
+			cfg := mockServer.Config(t)
+			cfg.InsecureSkipVerify = true
+			transport, err := newTransport(tt.runtime, configuration.MailConfig{SMTP: cfg})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Implicit TLS is only used with the port 465
+			transport.(*smtpTransport).implicitTLS = true
+
+			err = transport.Send("test@example.com", []string{"recipient@example.com"}, "Welcome", nil, "<p>Hello</p>", "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if !tt.wantErr {
+				receiveEmail(t, mockServer)
+			}
+		})
 	}
+}
 
-	// Initialize Mail Service
-	mailService, err := NewMailService(configuration.Development, mailCfg)
+func TestDisabledMailService(t *testing.T) {
+	// SMTP is disabled, and the team lists are not read
+	cfg := configuration.MailConfig{SMTP: configuration.SMTPConfig{Enabled: false}}
+	disabled, err := NewMailService(configuration.Development, cfg, os.DirFS(emailTemplatesDir))
 	if err != nil {
 		t.Fatalf("failed to create mail service: %v", err)
 	}
 
-	// Mock registration data
-	reg := &db.Registration{
-		FirstName:      "John",
-		CompanyName:    "Acme Corp",
-		RegistrationID: "20260222-12345678",
-		Email:          "recipient@example.com",
+	reg := &db.Registration{RegistrationID: "20260222-12345678", Email: "john@example.com", FirstName: "John"}
+	for name, service := range map[string]*Service{"disabled": disabled, "nil": nil} {
+		if err := service.SendWelcomeEmail(reg, ""); err != nil {
+			t.Errorf("%s: expected SendWelcomeEmail to do nothing, got %v", name, err)
+		}
+		if err := service.SendIssuerError(reg, "{}", "issuer unavailable", ""); err != nil {
+			t.Errorf("%s: expected SendIssuerError to do nothing, got %v", name, err)
+		}
+		if err := service.SendVerificationCode(reg.Email, "123456"); err != nil {
+			t.Errorf("%s: expected SendVerificationCode to do nothing, got %v", name, err)
+		}
 	}
+}
 
-	// Ensure template directory exists for test
-	templatePath := "src/email/email_welcome.html"
-	if _, err := os.Stat(templatePath); os.IsNotExist(err) {
-		t.Skip("skipping test because template file does not exist")
-	}
+func TestMailServiceWithEmptyTeamLists(t *testing.T) {
+	mailService, mockServer := newTestMailService(t, os.DirFS(emailTemplatesDir))
+	mailService.onboardTeamEmail = nil
+	mailService.issuerTeamEmail = nil
 
-	// Send email
-	err = mailService.SendWelcomeEmail(reg)
-	if err != nil {
-		t.Fatalf("SendWelcomeEmail failed: %v", err)
+	reg := &db.Registration{RegistrationID: "20260222-12345678", Email: "john@example.com", FirstName: "John"}
+	if err := mailService.SendWelcomeEmail(reg, ""); !errors.Is(err, ErrNoRecipients) {
+		t.Errorf("expected ErrNoRecipients from SendWelcomeEmail, got %v", err)
+	}
+	if err := mailService.SendIssuerError(reg, "{}", "issuer unavailable", ""); !errors.Is(err, ErrNoRecipients) {
+		t.Errorf("expected ErrNoRecipients from SendIssuerError, got %v", err)
 	}
 
-	// Verify received email
 	select {
-	case msg := <-mockServer.received:
-		if !strings.Contains(msg, "Welcome, John!") {
-			t.Errorf("expected email to contain 'Welcome, John!', got: %s", msg)
-		}
-		if !strings.Contains(msg, "Acme Corp") {
-			t.Errorf("expected email to contain 'Acme Corp', got: %s", msg)
+	case msg := <-mockServer.Received:
+		t.Errorf("expected no email to be sent, got: %s", msg)
+	default:
+	}
+}
+
+func TestPooledSMTPTransport(t *testing.T) {
+	mockServer := mailtest.StartSMTPServer(t)
+	cfg := mockServer.Config(t)
+	cfg.Pool = true
+	transport := &smtpTransport{config: cfg, password: "testpassword"}
+	defer transport.Close()
+
+	send := func(subject string) {
+		t.Helper()
+		if err := transport.Send("test@example.com", []string{"recipient@example.com"}, subject, nil, "<p>Hello</p>", ""); err != nil {
+			t.Fatalf("Send failed: %v", err)
 		}
-		if !strings.Contains(msg, "20260222-12345678") {
-			t.Errorf("expected email to contain registration ID, got: %s", msg)
+		if msg := receiveEmail(t, mockServer); !strings.Contains(msg, "Subject: "+subject) {
+			t.Errorf("expected the email %q, got: %s", subject, msg)
 		}
-	case <-time.After(2 * time.Second):
-		t.Errorf("timeout waiting for email")
+	}
+
+	// Several emails are sent over a single connection
+	for i := range 3 {
+		send(fmt.Sprintf("Email %d", i+1))
+	}
+	if got := mockServer.Connections(); got != 1 {
+		t.Fatalf("expected a single connection, got %d", got)
+	}
+
+	// A connection that is no longer usable is replaced
+	transport.client.Close()
+	send("After a broken connection")
+	if got := mockServer.Connections(); got != 2 {
+		t.Errorf("expected a new connection after the broken one, got %d connections", got)
+	}
+
+	// A connection idle for too long is replaced, as the server may have closed it
+	transport.lastUsed = time.Now().Add(-2 * defaultSMTPPoolIdleTimeout)
+	send("After a long idle time")
+	if got := mockServer.Connections(); got != 3 {
+		t.Errorf("expected a new connection after the idle time, got %d connections", got)
+	}
+
+	if err := transport.Close(); err != nil || transport.client != nil {
+		t.Errorf("expected the connection to be closed, got %v", err)
 	}
 }
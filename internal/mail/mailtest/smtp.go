@@ -0,0 +1,189 @@
+// Package mailtest provides a mock SMTP server to test the emails sent, in the mail package and in its users
+package mailtest
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+// receiveTimeout is how long Receive waits for an email before failing the test
+const receiveTimeout = 2 * time.Second
+
+// SMTPServer is a very simple SMTP server for testing, accepting any credentials
+type SMTPServer struct {
+	Addr     string
+	listener net.Listener
+	quit     chan struct{}
+	// Received receives the content of each message
+	Received chan string
+	// Recipients receives the RCPT addresses of each message, sent before the message itself
+	Recipients chan []string
+	// connections counts the connections accepted
+	connections atomic.Int32
+}
+
+// NewSMTPServer starts listening in the given address, with implicit TLS if tlsConfig is not nil
+func NewSMTPServer(addr string, tlsConfig *tls.Config) (*SMTPServer, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	return &SMTPServer{
+		Addr:       l.Addr().String(),
+		listener:   l,
+		quit:       make(chan struct{}),
+		Received:   make(chan string, 16),
+		Recipients: make(chan []string, 16),
+	}, nil
+}
+
+// StartSMTPServer starts a server in a random local port, stopped at the end of the test
+func StartSMTPServer(t testing.TB) *SMTPServer {
+	t.Helper()
+	s, err := NewSMTPServer("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("failed to start mock SMTP server: %v", err)
+	}
+	s.Start()
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// Config returns the configuration to send the emails to the server, without TLS
+func (s *SMTPServer) Config(t testing.TB) configuration.SMTPConfig {
+	t.Helper()
+	host, portStr, _ := net.SplitHostPort(s.Addr)
+	port, _ := strconv.Atoi(portStr)
+
+	passwordFile := filepath.Join(t.TempDir(), "smtppassword")
+	if err := os.WriteFile(passwordFile, []byte("testpassword"), 0600); err != nil {
+		t.Fatalf("failed to create password file: %v", err)
+	}
+
+	return configuration.SMTPConfig{
+		Enabled:      true,
+		Host:         host,
+		Port:         port,
+		Username:     "test@example.com",
+		PasswordFile: passwordFile,
+	}
+}
+
+// Receive waits for the next email, returning its recipients and its content
+func (s *SMTPServer) Receive(t testing.TB) (recipients []string, message string) {
+	t.Helper()
+	select {
+	case recipients = <-s.Recipients:
+	case <-time.After(receiveTimeout):
+		t.Fatal("timeout waiting for email")
+	}
+	select {
+	case message = <-s.Received:
+	case <-time.After(receiveTimeout):
+		t.Fatal("timeout waiting for email")
+	}
+	return recipients, message
+}
+
+// Connections returns the number of connections accepted by the server
+func (s *SMTPServer) Connections() int {
+	return int(s.connections.Load())
+}
+
+// Start accepts connections in the background, until the server is stopped
+func (s *SMTPServer) Start() {
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				select {
+				case <-s.quit:
+					return
+				default:
+					continue
+				}
+			}
+			s.connections.Add(1)
+			go s.handle(conn)
+		}
+	}()
+}
+
+// Stop closes the listener of the server
+func (s *SMTPServer) Stop() {
+	close(s.quit)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+func (s *SMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	tp := textproto.NewReader(reader)
+
+	conn.Write([]byte("220 Welcome to Mock SMTP\r\n"))
+
+	var rcpts []string
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		cmd := strings.ToUpper(fields[0])
+		switch cmd {
+		case "HELO", "EHLO":
+			conn.Write([]byte("250-Hello\r\n250-AUTH PLAIN\r\n250 OK\r\n"))
+		case "AUTH":
+			conn.Write([]byte("235 Authentication succeeded\r\n"))
+		case "MAIL", "NOOP":
+			conn.Write([]byte("250 OK\r\n"))
+		case "RSET":
+			rcpts = nil
+			conn.Write([]byte("250 OK\r\n"))
+		case "RCPT":
+			if _, addr, ok := strings.Cut(line, "<"); ok {
+				rcpts = append(rcpts, strings.TrimSuffix(addr, ">"))
+			}
+			conn.Write([]byte("250 OK\r\n"))
+		case "DATA":
+			conn.Write([]byte("354 Start mail input; end with <CRLF>.<CRLF>\r\n"))
+			var message strings.Builder
+			for {
+				line, err := tp.ReadLine()
+				if err != nil || line == "." {
+					break
+				}
+				message.WriteString(line + "\n")
+			}
+			s.Recipients <- rcpts
+			rcpts = nil
+			s.Received <- message.String()
+			conn.Write([]byte("250 OK\r\n"))
+		case "QUIT":
+			conn.Write([]byte("221 Bye\r\n"))
+			return
+		default:
+			conn.Write([]byte("500 Unknown command\r\n"))
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package mail
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hesusruiz/onboardng/common"
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+// The emails that can be previewed
+const (
+	PreviewWelcome      = "welcome"
+	PreviewIssuerError  = "issuer-error"
+	PreviewDailyDigest  = "daily-digest"
+	PreviewVerification = "verification-code"
+)
+
+var (
+	// ErrUnknownTemplate is returned when previewing an email that does not exist
+	ErrUnknownTemplate = errors.New("unknown email template")
+	// ErrNoMailService is returned when previewing without a mail service
+	ErrNoMailService = errors.New("the mail service is not configured")
+)
+
+// sampleOfferURI is the credential offer shown in the preview of the welcome email
+const sampleOfferURI = "openid-credential-offer://?credential_offer_uri=https%3A%2F%2Fissuer.dome-marketplace.eu%2Foffers%2Fsample"
+
+// sampleRegistration returns the registration rendered in the previews, in the given language
+func sampleRegistration(lang string) *db.Registration {
+	return &db.Registration{
+		RegistrationID: "20260101-12345678",
+		Email:          "jane.doe@example.com",
+		FirstName:      "Jane",
+		LastName:       "Doe",
+		CompanyName:    "ACME Corporation",
+		Country:        "ES",
+		VatID:          "ESB12345678",
+		Language:       lang,
+	}
+}
+
+// Preview renders an email with sample data as it would be sent, for designers to check the templates.
+// The templates are parsed again, so their changes are shown without restarting the server.
+// The inline images are embedded as data URLs, so the browser shows them.
+func (s *Service) Preview(name string, lang string) (string, error) {
+	if s == nil || s.templatesFS == nil {
+		return "", ErrNoMailService
+	}
+
+	templates, err := parseTemplates(s.templatesFS)
+	if err != nil {
+		return "", err
+	}
+
+	if !common.IsSupportedLanguage(lang) {
+		lang = common.DefaultLanguage
+	}
+	reg := sampleRegistration(lang)
+
+	switch name {
+	case PreviewWelcome:
+		onboardTeamEmail := "onboarding@dome-marketplace.eu"
+		if len(s.onboardTeamEmail) > 0 {
+			onboardTeamEmail = s.onboardTeamEmail[0]
+		}
+		body, images, err := s.renderWelcome(templates, reg, sampleOfferURI, onboardTeamEmail)
+		if err != nil {
+			return "", err
+		}
+		for _, img := range images {
+			dataURL := "data:" + img.ContentType + ";base64," + base64.StdEncoding.EncodeToString(img.Data)
+			body = strings.ReplaceAll(body, "cid:"+img.ContentID, dataURL)
+		}
+		return body, nil
+
+	case PreviewIssuerError:
+		payload := `{"mandatee": {"email": "` + reg.Email + `"}}`
+		return s.renderIssuerError(templates, reg, payload, "error calling LEAR Issuance Endpoint: 503 Service Unavailable", "sample-request-id")
+
+	case PreviewDailyDigest:
+		reg.Status = db.StatusIssued
+		counts := db.RegistrationCounts{Total: 1, Issued: 1}
+		return s.renderDailyDigest(templates, time.Now().AddDate(0, 0, -1), counts, []db.Registration{*reg})
+
+	case PreviewVerification:
+		return s.renderVerificationCode(templates, "123456")
+
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnknownTemplate, name)
+	}
+}
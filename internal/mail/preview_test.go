@@ -0,0 +1,78 @@
+package mail
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func TestPreview(t *testing.T) {
+	// Previews do not need to send emails
+	s, err := NewMailService(configuration.Development, configuration.MailConfig{}, os.DirFS(emailTemplatesDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		template string
+		lang     string
+		want     []string
+	}{
+		{template: PreviewWelcome, lang: "en", want: []string{"Jane", "ACME Corporation", "data:image/png;base64,"}},
+		{template: PreviewWelcome, lang: "fr", want: []string{"Jane", "Environnement de test"}},
+		{template: PreviewWelcome, lang: "xx", want: []string{"Jane", "Test Environment"}},
+		{template: PreviewIssuerError, lang: "en", want: []string{"20260101-12345678", "sample-request-id"}},
+		{template: PreviewDailyDigest, lang: "en", want: []string{"Daily Onboarding Summary", "ACME Corporation"}},
+		{template: PreviewVerification, lang: "en", want: []string{"Verify your email", "123456"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template+"/"+tt.lang, func(t *testing.T) {
+			body, err := s.Preview(tt.template, tt.lang)
+			if err != nil {
+				t.Fatalf("Preview failed: %v", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("expected the preview to contain %q", want)
+				}
+			}
+			if strings.Contains(body, "cid:") {
+				t.Errorf("expected the inline images to be embedded in the preview")
+			}
+		})
+	}
+
+	if _, err := s.Preview("invoice", "en"); !errors.Is(err, ErrUnknownTemplate) {
+		t.Errorf("expected ErrUnknownTemplate, got %v", err)
+	}
+
+	var disabled *Service
+	if _, err := disabled.Preview(PreviewWelcome, "en"); !errors.Is(err, ErrNoMailService) {
+		t.Errorf("expected ErrNoMailService, got %v", err)
+	}
+}
+
+func TestPreviewShowsTemplateChanges(t *testing.T) {
+	templates := fstest.MapFS{}
+	for name, file := range testTemplates {
+		templates[name] = &fstest.MapFile{Data: file.Data}
+	}
+	s, err := NewMailService(configuration.Development, configuration.MailConfig{}, templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	templates["email_welcome.html"] = &fstest.MapFile{Data: []byte(`{{define "content"}}Welcome aboard, {{.FirstName}}!{{end}}`)}
+	body, err := s.Preview(PreviewWelcome, "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "Welcome aboard, Jane!" {
+		t.Errorf("expected the changed template to be rendered, got %q", body)
+	}
+}
@@ -0,0 +1,209 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+// defaultSendGridEndpoint is the SendGrid v3 API to send emails
+const defaultSendGridEndpoint = "https://api.sendgrid.com/v3/mail/send"
+
+// sendGridTimeout bounds each call to the API, so a slow provider does not hold the registration
+const sendGridTimeout = 30 * time.Second
+
+// sendGridTransport sends the emails with the SendGrid Web API.
+// Deliveries, bounces and spam reports can then be tracked in SendGrid.
+type sendGridTransport struct {
+	endpoint   string
+	apiKey     string
+	bcc        []string
+	httpClient *http.Client
+}
+
+func newSendGridTransport(endpoint string, apiKey string, bcc []string) *sendGridTransport {
+	if endpoint == "" {
+		endpoint = defaultSendGridEndpoint
+	}
+	return &sendGridTransport{
+		endpoint:   endpoint,
+		apiKey:     apiKey,
+		bcc:        bcc,
+		httpClient: &http.Client{Timeout: sendGridTimeout},
+	}
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridAttachment struct {
+	Content     string `json:"content"`
+	Type        string `json:"type"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition"`
+	ContentID   string `json:"content_id"`
+}
+
+type sendGridPersonalization struct {
+	To  []sendGridAddress `json:"to"`
+	BCC []sendGridAddress `json:"bcc,omitempty"`
+}
+
+type sendGridMessage struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Attachments      []sendGridAttachment      `json:"attachments,omitempty"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+}
+
+func (t *sendGridTransport) Send(from string, to []string, subject string, headers map[string]string, html string, text string, images ...InlineImage) error {
+	msg := sendGridMessage{
+		From:    sendGridAddress{Email: from},
+		Subject: subject,
+		Headers: headers,
+	}
+
+	// SendGrid rejects an address repeated in the recipients and the hidden copies
+	var personalization sendGridPersonalization
+	for _, addr := range to {
+		personalization.To = append(personalization.To, sendGridAddress{Email: addr})
+	}
+	for _, addr := range auditRecipients(to, t.bcc) {
+		personalization.BCC = append(personalization.BCC, sendGridAddress{Email: addr})
+	}
+	msg.Personalizations = []sendGridPersonalization{personalization}
+
+	// SendGrid requires the plain text before the HTML
+	if text != "" {
+		msg.Content = append(msg.Content, sendGridContent{Type: "text/plain", Value: text})
+	}
+	msg.Content = append(msg.Content, sendGridContent{Type: "text/html", Value: html})
+
+	for _, img := range images {
+		msg.Attachments = append(msg.Attachments, sendGridAttachment{
+			Content:     base64.StdEncoding.EncodeToString(img.Data),
+			Type:        img.ContentType,
+			Filename:    img.Filename,
+			Disposition: "inline",
+			ContentID:   img.ContentID,
+		})
+	}
+
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to build SendGrid request: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(buf))
+	if err != nil {
+		return fmt.Errorf("failed to build SendGrid request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+t.apiKey)
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call SendGrid: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// The body explains why the email was rejected
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("SendGrid rejected the email: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	return nil
+}
+
+// The headers of the requests of the SendGrid Event Webhook with their signature
+const (
+	SendGridSignatureHeader = "X-Twilio-Email-Event-Webhook-Signature"
+	SendGridTimestampHeader = "X-Twilio-Email-Event-Webhook-Timestamp"
+)
+
+// sendGridEvents maps the events of the SendGrid Event Webhook to the delivery status. Other events are ignored.
+var sendGridEvents = map[string]string{
+	"delivered": db.DeliveryDelivered,
+	"deferred":  db.DeliveryDeferred,
+	"bounce":    db.DeliveryBounced,
+	"dropped":   db.DeliveryBounced,
+}
+
+// ParseSendGridWebhookKey parses the verification key of the signed Event Webhook, as shown by SendGrid (base64 DER)
+func ParseSendGridWebhookKey(encoded string) (*ecdsa.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SendGrid webhook key: %w", err)
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SendGrid webhook key: %w", err)
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid SendGrid webhook key: expected an ECDSA key, got %T", key)
+	}
+	return ecKey, nil
+}
+
+// VerifySendGridWebhook checks the signature of a request of the Event Webhook, made over the timestamp followed by the body
+func VerifySendGridWebhook(key *ecdsa.PublicKey, signature string, timestamp string, body []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || signature == "" || timestamp == "" {
+		return fmt.Errorf("missing or malformed signature")
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(timestamp))
+	hash.Write(body)
+	if !ecdsa.VerifyASN1(key, hash.Sum(nil), sig) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// ParseSendGridEvents returns the delivery events in the body of a request of the Event Webhook
+func ParseSendGridEvents(body []byte) ([]DeliveryEvent, error) {
+	var events []struct {
+		Email    string `json:"email"`
+		Event    string `json:"event"`
+		Reason   string `json:"reason"`
+		Response string `json:"response"`
+	}
+	if err := json.Unmarshal(body, &events); err != nil {
+		return nil, fmt.Errorf("invalid SendGrid events: %w", err)
+	}
+
+	var result []DeliveryEvent
+	for _, e := range events {
+		status, ok := sendGridEvents[e.Event]
+		if !ok || e.Email == "" {
+			continue
+		}
+		reason := e.Reason
+		if reason == "" {
+			reason = e.Response
+		}
+		result = append(result, DeliveryEvent{Recipient: e.Email, Status: status, Reason: reason})
+	}
+	return result, nil
+}
@@ -0,0 +1,201 @@
+package mail
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+func TestSendGridTransport(t *testing.T) {
+	var got sendGridMessage
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("invalid request body: %v", err)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	transport := newSendGridTransport(srv.URL, "sg-key", []string{"audit@example.com", "CC@example.com"})
+	img := InlineImage{ContentID: "qr@example.com", Filename: "qr.png", ContentType: "image/png", Data: []byte{0x89, 'P', 'N', 'G'}}
+	err := transport.Send("onboarding@example.com", []string{"john@example.com", "cc@example.com"}, "Welcome", nil, "<p>Hello</p>", "Hello", img)
+	if err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	if auth != "Bearer sg-key" {
+		t.Errorf("expected the API key in the Authorization header, got %q", auth)
+	}
+	if got.From.Email != "onboarding@example.com" || got.Subject != "Welcome" {
+		t.Errorf("unexpected sender or subject: %+v", got)
+	}
+	if len(got.Personalizations) != 1 || len(got.Personalizations[0].To) != 2 || got.Personalizations[0].To[1].Email != "cc@example.com" {
+		t.Errorf("unexpected recipients: %+v", got.Personalizations)
+	}
+	// The audit address already among the recipients is not repeated
+	if bcc := got.Personalizations[0].BCC; len(bcc) != 1 || bcc[0].Email != "audit@example.com" {
+		t.Errorf("expected the audit address as hidden copy, got %+v", bcc)
+	}
+	if len(got.Content) != 2 || got.Content[0].Type != "text/plain" || got.Content[1].Type != "text/html" {
+		t.Errorf("expected the plain text before the HTML, got %+v", got.Content)
+	}
+	if len(got.Attachments) != 1 || got.Attachments[0].Disposition != "inline" || got.Attachments[0].ContentID != "qr@example.com" {
+		t.Errorf("unexpected attachments: %+v", got.Attachments)
+	}
+}
+
+func TestSendGridTransportError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"errors":[{"message":"The provided authorization grant is invalid"}]}`))
+	}))
+	defer srv.Close()
+
+	err := newSendGridTransport(srv.URL, "bad-key", nil).Send("onboarding@example.com", []string{"john@example.com"}, "Welcome", nil, "<p>Hello</p>", "")
+	if err == nil || !strings.Contains(err.Error(), "authorization grant is invalid") {
+		t.Fatalf("expected the error returned by SendGrid, got %v", err)
+	}
+}
+
+func TestNewMailServiceProvider(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cfg     configuration.MailConfig
+		want    any
+		wantErr bool
+	}{
+		{name: "smtp by default", cfg: configuration.MailConfig{SMTP: configuration.SMTPConfig{Enabled: true, PasswordFile: secret}}, want: &smtpTransport{}},
+		{name: "sendgrid", cfg: configuration.MailConfig{Provider: configuration.SendGridMailProvider, SendGrid: configuration.SendGridConfig{Enabled: true, APIKeyFile: secret}}, want: &sendGridTransport{}},
+		{name: "disabled", cfg: configuration.MailConfig{Provider: configuration.SendGridMailProvider}, want: nil},
+		{name: "missing API key", cfg: configuration.MailConfig{Provider: configuration.SendGridMailProvider, SendGrid: configuration.SendGridConfig{Enabled: true, APIKeyFile: secret + ".missing"}}, wantErr: true},
+		{name: "unknown provider", cfg: configuration.MailConfig{Provider: "pigeon"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewMailService(configuration.Development, tt.cfg, testTemplates)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewMailService failed: %v", err)
+			}
+
+			switch tt.want.(type) {
+			case *smtpTransport:
+				if tr, ok := s.transport.(*smtpTransport); !ok || tr.password != "secret" {
+					t.Errorf("expected an SMTP transport with the password, got %#v", s.transport)
+				}
+			case *sendGridTransport:
+				if tr, ok := s.transport.(*sendGridTransport); !ok || tr.apiKey != "secret" || tr.endpoint != defaultSendGridEndpoint {
+					t.Errorf("expected a SendGrid transport with the API key, got %#v", s.transport)
+				}
+			default:
+				if s.transport != nil {
+					t.Errorf("expected no transport, got %#v", s.transport)
+				}
+				// Sending is a no-op when disabled
+				if err := s.SendWelcomeEmail(&db.Registration{}, ""); err != nil {
+					t.Errorf("expected no error when disabled, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestMIMEBodyWithText(t *testing.T) {
+	img := InlineImage{ContentID: "qr@example.com", Filename: "qr.png", ContentType: "image/png", Data: []byte("png")}
+	body, err := mimeBody("<p>Hello</p>", "Hello", []InlineImage{img})
+	if err != nil {
+		t.Fatalf("mimeBody failed: %v", err)
+	}
+
+	// The text is an alternative to the HTML with its images
+	wants := []string{"Content-Type: multipart/alternative", "Content-Type: text/plain", "Content-Type: multipart/related", "Content-ID: <qr@example.com>"}
+	last := -1
+	for _, want := range wants {
+		i := strings.Index(body, want)
+		if i < 0 {
+			t.Fatalf("expected the body to contain %q, got: %s", want, body)
+		}
+		if i < last {
+			t.Errorf("unexpected order of %q in: %s", want, body)
+		}
+		last = i
+	}
+}
+
+func TestSendGridWebhook(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParseSendGridWebhookKey(base64.StdEncoding.EncodeToString(der))
+	if err != nil {
+		t.Fatalf("ParseSendGridWebhookKey failed: %v", err)
+	}
+
+	body := []byte(`[
+		{"email": "john@example.com", "event": "bounce", "reason": "550 5.1.1 User unknown"},
+		{"email": "jane@example.com", "event": "delivered", "response": "250 OK"},
+		{"email": "jane@example.com", "event": "open"}
+	]`)
+	const timestamp = "1791540000"
+	hash := sha256.Sum256(append([]byte(timestamp), body...))
+	sig, err := ecdsa.SignASN1(rand.Reader, priv, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := base64.StdEncoding.EncodeToString(sig)
+
+	if err := VerifySendGridWebhook(key, signature, timestamp, body); err != nil {
+		t.Fatalf("expected a valid signature, got %v", err)
+	}
+	if err := VerifySendGridWebhook(key, signature, "1791540001", body); err == nil {
+		t.Errorf("expected an error for a different timestamp")
+	}
+	if err := VerifySendGridWebhook(key, "", timestamp, body); err == nil {
+		t.Errorf("expected an error for a missing signature")
+	}
+
+	events, err := ParseSendGridEvents(body)
+	if err != nil {
+		t.Fatalf("ParseSendGridEvents failed: %v", err)
+	}
+	want := []DeliveryEvent{
+		{Recipient: "john@example.com", Status: db.DeliveryBounced, Reason: "550 5.1.1 User unknown"},
+		{Recipient: "jane@example.com", Status: db.DeliveryDelivered, Reason: "250 OK"},
+	}
+	if len(events) != len(want) || events[0] != want[0] || events[1] != want[1] {
+		t.Errorf("expected %+v, got %+v", want, events)
+	}
+}
@@ -0,0 +1,216 @@
+package mail
+
+import (
+	"crypto/tls"
+	"fmt"
+	"maps"
+	"net/smtp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+// defaultSMTPPoolIdleTimeout is how long the pooled connection is reused after the last email,
+// when the configuration does not specify it
+const defaultSMTPPoolIdleTimeout = time.Minute
+
+// smtpTransport sends the emails with an SMTP server, using implicit TLS when the port is 465.
+// With pooling, the connection is kept open for the next email, and opened again when it fails.
+type smtpTransport struct {
+	config   configuration.SMTPConfig
+	password string
+	// bounceAddress is the envelope sender, where the servers send the bounces. The sender is used if empty.
+	bounceAddress string
+	// bcc are added as recipients of the SMTP conversation only, so they do not appear in the message
+	bcc         []string
+	implicitTLS bool
+	// insecureSkipVerify does not verify the certificate of the server, only outside production
+	insecureSkipVerify bool
+	// tlsConfig overrides the TLS configuration of implicit TLS, for tests
+	tlsConfig *tls.Config
+
+	// mu guards the pooled connection, used by a single email at a time
+	mu sync.Mutex
+	// client is the pooled connection, nil when there is none open
+	client *smtp.Client
+	// lastUsed is when the pooled connection sent its last email
+	lastUsed time.Time
+}
+
+func (t *smtpTransport) Send(from string, to []string, subject string, headers map[string]string, html string, text string, images ...InlineImage) error {
+	mime, err := mimeBody(html, text, images)
+	if err != nil {
+		return fmt.Errorf("failed to build email body: %w", err)
+	}
+	extra, err := extraHeaders(headers)
+	if err != nil {
+		return err
+	}
+	msg := []byte("From: " + from + "\n" +
+		"To: " + strings.Join(to, ", ") + "\n" +
+		"Subject: " + subject + "\n" +
+		extra +
+		mime)
+
+	envelopeFrom := from
+	if t.bounceAddress != "" {
+		envelopeFrom = t.bounceAddress
+	}
+	rcpts := append(slices.Clone(to), auditRecipients(to, t.bcc)...)
+
+	if t.config.Pool {
+		return t.sendPooled(envelopeFrom, rcpts, msg)
+	}
+
+	if t.implicitTLS {
+		c, err := t.dial()
+		if err != nil {
+			return err
+		}
+		defer c.Quit()
+		return deliver(c, envelopeFrom, rcpts, msg)
+	}
+
+	addr := fmt.Sprintf("%s:%d", t.config.Host, t.config.Port)
+	auth := smtp.PlainAuth("", t.config.Username, t.password, t.config.Host)
+	return smtp.SendMail(addr, auth, envelopeFrom, rcpts, msg)
+}
+
+// sendPooled sends the email with the pooled connection, opening it if there is none or it is no longer usable
+func (t *smtpTransport) sendPooled(envelopeFrom string, rcpts []string, msg []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	idleTimeout := t.config.PoolIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultSMTPPoolIdleTimeout
+	}
+	// The server may have closed a connection idle for long, or closed it for any other reason
+	if t.client != nil && (time.Since(t.lastUsed) > idleTimeout || t.client.Noop() != nil) {
+		t.client.Close()
+		t.client = nil
+	}
+
+	if t.client == nil {
+		c, err := t.dial()
+		if err != nil {
+			return err
+		}
+		t.client = c
+	}
+
+	if err := deliver(t.client, envelopeFrom, rcpts, msg); err != nil {
+		// The state of the conversation is unknown, so the next email opens a new connection
+		t.client.Close()
+		t.client = nil
+		return err
+	}
+	t.lastUsed = time.Now()
+	return nil
+}
+
+// Close ends the pooled connection, if there is one open
+func (t *smtpTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.client == nil {
+		return nil
+	}
+	err := t.client.Quit()
+	t.client = nil
+	return err
+}
+
+// dial connects and authenticates to the SMTP server. Without implicit TLS, it upgrades the connection with
+// STARTTLS and authenticates when the server supports them, like smtp.SendMail.
+func (t *smtpTransport) dial() (*smtp.Client, error) {
+	addr := fmt.Sprintf("%s:%d", t.config.Host, t.config.Port)
+	auth := smtp.PlainAuth("", t.config.Username, t.password, t.config.Host)
+
+	var c *smtp.Client
+	if t.implicitTLS {
+		tlsConfig := &tls.Config{
+			InsecureSkipVerify: t.insecureSkipVerify,
+			ServerName:         t.config.Host,
+		}
+		if t.tlsConfig != nil {
+			tlsConfig = t.tlsConfig
+		}
+
+		conn, err := tls.Dial("tcp", addr, tlsConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial TLS: %w", err)
+		}
+
+		c, err = smtp.NewClient(conn, t.config.Host)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to create SMTP client: %w", err)
+		}
+	} else {
+		var err error
+		c, err = smtp.Dial(addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect: %w", err)
+		}
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: t.config.Host, InsecureSkipVerify: t.insecureSkipVerify}); err != nil {
+				c.Close()
+				return nil, fmt.Errorf("failed to start TLS: %w", err)
+			}
+		}
+	}
+
+	if ok, _ := c.Extension("AUTH"); ok || t.implicitTLS {
+		if err := c.Auth(auth); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to authenticate: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// deliver sends a message with a connected client, that can send the next message afterwards
+func deliver(c *smtp.Client, envelopeFrom string, rcpts []string, msg []byte) error {
+	if err := c.Mail(envelopeFrom); err != nil {
+		return fmt.Errorf("failed to set sender: %w", err)
+	}
+
+	for _, addr := range rcpts {
+		if err := c.Rcpt(addr); err != nil {
+			return fmt.Errorf("failed to add recipient: %w", err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("failed to open data writer: %w", err)
+	}
+
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to close data writer: %w", err)
+	}
+	return nil
+}
+
+// extraHeaders formats the headers added to the message, sorted so the messages are reproducible.
+// A line break in a header would let its value inject other headers, so it is rejected.
+func extraHeaders(headers map[string]string) (string, error) {
+	var b strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(headers)) {
+		value := headers[name]
+		if strings.ContainsAny(name+value, "\r\n") {
+			return "", fmt.Errorf("invalid email header %q: line breaks are not allowed", name)
+		}
+		b.WriteString(name + ": " + value + "\n")
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,102 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+
+	"github.com/hesusruiz/onboardng/common"
+)
+
+const (
+	welcomeTemplateBase          = "email_welcome"
+	issuerErrorTemplateFile      = "issuer_error.html"
+	dailyDigestTemplateFile      = "daily_digest.html"
+	verificationCodeTemplateFile = "verification_code.html"
+)
+
+// emailTemplates holds the parsed email templates, so they are parsed only once
+type emailTemplates struct {
+	// welcome is keyed by language, and always has an entry for common.DefaultLanguage
+	welcome     map[string]*template.Template
+	issuerError *template.Template
+	dailyDigest *template.Template
+	// verificationCode is the email with the code to verify the email of the user
+	verificationCode *template.Template
+}
+
+// parseTemplates parses the email templates in the root of the given filesystem.
+// The welcome email is {base}.html for English, with optional localized versions named {base}.{lang}.html.
+func parseTemplates(templates fs.FS) (*emailTemplates, error) {
+	t := &emailTemplates{
+		welcome: make(map[string]*template.Template),
+	}
+
+	for _, lang := range common.SupportedLanguages {
+		name := welcomeTemplateBase + ".html"
+		if lang != common.DefaultLanguage {
+			name = welcomeTemplateBase + "." + lang + ".html"
+			if _, err := fs.Stat(templates, name); errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+		}
+
+		tmpl, err := template.ParseFS(templates, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse email template %s: %w", name, err)
+		}
+		t.welcome[lang] = tmpl
+	}
+
+	tmpl, err := template.ParseFS(templates, issuerErrorTemplateFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse email template %s: %w", issuerErrorTemplateFile, err)
+	}
+	t.issuerError = tmpl
+
+	tmpl, err = template.ParseFS(templates, dailyDigestTemplateFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse email template %s: %w", dailyDigestTemplateFile, err)
+	}
+	t.dailyDigest = tmpl
+
+	tmpl, err = template.ParseFS(templates, verificationCodeTemplateFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse email template %s: %w", verificationCodeTemplateFile, err)
+	}
+	t.verificationCode = tmpl
+
+	return t, nil
+}
+
+// welcomeFor returns the welcome template for the language, falling back to the English one
+func (t *emailTemplates) welcomeFor(lang string) *template.Template {
+	if tmpl, ok := t.welcome[lang]; ok {
+		return tmpl
+	}
+	return t.welcome[common.DefaultLanguage]
+}
+
+// currentTemplates returns the templates used to send the emails
+func (s *Service) currentTemplates() *emailTemplates {
+	s.templatesMu.RLock()
+	defer s.templatesMu.RUnlock()
+	return s.templates
+}
+
+// ReloadTemplates parses again the email templates, so their changes are sent without restarting the server.
+// If any template fails to parse, the error is returned and the emails keep being sent with the previous ones.
+func (s *Service) ReloadTemplates() error {
+	if s == nil || s.templatesFS == nil {
+		return nil
+	}
+	parsed, err := parseTemplates(s.templatesFS)
+	if err != nil {
+		return err
+	}
+	s.templatesMu.Lock()
+	s.templates = parsed
+	s.templatesMu.Unlock()
+	return nil
+}
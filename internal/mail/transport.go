@@ -0,0 +1,169 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+// MailTransport delivers an email already rendered, in HTML and optionally in plain text.
+// The headers, like the ones threading the email, are added to the standard ones and may be nil.
+// The inline images are referenced from the HTML as "cid:" followed by their content id.
+// Transports also deliver a hidden copy of every email to the configured audit addresses.
+type MailTransport interface {
+	Send(from string, to []string, subject string, headers map[string]string, html string, text string, images ...InlineImage) error
+}
+
+// InlineImage is an image embedded in an email
+type InlineImage struct {
+	ContentID   string
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// newTransport creates the transport of the configured provider, or nil if sending emails is disabled
+func newTransport(runtime configuration.RuntimeEnv, cfg configuration.MailConfig) (MailTransport, error) {
+	switch cfg.Provider {
+	case "", configuration.SMTPMailProvider:
+		if !cfg.SMTP.Enabled {
+			return nil, nil
+		}
+		password, err := readSecret(cfg.SMTP.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SMTP password file: %w", err)
+		}
+		return &smtpTransport{
+			config:             cfg.SMTP,
+			password:           password,
+			bounceAddress:      cfg.BounceAddress,
+			bcc:                cfg.BCCAuditEmail,
+			implicitTLS:        cfg.SMTP.TLS && cfg.SMTP.Port == 465,
+			insecureSkipVerify: configuration.SkipTLSVerify(runtime, cfg.SMTP.InsecureSkipVerify, "smtp"),
+		}, nil
+
+	case configuration.SendGridMailProvider:
+		if !cfg.SendGrid.Enabled {
+			return nil, nil
+		}
+		apiKey, err := readSecret(cfg.SendGrid.APIKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SendGrid API key file: %w", err)
+		}
+		return newSendGridTransport(cfg.SendGrid.Endpoint, apiKey, cfg.BCCAuditEmail), nil
+
+	default:
+		return nil, fmt.Errorf("unknown mail provider %q", cfg.Provider)
+	}
+}
+
+// auditRecipients returns the audit addresses not already among the recipients
+func auditRecipients(to []string, bcc []string) []string {
+	var result []string
+	for _, addr := range bcc {
+		if !slices.ContainsFunc(to, func(t string) bool { return strings.EqualFold(t, addr) }) &&
+			!slices.ContainsFunc(result, func(r string) bool { return strings.EqualFold(r, addr) }) {
+			result = append(result, addr)
+		}
+	}
+	return result
+}
+
+// readSecret reads a secret stored in a file, ignoring the surrounding whitespace
+func readSecret(file string) (string, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// mimeBody returns the MIME headers and body of an email.
+// The HTML is sent alone when there is neither a plain text version nor images, as the emails always were.
+// Otherwise the HTML and its images are a multipart/related part, and the text an alternative to it.
+func mimeBody(html string, text string, images []InlineImage) (string, error) {
+	if text == "" && len(images) == 0 {
+		return "MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n" + html, nil
+	}
+
+	contentType, body, err := htmlPart(html, images)
+	if err != nil {
+		return "", err
+	}
+
+	if text != "" {
+		var buf bytes.Buffer
+		w := multipart.NewWriter(&buf)
+		if err := writePart(w, textproto.MIMEHeader{"Content-Type": {`text/plain; charset="UTF-8"`}}, []byte(text)); err != nil {
+			return "", err
+		}
+		if err := writePart(w, textproto.MIMEHeader{"Content-Type": {contentType}}, []byte(body)); err != nil {
+			return "", err
+		}
+		if err := w.Close(); err != nil {
+			return "", err
+		}
+		contentType = `multipart/alternative; boundary="` + w.Boundary() + `"`
+		body = buf.String()
+	}
+
+	return "MIME-version: 1.0;\nContent-Type: " + contentType + ";\n\n" + body, nil
+}
+
+// htmlPart returns the content type and body of the HTML with its inline images
+func htmlPart(html string, images []InlineImage) (string, string, error) {
+	if len(images) == 0 {
+		return `text/html; charset="UTF-8"`, html, nil
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	if err := writePart(w, textproto.MIMEHeader{"Content-Type": {`text/html; charset="UTF-8"`}}, []byte(html)); err != nil {
+		return "", "", err
+	}
+
+	for _, img := range images {
+		header := textproto.MIMEHeader{
+			"Content-Type":              {img.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-ID":                {"<" + img.ContentID + ">"},
+			"Content-Disposition":       {`inline; filename="` + img.Filename + `"`},
+		}
+
+		// Lines of base64 can not be longer than 76 characters
+		encoded := base64.StdEncoding.EncodeToString(img.Data)
+		var lines strings.Builder
+		for len(encoded) > 76 {
+			lines.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+		lines.WriteString(encoded)
+
+		if err := writePart(w, header, []byte(lines.String())); err != nil {
+			return "", "", err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return "", "", err
+	}
+
+	return `multipart/related; boundary="` + w.Boundary() + `"`, buf.String(), nil
+}
+
+func writePart(w *multipart.Writer, header textproto.MIMEHeader, content []byte) error {
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(content)
+	return err
+}
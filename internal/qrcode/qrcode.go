@@ -0,0 +1,21 @@
+// Package qrcode renders QR codes for short texts like the credential offer links.
+// The symbols are generated by github.com/skip2/go-qrcode, so the rest of the server does not depend on it.
+package qrcode
+
+import (
+	qr "github.com/skip2/go-qrcode"
+)
+
+// PNG renders the content as a black and white QR code with error correction level M, as a PNG image
+// with each module as a square of scale pixels and the mandatory quiet zone around the symbol
+func PNG(content string, scale int) ([]byte, error) {
+	if scale < 1 {
+		scale = 1
+	}
+	code, err := qr.New(content, qr.Medium)
+	if err != nil {
+		return nil, err
+	}
+	// A negative size asks for an image of scale pixels per module instead of a fixed size
+	return code.PNG(-scale)
+}
@@ -0,0 +1,57 @@
+package qrcode
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+
+	qr "github.com/skip2/go-qrcode"
+)
+
+// quietZone is the number of light modules around the symbol
+const quietZone = 4
+
+func TestPNG(t *testing.T) {
+	contents := []string{
+		"https://dome-marketplace.eu",
+		"openid-credential-offer://?credential_offer_uri=https%3A%2F%2Fissuer.dome-marketplace.eu%2Foid4vci%2Fv1%2Fcredential-offer%2F8a6f3c2e",
+	}
+
+	for _, content := range contents {
+		buf, err := PNG(content, 4)
+		if err != nil {
+			t.Fatalf("PNG failed: %v", err)
+		}
+		img, err := png.Decode(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatalf("invalid PNG: %v", err)
+		}
+
+		// The bitmap of the library includes the quiet zone
+		code, err := qr.New(content, qr.Medium)
+		if err != nil {
+			t.Fatal(err)
+		}
+		side := len(code.Bitmap()) * 4
+		if img.Bounds().Dx() != side || img.Bounds().Dy() != side {
+			t.Fatalf("expected a %dx%d image, got %v", side, side, img.Bounds())
+		}
+
+		// The top left corner of the finder pattern is dark, the quiet zone light
+		isDark := func(x, y int) bool {
+			r, _, _, _ := img.At(x, y).RGBA()
+			return r == 0
+		}
+		if isDark(0, 0) || !isDark(quietZone*4, quietZone*4) {
+			t.Errorf("unexpected quiet zone or finder pattern")
+		}
+	}
+}
+
+func TestPNGTooLong(t *testing.T) {
+	// The largest QR code holds 2331 bytes at level M
+	if _, err := PNG(strings.Repeat("\x00", 2332), 4); err == nil {
+		t.Fatal("expected an error for a content too long")
+	}
+}
@@ -0,0 +1,398 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hesusruiz/onboardng/credissuance"
+	"github.com/hesusruiz/onboardng/internal/db"
+	"github.com/hesusruiz/onboardng/internal/mail"
+)
+
+// adminStats is the summary of the registrations for the dashboard of the onboarding team
+type adminStats struct {
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	db.RegistrationCounts
+	ByCountry map[string]int `json:"by_country"`
+	ByDay     map[string]int `json:"by_day"`
+}
+
+// HandleAdminStats returns the number of registrations by outcome, by country and by day.
+// The optional "from" and "to" query parameters (YYYY-MM-DD, both included) limit the days counted.
+func (s *Server) HandleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := adminStats{From: r.URL.Query().Get("from"), To: r.URL.Query().Get("to")}
+	var statsRange db.StatsRange
+	var err error
+	statsRange.From, statsRange.To, err = parseDateRange(stats.From, stats.To)
+	if err != nil {
+		s.SendJSON(w, http.StatusBadRequest, false, err.Error(), nil)
+		return
+	}
+
+	if err := s.computeStats(r.Context(), &stats, statsRange); err != nil {
+		slog.ErrorContext(r.Context(), "❌ Error computing the registration stats", "error", err)
+		s.SendJSON(w, http.StatusInternalServerError, false, "Failed to compute the stats", nil)
+		return
+	}
+
+	s.SendJSON(w, http.StatusOK, true, "Registration stats", stats)
+}
+
+// parseDateRange parses the days of the "from" and "to" query parameters (YYYY-MM-DD, both included) into the times
+// the range starts and ends. An empty day leaves its end of the range open, with a zero time.
+func parseDateRange(fromDay, toDay string) (from, to time.Time, err error) {
+	if fromDay != "" {
+		from, err = time.ParseInLocation(time.DateOnly, fromDay, time.Local)
+		if err != nil {
+			return from, to, errors.New("from must be a date as YYYY-MM-DD")
+		}
+	}
+	if toDay != "" {
+		to, err = time.ParseInLocation(time.DateOnly, toDay, time.Local)
+		if err != nil {
+			return from, to, errors.New("to must be a date as YYYY-MM-DD")
+		}
+		// The range includes the whole last day
+		to = to.AddDate(0, 0, 1)
+	}
+	return from, to, nil
+}
+
+// computeStats fills the counts of the registrations in the range
+func (s *Server) computeStats(ctx context.Context, stats *adminStats, statsRange db.StatsRange) error {
+	var err error
+	stats.RegistrationCounts, err = s.DB.CountRegistrationsContext(ctx, statsRange)
+	if err != nil {
+		return err
+	}
+	stats.ByCountry, err = s.DB.CountRegistrationsByCountryContext(ctx, statsRange)
+	if err != nil {
+		return err
+	}
+	stats.ByDay, err = s.DB.CountRegistrationsByDayContext(ctx, statsRange)
+	return err
+}
+
+// The number of registrations in a page of the admin list, when not given in the request and at most
+const (
+	defaultAdminPageSize = 50
+	maxAdminPageSize     = 200
+)
+
+// adminRegistrations is a page of the registrations, with the total number for the pagination
+type adminRegistrations struct {
+	Total         int               `json:"total"`
+	Limit         int               `json:"limit"`
+	Offset        int               `json:"offset"`
+	Registrations []db.Registration `json:"registrations"`
+}
+
+// HandleAdminRegistrations returns a page of the registrations, the most recent first, and their total number.
+// The optional "status", "country", "from" and "to" (YYYY-MM-DD, both included) query parameters filter the
+// registrations, "sort" (one of db.SortColumns) and "order" ("asc" or "desc") order them, and "limit" and "offset"
+// select the page.
+func (s *Server) HandleAdminRegistrations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := db.RegistrationFilter{
+		Status:  query.Get("status"),
+		Country: strings.ToUpper(query.Get("country")),
+		Sort:    query.Get("sort"),
+	}
+	switch filter.Status {
+	case "", db.StatusPending, db.StatusIssued, db.StatusFailed:
+	default:
+		s.SendJSON(w, http.StatusBadRequest, false, "status must be pending, issued or failed", nil)
+		return
+	}
+	var err error
+	filter.From, filter.To, err = parseDateRange(query.Get("from"), query.Get("to"))
+	if err != nil {
+		s.SendJSON(w, http.StatusBadRequest, false, err.Error(), nil)
+		return
+	}
+	if filter.Sort != "" && !slices.Contains(db.SortColumns, filter.Sort) {
+		s.SendJSON(w, http.StatusBadRequest, false, "sort must be one of "+strings.Join(db.SortColumns, ", "), nil)
+		return
+	}
+	switch query.Get("order") {
+	case "", "desc":
+	case "asc":
+		filter.Ascending = true
+	default:
+		s.SendJSON(w, http.StatusBadRequest, false, "order must be asc or desc", nil)
+		return
+	}
+
+	page := adminRegistrations{Limit: defaultAdminPageSize, Registrations: []db.Registration{}}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxAdminPageSize {
+			s.SendJSON(w, http.StatusBadRequest, false, "limit must be a number from 1 to "+strconv.Itoa(maxAdminPageSize), nil)
+			return
+		}
+		page.Limit = limit
+	}
+	if v := query.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			s.SendJSON(w, http.StatusBadRequest, false, "offset must be zero or a positive number", nil)
+			return
+		}
+		page.Offset = offset
+	}
+
+	total, err := s.DB.CountMatchingRegistrationsContext(r.Context(), filter)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "❌ Error counting the registrations", "error", err)
+		s.SendJSON(w, http.StatusInternalServerError, false, "Failed to list the registrations", nil)
+		return
+	}
+	page.Total = total
+
+	regs, err := s.DB.ListRegistrationsContext(r.Context(), filter, page.Limit, page.Offset)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "❌ Error listing the registrations", "error", err)
+		s.SendJSON(w, http.StatusInternalServerError, false, "Failed to list the registrations", nil)
+		return
+	}
+	if regs != nil {
+		page.Registrations = regs
+	}
+
+	s.SendJSON(w, http.StatusOK, true, "Registrations", page)
+}
+
+// The number of registrations found by the admin search, when not given in the request and at most
+const (
+	defaultAdminSearchLimit = 20
+	maxAdminSearchLimit     = 100
+)
+
+// HandleAdminSearchRegistrations returns the registrations with all the words of the "q" query parameter in their
+// company name, email, names or VAT ID, the best matches first. The optional "limit" is the number returned.
+func (s *Server) HandleAdminSearchRegistrations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	term := strings.TrimSpace(r.URL.Query().Get("q"))
+	if term == "" {
+		s.SendJSON(w, http.StatusBadRequest, false, "q is required", nil)
+		return
+	}
+	limit := defaultAdminSearchLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxAdminSearchLimit {
+			s.SendJSON(w, http.StatusBadRequest, false, "limit must be a number from 1 to "+strconv.Itoa(maxAdminSearchLimit), nil)
+			return
+		}
+	}
+
+	regs, err := s.DB.SearchRegistrationsContext(r.Context(), term, limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "❌ Error searching the registrations", "error", err)
+		s.SendJSON(w, http.StatusInternalServerError, false, "Failed to search the registrations", nil)
+		return
+	}
+	if regs == nil {
+		regs = []db.Registration{}
+	}
+
+	s.SendJSON(w, http.StatusOK, true, "Registrations found", regs)
+}
+
+// adminRegistrationDetail is a registration with the request sent to the Issuer and its response,
+// to diagnose the failures of the Issuer without issuing the credential again
+type adminRegistrationDetail struct {
+	*db.Registration
+	IssuancePayload json.RawMessage    `json:"issuance_payload,omitempty"`
+	IssuerResponse  *db.IssuerResponse `json:"issuer_response,omitempty"`
+}
+
+// HandleAdminRegistration returns the registration with the id of the path, with the last request sent to the
+// Issuer and the status, body and duration of its response, if any.
+func (s *Server) HandleAdminRegistration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	registrationID := r.PathValue("id")
+	reg, err := s.DB.GetRegistrationByIDContext(r.Context(), registrationID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.SendJSON(w, http.StatusNotFound, false, "Registration not found", nil)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "❌ Error reading the registration", "registration_id", registrationID, "error", err)
+		s.SendJSON(w, http.StatusInternalServerError, false, "Failed to read the registration", nil)
+		return
+	}
+
+	detail := adminRegistrationDetail{Registration: reg}
+	payload, err := s.DB.GetIssuancePayloadContext(r.Context(), registrationID)
+	if err == nil && payload != "" {
+		detail.IssuancePayload = json.RawMessage(payload)
+	}
+	if err == nil {
+		detail.IssuerResponse, err = s.DB.GetIssuerResponseContext(r.Context(), registrationID)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "❌ Error reading the issuance of the registration", "registration_id", registrationID, "error", err)
+		s.SendJSON(w, http.StatusInternalServerError, false, "Failed to read the issuance of the registration", nil)
+		return
+	}
+
+	s.SendJSON(w, http.StatusOK, true, "Registration found", detail)
+}
+
+// HandleAdminIssuancePayload returns the last request sent to the Issuer for the registration with the id of the
+// path, to check what was sent when the issuance failed before issuing it again.
+func (s *Server) HandleAdminIssuancePayload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	registrationID := r.PathValue("id")
+	payload, err := s.DB.GetIssuancePayloadContext(r.Context(), registrationID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.SendJSON(w, http.StatusNotFound, false, "Registration not found", nil)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "❌ Error reading the issuance payload", "registration_id", registrationID, "error", err)
+		s.SendJSON(w, http.StatusInternalServerError, false, "Failed to read the issuance payload", nil)
+		return
+	}
+	if payload == "" {
+		s.SendJSON(w, http.StatusNotFound, false, "No request was sent to the Issuer for this registration", nil)
+		return
+	}
+
+	s.SendJSON(w, http.StatusOK, true, "Issuance payload", json.RawMessage(payload))
+}
+
+// welcomeEmailStatus is the status of the welcome email of a registration, after sending it again
+type welcomeEmailStatus struct {
+	RegistrationID  string    `json:"registration_id"`
+	NotifEmailAt    time.Time `json:"notif_email_at,omitempty"`
+	NotifEmailError string    `json:"notif_email_error,omitempty"`
+	DeliveryStatus  string    `json:"delivery_status,omitempty"`
+}
+
+// HandleAdminResendWelcome sends again the welcome email of the registration with the id of the path, for the users
+// who did not get it, without issuing the credential again. When the credential was issued, the email includes
+// the credential offer of the last response of the Issuer. It returns the new status of the email.
+func (s *Server) HandleAdminResendWelcome(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	registrationID := r.PathValue("id")
+	reg, err := s.DB.GetRegistrationByIDContext(r.Context(), registrationID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.SendJSON(w, http.StatusNotFound, false, "Registration not found", nil)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "❌ Error reading the registration", "registration_id", registrationID, "error", err)
+		s.SendJSON(w, http.StatusInternalServerError, false, "Failed to read the registration", nil)
+		return
+	}
+
+	offerURI := ""
+	if reg.Status == db.StatusIssued {
+		offerURI = s.lastCredentialOffer(r.Context(), reg)
+	}
+
+	slog.InfoContext(r.Context(), "Sending the welcome email again", "registration_id", reg.RegistrationID, "email", reg.Email)
+	err = s.sendWelcomeEmail(context.WithoutCancel(r.Context()), reg, offerURI, false)
+	status := welcomeEmailStatus{
+		RegistrationID:  reg.RegistrationID,
+		NotifEmailAt:    reg.NotifEmailAt,
+		NotifEmailError: reg.NotifEmailError,
+		DeliveryStatus:  reg.DeliveryStatus,
+	}
+	if err != nil {
+		s.SendJSON(w, http.StatusBadGateway, false, "Failed to send the welcome email", status)
+		return
+	}
+	s.SendJSON(w, http.StatusOK, true, "Welcome email sent", status)
+}
+
+// lastCredentialOffer returns the credential offer in the last response of the Issuer for the registration,
+// empty if there is none
+func (s *Server) lastCredentialOffer(ctx context.Context, reg *db.Registration) string {
+	resp, err := s.DB.GetIssuerResponseContext(ctx, reg.RegistrationID)
+	if err != nil {
+		slog.WarnContext(ctx, "⚠️ Could not read the response of the Issuer", "registration_id", reg.RegistrationID, "error", err)
+		return ""
+	}
+	if resp == nil || resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return ""
+	}
+	result, err := credissuance.ParseIssuanceResponse([]byte(resp.Body))
+	if err != nil || result == nil {
+		slog.WarnContext(ctx, "⚠️ Could not read the credential offer", "registration_id", reg.RegistrationID, "error", err)
+		return ""
+	}
+	return result.OfferURI
+}
+
+// emailPreviewCSP lets the previews show their inline styles and embedded images, and nothing else
+const emailPreviewCSP = "default-src 'none'; style-src 'unsafe-inline'; img-src data: https:; frame-ancestors 'none'"
+
+// HandleAdminEmailPreview renders an email with sample data, for designers to check the templates without registering.
+// The "template" query parameter selects the email ("welcome" by default, "issuer-error", "daily-digest" or
+// "verification-code"), and "lang" its language.
+func (s *Server) HandleAdminEmailPreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("template")
+	if name == "" {
+		name = mail.PreviewWelcome
+	}
+
+	body, err := s.Mail.Preview(name, r.URL.Query().Get("lang"))
+	if errors.Is(err, mail.ErrUnknownTemplate) {
+		s.SendJSON(w, http.StatusNotFound, false, err.Error(), nil)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "❌ Error rendering the email preview", "template", name, "error", err)
+		s.SendJSON(w, http.StatusInternalServerError, false, "Failed to render the email", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", emailPreviewCSP)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(body))
+}
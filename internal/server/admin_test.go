@@ -0,0 +1,385 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+	"github.com/hesusruiz/onboardng/internal/mail"
+)
+
+func TestHandleAdminStats(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development})
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Development)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	s.DB = dbService
+
+	registrations := []*db.Registration{
+		{RegistrationID: "reg-1", Email: "john@example.com", VatID: "ES12345678", Country: "ES"},
+		{RegistrationID: "reg-2", Email: "jane@example.com", VatID: "ES87654321", Country: "ES"},
+		{RegistrationID: "reg-3", Email: "jean@example.com", VatID: "FR12345678901", Country: "FR"},
+	}
+	for _, reg := range registrations {
+		if err := dbService.SaveRegistration(reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	registrations[2].Status = db.StatusFailed
+	if err := dbService.UpdateRegistrationStatus(registrations[2]); err != nil {
+		t.Fatal(err)
+	}
+	today := s.now().Format("2006-01-02")
+
+	tests := []struct {
+		name       string
+		query      string
+		wantCode   int
+		wantTotal  int
+		wantFailed int
+	}{
+		{name: "all", wantCode: http.StatusOK, wantTotal: 3, wantFailed: 1},
+		{name: "including today", query: "?from=" + today + "&to=" + today, wantCode: http.StatusOK, wantTotal: 3, wantFailed: 1},
+		{name: "before today", query: "?to=2000-01-01", wantCode: http.StatusOK},
+		{name: "invalid date", query: "?from=yesterday", wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/admin/stats"+tt.query, nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rec.Code, rec.Body.String())
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Data adminStats `json:"data"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Data.Total != tt.wantTotal || resp.Data.Failed != tt.wantFailed {
+				t.Errorf("expected %d registrations and %d failed, got %s", tt.wantTotal, tt.wantFailed, rec.Body.String())
+			}
+			if tt.wantTotal > 0 && (resp.Data.ByCountry["ES"] != 2 || resp.Data.ByDay[today] != 3) {
+				t.Errorf("expected the counts by country and day, got %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandleAdminRegistrations(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development})
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Development)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	s.DB = dbService
+
+	registrations := []*db.Registration{
+		{RegistrationID: "reg-1", Email: "john@example.com", VatID: "ES12345678", Country: "ES"},
+		{RegistrationID: "reg-2", Email: "jane@example.com", VatID: "ES87654321", Country: "ES"},
+		{RegistrationID: "reg-3", Email: "jean@example.com", VatID: "FR12345678901", Country: "FR"},
+	}
+	for _, reg := range registrations {
+		if err := dbService.SaveRegistration(reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	registrations[1].Status = db.StatusFailed
+	if err := dbService.UpdateRegistrationStatus(registrations[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	today := time.Now().Format(time.DateOnly)
+	tomorrow := time.Now().AddDate(0, 0, 1).Format(time.DateOnly)
+	yesterday := time.Now().AddDate(0, 0, -1).Format(time.DateOnly)
+
+	tests := []struct {
+		name      string
+		query     string
+		wantCode  int
+		wantTotal int
+		wantPage  int
+		wantFirst string
+	}{
+		{name: "all", wantCode: http.StatusOK, wantTotal: 3, wantPage: 3},
+		{name: "first page", query: "?limit=2", wantCode: http.StatusOK, wantTotal: 3, wantPage: 2},
+		{name: "last page", query: "?limit=2&offset=2", wantCode: http.StatusOK, wantTotal: 3, wantPage: 1},
+		{name: "by country", query: "?country=es", wantCode: http.StatusOK, wantTotal: 2, wantPage: 2},
+		{name: "by status and country", query: "?status=failed&country=ES&limit=1", wantCode: http.StatusOK, wantTotal: 1, wantPage: 1},
+		{name: "no match", query: "?country=DE", wantCode: http.StatusOK},
+		{name: "from today", query: "?from=" + today, wantCode: http.StatusOK, wantTotal: 3, wantPage: 3},
+		{name: "until today", query: "?from=" + yesterday + "&to=" + today, wantCode: http.StatusOK, wantTotal: 3, wantPage: 3},
+		{name: "from tomorrow", query: "?from=" + tomorrow, wantCode: http.StatusOK},
+		{name: "until yesterday", query: "?to=" + yesterday, wantCode: http.StatusOK},
+		{name: "failed today", query: "?status=failed&from=" + today, wantCode: http.StatusOK, wantTotal: 1, wantPage: 1, wantFirst: "reg-2"},
+		{name: "by email", query: "?sort=email&order=asc", wantCode: http.StatusOK, wantTotal: 3, wantPage: 3, wantFirst: "reg-2"},
+		{name: "by email descending", query: "?sort=email", wantCode: http.StatusOK, wantTotal: 3, wantPage: 3, wantFirst: "reg-1"},
+		{name: "by country ascending", query: "?sort=country&order=asc&limit=1", wantCode: http.StatusOK, wantTotal: 3, wantPage: 1},
+		{name: "by VAT ID of ES", query: "?country=ES&sort=vat_id&order=desc", wantCode: http.StatusOK, wantTotal: 2, wantPage: 2, wantFirst: "reg-2"},
+		{name: "unknown status", query: "?status=deleted", wantCode: http.StatusBadRequest},
+		{name: "invalid from", query: "?from=2024-13-01", wantCode: http.StatusBadRequest},
+		{name: "invalid to", query: "?to=yesterday", wantCode: http.StatusBadRequest},
+		{name: "invalid sort column", query: "?sort=password", wantCode: http.StatusBadRequest},
+		{name: "sort injection", query: "?sort=created_at%3B%20DROP%20TABLE%20registrations", wantCode: http.StatusBadRequest},
+		{name: "invalid order", query: "?sort=email&order=up", wantCode: http.StatusBadRequest},
+		{name: "limit too large", query: "?limit=1000", wantCode: http.StatusBadRequest},
+		{name: "negative offset", query: "?offset=-1", wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/admin/registrations"+tt.query, nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rec.Code, rec.Body.String())
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Data adminRegistrations `json:"data"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Data.Total != tt.wantTotal || len(resp.Data.Registrations) != tt.wantPage {
+				t.Errorf("expected %d of %d registrations, got %s", tt.wantPage, tt.wantTotal, rec.Body.String())
+			}
+			if tt.wantFirst != "" && resp.Data.Registrations[0].RegistrationID != tt.wantFirst {
+				t.Errorf("expected %s first, got %s", tt.wantFirst, resp.Data.Registrations[0].RegistrationID)
+			}
+		})
+	}
+}
+
+func TestHandleAdminSearchRegistrations(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development})
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Development)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	s.DB = dbService
+
+	for _, reg := range []*db.Registration{
+		{RegistrationID: "reg-1", Email: "john@acme.com", VatID: "ES12345678", CompanyName: "ACME"},
+		{RegistrationID: "reg-2", Email: "jane@example.com", VatID: "ES87654321", CompanyName: "ACME Spain"},
+		{RegistrationID: "reg-3", Email: "jean@example.com", VatID: "FR12345678901", CompanyName: "Globex"},
+	} {
+		if err := dbService.SaveRegistration(reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		wantIDs  int
+	}{
+		{name: "company name", query: "?q=acme", wantCode: http.StatusOK, wantIDs: 2},
+		{name: "limited", query: "?q=acme&limit=1", wantCode: http.StatusOK, wantIDs: 1},
+		{name: "no match", query: "?q=initech", wantCode: http.StatusOK},
+		{name: "missing term", query: "?q=+", wantCode: http.StatusBadRequest},
+		{name: "invalid limit", query: "?q=acme&limit=0", wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/admin/registrations/search"+tt.query, nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rec.Code, rec.Body.String())
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Data []db.Registration `json:"data"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Data == nil || len(resp.Data) != tt.wantIDs {
+				t.Errorf("expected %d registrations, got %s", tt.wantIDs, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandleAdminIssuancePayload(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development})
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Development)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	s.DB = dbService
+
+	for _, reg := range []*db.Registration{
+		{RegistrationID: "reg-1", Email: "john@example.com", VatID: "ES12345678", CompanyName: "ACME"},
+		{RegistrationID: "reg-2", Email: "jane@example.com", VatID: "ES87654321", CompanyName: "Globex"},
+	} {
+		if err := dbService.SaveRegistration(reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	payload := `{"mandator": {"organization": "ACME"}}`
+	if err := dbService.SaveIssuancePayload("reg-1", payload); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		id       string
+		wantCode int
+	}{
+		{name: "issued", id: "reg-1", wantCode: http.StatusOK},
+		{name: "not sent to the Issuer", id: "reg-2", wantCode: http.StatusNotFound},
+		{name: "unknown registration", id: "reg-3", wantCode: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/admin/registrations/"+tt.id+"/payload", nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rec.Code, rec.Body.String())
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Data json.RawMessage `json:"data"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(resp.Data), `"organization":"ACME"`) && !strings.Contains(string(resp.Data), `"organization": "ACME"`) {
+				t.Errorf("expected the saved payload, got %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandleAdminRegistration(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development})
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Development)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	s.DB = dbService
+
+	for _, reg := range []*db.Registration{
+		{RegistrationID: "reg-1", Email: "john@example.com", VatID: "ES12345678", CompanyName: "ACME"},
+		{RegistrationID: "reg-2", Email: "jane@example.com", VatID: "ES87654321", CompanyName: "Globex"},
+	} {
+		if err := dbService.SaveRegistration(reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dbService.SaveIssuancePayload("reg-1", `{"mandator": {"organization": "ACME"}}`); err != nil {
+		t.Fatal(err)
+	}
+	issuerResponse := &db.IssuerResponse{StatusCode: http.StatusBadGateway, Body: "upstream timeout", DurationMs: 30000}
+	if err := dbService.SaveIssuerResponse("reg-1", issuerResponse); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(id string) (*httptest.ResponseRecorder, adminRegistrationDetail) {
+		rec := httptest.NewRecorder()
+		s.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/admin/registrations/"+id, nil))
+		detail := adminRegistrationDetail{Registration: &db.Registration{}}
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &APIResponse{Data: &detail}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec, detail
+	}
+
+	rec, detail := get("reg-1")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if detail.CompanyName != "ACME" || detail.RegistrationID != "reg-1" {
+		t.Errorf("expected the registration, got %+v", detail.Registration)
+	}
+	if !strings.Contains(string(detail.IssuancePayload), `"organization"`) {
+		t.Errorf("expected the issuance payload, got %s", detail.IssuancePayload)
+	}
+	if detail.IssuerResponse == nil || *detail.IssuerResponse != *issuerResponse {
+		t.Errorf("expected the response of the Issuer %+v, got %+v", issuerResponse, detail.IssuerResponse)
+	}
+
+	// Not sent to the Issuer yet
+	rec, detail = get("reg-2")
+	if rec.Code != http.StatusOK || detail.IssuancePayload != nil || detail.IssuerResponse != nil {
+		t.Errorf("expected the registration without issuance, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if rec, _ := get("reg-3"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown registration, got %d", rec.Code)
+	}
+}
+
+func TestHandleAdminEmailPreview(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development})
+	mailService, err := mail.NewMailService(configuration.Development, configuration.MailConfig{}, os.DirFS("../../src/email"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Mail = mailService
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		want     string
+	}{
+		{name: "default", wantCode: http.StatusOK, want: "Jane"},
+		{name: "welcome in Spanish", query: "?template=welcome&lang=es", wantCode: http.StatusOK, want: "Entorno de pruebas"},
+		{name: "issuer error", query: "?template=issuer-error", wantCode: http.StatusOK, want: "20260101-12345678"},
+		{name: "unknown template", query: "?template=invoice", wantCode: http.StatusNotFound, want: "unknown email template"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/admin/email-preview"+tt.query, nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rec.Code, rec.Body.String())
+			}
+			if !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("expected the response to contain %q, got %s", tt.want, rec.Body.String())
+			}
+			if tt.wantCode == http.StatusOK {
+				if got := rec.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+					t.Errorf("expected an HTML response, got %q", got)
+				}
+				if got := rec.Header().Get("Content-Security-Policy"); got != emailPreviewCSP {
+					t.Errorf("expected the preview policy, got %q", got)
+				}
+			}
+		})
+	}
+}
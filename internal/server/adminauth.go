@@ -0,0 +1,63 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+// minAdminTokenLength makes the admin token too long to be guessed
+const minAdminTokenLength = 32
+
+// loadAdminToken reads the token of the admin endpoints from the file, or returns nil if no file is configured
+func loadAdminToken(file string) ([]byte, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read admin token file: %w", err)
+	}
+	token := []byte(strings.TrimSpace(string(content)))
+	if len(token) < minAdminTokenLength {
+		return nil, fmt.Errorf("the admin token in %s must have at least %d characters", file, minAdminTokenLength)
+	}
+	return token, nil
+}
+
+// handleAdmin registers the handler for /api/admin/{name}, protected by the admin token.
+// Without a token, admin endpoints are only served in development, so local testing is not blocked.
+func (s *Server) handleAdmin(mux *http.ServeMux, name string, handler http.HandlerFunc) {
+	if s.adminToken == nil && s.Config.Runtime != configuration.Development {
+		slog.Warn("⚠️ Admin endpoint disabled, no admin token configured", "endpoint", s.apiPath("admin/"+name))
+		return
+	}
+	s.handleAPI(mux, "admin/"+name, s.AdminAuth(handler))
+}
+
+// AdminAuth middleware requires the admin token in the header "Authorization: Bearer {token}".
+// Without a token configured every request is accepted, which handleAdmin only allows in development.
+func (s *Server) AdminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == nil {
+			next(w, r)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), s.adminToken) != 1 {
+			slog.WarnContext(r.Context(), "⚠️ Rejected admin request", "ip", clientIP(r), "path", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			s.SendJSON(w, http.StatusUnauthorized, false, "Unauthorized", nil)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func TestAdminAuth(t *testing.T) {
+	const token = "0123456789abcdef0123456789abcdef"
+	tokenFile := filepath.Join(t.TempDir(), "admin.txt")
+	if err := os.WriteFile(tokenFile, []byte(token+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		runtime       configuration.RuntimeEnv
+		tokenFile     string
+		authorization string
+		wantCode      int
+	}{
+		{name: "valid token", runtime: configuration.Production, tokenFile: tokenFile, authorization: "Bearer " + token, wantCode: http.StatusOK},
+		{name: "missing token", runtime: configuration.Production, tokenFile: tokenFile, wantCode: http.StatusUnauthorized},
+		{name: "wrong token", runtime: configuration.Production, tokenFile: tokenFile, authorization: "Bearer " + strings.Repeat("x", len(token)), wantCode: http.StatusUnauthorized},
+		{name: "not a bearer token", runtime: configuration.Production, tokenFile: tokenFile, authorization: "Basic " + token, wantCode: http.StatusUnauthorized},
+		{name: "token required in development when configured", runtime: configuration.Development, tokenFile: tokenFile, wantCode: http.StatusUnauthorized},
+		{name: "open in development without token", runtime: configuration.Development, wantCode: http.StatusOK},
+		{name: "disabled in production without token", runtime: configuration.Production, authorization: "Bearer " + token, wantCode: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, configuration.EnvConfig{Runtime: tt.runtime, AdminTokenFile: tt.tokenFile})
+
+			var reached bool
+			mux := http.NewServeMux()
+			mux.Handle("/", http.NotFoundHandler())
+			s.handleAdmin(mux, "test", func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/api/admin/test", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Errorf("expected %d, got %d: %s", tt.wantCode, rec.Code, rec.Body.String())
+			}
+			if reached != (tt.wantCode == http.StatusOK) {
+				t.Errorf("expected the handler to be reached only when authorized")
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("expected a WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestLoadAdminTokenTooShort(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "admin.txt")
+	if err := os.WriteFile(tokenFile, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadAdminToken(tokenFile); err == nil {
+		t.Errorf("expected a short admin token to be rejected")
+	}
+}
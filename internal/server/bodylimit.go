@@ -0,0 +1,52 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// defaultMaxBodySize is the maximum size of the body of the API requests when the configuration does not specify it.
+// It is enough for a registration, which is the largest request of the forms.
+const defaultMaxBodySize = 8 << 10
+
+// apiBodyLimits are the body limits of the endpoints receiving larger requests than the forms
+var apiBodyLimits = map[string]int64{
+	"mail-events": maxMailEventsSize,
+}
+
+func (s *Server) maxBodySize() int64 {
+	if s.Config.MaxBodySize > 0 {
+		return s.Config.MaxBodySize
+	}
+	return defaultMaxBodySize
+}
+
+// LimitBody middleware rejects requests with a body larger than limit bytes, so a client can not exhaust the memory
+// of the server. Requests announcing a larger body are rejected upfront, and reading more than limit bytes from the
+// body of the others fails with an *http.MaxBytesError.
+func (s *Server) LimitBody(limit int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			s.SendJSON(w, http.StatusRequestEntityTooLarge, false, "Request too large", nil)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next(w, r)
+	}
+}
+
+// sendBodyError replies to a request whose body could not be read or decoded
+func (s *Server) sendBodyError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		s.SendJSON(w, http.StatusRequestEntityTooLarge, false, "Request too large", nil)
+		return
+	}
+	// encoding/json has no error type for unknown fields, only the message `json: unknown field "name"`
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		s.SendJSON(w, http.StatusBadRequest, false, "Invalid request body: unknown field "+field, nil)
+		return
+	}
+	s.SendJSON(w, http.StatusBadRequest, false, "Invalid request body", nil)
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func TestLimitBody(t *testing.T) {
+	oversized := `{"email": "john@example.com", "padding": "` + strings.Repeat("x", defaultMaxBodySize) + `"}`
+
+	tests := []struct {
+		name        string
+		maxBodySize int64
+		body        string
+		// unknownLength sends the body without Content-Length, so it is only detected while reading it
+		unknownLength bool
+		wantStatus    int
+	}{
+		{name: "small body", body: `{"email": "not an email"}`, wantStatus: http.StatusBadRequest},
+		{name: "oversized body", body: oversized, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "oversized body of unknown length", body: oversized, unknownLength: true, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "configured limit", maxBodySize: 16, body: `{"email": "not an email"}`, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development, MaxBodySize: tt.maxBodySize})
+
+			req := httptest.NewRequest(http.MethodPost, "/api/validate-email", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.unknownLength {
+				req.ContentLength = -1
+				req.Body = io.NopCloser(strings.NewReader(tt.body))
+			}
+			tokenRec := httptest.NewRecorder()
+			s.Handler.ServeHTTP(tokenRec, httptest.NewRequest(http.MethodGet, "/api/csrf", nil))
+			for _, cookie := range tokenRec.Result().Cookies() {
+				req.AddCookie(cookie)
+				req.Header.Set(csrfHeaderName, cookie.Value)
+			}
+
+			rec := httptest.NewRecorder()
+			s.Handler.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
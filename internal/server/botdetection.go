@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+// The registration form has two kinds of traps for the bots: hidden honeypot fields that people leave empty,
+// and a minimum time between loading the form and submitting it. The page gets the names of the honeypots and
+// a form token with the time it was loaded from /api/form-token, so the traps can change without a release.
+
+// defaultHoneypotFields are the honeypots of the form when the configuration does not specify them
+var defaultHoneypotFields = []string{"website"}
+
+// formTokenField is the field of the registration with the form token
+const formTokenField = "formToken"
+
+// formTokenPrefix separates the form tokens from the other tokens signed with the same secret
+const formTokenPrefix = "form-token:"
+
+// errMissingFormToken is returned when the fill time is checked and the registration has no form token,
+// usually because the page was loaded before the check was enabled
+var errMissingFormToken = errors.New("the form has expired, please reload the page")
+
+// formTraps are the values of the fields of a registration that are not part of the registration itself
+type formTraps struct {
+	// Honeypots has the names of the honeypot fields that were filled
+	Honeypots []string
+	FormToken string
+}
+
+// honeypotFields returns the names of the honeypot fields of the form
+func (s *Server) honeypotFields() []string {
+	if len(s.Config.BotDetection.HoneypotFields) == 0 {
+		return defaultHoneypotFields
+	}
+	return s.Config.BotDetection.HoneypotFields
+}
+
+// validateHoneypotFields checks that the honeypots do not hide the fields of a registration
+func validateHoneypotFields(names []string) error {
+	reserved := map[string]bool{formTokenField: true}
+	t := reflect.TypeFor[RegistrationRequest]()
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		reserved[name] = true
+	}
+
+	for _, name := range names {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("empty honeypot field name")
+		}
+		if reserved[name] {
+			return fmt.Errorf("honeypot field %q is a field of the registration", name)
+		}
+	}
+	return nil
+}
+
+// decodeRegistrationRequest decodes the registration of the request, taking out the traps of the form.
+// Like decodeJSON, it rejects the fields that are not in the registration nor traps.
+func (s *Server) decodeRegistrationRequest(r *http.Request) (RegistrationRequest, formTraps, error) {
+	var req RegistrationRequest
+	var traps formTraps
+
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		return req, traps, err
+	}
+
+	for _, name := range s.honeypotFields() {
+		raw, ok := fields[name]
+		if !ok {
+			continue
+		}
+		delete(fields, name)
+		// Bots may fill the field with anything, not only strings
+		var value string
+		if json.Unmarshal(raw, &value) != nil {
+			value = string(raw)
+		}
+		if value = strings.TrimSpace(value); value != "" && value != "null" {
+			traps.Honeypots = append(traps.Honeypots, name)
+		}
+	}
+
+	if raw, ok := fields[formTokenField]; ok {
+		delete(fields, formTokenField)
+		json.Unmarshal(raw, &traps.FormToken)
+	}
+
+	buf, err := json.Marshal(fields)
+	if err != nil {
+		return req, traps, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	return req, traps, dec.Decode(&req)
+}
+
+// caughtByTrap returns the trap that caught the registration as sent by a bot, or an empty string.
+// It returns an error when the fill time can not be checked because the registration has no form token.
+func (s *Server) caughtByTrap(traps formTraps) (string, error) {
+	if len(traps.Honeypots) > 0 {
+		return "honeypot " + strings.Join(traps.Honeypots, ","), nil
+	}
+
+	minFillTime := s.Config.BotDetection.MinFillTime
+	if minFillTime <= 0 {
+		return "", nil
+	}
+	if traps.FormToken == "" {
+		return "", errMissingFormToken
+	}
+	issued, ok := s.formTokenTime(traps.FormToken)
+	if !ok {
+		return "invalid form token", nil
+	}
+	if fillTime := s.now().Sub(issued); fillTime < minFillTime {
+		return "fill time " + fillTime.Round(time.Millisecond).String(), nil
+	}
+	return "", nil
+}
+
+// formToken returns the token that tells when the form was loaded, signed so it can not be backdated
+func (s *Server) formToken(issued time.Time) string {
+	ms := strconv.FormatInt(issued.UnixMilli(), 10)
+	return ms + "." + s.formTokenSignature(ms)
+}
+
+// formTokenTime returns when the form of the token was loaded, if the token is valid
+func (s *Server) formTokenTime(token string) (time.Time, bool) {
+	ms, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.formTokenSignature(ms))) {
+		return time.Time{}, false
+	}
+	unixMilli, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(unixMilli), true
+}
+
+func (s *Server) formTokenSignature(ms string) string {
+	mac := hmac.New(sha256.New, s.statusSecret)
+	mac.Write([]byte(formTokenPrefix + ms))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// formSetup is what the registration page needs to set the traps of the form, and the extra fields to show
+type formSetup struct {
+	FormToken      string       `json:"form_token"`
+	HoneypotFields []string     `json:"honeypot_fields"`
+	ExtraFields    []extraField `json:"extra_fields,omitempty"`
+}
+
+// extraField is an extra field of the configuration, as shown in the registration form
+type extraField struct {
+	Name      string `json:"name"`
+	Label     string `json:"label"`
+	Required  bool   `json:"required"`
+	MaxLength int    `json:"max_length"`
+}
+
+// extraFields returns the extra fields of the configuration to show in the registration form
+func (s *Server) extraFields() []extraField {
+	var fields []extraField
+	for _, f := range s.Config.ExtraFields {
+		field := extraField{Name: f.Name, Label: f.Label, Required: f.Required, MaxLength: f.MaxLength}
+		if field.Label == "" {
+			field.Label = f.Name
+		}
+		if field.MaxLength == 0 {
+			field.MaxLength = configuration.DefaultExtraFieldMaxLength
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// HandleFormToken returns the form token and the names of the honeypot fields, requested when the page is loaded
+func (s *Server) HandleFormToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	s.SendJSON(w, http.StatusOK, true, "Form token", formSetup{
+		FormToken:      s.formToken(s.now()),
+		HoneypotFields: s.honeypotFields(),
+		ExtraFields:    s.extraFields(),
+	})
+}
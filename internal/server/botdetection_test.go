@@ -0,0 +1,177 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+// newBotDetectionServer returns a server with the given traps, storing the bot attempts in a database
+func newBotDetectionServer(t *testing.T, botDetection configuration.BotDetectionConfig) *Server {
+	t.Helper()
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development, BotDetection: botDetection})
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Development)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbService.Close() })
+	s.DB = dbService
+	return s
+}
+
+// getFormToken requests the setup of the form like the registration page
+func getFormToken(t *testing.T, s *Server) formSetup {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/form-token", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Data formSetup `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Data
+}
+
+// The registrations in these tests are incomplete: the ones caught by a trap get a fake success,
+// and the others go on to the validation of the data, which rejects them
+const (
+	caughtByTrap    = http.StatusOK
+	notCaughtByTrap = http.StatusBadRequest
+)
+
+func TestHoneypotFields(t *testing.T) {
+	tests := []struct {
+		name       string
+		honeypots  []string
+		body       string
+		wantStatus int
+	}{
+		{name: "default honeypot filled", body: `{"email": "bot@example.com", "website": "http://spam.example.com"}`, wantStatus: caughtByTrap},
+		{name: "default honeypot empty", body: `{"email": "jane@example.com", "website": ""}`, wantStatus: notCaughtByTrap},
+		{name: "default honeypot absent", body: `{"email": "jane@example.com"}`, wantStatus: notCaughtByTrap},
+		{name: "configured honeypot filled", honeypots: []string{"fax", "homepage"}, body: `{"email": "bot@example.com", "homepage": "x"}`, wantStatus: caughtByTrap},
+		{name: "configured honeypot filled with a number", honeypots: []string{"fax", "homepage"}, body: `{"email": "bot@example.com", "fax": 5551234}`, wantStatus: caughtByTrap},
+		{name: "configured honeypots empty", honeypots: []string{"fax", "homepage"}, body: `{"email": "jane@example.com", "fax": "", "homepage": " "}`, wantStatus: notCaughtByTrap},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newBotDetectionServer(t, configuration.BotDetectionConfig{HoneypotFields: tt.honeypots})
+			before := botAttempts.Value()
+
+			rec := postJSON(s, "/api/register", tt.body)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+			if caught := botAttempts.Value() - before; (caught == 1) != (tt.wantStatus == caughtByTrap) {
+				t.Errorf("expected caught %v, got %d bot attempts", tt.wantStatus == caughtByTrap, caught)
+			}
+		})
+	}
+
+	// Once the honeypots are configured, the default one is an unknown field
+	s := newBotDetectionServer(t, configuration.BotDetectionConfig{HoneypotFields: []string{"fax"}})
+	if rec := postJSON(s, "/api/register", `{"email": "jane@example.com", "website": "x"}`); !strings.Contains(rec.Body.String(), "unknown field") {
+		t.Errorf("expected the default honeypot to be rejected as unknown, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMinFillTime(t *testing.T) {
+	s := newBotDetectionServer(t, configuration.BotDetectionConfig{HoneypotFields: []string{"fax"}, MinFillTime: 3 * time.Second})
+	start := time.Now()
+	s.now = func() time.Time { return start }
+
+	setup := getFormToken(t, s)
+	if !slices.Equal(setup.HoneypotFields, []string{"fax"}) || setup.FormToken == "" {
+		t.Fatalf("unexpected form setup %+v", setup)
+	}
+
+	// A forged token is caught even when it looks old enough
+	issued, _, _ := strings.Cut(setup.FormToken, ".")
+	forged := strings.Replace(setup.FormToken, issued, "1000", 1)
+
+	tests := []struct {
+		name       string
+		elapsed    time.Duration
+		token      string
+		wantStatus int
+	}{
+		{name: "too fast", elapsed: time.Second, token: setup.FormToken, wantStatus: caughtByTrap},
+		{name: "human speed", elapsed: 10 * time.Second, token: setup.FormToken, wantStatus: notCaughtByTrap},
+		{name: "forged token", elapsed: 10 * time.Second, token: forged, wantStatus: caughtByTrap},
+		{name: "malformed token", elapsed: 10 * time.Second, token: "not-a-token", wantStatus: caughtByTrap},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.now = func() time.Time { return start.Add(tt.elapsed) }
+			before := botAttempts.Value()
+
+			body := `{"email": "jane@example.com", "formToken": "` + tt.token + `"}`
+			rec := postJSON(s, "/api/register", body)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+			if caught := botAttempts.Value() - before; (caught == 1) != (tt.wantStatus == caughtByTrap) {
+				t.Errorf("expected caught %v, got %d bot attempts", tt.wantStatus == caughtByTrap, caught)
+			}
+		})
+	}
+
+	// Without the token the user is asked to reload the page, which may be older than the check
+	rec := postJSON(s, "/api/register", `{"email": "jane@example.com"}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "reload the page") {
+		t.Errorf("expected the user to be asked to reload the page, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestFormSetupExtraFields(t *testing.T) {
+	s := newBotDetectionServer(t, configuration.BotDetectionConfig{})
+	if setup := getFormToken(t, s); len(setup.ExtraFields) != 0 {
+		t.Errorf("expected no extra fields without configuration, got %+v", setup.ExtraFields)
+	}
+
+	s.Config.ExtraFields = []configuration.ExtraFieldConfig{
+		{Name: "department", Label: "Department", Required: true},
+		{Name: "jobTitle", Claim: "role", MaxLength: 50},
+	}
+	want := []extraField{
+		{Name: "department", Label: "Department", Required: true, MaxLength: configuration.DefaultExtraFieldMaxLength},
+		{Name: "jobTitle", Label: "jobTitle", MaxLength: 50},
+	}
+	if setup := getFormToken(t, s); !slices.Equal(setup.ExtraFields, want) {
+		t.Errorf("expected the extra fields %+v, got %+v", want, setup.ExtraFields)
+	}
+}
+
+func TestValidateHoneypotFields(t *testing.T) {
+	tests := []struct {
+		names   []string
+		wantErr bool
+	}{
+		{names: nil},
+		{names: []string{"website", "fax"}},
+		{names: []string{"email"}, wantErr: true},
+		{names: []string{"vatId"}, wantErr: true},
+		{names: []string{"formToken"}, wantErr: true},
+		{names: []string{" "}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := validateHoneypotFields(tt.names); (err != nil) != tt.wantErr {
+			t.Errorf("%q: expected error %v, got %v", tt.names, tt.wantErr, err)
+		}
+	}
+}
@@ -1,9 +1,76 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"log/slog"
 	"time"
 )
 
+// defaultVerificationCodeTTL is how long a verification code is valid when the configuration does not specify it
+const defaultVerificationCodeTTL = 15 * time.Minute
+
+// defaultVerifiedEmailWindow is how long a verified email can be registered when the configuration does not specify it
+const defaultVerifiedEmailWindow = 30 * time.Minute
+
+// defaultVerificationCodeMaxAttempts is the number of wrong guesses of a code before it is invalidated,
+// when the configuration does not specify it
+const defaultVerificationCodeMaxAttempts = 5
+
+// maxVerificationFailureDelay bounds the wait after a wrong guess, so a request is never held for too long
+const maxVerificationFailureDelay = 5 * time.Second
+
+var (
+	// ErrInvalidCode is returned when there is no code for the email, or it is not the one provided
+	ErrInvalidCode = errors.New("invalid verification code")
+	// ErrCodeExpired is returned when the code is correct but older than the verification code TTL
+	ErrCodeExpired = errors.New("verification code expired, please request a new one")
+	// ErrTooManyAttempts is returned when the code was guessed wrong too many times, and it was invalidated
+	ErrTooManyAttempts = errors.New("too many failed attempts, please request a new code")
+	// ErrTooManyCodes is returned when the email was sent too many codes in the last minutes
+	ErrTooManyCodes = errors.New("too many codes requested, please wait a few minutes")
+	// ErrDailyCodeLimit is returned when the email was sent the maximum number of codes of a day
+	ErrDailyCodeLimit = errors.New("too many codes requested today, please try again tomorrow")
+)
+
+// The limits of the codes sent to each email, and of the requests from each IP address to the limited endpoints
+const (
+	maxEmailAttempts    = 3
+	emailAttemptsWindow = 3 * time.Minute
+	ipRequestsPerSecond = 1
+	ipRequestsBurst     = 5
+)
+
+// defaultMaxCodesPerDay is the number of codes sent to each email in a day, when the configuration does not specify it
+const defaultMaxCodesPerDay = 10
+
+// emailDailyWindow is the window of the daily limit of the codes sent to each email
+const emailDailyWindow = 24 * time.Hour
+
+// rateLimits counts the requests limited by the server
+type rateLimits interface {
+	// allowEmail counts a code sent to the email, reporting whether it is within the limit
+	allowEmail(ctx context.Context, email string) (bool, error)
+	// allowEmailDaily counts a code sent to the email in the daily window, reporting whether it is within the limit
+	allowEmailDaily(ctx context.Context, email string, limit int) (bool, error)
+	// allowIP counts a request from the IP address, reporting whether it is within the limit
+	allowIP(ctx context.Context, ip string) (bool, error)
+}
+
+// codeStore keeps the verification codes sent to the emails, and the emails verified with them.
+// The emails and codes are the keys returned by emailKey and codeKey, hashed if so configured.
+type codeStore interface {
+	// storeCode saves the code sent to the email, replacing the previous one
+	storeCode(ctx context.Context, email, code string) error
+	// checkCode checks the code of the email as VerifyCode without the delay, returning the failed attempts so far
+	// when the code is wrong
+	checkCode(ctx context.Context, email, code string) (failedAttempts int, err error)
+	// emailVerified reports whether the email was verified within the verified email window
+	emailVerified(ctx context.Context, email string) (bool, error)
+	// consumeVerifiedEmail forgets that the email was verified
+	consumeVerifiedEmail(ctx context.Context, email string) error
+}
+
 type RateLimitEntry struct {
 	Count     int
 	StartTime time.Time
@@ -12,60 +79,221 @@ type RateLimitEntry struct {
 type VerificationCodeEntry struct {
 	Code      string
 	CreatedAt time.Time
+	// FailedAttempts counts the wrong guesses of the code
+	FailedAttempts int
 }
 
-// RegisterEmailAttempt checks if an email is allowed to receive a code and updates the rate limiter.
-func (s *Server) RegisterEmailAttempt(email string) bool {
+// RegisterEmailAttempt checks if an email is allowed to receive a code and updates the rate limiters.
+// It returns ErrTooManyCodes over the limit of the last minutes, and ErrDailyCodeLimit over the daily one.
+// The codes refused by the first limit do not count for the daily one.
+// The email is allowed if the limits can not be checked, so the codes are still sent.
+func (s *Server) RegisterEmailAttempt(email string) error {
 	s.cleanupExpired()
+	ctx := context.Background()
+	key := s.emailKey(email)
+
+	allowed, err := s.limits.allowEmail(ctx, key)
+	if err != nil {
+		slog.Error("❌ Error checking the rate limit of the email, allowed", "email", email, "error", err)
+		return nil
+	}
+	if !allowed {
+		return ErrTooManyCodes
+	}
+
+	allowed, err = s.limits.allowEmailDaily(ctx, key, s.maxCodesPerDay())
+	if err != nil {
+		slog.Error("❌ Error checking the daily limit of the email, allowed", "email", email, "error", err)
+		return nil
+	}
+	if !allowed {
+		slog.Warn("⚠️ Daily limit of verification codes reached", "email", email)
+		return ErrDailyCodeLimit
+	}
+	return nil
+}
+
+// maxCodesPerDay returns the number of codes sent to each email in a day
+func (s *Server) maxCodesPerDay() int {
+	if s.Config.VerificationCode.MaxCodesPerDay > 0 {
+		return s.Config.VerificationCode.MaxCodesPerDay
+	}
+	return defaultMaxCodesPerDay
+}
+
+// StoreVerificationCode saves a new verification code for an email.
+func (s *Server) StoreVerificationCode(email, code string) error {
+	return s.codes.storeCode(context.Background(), s.emailKey(email), s.codeKey(email, code))
+}
+
+// verificationCodeTTL returns how long a verification code is valid
+func (s *Server) verificationCodeTTL() time.Duration {
+	if s.Config.VerificationCodeTTL > 0 {
+		return s.Config.VerificationCodeTTL
+	}
+	return defaultVerificationCodeTTL
+}
+
+// verifiedEmailWindow returns how long after verifying an email it can be registered
+func (s *Server) verifiedEmailWindow() time.Duration {
+	if s.Config.VerifiedEmailWindow > 0 {
+		return s.Config.VerifiedEmailWindow
+	}
+	return defaultVerifiedEmailWindow
+}
+
+// verificationCodeMaxAttempts returns the number of wrong guesses of a code before it is invalidated
+func (s *Server) verificationCodeMaxAttempts() int {
+	if s.Config.VerificationCode.MaxAttempts > 0 {
+		return s.Config.VerificationCode.MaxAttempts
+	}
+	return defaultVerificationCodeMaxAttempts
+}
+
+// verificationFailureDelay returns the wait after the given number of wrong guesses of a code
+func (s *Server) verificationFailureDelay(failedAttempts int) time.Duration {
+	delay := s.Config.VerificationCode.FailureDelay * time.Duration(failedAttempts)
+	return min(delay, maxVerificationFailureDelay)
+}
+
+// VerifyCode checks if the provided code is correct and not expired for the given email, and deletes it if so.
+// An expired code is deleted even if it is correct, so a new one must be requested.
+// A wrong code counts as a failed attempt, and the code is deleted after too many of them.
+// On success the email is marked as verified, so it can be registered.
+func (s *Server) VerifyCode(email, code string) error {
+	failedAttempts, err := s.codes.checkCode(context.Background(), s.emailKey(email), s.codeKey(email, code))
+	if failedAttempts > 0 {
+		// Slow down the guesses, without holding the lock
+		time.Sleep(s.verificationFailureDelay(failedAttempts))
+	}
+	return err
+}
 
+// EmailVerified reports whether the email was verified with a code within the verified email window.
+// The email is not verified if the store of the codes fails.
+func (s *Server) EmailVerified(email string) bool {
+	verified, err := s.codes.emailVerified(context.Background(), s.emailKey(email))
+	if err != nil {
+		slog.Error("❌ Error checking the verification of the email", "email", email, "error", err)
+		return false
+	}
+	return verified
+}
+
+// ConsumeVerifiedEmail forgets that the email was verified, so each verification allows a single registration
+func (s *Server) ConsumeVerifiedEmail(email string) {
+	if err := s.codes.consumeVerifiedEmail(context.Background(), s.emailKey(email)); err != nil {
+		slog.Error("❌ Error forgetting the verification of the email", "email", email, "error", err)
+	}
+}
+
+// memoryStore keeps the rate limits and the verification codes in the memory of the server, for a single instance
+type memoryStore struct {
+	s *Server
+}
+
+func (m memoryStore) allowEmail(ctx context.Context, email string) (bool, error) {
+	s := m.s
 	s.RateLimiterMu.Lock()
 	defer s.RateLimiterMu.Unlock()
 
 	entry, exists := s.EmailRateLimiter[email]
 
-	if !exists || time.Since(entry.StartTime) > 3*time.Minute {
+	if !exists || s.now().Sub(entry.StartTime) > emailAttemptsWindow {
 		s.EmailRateLimiter[email] = &RateLimitEntry{
 			Count:     1,
-			StartTime: time.Now(),
+			StartTime: s.now(),
 		}
-		return true
+		return true, nil
 	}
 
-	if entry.Count >= 3 {
-		return false
+	if entry.Count >= maxEmailAttempts {
+		return false, nil
 	}
 
 	entry.Count++
-	return true
+	return true, nil
 }
 
-// StoreVerificationCode saves a new verification code for an email.
-func (s *Server) StoreVerificationCode(email, code string) {
+func (m memoryStore) allowEmailDaily(ctx context.Context, email string, limit int) (bool, error) {
+	s := m.s
+	s.RateLimiterMu.Lock()
+	defer s.RateLimiterMu.Unlock()
+
+	entry, exists := s.EmailDailyLimiter[email]
+	if !exists || s.now().Sub(entry.StartTime) > emailDailyWindow {
+		s.EmailDailyLimiter[email] = &RateLimitEntry{Count: 1, StartTime: s.now()}
+		return true, nil
+	}
+	if entry.Count >= limit {
+		return false, nil
+	}
+	entry.Count++
+	return true, nil
+}
+
+func (m memoryStore) allowIP(ctx context.Context, ip string) (bool, error) {
+	return m.s.getIPLimiter(ip).Allow(), nil
+}
+
+func (m memoryStore) storeCode(ctx context.Context, email, code string) error {
+	s := m.s
 	s.CodesMu.Lock()
 	defer s.CodesMu.Unlock()
 	s.VerificationCodes[email] = &VerificationCodeEntry{
 		Code:      code,
-		CreatedAt: time.Now(),
+		CreatedAt: s.now(),
 	}
+	return nil
 }
 
-// VerifyCode checks if the provided code is correct for the given email and deletes it if so.
-func (s *Server) VerifyCode(email, code string) bool {
+func (m memoryStore) checkCode(ctx context.Context, email, code string) (failedAttempts int, err error) {
+	s := m.s
 	s.CodesMu.Lock()
 	defer s.CodesMu.Unlock()
 
 	entry, exists := s.VerificationCodes[email]
-	if !exists || entry.Code != code {
-		return false
+	if !exists {
+		return 0, ErrInvalidCode
+	}
+	if !sameCode(entry.Code, code) {
+		entry.FailedAttempts++
+		if entry.FailedAttempts >= s.verificationCodeMaxAttempts() {
+			delete(s.VerificationCodes, email)
+			return entry.FailedAttempts, ErrTooManyAttempts
+		}
+		return entry.FailedAttempts, ErrInvalidCode
 	}
 
 	delete(s.VerificationCodes, email)
-	return true
+	if s.now().Sub(entry.CreatedAt) > s.verificationCodeTTL() {
+		return 0, ErrCodeExpired
+	}
+	s.VerifiedEmails[email] = s.now()
+	return 0, nil
+}
+
+func (m memoryStore) emailVerified(ctx context.Context, email string) (bool, error) {
+	s := m.s
+	s.CodesMu.RLock()
+	defer s.CodesMu.RUnlock()
+
+	verifiedAt, exists := s.VerifiedEmails[email]
+	return exists && s.now().Sub(verifiedAt) <= s.verifiedEmailWindow(), nil
+}
+
+func (m memoryStore) consumeVerifiedEmail(ctx context.Context, email string) error {
+	s := m.s
+	s.CodesMu.Lock()
+	defer s.CodesMu.Unlock()
+	delete(s.VerifiedEmails, email)
+	return nil
 }
 
-// cleanupExpired removes entries older than 15 minutes from the in-memory caches.
+// cleanupExpired removes rate limiter entries older than 15 minutes or the daily window, expired verification codes,
+// expired verified emails and expired idempotent responses from the in-memory caches.
 func (s *Server) cleanupExpired() {
-	now := time.Now()
+	now := s.now()
 	expirationLimit := 15 * time.Minute
 
 	// Cleanup EmailRateLimiter
@@ -75,14 +303,37 @@ func (s *Server) cleanupExpired() {
 			delete(s.EmailRateLimiter, email)
 		}
 	}
+	for email, entry := range s.EmailDailyLimiter {
+		if now.Sub(entry.StartTime) > emailDailyWindow {
+			delete(s.EmailDailyLimiter, email)
+		}
+	}
 	s.RateLimiterMu.Unlock()
 
 	// Cleanup VerificationCodes
 	s.CodesMu.Lock()
 	for email, entry := range s.VerificationCodes {
-		if now.Sub(entry.CreatedAt) > expirationLimit {
+		if now.Sub(entry.CreatedAt) > s.verificationCodeTTL() {
 			delete(s.VerificationCodes, email)
 		}
 	}
+	for email, verifiedAt := range s.VerifiedEmails {
+		if now.Sub(verifiedAt) > s.verifiedEmailWindow() {
+			delete(s.VerifiedEmails, email)
+		}
+	}
 	s.CodesMu.Unlock()
+
+	// Cleanup the responses of completed idempotent requests
+	s.IdempotencyMu.Lock()
+	for key, entry := range s.IdempotentResponses {
+		select {
+		case <-entry.done:
+			if now.Sub(entry.createdAt) > s.idempotencyWindow() {
+				delete(s.IdempotentResponses, key)
+			}
+		default:
+		}
+	}
+	s.IdempotencyMu.Unlock()
 }
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func TestVerifyCodeExpiry(t *testing.T) {
+	const ttl = 10 * time.Minute
+
+	tests := []struct {
+		name    string
+		age     time.Duration
+		code    string
+		wantErr error
+	}{
+		{name: "fresh code", age: 0, code: "123456"},
+		{name: "code at the TTL is still valid", age: ttl, code: "123456"},
+		{name: "code just past the TTL", age: ttl + time.Nanosecond, code: "123456", wantErr: ErrCodeExpired},
+		{name: "wrong code is invalid, not expired", age: ttl + time.Minute, code: "654321", wantErr: ErrInvalidCode},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, configuration.EnvConfig{VerificationCodeTTL: ttl})
+			start := time.Now()
+			s.now = func() time.Time { return start }
+			s.StoreVerificationCode("john@example.com", "123456")
+
+			s.now = func() time.Time { return start.Add(tt.age) }
+			if err := s.VerifyCode("john@example.com", tt.code); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+
+			// A correct code can only be used once, expired or not
+			if tt.code == "123456" {
+				if err := s.VerifyCode("john@example.com", tt.code); !errors.Is(err, ErrInvalidCode) {
+					t.Errorf("expected the code to be consumed, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyCodeDefaultTTL(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{})
+	start := time.Now()
+	s.now = func() time.Time { return start }
+	s.StoreVerificationCode("john@example.com", "123456")
+
+	s.now = func() time.Time { return start.Add(defaultVerificationCodeTTL + time.Second) }
+	if err := s.VerifyCode("john@example.com", "123456"); !errors.Is(err, ErrCodeExpired) {
+		t.Errorf("expected %v, got %v", ErrCodeExpired, err)
+	}
+}
+
+func TestHandleVerifyCodeExpiredMessage(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development, VerificationCodeTTL: time.Minute})
+	start := time.Now()
+	s.now = func() time.Time { return start }
+	s.StoreVerificationCode("john@example.com", "123456")
+	s.now = func() time.Time { return start.Add(2 * time.Minute) }
+
+	rec := postJSON(s, "/api/verify-code", `{"email": "john@example.com", "code": "123456"}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "expired") {
+		t.Errorf("expected an expired code error, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = postJSON(s, "/api/verify-code", `{"email": "john@example.com", "code": "123456"}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "Invalid verification code") {
+		t.Errorf("expected an invalid code error, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestVerifyCodeLockout(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxAttempts int
+		wantLockout int
+	}{
+		{name: "default threshold", wantLockout: defaultVerificationCodeMaxAttempts},
+		{name: "configured threshold", maxAttempts: 3, wantLockout: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, configuration.EnvConfig{VerificationCode: configuration.VerificationCodeConfig{MaxAttempts: tt.maxAttempts}})
+			s.StoreVerificationCode("john@example.com", "123456")
+
+			for attempt := 1; attempt < tt.wantLockout; attempt++ {
+				if err := s.VerifyCode("john@example.com", "000000"); !errors.Is(err, ErrInvalidCode) {
+					t.Fatalf("attempt %d: expected %v, got %v", attempt, ErrInvalidCode, err)
+				}
+			}
+			if err := s.VerifyCode("john@example.com", "000000"); !errors.Is(err, ErrTooManyAttempts) {
+				t.Fatalf("attempt %d: expected %v, got %v", tt.wantLockout, ErrTooManyAttempts, err)
+			}
+
+			// The code is invalidated, even the right one
+			if err := s.VerifyCode("john@example.com", "123456"); !errors.Is(err, ErrInvalidCode) {
+				t.Errorf("expected the code to be invalidated, got %v", err)
+			}
+
+			// A new code starts counting again
+			s.StoreVerificationCode("john@example.com", "654321")
+			if err := s.VerifyCode("john@example.com", "000000"); !errors.Is(err, ErrInvalidCode) {
+				t.Errorf("expected %v, got %v", ErrInvalidCode, err)
+			}
+			if err := s.VerifyCode("john@example.com", "654321"); err != nil {
+				t.Errorf("expected the new code to be verified, got %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyCodeFailureDelay(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	s := newTestServer(t, configuration.EnvConfig{VerificationCode: configuration.VerificationCodeConfig{FailureDelay: delay}})
+	s.StoreVerificationCode("john@example.com", "123456")
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		start := time.Now()
+		s.VerifyCode("john@example.com", "000000")
+		if elapsed := time.Since(start); elapsed < time.Duration(attempt)*delay {
+			t.Errorf("attempt %d: expected to wait at least %v, waited %v", attempt, time.Duration(attempt)*delay, elapsed)
+		}
+	}
+
+	if got := s.verificationFailureDelay(1000); got != maxVerificationFailureDelay {
+		t.Errorf("expected the delay to be capped at %v, got %v", maxVerificationFailureDelay, got)
+	}
+}
+
+func TestHandleVerifyCodeTooManyAttempts(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development, VerificationCode: configuration.VerificationCodeConfig{MaxAttempts: 2}})
+	s.StoreVerificationCode("john@example.com", "123456")
+
+	rec := postJSON(s, "/api/verify-code", `{"email": "john@example.com", "code": "000000"}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "Invalid verification code") {
+		t.Errorf("expected an invalid code error, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = postJSON(s, "/api/verify-code", `{"email": "john@example.com", "code": "000000"}`)
+	if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "request a new verification code") {
+		t.Errorf("expected a too many attempts error, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestEmailDailyCodeLimit(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{VerificationCode: configuration.VerificationCodeConfig{MaxCodesPerDay: 4}})
+	start := time.Now()
+	s.now = func() time.Time { return start }
+	const email = "john@example.com"
+
+	// The short window allows 3 codes, and refuses the next one without counting it for the day
+	for i := range maxEmailAttempts {
+		if err := s.RegisterEmailAttempt(email); err != nil {
+			t.Fatalf("attempt %d: expected to be allowed, got %v", i+1, err)
+		}
+	}
+	if err := s.RegisterEmailAttempt(email); !errors.Is(err, ErrTooManyCodes) {
+		t.Fatalf("expected %v, got %v", ErrTooManyCodes, err)
+	}
+
+	// After the short window one more code fits in the day, and then the daily limit applies
+	s.now = func() time.Time { return start.Add(emailAttemptsWindow + time.Second) }
+	if err := s.RegisterEmailAttempt(email); err != nil {
+		t.Fatalf("expected the fourth code of the day to be allowed, got %v", err)
+	}
+	if err := s.RegisterEmailAttempt(email); !errors.Is(err, ErrDailyCodeLimit) {
+		t.Fatalf("expected %v, got %v", ErrDailyCodeLimit, err)
+	}
+	if err := s.RegisterEmailAttempt("jane@example.com"); err != nil {
+		t.Errorf("expected other emails to be allowed, got %v", err)
+	}
+
+	// The next day the codes are allowed again
+	s.now = func() time.Time { return start.Add(emailDailyWindow + time.Second) }
+	if err := s.RegisterEmailAttempt(email); err != nil {
+		t.Errorf("expected to be allowed after the daily window, got %v", err)
+	}
+}
+
+func TestHandleValidateEmailDailyLimitMessage(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{
+		Runtime:          configuration.Development,
+		VerificationCode: configuration.VerificationCodeConfig{MaxCodesPerDay: 1},
+	})
+
+	if rec := postJSON(s, "/api/validate-email", `{"email": "john@example.com"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	rec := postJSON(s, "/api/validate-email", `{"email": "john@example.com"}`)
+	if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "today") {
+		t.Errorf("expected the daily limit message, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
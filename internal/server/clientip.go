@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Behind a reverse proxy the peer of every request is the proxy, so the address of the client is taken from
+// the X-Forwarded-For or X-Real-IP headers set by the proxy. The headers are only trusted when the peer is one
+// of the configured proxies, as any client can send them.
+
+type clientIPKey struct{}
+
+// parseTrustedProxies parses the trusted proxies of the configuration, as CIDR ranges or single addresses
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if prefix, err := netip.ParsePrefix(proxy); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an IP address or a CIDR range", proxy)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// trustedProxy reports whether the address is one of the trusted proxies
+func (s *Server) trustedProxy(addr netip.Addr) bool {
+	for _, prefix := range s.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP middleware resolves the address of the client of each request and stores it in the request context,
+// where clientIP finds it
+func (s *Server) ClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := s.resolveClientIP(r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+	})
+}
+
+// resolveClientIP returns the address of the client in its canonical form. When the peer is a trusted proxy,
+// it is the last address of X-Forwarded-For that is not a trusted proxy, or else the address of X-Real-IP.
+func (s *Server) resolveClientIP(r *http.Request) string {
+	peer, ok := parseIP(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !s.trustedProxy(peer) {
+		return peer.String()
+	}
+
+	// Each proxy appends the address of its peer, so the client is the first one from the right not trusted
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	var client netip.Addr
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, ok := parseIP(forwarded[i])
+		if !ok {
+			// The chain can not be followed beyond an invalid address
+			break
+		}
+		client = addr
+		if !s.trustedProxy(addr) {
+			break
+		}
+	}
+	if client.IsValid() {
+		return client.String()
+	}
+
+	if addr, ok := parseIP(r.Header.Get("X-Real-IP")); ok {
+		return addr.String()
+	}
+	return peer.String()
+}
+
+// parseIP parses an address with or without port, like "192.0.2.1", "[2001:db8::1]:443" or "2001:DB8::1",
+// without the zone and with the IPv4 addresses mapped to IPv6 as plain IPv4
+func parseIP(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().WithZone("").Unmap(), true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.WithZone("").Unmap(), true
+}
+
+// clientIP returns the IP address of the client that sent the request, as resolved by the ClientIP middleware,
+// or else of the peer
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	if addr, ok := parseIP(r.RemoteAddr); ok {
+		return addr.String()
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{
+		Runtime:        configuration.Development,
+		TrustedProxies: []string{"10.0.0.0/8", "2001:db8:ffff::/48", "192.0.2.10"},
+	})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		want       string
+	}{
+		{name: "direct client", remoteAddr: "198.51.100.7:51234", want: "198.51.100.7"},
+		{name: "direct IPv6 client", remoteAddr: "[2001:DB8:0:0::1]:51234", want: "2001:db8::1"},
+		{name: "IPv6 client with zone", remoteAddr: "[fe80::1%eth0]:51234", want: "fe80::1"},
+		{name: "IPv4-mapped client", remoteAddr: "[::ffff:198.51.100.7]:51234", want: "198.51.100.7"},
+		{name: "untrusted peer forging the headers", remoteAddr: "198.51.100.7:51234", forwarded: []string{"203.0.113.1"}, realIP: "203.0.113.2", want: "198.51.100.7"},
+		{name: "trusted proxy", remoteAddr: "10.1.2.3:40000", forwarded: []string{"203.0.113.1"}, want: "203.0.113.1"},
+		{name: "trusted single address", remoteAddr: "192.0.2.10:40000", forwarded: []string{"203.0.113.1"}, want: "203.0.113.1"},
+		{name: "trusted IPv6 proxy", remoteAddr: "[2001:db8:ffff::5]:40000", forwarded: []string{"2001:DB8:1::1"}, want: "2001:db8:1::1"},
+		{name: "chain of trusted proxies", remoteAddr: "10.1.2.3:40000", forwarded: []string{"203.0.113.1, 10.0.0.2", "10.0.0.3"}, want: "203.0.113.1"},
+		{name: "client forging the first address", remoteAddr: "10.1.2.3:40000", forwarded: []string{"1.1.1.1, 203.0.113.1"}, want: "203.0.113.1"},
+		{name: "forwarded address with port", remoteAddr: "10.1.2.3:40000", forwarded: []string{"[2001:db8:1::1]:443"}, want: "2001:db8:1::1"},
+		{name: "only trusted proxies forwarded", remoteAddr: "10.1.2.3:40000", forwarded: []string{"10.0.0.9, 10.0.0.2"}, want: "10.0.0.9"},
+		{name: "invalid forwarded address", remoteAddr: "10.1.2.3:40000", forwarded: []string{"unknown"}, want: "10.1.2.3"},
+		{name: "real ip header", remoteAddr: "10.1.2.3:40000", realIP: "203.0.113.2", want: "203.0.113.2"},
+		{name: "forwarded before real ip", remoteAddr: "10.1.2.3:40000", forwarded: []string{"203.0.113.1"}, realIP: "203.0.113.2", want: "203.0.113.1"},
+		{name: "trusted proxy without headers", remoteAddr: "10.1.2.3:40000", want: "10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/countries", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, header := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			if got := s.resolveClientIP(r); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/8", "::1", " 192.0.2.10 "}); err != nil {
+		t.Errorf("expected valid proxies, got %v", err)
+	}
+	for _, invalid := range []string{"10.0.0.0/33", "proxy.example.com", ""} {
+		if _, err := parseTrustedProxies([]string{invalid}); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestRateLimitBehindProxy(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development, TrustedProxies: []string{"10.0.0.0/8"}})
+
+	status := func(forwardedFor string) int {
+		r := httptest.NewRequest(http.MethodGet, "/api/registration-status?registration_id=x&token=y", nil)
+		r.RemoteAddr = "10.0.0.1:40000"
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+		rec := httptest.NewRecorder()
+		s.Handler.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	// The burst of a client is exhausted without affecting the other clients behind the same proxy
+	for range 5 {
+		status("203.0.113.1")
+	}
+	if code := status("203.0.113.1"); code != http.StatusTooManyRequests {
+		t.Errorf("expected the client to be limited, got %d", code)
+	}
+	if code := status("203.0.113.2"); code == http.StatusTooManyRequests {
+		t.Errorf("expected another client behind the proxy not to be limited")
+	}
+}
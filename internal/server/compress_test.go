@@ -0,0 +1,85 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func TestCompressLargeJSON(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{})
+
+	for _, acceptEncoding := range []string{"gzip, deflate, br", ""} {
+		req := httptest.NewRequest(http.MethodGet, "/api/countries", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		s.Handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected %d, got %d", http.StatusOK, rec.Code)
+		}
+		if !strings.Contains(strings.Join(rec.Header().Values("Vary"), ","), "Accept-Encoding") {
+			t.Errorf("expected Vary: Accept-Encoding, got %v", rec.Header().Values("Vary"))
+		}
+
+		body := io.Reader(rec.Body)
+		gzipped := rec.Header().Get("Content-Encoding") == "gzip"
+		if gzipped != (acceptEncoding != "") {
+			t.Fatalf("Accept-Encoding %q: expected gzipped %v, got %v", acceptEncoding, acceptEncoding != "", gzipped)
+		}
+		if gzipped {
+			gz, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatalf("expected a gzip body: %v", err)
+			}
+			body = gz
+		}
+		var resp APIResponse
+		if err := json.NewDecoder(body).Decode(&resp); err != nil || !resp.Success {
+			t.Errorf("expected the countries, got %+v: %v", resp, err)
+		}
+	}
+}
+
+func TestCompressSkips(t *testing.T) {
+	large := strings.Repeat("a", 2*minCompressSize)
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		header      map[string]string
+	}{
+		{name: "small body", contentType: "application/json", body: `{"success": true}`},
+		{name: "already compressed", contentType: "image/png", body: large},
+		{name: "event stream", contentType: "text/event-stream", body: large},
+		{name: "range", contentType: "text/html", body: large, header: map[string]string{"Range": "bytes=0-10"}},
+		{name: "gzip refused", contentType: "text/html", body: large, header: map[string]string{"Accept-Encoding": "gzip;q=0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				io.WriteString(w, tt.body)
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			for name, value := range tt.header {
+				req.Header.Set(name, value)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != tt.body {
+				t.Errorf("expected the body as it is, got %q encoded as %q", rec.Body.String(), rec.Header().Get("Content-Encoding"))
+			}
+		})
+	}
+}
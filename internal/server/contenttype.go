@@ -0,0 +1,31 @@
+package server
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// RequireJSON middleware rejects with 415 the requests with a body that is not declared as JSON, so a form or
+// plain text body gets a clear error instead of a failure to decode it. The only charset accepted is UTF-8, the
+// encoding of JSON. Requests without a body, like GET requests, are not checked.
+func (s *Server) RequireJSON(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength == 0 || r.Method == http.MethodGet || r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			s.SendJSON(w, http.StatusUnsupportedMediaType, false, "Content-Type must be application/json", nil)
+			return
+		}
+		if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") {
+			s.SendJSON(w, http.StatusUnsupportedMediaType, false, "Unsupported charset "+charset+", expected utf-8", nil)
+			return
+		}
+
+		next(w, r)
+	}
+}
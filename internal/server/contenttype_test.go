@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func TestRequireJSON(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		wantStatus  int
+	}{
+		{name: "json", contentType: "application/json", wantStatus: http.StatusBadRequest},
+		{name: "json with charset", contentType: "application/json; charset=UTF-8", wantStatus: http.StatusBadRequest},
+		{name: "missing", contentType: "", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "form", contentType: "application/x-www-form-urlencoded", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "plain text", contentType: "text/plain; charset=utf-8", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "other charset", contentType: "application/json; charset=iso-8859-1", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "malformed", contentType: "application/json; charset", wantStatus: http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development})
+
+			// The email is invalid, so a request accepted as JSON is rejected by the handler with 400
+			req := httptest.NewRequest(http.MethodPost, "/api/validate-email", strings.NewReader(`{"email": "not an email"}`))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			tokenRec := httptest.NewRecorder()
+			s.Handler.ServeHTTP(tokenRec, httptest.NewRequest(http.MethodGet, "/api/csrf", nil))
+			for _, cookie := range tokenRec.Result().Cookies() {
+				req.AddCookie(cookie)
+				req.Header.Set(csrfHeaderName, cookie.Value)
+			}
+
+			rec := httptest.NewRecorder()
+			s.Handler.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/hesusruiz/onboardng/common"
+)
+
+// countriesCacheControl lets browsers and proxies keep the list of countries for a day, as it only changes with a release
+const countriesCacheControl = "public, max-age=86400"
+
+// HandleCountries returns the countries accepted in the registrations, with their code and name.
+// It is the same list used to validate the registrations and to build the form, without the countries not accepted
+// by the configuration, so clients can stay in sync.
+// The names are in the language of the "lang" query parameter or of the Accept-Language header, English by default.
+func (s *Server) HandleCountries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lang := common.ResolveLanguage(requestLanguage(r), "")
+
+	w.Header().Set("Cache-Control", countriesCacheControl)
+	w.Header().Add("Vary", "Accept-Language")
+	countries := slices.DeleteFunc(common.LocalizedCountries(lang), func(c common.Country) bool {
+		return !s.Config.Countries.Accepts(c.Code)
+	})
+	s.SendJSON(w, http.StatusOK, true, "Supported countries", countries)
+}
+
+// requestLanguage returns the language asked in the "lang" query parameter, or else the first language of the
+// Accept-Language header without its region (e.g. "de" for "de-AT,de;q=0.9")
+func requestLanguage(r *http.Request) string {
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		return lang
+	}
+	first, _, _ := strings.Cut(r.Header.Get("Accept-Language"), ",")
+	first, _, _ = strings.Cut(first, ";")
+	first, _, _ = strings.Cut(first, "-")
+	return strings.TrimSpace(first)
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/common"
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func TestHandleCountriesAccepted(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{
+		Runtime:   configuration.Development,
+		Countries: configuration.CountryConfig{Allowed: []string{"ES", "PT", "FR"}, Blocked: []string{"FR"}},
+	})
+
+	rec := httptest.NewRecorder()
+	s.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, supportedCountriesPath, nil))
+	var resp struct {
+		Data []common.Country `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	var codes []string
+	for _, c := range resp.Data {
+		codes = append(codes, c.Code)
+	}
+	slices.Sort(codes)
+	if !slices.Equal(codes, []string{"ES", "PT"}) {
+		t.Errorf("expected only the accepted countries, got %v", codes)
+	}
+
+	cfg := configuration.EnvConfig{Countries: configuration.CountryConfig{Allowed: []string{"XX"}}}
+	if _, err := NewServer(cfg, nil, nil, nil, t.TempDir()); err == nil {
+		t.Errorf("expected an unsupported allowed country to be rejected")
+	}
+}
+
+func TestHandleCountries(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development})
+
+	tests := []struct {
+		name           string
+		query          string
+		acceptLanguage string
+		wantLang       string
+	}{
+		{name: "default", wantLang: "en"},
+		{name: "query parameter", query: "?lang=de", acceptLanguage: "fr", wantLang: "de"},
+		{name: "Accept-Language", acceptLanguage: "es-ES,es;q=0.9,en;q=0.8", wantLang: "es"},
+		{name: "unsupported language", query: "?lang=pl", wantLang: "en"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, supportedCountriesPath+tt.query, nil)
+			if tt.acceptLanguage != "" {
+				req.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+			rec := httptest.NewRecorder()
+			s.Handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+			}
+			if got := rec.Header().Get("Cache-Control"); got != countriesCacheControl {
+				t.Errorf("expected Cache-Control %q, got %q", countriesCacheControl, got)
+			}
+
+			var resp struct {
+				Success bool             `json:"success"`
+				Data    []common.Country `json:"data"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if !resp.Success || len(resp.Data) != len(common.Countries) {
+				t.Fatalf("expected the %d supported countries, got %s", len(common.Countries), rec.Body.String())
+			}
+			for i, c := range resp.Data {
+				want := common.Countries[i]
+				if c.Code != want.Code || c.Name != want.LocalizedName(tt.wantLang) {
+					t.Errorf("expected %s %q, got %s %q", want.Code, want.LocalizedName(tt.wantLang), c.Code, c.Name)
+				}
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	s.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, supportedCountriesPath, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected %d for POST, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
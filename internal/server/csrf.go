@@ -0,0 +1,69 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+// We protect the API with the double-submit cookie pattern: GET /api/csrf sets a random token in a cookie
+// and also returns it in the body. The page sends the token back in the X-CSRF-Token header, and a request is
+// accepted only if the header matches the cookie. Another site can make the browser send the cookie,
+// but can not read it to set the header.
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// HandleCSRFToken issues a new CSRF token, in a cookie and in the response body
+func (s *Server) HandleCSRFToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	// The page and the API are in different sites except in development, so the cookie must be
+	// sent in cross-site requests, which browsers only allow for secure cookies
+	cookie := &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     s.Config.Prefix() + "/api/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	}
+	if s.Config.Runtime == configuration.Development {
+		cookie.Secure = false
+		cookie.SameSite = http.SameSiteLaxMode
+	}
+	http.SetCookie(w, cookie)
+	w.Header().Set("Cache-Control", "no-store")
+
+	s.SendJSON(w, http.StatusOK, true, "CSRF token issued", map[string]string{"csrf_token": token})
+}
+
+// validateCSRF checks that the X-CSRF-Token header matches the CSRF cookie.
+// During the deprecation period, and only if enabled in the configuration, a request without
+// a CSRF token is still accepted if it has the X-Requested-With header.
+func (s *Server) validateCSRF(r *http.Request) bool {
+	header := r.Header.Get(csrfHeaderName)
+	cookie, err := r.Cookie(csrfCookieName)
+	if header != "" && err == nil && cookie.Value != "" {
+		return subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) == 1
+	}
+
+	if s.Config.CSRF.AllowLegacyHeader && r.Header.Get("X-Requested-With") != "" {
+		slog.Warn("⚠️ Request accepted with the deprecated X-Requested-With CSRF check", "path", r.URL.Path)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func TestHandleCSRFToken(t *testing.T) {
+	tests := []struct {
+		runtime    configuration.RuntimeEnv
+		wantSecure bool
+		wantSite   http.SameSite
+	}{
+		{runtime: configuration.Development, wantSecure: false, wantSite: http.SameSiteLaxMode},
+		{runtime: configuration.Production, wantSecure: true, wantSite: http.SameSiteNoneMode},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.runtime), func(t *testing.T) {
+			s := newTestServer(t, configuration.EnvConfig{Runtime: tt.runtime})
+
+			rec := httptest.NewRecorder()
+			s.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/csrf", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected %d, got %d", http.StatusOK, rec.Code)
+			}
+
+			var resp struct {
+				Data struct {
+					Token string `json:"csrf_token"`
+				} `json:"data"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			cookies := rec.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Name != csrfCookieName {
+				t.Fatalf("expected the %s cookie, got %v", csrfCookieName, cookies)
+			}
+			c := cookies[0]
+			if resp.Data.Token == "" || c.Value != resp.Data.Token {
+				t.Errorf("the token in the body %q does not match the cookie %q", resp.Data.Token, c.Value)
+			}
+			if !c.HttpOnly || c.Secure != tt.wantSecure || c.SameSite != tt.wantSite {
+				t.Errorf("unexpected cookie attributes: %+v", c)
+			}
+		})
+	}
+}
+
+func TestValidateCSRF(t *testing.T) {
+	tests := []struct {
+		name          string
+		allowLegacy   bool
+		cookie        string
+		header        string
+		requestedWith bool
+		want          bool
+	}{
+		{name: "matching token", cookie: "abc", header: "abc", want: true},
+		{name: "mismatched token", cookie: "abc", header: "abd", want: false},
+		{name: "header without cookie", header: "abc", want: false},
+		{name: "cookie without header", cookie: "abc", want: false},
+		{name: "legacy header rejected by default", requestedWith: true, want: false},
+		{name: "legacy header accepted when allowed", allowLegacy: true, requestedWith: true, want: true},
+		{name: "mismatched token is not rescued by the legacy header", allowLegacy: true, cookie: "abc", header: "abd", requestedWith: true, want: false},
+		{name: "nothing", allowLegacy: true, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, configuration.EnvConfig{
+				Runtime: configuration.Development,
+				CSRF:    configuration.CSRFConfig{AllowLegacyHeader: tt.allowLegacy},
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/api/register", nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: tt.cookie})
+			}
+			if tt.header != "" {
+				req.Header.Set(csrfHeaderName, tt.header)
+			}
+			if tt.requestedWith {
+				req.Header.Set("X-Requested-With", "XMLHttpRequest")
+			}
+
+			if got := s.validateCSRF(req); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// SendDailyDigests sends the digest of the registrations of the previous day at the configured time every day,
+// until the context is done. It is started in its own goroutine when the daily digest is enabled.
+func (s *Server) SendDailyDigests(ctx context.Context) {
+	cfg := s.Config.Mail.DailyDigest
+	if !cfg.Enabled || s.DB == nil {
+		return
+	}
+	hour, minute, err := cfg.ScheduledAt()
+	if err != nil {
+		slog.Error("❌ Daily digest not scheduled", "error", err)
+		return
+	}
+
+	for {
+		next := nextDailyRun(s.now(), hour, minute)
+		slog.Info("Daily digest scheduled", "at", next)
+
+		timer := time.NewTimer(next.Sub(s.now()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		s.sendDailyDigest(ctx, next.AddDate(0, 0, -1))
+	}
+}
+
+// nextDailyRun returns the next time after now at the given hour and minute
+func nextDailyRun(now time.Time, hour int, minute int) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// sendDailyDigest sends the digest of the registrations of the day, logging the result
+func (s *Server) sendDailyDigest(ctx context.Context, day time.Time) {
+	sent, err := s.Mail.SendDailyDigest(s.DB, day)
+	if err != nil {
+		slog.ErrorContext(ctx, "❌ Error sending the daily digest", "day", day.Format(time.DateOnly), "error", err)
+		return
+	}
+	if sent {
+		slog.InfoContext(ctx, "📧 Daily digest sent", "day", day.Format(time.DateOnly))
+	} else {
+		slog.InfoContext(ctx, "Daily digest not sent", "day", day.Format(time.DateOnly))
+	}
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextDailyRun(t *testing.T) {
+	day := func(d, hour, minute int) time.Time { return time.Date(2026, 3, d, hour, minute, 0, 0, time.Local) }
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want time.Time
+	}{
+		{name: "before the time", now: day(10, 7, 30), want: day(10, 8, 0)},
+		{name: "at the time", now: day(10, 8, 0), want: day(11, 8, 0)},
+		{name: "after the time", now: day(10, 9, 0), want: day(11, 8, 0)},
+		{name: "end of the month", now: day(31, 23, 0), want: time.Date(2026, 4, 1, 8, 0, 0, 0, time.Local)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextDailyRun(tt.now, 8, 0); !got.Equal(tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+	"github.com/hesusruiz/onboardng/internal/mail"
+	"github.com/hesusruiz/onboardng/internal/mail/mailtest"
+)
+
+// The tests of the full registration flow run the real server with an in-memory database, a mock Issuer and
+// a mock SMTP server, and go through the same requests as the registration page.
+
+// testRegistrationRequest returns a valid registration request, changed by the given options
+func testRegistrationRequest(options ...func(*RegistrationRequest)) RegistrationRequest {
+	req := RegistrationRequest{
+		FirstName:   "Jane",
+		LastName:    "Doe",
+		CompanyName: "ACME",
+		Country:     "ES",
+		VatId:       "B12345678",
+		Email:       "jane@example.com",
+	}
+	for _, option := range options {
+		option(&req)
+	}
+	return req
+}
+
+// testFlowConfig returns the configuration of a production server accepting only verified emails,
+// sending the emails with the given SMTP configuration
+func testFlowConfig(smtp configuration.SMTPConfig) configuration.EnvConfig {
+	return configuration.EnvConfig{
+		Runtime:              configuration.Production,
+		RequireVerifiedEmail: true,
+		Mail: configuration.MailConfig{
+			OnboardTeamEmail: []string{"onboarding@example.com"},
+			IssuerTeamEmail:  []string{"issuer@example.com"},
+			SMTP:             smtp,
+		},
+	}
+}
+
+// testFlow is a server with all its dependencies, to follow a registration from the start
+type testFlow struct {
+	s    *Server
+	db   *db.Service
+	smtp *mailtest.SMTPServer
+	// issuanceRequests receives the body of the requests to the Issuer
+	issuanceRequests chan string
+}
+
+// newTestFlow starts a server whose Issuer replies with the given handler after recording the request
+func newTestFlow(t *testing.T, issue http.HandlerFunc) *testFlow {
+	t.Helper()
+
+	f := &testFlow{
+		smtp:             mailtest.StartSMTPServer(t),
+		issuanceRequests: make(chan string, 8),
+	}
+	cfg := testFlowConfig(f.smtp.Config(t))
+
+	dbService, err := db.Open("file:/"+t.Name()+"?vfs=memdb", cfg.Runtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbService.Close() })
+	f.db = dbService
+
+	mailService, err := mail.NewMailService(cfg.Runtime, cfg.Mail, os.DirFS("../../src/email"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.s, err = NewServer(cfg, dbService, nil, mailService, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.s.Issuer = newTestIssuer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		f.issuanceRequests <- string(body)
+		issue(w, r)
+	})
+	return f
+}
+
+// call sends a request to the API and decodes the data of the response into data, if not nil
+func (f *testFlow) call(t *testing.T, path string, body any, wantStatus int, data any) {
+	t.Helper()
+	buf, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := postJSON(f.s, path, string(buf))
+	if rec.Code != wantStatus {
+		t.Fatalf("%s: expected %d, got %d: %s", path, wantStatus, rec.Code, rec.Body.String())
+	}
+	if data == nil {
+		return
+	}
+	resp := APIResponse{Data: data}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s: invalid response: %v", path, err)
+	}
+}
+
+// verificationCodeInEmail finds the code of the default format in the email with the verification code
+var verificationCodeInEmail = regexp.MustCompile(`(\d{6})</div>`)
+
+// verifyEmail asks for a verification code for the email and sends back the one received by email, like the user
+// of the registration page
+func (f *testFlow) verifyEmail(t *testing.T, email string) {
+	t.Helper()
+	var sent struct {
+		Code string `json:"code"`
+	}
+	f.call(t, "/api/validate-email", map[string]string{"email": email}, http.StatusOK, &sent)
+	if sent.Code != "" {
+		t.Fatalf("expected the code to be sent only by email in production, got %q", sent.Code)
+	}
+
+	recipients, message := f.smtp.Receive(t)
+	if !slices.Equal(recipients, []string{email}) {
+		t.Fatalf("expected the verification code to be sent to %s, got %v", email, recipients)
+	}
+	match := verificationCodeInEmail.FindStringSubmatch(message)
+	if match == nil {
+		t.Fatalf("expected a verification code in the email: %s", message)
+	}
+	f.call(t, "/api/verify-code", map[string]string{"email": email, "code": match[1]}, http.StatusOK, nil)
+}
+
+// receiveEmails waits for n emails, returning them by their first recipient
+func (f *testFlow) receiveEmails(t *testing.T, n int) map[string]string {
+	t.Helper()
+	emails := make(map[string]string)
+	for range n {
+		recipients, message := f.smtp.Receive(t)
+		if len(recipients) == 0 {
+			t.Fatalf("expected the recipients of the email: %s", message)
+		}
+		emails[recipients[0]] = message
+	}
+	return emails
+}
+
+func TestRegistrationFlow(t *testing.T) {
+	f := newTestFlow(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"credential_id": "cred-1", "credential_offer_uri": "https://issuer.example.com/offers/1"}`))
+	})
+	req := testRegistrationRequest()
+
+	// The registration is rejected until the email is verified
+	f.call(t, "/api/register", req, http.StatusForbidden, nil)
+	f.verifyEmail(t, req.Email)
+
+	var result registrationResult
+	f.call(t, "/api/register", req, http.StatusOK, &result)
+	if result.RegistrationID == "" || result.CredentialID != "cred-1" || result.StatusToken == "" {
+		t.Fatalf("unexpected registration result %+v", result)
+	}
+
+	// The Issuer receives the data of the registration
+	issuance := <-f.issuanceRequests
+	if !strings.Contains(issuance, `"organizationIdentifier":"ES-B12345678"`) || !strings.Contains(issuance, `"email":"jane@example.com"`) {
+		t.Errorf("unexpected issuance request %s", issuance)
+	}
+
+	reg, err := f.db.GetRegistrationByID(result.RegistrationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.Email != req.Email || reg.CompanyName != req.CompanyName || reg.VatID != req.VatId || reg.Country != req.Country {
+		t.Errorf("unexpected registration saved %+v", reg)
+	}
+	if reg.Status != db.StatusIssued || reg.CredentialID != "cred-1" || reg.IssuanceError != "" {
+		t.Errorf("expected the credential to be issued, got status %q, credential %q and error %q", reg.Status, reg.CredentialID, reg.IssuanceError)
+	}
+	if reg.NotifEmailAt.IsZero() || reg.DeliveryStatus != db.DeliverySent {
+		t.Errorf("expected the welcome email to be recorded, got %v and %q", reg.NotifEmailAt, reg.DeliveryStatus)
+	}
+
+	// The user receives the welcome email with the credential offer
+	recipients, welcome := f.smtp.Receive(t)
+	if !slices.Contains(recipients, req.Email) {
+		t.Errorf("expected the welcome email to be sent to %s, got %v", req.Email, recipients)
+	}
+	if !strings.Contains(welcome, result.RegistrationID) {
+		t.Errorf("expected the registration id in the welcome email, got: %s", welcome)
+	}
+
+	// The verification was consumed by the registration, and no other code is sent for a registered email
+	f.call(t, "/api/register", req, http.StatusForbidden, nil)
+	f.call(t, "/api/validate-email", map[string]string{"email": req.Email}, http.StatusConflict, nil)
+}
+
+func TestRegistrationFlowIssuerFailure(t *testing.T) {
+	f := newTestFlow(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	req := testRegistrationRequest(func(r *RegistrationRequest) {
+		r.Email = "john@example.com"
+		r.FirstName = "John"
+	})
+
+	f.verifyEmail(t, req.Email)
+	var result registrationResult
+	f.call(t, "/api/register", req, http.StatusOK, &result)
+
+	reg, err := f.db.GetRegistrationByID(result.RegistrationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.Status != db.StatusFailed || reg.IssuanceError == "" {
+		t.Errorf("expected the issuance to fail, got status %q and error %q", reg.Status, reg.IssuanceError)
+	}
+	// The response of the Issuer is kept to diagnose the failure
+	if resp, err := f.db.GetIssuerResponse(result.RegistrationID); err != nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected the response of the Issuer to be saved, got %+v: %v", resp, err)
+	}
+
+	// The issuer team is told about the error, and the user gets the welcome email anyway
+	emails := f.receiveEmails(t, 2)
+	if msg, ok := emails["issuer@example.com"]; !ok || !strings.Contains(msg, result.RegistrationID) {
+		t.Errorf("expected the issuer error email with the registration id, got %v", emails)
+	}
+	if _, ok := emails[req.Email]; !ok {
+		t.Errorf("expected the welcome email to %s, got %v", req.Email, emails)
+	}
+}
+
+func TestRegistrationFlowIssuerErrorResponse(t *testing.T) {
+	// The Issuer accepts the request but reports an error in the body
+	f := newTestFlow(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"error": "invalid_request", "error_description": "The mandator is missing"}`))
+	})
+	req := testRegistrationRequest()
+
+	f.verifyEmail(t, req.Email)
+	var result registrationResult
+	f.call(t, "/api/register", req, http.StatusOK, &result)
+	if result.CredentialID != "" {
+		t.Errorf("expected no credential, got %q", result.CredentialID)
+	}
+
+	reg, err := f.db.GetRegistrationByID(result.RegistrationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.Status != db.StatusFailed || !strings.Contains(reg.IssuanceError, "The mandator is missing") {
+		t.Errorf("expected the issuance to fail with the error of the Issuer, got status %q and error %q", reg.Status, reg.IssuanceError)
+	}
+	if emails := f.receiveEmails(t, 2); emails["issuer@example.com"] == "" {
+		t.Errorf("expected the issuer team to be told about the error, got %v", emails)
+	}
+}
+
+func TestRegistrationFlowResendWelcome(t *testing.T) {
+	f := newTestFlow(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"credential_id": "cred-1", "credential_offer_uri": "https://issuer.example.com/offers/1"}`))
+	})
+	req := testRegistrationRequest()
+	f.verifyEmail(t, req.Email)
+
+	var result registrationResult
+	f.call(t, "/api/register", req, http.StatusOK, &result)
+	f.smtp.Receive(t)
+
+	// The admin endpoints are not served without a token in production, so the handler is called directly
+	resend := func(method string, registrationID string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/admin/registrations/"+registrationID+"/resend-welcome", nil)
+		r.SetPathValue("id", registrationID)
+		rec := httptest.NewRecorder()
+		f.s.HandleAdminResendWelcome(rec, r)
+		return rec
+	}
+
+	rec := resend(http.MethodPost, result.RegistrationID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var status welcomeEmailStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &APIResponse{Data: &status}); err != nil {
+		t.Fatal(err)
+	}
+	if status.RegistrationID != result.RegistrationID || status.NotifEmailAt.IsZero() || status.NotifEmailError != "" || status.DeliveryStatus != db.DeliverySent {
+		t.Errorf("unexpected email status %+v", status)
+	}
+
+	recipients, welcome := f.smtp.Receive(t)
+	if !slices.Contains(recipients, req.Email) || !strings.Contains(welcome, result.RegistrationID) {
+		t.Errorf("expected the welcome email to be sent again to %s, got %v: %s", req.Email, recipients, welcome)
+	}
+
+	// The credential is not issued again
+	select {
+	case <-f.issuanceRequests:
+	default:
+		t.Fatal("expected the issuance request of the registration")
+	}
+	select {
+	case issuance := <-f.issuanceRequests:
+		t.Errorf("unexpected issuance request %s", issuance)
+	default:
+	}
+
+	if rec := resend(http.MethodPost, "unknown"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown registration, got %d", rec.Code)
+	}
+	if rec := resend(http.MethodGet, result.RegistrationID); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET, got %d", rec.Code)
+	}
+}
+
+func TestRegistrationFlowExtraFields(t *testing.T) {
+	f := newTestFlow(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"credential_id": "cred-1"}`))
+	})
+	f.s.Config.AdditionalClaims = map[string]any{"program": "DOME"}
+	f.s.Config.ExtraFields = []configuration.ExtraFieldConfig{
+		{Name: "department", Required: true},
+		{Name: "jobTitle", Claim: "role", MaxLength: 10},
+	}
+	f.verifyEmail(t, "jane@example.com")
+
+	// The extra fields are checked against the configuration
+	for _, extra := range []map[string]string{
+		{"jobTitle": "Manager"},
+		{"department": "Sales", "salary": "1000"},
+		{"department": "Sales", "jobTitle": "Chief Executive Officer"},
+	} {
+		req := testRegistrationRequest(func(r *RegistrationRequest) { r.Extra = extra })
+		f.call(t, "/api/register", req, http.StatusBadRequest, nil)
+	}
+
+	req := testRegistrationRequest(func(r *RegistrationRequest) {
+		r.Extra = map[string]string{"department": " Sales ", "jobTitle": "Manager"}
+	})
+	var result registrationResult
+	f.call(t, "/api/register", req, http.StatusOK, &result)
+
+	// The Issuer receives them as claims of the payload, with the additional claims of the configuration
+	issuance := <-f.issuanceRequests
+	for _, claim := range []string{`"department":"Sales"`, `"role":"Manager"`, `"program":"DOME"`} {
+		if !strings.Contains(issuance, claim) {
+			t.Errorf("expected %s in the issuance request %s", claim, issuance)
+		}
+	}
+
+	// They are kept with the registration, to issue the credential again
+	reg, err := f.db.GetRegistrationByID(result.RegistrationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.ExtraFields["department"] != "Sales" || reg.ExtraFields["jobTitle"] != "Manager" {
+		t.Errorf("unexpected extra fields saved %v", reg.ExtraFields)
+	}
+}
@@ -1,19 +1,28 @@
 package server
 
 import (
-	"crypto/rand"
+	"cmp"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"log/slog"
-	"math/big"
+	"maps"
 	"net/http"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/hesusruiz/onboardng/common"
 	"github.com/hesusruiz/onboardng/credissuance"
+	"github.com/hesusruiz/onboardng/internal/configuration"
 	"github.com/hesusruiz/onboardng/internal/db"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // APIResponse is the reply to the API calls
@@ -30,7 +39,10 @@ type RegistrationRequest struct {
 	Country     string `json:"country"`
 	VatId       string `json:"vatId"`
 	Email       string `json:"email"`
-	Website     string `json:"website"`
+	// Language overrides the language derived from the country for the emails we send
+	Language string `json:"language"`
+	// Extra are the fields of the form added to the claims of the credential, accepted only if in the configuration
+	Extra map[string]string `json:"extra,omitempty"`
 }
 
 // SendJSON utility helper
@@ -44,12 +56,37 @@ func (s *Server) SendJSON(w http.ResponseWriter, status int, success bool, messa
 	})
 }
 
-// EnableCORS middleware to allow all origins
+// decodeJSON decodes the JSON body of a request, rejecting the fields not in v so typos in the names are reported
+func decodeJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// The methods and headers that pages in the allowed origins can use when calling the API
+const (
+	corsAllowedMethods = "GET, POST, OPTIONS"
+	corsAllowedHeaders = "Content-Type, X-Requested-With, X-CSRF-Token, Idempotency-Key"
+)
+
+// EnableCORS middleware to allow calls from the origins in the configuration.
+// The Origin of the request is echoed back only if it is allowed, and credentials are allowed for the listed origins
+// so the browser sends the CSRF cookie. The origins only matched by the wildcard get no credentials, as otherwise any
+// site could read a CSRF token and use it. Requests from other origins get no CORS headers, so the browser blocks them.
 func (s *Server) EnableCORS(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Requested-With, Authorization")
+		// The response depends on the Origin, caches must not share it between origins
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		if origin != "" && s.Config.OriginAllowed(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if s.Config.OriginListed(origin) {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+		}
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusNoContent)
@@ -60,64 +97,90 @@ func (s *Server) EnableCORS(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// validateCSRF checks the X-Requested-With header
-func validateCSRF(r *http.Request) bool {
-	return r.Header.Get("X-Requested-With") != ""
-}
-
-func generateCode() string {
-	n, _ := rand.Int(rand.Reader, big.NewInt(1000000))
-	return fmt.Sprintf("%06d", n)
-}
-
 // isValidEmail checks if the email address provided has a valid format
 func isValidEmail(email string) bool {
 	re := regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,}$`)
 	return re.MatchString(strings.ToLower(email))
 }
 
-// generateRegistrationID creates a human-readable but unguessable ID in the format YYYYMMDD-{8-digit}
-func generateRegistrationID() string {
-	dateStr := time.Now().Format("20060102")
-	n, _ := rand.Int(rand.Reader, big.NewInt(100000000)) // 8 digits
-	return fmt.Sprintf("%s-%08d", dateStr, n)
-}
-
 func (s *Server) HandleValidateEmail(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	if !validateCSRF(r) {
-		s.SendJSON(w, http.StatusForbidden, false, "Security check failed: missing CSRF header", nil)
+	if !s.validateCSRF(r) {
+		s.SendJSON(w, http.StatusForbidden, false, "Security check failed: missing or invalid CSRF token", nil)
 		return
 	}
 
 	var req struct {
 		Email string `json:"email"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		s.SendJSON(w, http.StatusBadRequest, false, "Invalid request body", nil)
+	if err := decodeJSON(r, &req); err != nil {
+		s.sendBodyError(w, err)
 		return
 	}
+	req.Email = normalizeEmail(req.Email)
 
 	if req.Email == "" || !isValidEmail(req.Email) {
 		s.SendJSON(w, http.StatusBadRequest, false, "A valid email is required", nil)
 		return
 	}
 
+	// In production the registration would be rejected, so do not make the user verify the email first.
+	// Development and preproduction amend the existing registration instead.
+	if s.Config.Runtime == configuration.Production {
+		_, err := s.DB.GetRegistrationByEmailContext(r.Context(), req.Email)
+		if err == nil {
+			s.SendJSON(w, http.StatusConflict, false, s.duplicateRegistrationMessage(db.ErrDuplicateEmail), nil)
+			return
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.ErrorContext(r.Context(), "❌ Error looking up registration by email", "error", err)
+			s.SendJSON(w, http.StatusInternalServerError, false, "Failed to validate the email", nil)
+			return
+		}
+	}
+
 	// Rate limiting
-	if !s.RegisterEmailAttempt(req.Email) {
-		s.SendJSON(w, http.StatusTooManyRequests, false, "Too many requests. Please wait a few minutes.", nil)
+	if err := s.RegisterEmailAttempt(req.Email); err != nil {
+		message := "Too many requests. Please wait a few minutes."
+		if errors.Is(err, ErrDailyCodeLimit) {
+			message = "Too many codes requested for this email today. Please try again tomorrow."
+		}
+		s.SendJSON(w, http.StatusTooManyRequests, false, message, nil)
 		return
 	}
 
 	// Generate and store code
-	code := generateCode()
-	s.StoreVerificationCode(req.Email, code)
+	code, err := s.generateCode()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "❌ Error generating verification code", "error", err)
+		s.SendJSON(w, http.StatusInternalServerError, false, "Failed to generate the verification code", nil)
+		return
+	}
+	if err := s.StoreVerificationCode(req.Email, code); err != nil {
+		slog.ErrorContext(r.Context(), "❌ Error storing verification code", "error", err)
+		s.SendJSON(w, http.StatusInternalServerError, false, "Failed to generate the verification code", nil)
+		return
+	}
+
+	_, span := startSpan(r.Context(), "SendVerificationCode")
+	err = s.Mail.SendVerificationCode(req.Email, code)
+	endSpan(span, err)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "❌ Error sending verification code", "error", err)
+		s.SendJSON(w, http.StatusBadGateway, false, "Failed to send the verification code", nil)
+		return
+	}
 
-	s.SendJSON(w, http.StatusOK, true, "Validation code sent to your email", map[string]string{"code": code})
+	// Only development shows the code to the caller, elsewhere it proves that the user receives the emails
+	var data any
+	if s.Config.Runtime == configuration.Development {
+		data = map[string]string{"code": code}
+	}
+	s.SendJSON(w, http.StatusOK, true, "Validation code sent to your email", data)
 }
 
 func (s *Server) HandleVerifyCode(w http.ResponseWriter, r *http.Request) {
@@ -126,8 +189,8 @@ func (s *Server) HandleVerifyCode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !validateCSRF(r) {
-		s.SendJSON(w, http.StatusForbidden, false, "Security check failed: missing CSRF header", nil)
+	if !s.validateCSRF(r) {
+		s.SendJSON(w, http.StatusForbidden, false, "Security check failed: missing or invalid CSRF token", nil)
 		return
 	}
 
@@ -135,47 +198,257 @@ func (s *Server) HandleVerifyCode(w http.ResponseWriter, r *http.Request) {
 		Email string `json:"email"`
 		Code  string `json:"code"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		s.SendJSON(w, http.StatusBadRequest, false, "Invalid request body", nil)
+	if err := decodeJSON(r, &req); err != nil {
+		s.sendBodyError(w, err)
 		return
 	}
+	req.Email = normalizeEmail(req.Email)
 
-	if !s.VerifyCode(req.Email, req.Code) {
-		s.SendJSON(w, http.StatusBadRequest, false, "Invalid verification code", nil)
+	if err := s.VerifyCode(req.Email, normalizeCode(req.Code)); err != nil {
+		if errors.Is(err, ErrTooManyAttempts) {
+			slog.WarnContext(r.Context(), "⚠️ Verification code invalidated after too many failed attempts", "email", req.Email, "ip", clientIP(r))
+			s.SendJSON(w, http.StatusTooManyRequests, false, "Too many failed attempts, please request a new verification code", nil)
+			return
+		}
+		message := "Invalid verification code"
+		if errors.Is(err, ErrCodeExpired) {
+			message = "Verification code expired, please request a new one"
+		}
+		s.SendJSON(w, http.StatusBadRequest, false, message, nil)
 		return
 	}
 
 	s.SendJSON(w, http.StatusOK, true, "Email verified successfully", nil)
 }
 
-func (s *RegistrationRequest) Validate() error {
-	if s.FirstName == "" {
-		return fmt.Errorf("first name is required")
+// Normalize removes the surrounding whitespace of all fields, and puts the codes and the email in their canonical case,
+// so they are validated, stored and issued in the same form whatever the user typed
+func (s *RegistrationRequest) Normalize() {
+	s.FirstName = strings.TrimSpace(s.FirstName)
+	s.LastName = strings.TrimSpace(s.LastName)
+	s.CompanyName = strings.TrimSpace(s.CompanyName)
+	s.Country = strings.ToUpper(strings.TrimSpace(s.Country))
+	// VAT IDs are often written with spaces between the country prefix and the number
+	s.VatId = strings.ToUpper(strings.Join(strings.Fields(s.VatId), ""))
+	s.Email = normalizeEmail(s.Email)
+	s.Language = strings.ToLower(strings.TrimSpace(s.Language))
+	for name, value := range s.Extra {
+		if value = strings.TrimSpace(value); value == "" {
+			delete(s.Extra, name)
+		} else {
+			s.Extra[name] = value
+		}
+	}
+}
+
+// normalizeEmail returns the email without surrounding whitespace and in lower case
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// The limits of the length of the fields of the registrations, in characters. They keep huge values out of the
+// database and the credentials, while fitting any real name, company, VAT ID and email.
+const (
+	maxNameLength        = 100
+	minCompanyNameLength = 2
+	maxCompanyNameLength = 200
+	minVatIDLength       = 4
+	maxVatIDLength       = 32
+	minEmailLength       = 6
+	maxEmailLength       = 254
+)
+
+// ValidationErrors maps the JSON names of the invalid fields of a request to what is wrong with them,
+// so the form can highlight all of them at once. The extra fields are named "extra.<name>".
+type ValidationErrors map[string]string
+
+// registrationFields are the fields of the registration requests, in the order of the form
+var registrationFields = []string{"firstName", "lastName", "companyName", "country", "vatId", "email"}
+
+// Error returns the messages of all the fields, in the order of the form
+func (e ValidationErrors) Error() string {
+	fields := slices.SortedFunc(maps.Keys(e), func(a, b string) int {
+		return cmp.Or(cmp.Compare(formIndex(a), formIndex(b)), strings.Compare(a, b))
+	})
+	messages := make([]string, len(fields))
+	for i, field := range fields {
+		messages[i] = e[field]
 	}
-	if s.LastName == "" {
-		return fmt.Errorf("last name is required")
+	return strings.Join(messages, "; ")
+}
+
+// formIndex returns the position of the field in the form, the extra fields at the end
+func formIndex(field string) int {
+	if i := slices.Index(registrationFields, field); i >= 0 {
+		return i
 	}
-	if s.CompanyName == "" {
-		return fmt.Errorf("company name is required")
+	return len(registrationFields)
+}
+
+// Validate checks all the fields of the request, returning the ValidationErrors of the invalid ones
+func (s *RegistrationRequest) Validate() error {
+	if errs := s.validate(); len(errs) > 0 {
+		return errs
 	}
+	return nil
+}
+
+// validate returns the errors of the invalid fields of the request, empty if all are valid
+func (s *RegistrationRequest) validate() ValidationErrors {
+	errs := make(ValidationErrors)
+	errs.check("firstName", requiredLength("first name", s.FirstName, 1, maxNameLength))
+	errs.check("lastName", requiredLength("last name", s.LastName, 1, maxNameLength))
+	errs.check("companyName", requiredLength("company name", s.CompanyName, minCompanyNameLength, maxCompanyNameLength))
 	if s.Country == "" {
-		return fmt.Errorf("country is required")
+		errs["country"] = "country is required"
+	}
+	errs.check("vatId", requiredLength("VAT ID", s.VatId, minVatIDLength, maxVatIDLength))
+	if err := requiredLength("email", s.Email, minEmailLength, maxEmailLength); err != nil {
+		errs.check("email", err)
+	} else if !isValidEmail(s.Email) {
+		errs["email"] = "invalid email address format"
 	}
-	if !common.IsValidCountry(s.Country) {
-		return fmt.Errorf("invalid country code")
+	return errs
+}
+
+// check records the error of the field, if any
+func (e ValidationErrors) check(field string, err error) {
+	if err != nil {
+		e[field] = err.Error()
 	}
-	if s.VatId == "" {
-		return fmt.Errorf("VAT ID is required")
+}
+
+// requiredLength rejects the value of the field when empty, or with fewer than min or more than max characters
+func requiredLength(field string, value string, min int, max int) error {
+	if value == "" {
+		return fmt.Errorf("%s is required", field)
 	}
-	if s.Email == "" {
-		return fmt.Errorf("email is required")
+	return validateLength(field, value, min, max)
+}
+
+// validateLength rejects the value of the field with fewer than min or more than max characters
+func validateLength(field string, value string, min int, max int) error {
+	length := utf8.RuneCountInString(value)
+	if length < min {
+		return fmt.Errorf("%s must have at least %d characters", field, min)
 	}
-	if !isValidEmail(s.Email) {
-		return fmt.Errorf("invalid email address format")
+	if length > max {
+		return fmt.Errorf("%s must have at most %d characters", field, max)
 	}
 	return nil
 }
 
+// validateExtraFields records in errs the extra fields not in the configuration or too long, and the required ones
+// missing
+func (s *Server) validateExtraFields(extra map[string]string, errs ValidationErrors) {
+	for name, value := range extra {
+		f, ok := s.Config.ExtraField(name)
+		if !ok {
+			errs["extra."+name] = fmt.Sprintf("unknown extra field %q", name)
+			continue
+		}
+		maxLength := f.MaxLength
+		if maxLength == 0 {
+			maxLength = configuration.DefaultExtraFieldMaxLength
+		}
+		if utf8.RuneCountInString(value) > maxLength {
+			errs["extra."+name] = fmt.Sprintf("extra field %q is longer than %d characters", name, maxLength)
+		}
+	}
+	for _, f := range s.Config.ExtraFields {
+		if _, ok := extra[f.Name]; f.Required && !ok {
+			errs["extra."+f.Name] = fmt.Sprintf("extra field %q is required", f.Name)
+		}
+	}
+}
+
+// supportedCountriesPath is the API endpoint listing the country codes we accept
+const supportedCountriesPath = "/api/countries"
+
+// resolveCountry applies the configured policy when the country of the request is not in common.Countries,
+// and rejects the countries not accepted by the allowed and blocked countries of the configuration.
+// It may replace the country of the request, and returns a note to store with the registration when
+// the registration has to be reviewed manually.
+func (s *Server) resolveCountry(ctx context.Context, req *RegistrationRequest) (reviewNote string, err error) {
+	if !common.IsValidCountry(req.Country) {
+		reviewNote, err = s.resolveUnknownCountry(ctx, req)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if !s.Config.Countries.Accepts(req.Country) {
+		slog.InfoContext(ctx, "Registration from a country not accepted by the configuration rejected", "country", req.Country, "email", req.Email)
+		return "", fmt.Errorf("registrations from country %q are not accepted, see %s for the list of accepted countries", req.Country, supportedCountriesPath)
+	}
+	return reviewNote, nil
+}
+
+// resolveUnknownCountry applies the configured policy to a country that is not in common.Countries
+func (s *Server) resolveUnknownCountry(ctx context.Context, req *RegistrationRequest) (reviewNote string, err error) {
+	cfg := s.Config.Countries
+	switch cfg.UnknownPolicy {
+	case configuration.FlagUnknownCountry:
+		slog.WarnContext(ctx, "⚠️ Accepting registration with unsupported country, flagged for review", "country", req.Country, "email", req.Email)
+		return fmt.Sprintf("unsupported country code %q", req.Country), nil
+
+	case configuration.DefaultUnknownCountry:
+		if common.IsValidCountry(cfg.DefaultCountry) {
+			slog.WarnContext(ctx, "⚠️ Replacing unsupported country with the default one", "country", req.Country, "default", cfg.DefaultCountry, "email", req.Email)
+			req.Country = cfg.DefaultCountry
+			return "", nil
+		}
+		slog.ErrorContext(ctx, "❌ The configured default country is not supported, rejecting registration", "default", cfg.DefaultCountry)
+	}
+
+	return "", fmt.Errorf("country code %q is not supported, see %s for the list of supported countries", req.Country, supportedCountriesPath)
+}
+
+// botAttempts counts the registrations caught by the traps of the form since the server started
+var botAttempts = expvar.NewInt("onboarding_bot_attempts")
+
+// recordBotAttempt logs and stores a registration caught by a trap of the form, a honeypot field or the fill time.
+// Failing to store it is only logged, as the bot gets a fake success anyway.
+func (s *Server) recordBotAttempt(r *http.Request, email string, trap string) {
+	botAttempts.Add(1)
+
+	attempt := &db.BotAttempt{
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Email:     email,
+	}
+	slog.InfoContext(r.Context(), "🤖 Bot detected by the form traps", "trap", trap, "ip", attempt.IP, "user_agent", attempt.UserAgent, "email", attempt.Email, "total", botAttempts.Value())
+
+	if err := s.DB.SaveBotAttemptContext(r.Context(), attempt); err != nil {
+		slog.ErrorContext(r.Context(), "❌ Error saving bot attempt", "error", err)
+	}
+}
+
+// duplicateRegistrationMessage tells the user which data is already registered and how to proceed
+func (s *Server) duplicateRegistrationMessage(err error) string {
+	message := "This company is already registered in DOME Marketplace."
+	if errors.Is(err, db.ErrDuplicateEmail) {
+		message = "This email is already registered in DOME Marketplace."
+	} else if errors.Is(err, db.ErrDuplicateVatID) {
+		message = "A company with this VAT ID is already registered in DOME Marketplace."
+	}
+
+	contact := "the DOME onboarding team"
+	if len(s.Config.Mail.OnboardTeamEmail) > 0 {
+		contact += " at " + s.Config.Mail.OnboardTeamEmail[0]
+	}
+	return message + " If you need to change the registration or did not receive the welcome email, please contact " + contact + "."
+}
+
+// registrationResult is the data returned to the caller of a successful registration.
+// CredentialID is only present when the Issuer issued the credential and identified it in its response.
+// StatusToken allows the user to query the status of the registration in /api/registration-status.
+type registrationResult struct {
+	RegistrationID string `json:"registration_id"`
+	CredentialID   string `json:"credential_id,omitempty"`
+	StatusToken    string `json:"status_token,omitempty"`
+}
+
 // HandleRegister handles the registration process
 // It validates the request data, generates a registration ID, and sends an email to the user
 func (s *Server) HandleRegister(w http.ResponseWriter, r *http.Request) {
@@ -184,136 +457,237 @@ func (s *Server) HandleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !validateCSRF(r) {
-		s.SendJSON(w, http.StatusForbidden, false, "Security check failed: missing CSRF header", nil)
+	if !s.validateCSRF(r) {
+		s.SendJSON(w, http.StatusForbidden, false, "Security check failed: missing or invalid CSRF token", nil)
 		return
 	}
 
-	var requestData RegistrationRequest
-	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-		s.SendJSON(w, http.StatusBadRequest, false, "Invalid request body", nil)
+	requestData, traps, err := s.decodeRegistrationRequest(r)
+	if err != nil {
+		s.sendBodyError(w, err)
 		return
 	}
+	requestData.Normalize()
 
-	if requestData.Website != "" {
-		slog.Info("🤖 Bot detected via honeypot field")
+	trap, err := s.caughtByTrap(traps)
+	if err != nil {
+		s.SendJSON(w, http.StatusBadRequest, false, err.Error(), nil)
+		return
+	}
+	if trap != "" {
+		// Pretend the registration succeeded, so the bot does not learn about the traps
+		s.recordBotAttempt(r, requestData.Email, trap)
 		s.SendJSON(w, http.StatusOK, true, "Registration successful", nil)
 		return
 	}
 
-	if err := requestData.Validate(); err != nil {
-		s.SendJSON(w, http.StatusBadRequest, false, err.Error(), nil)
+	// Report all the invalid fields at once, so the user can fix them in a single round trip
+	errs := requestData.validate()
+	s.validateExtraFields(requestData.Extra, errs)
+	var reviewNote string
+	if _, missing := errs["country"]; !missing {
+		reviewNote, err = s.resolveCountry(r.Context(), &requestData)
+		errs.check("country", err)
+	}
+	if len(errs) > 0 {
+		s.SendJSON(w, http.StatusBadRequest, false, errs.Error(), errs)
+		return
+	}
+
+	if s.Config.RequireVerifiedEmail && !s.EmailVerified(requestData.Email) {
+		s.SendJSON(w, http.StatusForbidden, false, "Please verify your email before registering", nil)
 		return
 	}
 
-	slog.Info("Attempting to issue credential for registration", "email", requestData.Email, "vatID", requestData.VatId)
-
-	cred := &credissuance.LEARIssuanceRequestBody{
-		Schema:        "LEARCredentialEmployee",
-		OperationMode: "S",
-		Format:        "jwt_vc_json",
-		Payload: credissuance.Payload{
-			Mandator: credissuance.Mandator{
-				OrganizationIdentifier: requestData.Country + "-" + requestData.VatId,
-				Organization:           requestData.CompanyName,
-				Country:                requestData.Country,
-				CommonName:             requestData.FirstName + " " + requestData.LastName,
-				EmailAddress:           requestData.Email,
-			},
-			Mandatee: credissuance.Mandatee{
-				FirstName:   requestData.FirstName,
-				LastName:    requestData.LastName,
-				Nationality: requestData.Country,
-				Email:       requestData.Email,
-			},
-			Power: []credissuance.Power{
-				{
-					Type:     "domain",
-					Domain:   "DOME",
-					Function: "Onboarding",
-					Action:   credissuance.Strings{"execute", "verify"},
-				},
-			},
-		},
-	}
-
-	regID := generateRegistrationID()
+	slog.InfoContext(r.Context(), "Attempting to issue credential for registration", "email", requestData.Email, "vatID", requestData.VatId)
+
 	reg := &db.Registration{
-		RegistrationID: regID,
-		Email:          requestData.Email,
-		FirstName:      requestData.FirstName,
-		LastName:       requestData.LastName,
-		CompanyName:    requestData.CompanyName,
-		Country:        requestData.Country,
-		VatID:          requestData.VatId,
+		Email:                  requestData.Email,
+		FirstName:              requestData.FirstName,
+		LastName:               requestData.LastName,
+		CompanyName:            requestData.CompanyName,
+		Country:                requestData.Country,
+		VatID:                  requestData.VatId,
+		ReviewNote:             reviewNote,
+		Language:               common.ResolveLanguage(requestData.Language, requestData.Country),
+		IdempotencyKey:         r.Header.Get(idempotencyKeyHeader),
+		IdempotencyFingerprint: idempotencyFingerprint(r.Context()),
+		ExtraFields:            requestData.Extra,
+	}
+
+	// Wait for a slot to issue the credential before saving the registration, so when the Issuer is busy
+	// nothing is saved and the user can try again
+	release, err := s.issuances.acquire(r.Context())
+	if err != nil {
+		slog.WarnContext(r.Context(), "⚠️ Registration rejected, too many issuances in progress", "email", reg.Email, "error", err)
+		w.Header().Set("Retry-After", strconv.Itoa(s.issuances.retryAfter()))
+		s.SendJSON(w, http.StatusServiceUnavailable, false, "Too many registrations in progress, please try again in a few seconds", nil)
+		return
 	}
+	defer release()
 
 	// Create an initial registration in the database, updated with error and status later
-	if err := s.DB.SaveRegistration(reg); err != nil {
-		slog.Error("❌ Error saving initial registration", "error", err)
-		s.SendJSON(w, http.StatusInternalServerError, false, "Failed to save registration", err.Error())
-		return
+	queued := false
+	outbox, err := s.saveNewRegistration(r.Context(), reg)
+	if err != nil {
+		if errors.Is(err, db.ErrDuplicateEmail) || errors.Is(err, db.ErrDuplicateVatID) {
+			slog.InfoContext(r.Context(), "Duplicate registration rejected", "email", reg.Email, "vat_id", reg.VatID, "error", err)
+			s.SendJSON(w, http.StatusConflict, false, s.duplicateRegistrationMessage(err), nil)
+			return
+		}
+		if r.Context().Err() != nil {
+			slog.WarnContext(r.Context(), "⚠️ Registration cancelled by the client before it was saved", "email", reg.Email, "error", err)
+			return
+		}
+		slog.ErrorContext(r.Context(), "❌ Error saving initial registration", "error", err)
+
+		// The database is failing: keep the registration in the queue and go on with the onboarding
+		if reg.RegistrationID == "" || errors.Is(err, db.ErrDuplicateRegistrationID) || s.queueRegistration(r.Context(), reg) != nil {
+			s.SendJSON(w, http.StatusInternalServerError, false, "Failed to save registration", err.Error())
+			return
+		}
+		queued = true
+		// The side effects are not in the outbox, and are delivered only once
+		outbox = s.registrationCreatedItems(reg)
 	}
 
+	trace.SpanFromContext(r.Context()).SetAttributes(registrationAttributes(reg)...)
+
+	// The verification of the email allows a single registration
+	s.ConsumeVerifiedEmail(reg.Email)
+
+	for _, item := range outbox {
+		s.deliverOutboxItem(context.WithoutCancel(r.Context()), item)
+	}
+
+	cred := s.newIssuanceRequest(reg)
+	payload := s.recordIssuancePayload(r.Context(), reg, cred, queued)
+
 	reg.IssuanceAt = time.Now()
-	_, issError := s.Issuer.LEARIssuanceRequest(cred)
+	// The registration is saved, so the issuance goes on even if the client goes away
+	issResponse, issError := s.Issuer.LEARIssuanceRequestContext(context.WithoutCancel(r.Context()), cred)
+	s.recordIssuerResponse(r.Context(), reg, issResponse, queued)
+	var issResult *credissuance.IssuanceResult
+	if issError == nil {
+		issResult, issError = parseIssuanceResponse(r.Context(), reg, issResponse.Body)
+	}
 	if issError != nil {
 		// There was an error, update the register and send an email informing of the error
-
-		slog.Error("❌ Error calling issuance service", "error", issError)
-		reg.IssuanceError = issError.Error()
-		if updateErr := s.DB.UpdateRegistrationStatus(reg); updateErr != nil {
-			slog.Error("❌ Error updating registration status with issuance error", "error", updateErr)
+		slog.ErrorContext(r.Context(), "❌ Error calling issuance service", "kind", issuanceFailureKind(issError), "error", issError)
+		s.failIssuance(r.Context(), reg, payload, issError.Error(), queued)
+		if !retryable(issError) && !queued {
+			// Retrying in the background would be rejected again, or could issue a duplicate credential
+			s.endIssuanceRetries(r.Context(), reg)
 		}
 
-		// Format the information we sent to the Issuer
-		buf, err := json.MarshalIndent(cred, "", "  ")
-		if err != nil {
-			slog.Error("❌ Error marshalling credential data", "error", err)
-		}
+		s.SendJSON(w, http.StatusOK, true, "Registration successful", registrationResult{
+			RegistrationID: reg.RegistrationID,
+			StatusToken:    s.statusToken(reg.RegistrationID),
+		})
+		return
+	}
 
-		// Send an email informing of the error, including the information that we wanted to issue
-		err = s.Mail.SendIssuerError(reg, string(buf), reg.IssuanceError)
-		if err != nil {
-			slog.Error("❌ Error sending issuer error email", "error", err)
-		}
+	// Issuance correct, update the register and send an email informing of the success.
+	// In asynchronous mode it is done when the Issuer sends the result.
+	if s.Config.Issuer.Async() {
+		s.awaitIssuance(r.Context(), reg, queued)
+	} else {
+		s.completeIssuance(r.Context(), reg, issResult, queued)
+	}
 
-		// Send a welcome email to the user, as if no error happened
-		err = s.Mail.SendWelcomeEmail(reg)
-		if err != nil {
-			slog.Error("❌ Error sending welcome email", "error", err)
-			reg.NotifEmailError = err.Error()
-		} else {
-			slog.Info("📧 Welcome email sent", "email", reg.Email)
-			reg.NotifEmailAt = time.Now()
-			reg.NotifEmailError = ""
-		}
-		if updateErr := s.DB.UpdateRegistrationStatus(reg); updateErr != nil {
-			slog.Error("❌ Error updating registration status with email result", "error", updateErr)
+	s.SendJSON(w, http.StatusOK, true, "Registration successful", registrationResult{
+		RegistrationID: reg.RegistrationID,
+		CredentialID:   reg.CredentialID,
+		StatusToken:    s.statusToken(reg.RegistrationID),
+	})
+}
+
+// recordIssuancePayload formats the request sent to the Issuer for a registration and saves it with the registration,
+// so the issuer team can check it later. It returns the formatted request.
+func (s *Server) recordIssuancePayload(ctx context.Context, reg *db.Registration, cred *credissuance.LEARIssuanceRequestBody, queued bool) string {
+	buf, err := json.MarshalIndent(cred, "", "  ")
+	if err != nil {
+		slog.ErrorContext(ctx, "❌ Error marshalling credential data", "error", err)
+		return ""
+	}
+	if !queued {
+		if err := s.DB.SaveIssuancePayloadContext(context.WithoutCancel(ctx), reg.RegistrationID, string(buf)); err != nil {
+			slog.ErrorContext(ctx, "❌ Error saving the issuance payload", "registration_id", reg.RegistrationID, "error", err)
 		}
+	}
+	return string(buf)
+}
 
-		s.SendJSON(w, http.StatusOK, true, "Registration successful", nil)
+// recordIssuerResponse saves with the registration the status, the body and the duration of the response
+// of the Issuer, so the failures can be diagnosed later. Nothing is saved if the Issuer did not reply.
+func (s *Server) recordIssuerResponse(ctx context.Context, reg *db.Registration, resp *credissuance.IssuanceResponse, queued bool) {
+	if resp == nil || queued {
 		return
 	}
+	issuerResponse := &db.IssuerResponse{
+		StatusCode: resp.StatusCode,
+		Body:       string(resp.Body),
+		DurationMs: resp.Duration.Milliseconds(),
+	}
+	if err := s.DB.SaveIssuerResponseContext(context.WithoutCancel(ctx), reg.RegistrationID, issuerResponse); err != nil {
+		slog.ErrorContext(ctx, "❌ Error saving the response of the Issuer", "registration_id", reg.RegistrationID, "error", err)
+	}
+}
 
-	// Issuance correct, update the register and send an email informing of the success
-	reg.IssuanceError = ""
-	if err := s.DB.UpdateRegistrationStatus(reg); err != nil {
-		slog.Error("❌ Error updating registration status with issuance success", "error", err)
+// failIssuance records that the Issuer failed to issue the credential of a registration, informs the issuer team
+// with the request that was sent, and sends the welcome email to the user as if no error happened.
+// queued tells that the registration is in the queue because the database failed.
+func (s *Server) failIssuance(ctx context.Context, reg *db.Registration, payload string, reason string, queued bool) {
+	reg.IssuanceError = reason
+	reg.Status = db.StatusFailed
+	welcome := s.recordWelcomeEmail(ctx, reg, "", queued)
+
+	// Send an email informing of the error, including the information that we wanted to issue
+	_, span := startSpan(ctx, "SendIssuerError", registrationAttributes(reg)...)
+	err := s.Mail.SendIssuerError(reg, payload, reg.IssuanceError, RequestIDFromContext(ctx))
+	endSpan(span, err)
+	if err != nil {
+		slog.ErrorContext(ctx, "❌ Error sending issuer error email", "error", err)
 	}
 
-	err := s.Mail.SendWelcomeEmail(reg)
+	// Send a welcome email to the user, as if no error happened
+	if s.scheduledWelcomeEmail(ctx, welcome) {
+		return
+	}
+	err = s.sendWelcomeEmail(ctx, reg, "", queued)
+	s.recordOutboxDelivery(ctx, welcome, err)
+}
+
+// parseIssuanceResponse reads the issued credential and its offer from the response of the Issuer.
+// Only the errors reported by the Issuer are returned. The Issuer accepted the request, so a response that can
+// not be read is logged and the credential is considered issued, without identifier or offer.
+func parseIssuanceResponse(ctx context.Context, reg *db.Registration, issResponse []byte) (*credissuance.IssuanceResult, error) {
+	result, err := credissuance.ParseIssuanceResponse(issResponse)
+	var issuerErr *credissuance.IssuerError
+	if errors.As(err, &issuerErr) {
+		return nil, err
+	}
 	if err != nil {
-		slog.Error("❌ Error sending welcome email", "error", err)
-		reg.NotifEmailError = err.Error()
-	} else {
-		slog.Info("📧 Welcome email sent", "email", reg.Email)
-		reg.NotifEmailAt = time.Now()
-		reg.NotifEmailError = ""
+		slog.WarnContext(ctx, "⚠️ Could not read the response of the Issuer", "registration_id", reg.RegistrationID, "error", err)
+	}
+	if result == nil {
+		result = &credissuance.IssuanceResult{}
 	}
-	if updateErr := s.DB.UpdateRegistrationStatus(reg); updateErr != nil {
-		slog.Error("❌ Error updating registration status with email result", "error", updateErr)
+	return result, nil
+}
+
+// completeIssuance records the credential issued for a registration and sends the welcome email with its offer.
+// queued tells that the registration is in the queue because the database failed.
+func (s *Server) completeIssuance(ctx context.Context, reg *db.Registration, result *credissuance.IssuanceResult, queued bool) {
+	// Keep a reference to the issued credential
+	reg.CredentialID = result.CredentialID
+	reg.IssuanceError = ""
+	reg.Status = db.StatusIssued
+	welcome := s.recordWelcomeEmail(ctx, reg, result.OfferURI, queued)
+	if s.scheduledWelcomeEmail(ctx, welcome) {
+		return
 	}
 
-	s.SendJSON(w, http.StatusOK, true, "Registration successful", nil)
+	err := s.sendWelcomeEmail(ctx, reg, result.OfferURI, queued)
+	s.recordOutboxDelivery(ctx, welcome, err)
 }
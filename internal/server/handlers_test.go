@@ -0,0 +1,618 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+func TestResolveCountry(t *testing.T) {
+	tests := []struct {
+		name        string
+		countries   configuration.CountryConfig
+		country     string
+		wantCountry string
+		wantNote    bool
+		wantErr     bool
+	}{
+		{
+			name:        "supported country is always accepted",
+			countries:   configuration.CountryConfig{},
+			country:     "ES",
+			wantCountry: "ES",
+		},
+		{
+			name:      "reject is the default policy",
+			countries: configuration.CountryConfig{},
+			country:   "XX",
+			wantErr:   true,
+		},
+		{
+			name:      "reject policy",
+			countries: configuration.CountryConfig{UnknownPolicy: configuration.RejectUnknownCountry},
+			country:   "XX",
+			wantErr:   true,
+		},
+		{
+			name:        "flag policy accepts and returns a review note",
+			countries:   configuration.CountryConfig{UnknownPolicy: configuration.FlagUnknownCountry},
+			country:     "XX",
+			wantCountry: "XX",
+			wantNote:    true,
+		},
+		{
+			name:        "default policy replaces the country",
+			countries:   configuration.CountryConfig{UnknownPolicy: configuration.DefaultUnknownCountry, DefaultCountry: "BE"},
+			country:     "XX",
+			wantCountry: "BE",
+		},
+		{
+			name:      "default policy with an unsupported default rejects",
+			countries: configuration.CountryConfig{UnknownPolicy: configuration.DefaultUnknownCountry, DefaultCountry: "YY"},
+			country:   "XX",
+			wantErr:   true,
+		},
+		{
+			name:        "allowed country",
+			countries:   configuration.CountryConfig{Allowed: []string{"ES", "PT"}},
+			country:     "ES",
+			wantCountry: "ES",
+		},
+		{
+			name:      "country not allowed",
+			countries: configuration.CountryConfig{Allowed: []string{"ES", "PT"}},
+			country:   "US",
+			wantErr:   true,
+		},
+		{
+			name:      "blocked country",
+			countries: configuration.CountryConfig{Blocked: []string{"US"}},
+			country:   "US",
+			wantErr:   true,
+		},
+		{
+			name:      "flagged country not allowed",
+			countries: configuration.CountryConfig{UnknownPolicy: configuration.FlagUnknownCountry, Allowed: []string{"ES"}},
+			country:   "XX",
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{Config: configuration.EnvConfig{Countries: tt.countries}}
+			req := &RegistrationRequest{Country: tt.country, Email: "john@example.com"}
+
+			note, err := s.resolveCountry(context.Background(), req)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				if !strings.Contains(err.Error(), tt.country) {
+					t.Errorf("expected error to name the country code %q, got: %v", tt.country, err)
+				}
+				if !strings.Contains(err.Error(), supportedCountriesPath) {
+					t.Errorf("expected error to link to %s, got: %v", supportedCountriesPath, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if req.Country != tt.wantCountry {
+				t.Errorf("expected country %q, got %q", tt.wantCountry, req.Country)
+			}
+			if (note != "") != tt.wantNote {
+				t.Errorf("expected review note %v, got %q", tt.wantNote, note)
+			}
+		})
+	}
+}
+
+func TestHoneypotRecordsBotAttempt(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development})
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Development)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	s.DB = dbService
+
+	before := botAttempts.Value()
+	start := time.Now().Add(-time.Second)
+
+	rec := postJSON(s, "/api/register", `{"email": "bot@example.com", "website": "http://spam.example.com"}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"success":true`) {
+		t.Fatalf("expected a fake success, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if got := botAttempts.Value() - before; got != 1 {
+		t.Errorf("expected the bot attempts metric to increase by 1, got %d", got)
+	}
+	count, err := dbService.CountBotAttempts(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 stored bot attempt, got %d", count)
+	}
+}
+
+func TestRegisterDuplicateInProduction(t *testing.T) {
+	cfg := configuration.EnvConfig{
+		Runtime: configuration.Production,
+		Mail:    configuration.MailConfig{OnboardTeamEmail: []string{"onboarding@example.com"}},
+	}
+
+	tests := []struct {
+		name    string
+		email   string
+		vatID   string
+		wantMsg string
+	}{
+		{name: "same email", email: "john@example.com", vatID: "ES87654321", wantMsg: "This email is already registered"},
+		{name: "same VAT ID", email: "jane@example.com", vatID: "ES12345678", wantMsg: "this VAT ID is already registered"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, cfg)
+			dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Production)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dbService.Close()
+			s.DB = dbService
+
+			if err := dbService.SaveRegistration(&db.Registration{RegistrationID: "reg-1", Email: "john@example.com", VatID: "ES12345678"}); err != nil {
+				t.Fatal(err)
+			}
+
+			body := `{"firstName": "Jane", "lastName": "Doe", "companyName": "ACME", "country": "ES", "vatId": "` + tt.vatID + `", "email": "` + tt.email + `"}`
+			rec := postJSON(s, "/api/register", body)
+			if rec.Code != http.StatusConflict {
+				t.Fatalf("expected %d, got %d: %s", http.StatusConflict, rec.Code, rec.Body.String())
+			}
+			for _, want := range []string{tt.wantMsg, "onboarding@example.com"} {
+				if !strings.Contains(rec.Body.String(), want) {
+					t.Errorf("expected the message to contain %q, got %s", want, rec.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestNewServerRejectsInvalidPowers(t *testing.T) {
+	cfg := configuration.EnvConfig{
+		Runtime: configuration.Development,
+		Powers:  []configuration.PowerConfig{{Type: "domain", Domain: "DOME", Function: "Onboarding"}},
+	}
+	if _, err := NewServer(cfg, nil, nil, nil, t.TempDir()); err == nil {
+		t.Fatalf("expected an error for a power without actions")
+	}
+}
+
+func TestRejectUnknownFields(t *testing.T) {
+	tests := []struct {
+		name      string
+		path      string
+		body      string
+		wantField string
+	}{
+		{
+			name:      "typo in a registration field",
+			path:      "/api/register",
+			body:      `{"frstName": "John", "lastName": "Doe", "companyName": "ACME", "country": "ES", "vatId": "ES12345678", "email": "john@example.com"}`,
+			wantField: `unknown field \"frstName\"`,
+		},
+		{
+			name:      "unexpected registration field",
+			path:      "/api/register",
+			body:      `{"firstName": "John", "lastName": "Doe", "companyName": "ACME", "country": "ES", "vatId": "ES12345678", "email": "john@example.com", "role": "admin"}`,
+			wantField: `unknown field \"role\"`,
+		},
+		{
+			name:      "unexpected field in the email validation",
+			path:      "/api/validate-email",
+			body:      `{"email": "john@example.com", "name": "John"}`,
+			wantField: `unknown field \"name\"`,
+		},
+		{
+			name:      "unexpected field in the code verification",
+			path:      "/api/verify-code",
+			body:      `{"email": "john@example.com", "code": "123456", "remember": true}`,
+			wantField: `unknown field \"remember\"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development})
+
+			rec := postJSON(s, tt.path, tt.body)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("expected %d, got %d: %s", http.StatusBadRequest, rec.Code, rec.Body.String())
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantField) {
+				t.Errorf("expected the message to name the field, got %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRegistrationRequestValidateLength(t *testing.T) {
+	// email returns a valid email address with the given number of characters
+	email := func(length int) string {
+		return strings.Repeat("a", length-len("@example.com")) + "@example.com"
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(r *RegistrationRequest)
+		wantErr string
+	}{
+		{name: "first name at the maximum", modify: func(r *RegistrationRequest) { r.FirstName = strings.Repeat("é", maxNameLength) }},
+		{name: "first name too long", modify: func(r *RegistrationRequest) { r.FirstName = strings.Repeat("é", maxNameLength+1) }, wantErr: "first name must have at most 100 characters"},
+		{name: "last name at the minimum", modify: func(r *RegistrationRequest) { r.LastName = "O" }},
+		{name: "last name at the maximum", modify: func(r *RegistrationRequest) { r.LastName = strings.Repeat("a", maxNameLength) }},
+		{name: "last name too long", modify: func(r *RegistrationRequest) { r.LastName = strings.Repeat("a", maxNameLength+1) }, wantErr: "last name must have at most 100 characters"},
+		{name: "company name at the minimum", modify: func(r *RegistrationRequest) { r.CompanyName = "HP" }},
+		{name: "company name too short", modify: func(r *RegistrationRequest) { r.CompanyName = "H" }, wantErr: "company name must have at least 2 characters"},
+		{name: "company name at the maximum", modify: func(r *RegistrationRequest) { r.CompanyName = strings.Repeat("a", maxCompanyNameLength) }},
+		{name: "company name too long", modify: func(r *RegistrationRequest) { r.CompanyName = strings.Repeat("a", 10<<20) }, wantErr: "company name must have at most 200 characters"},
+		{name: "VAT ID at the minimum", modify: func(r *RegistrationRequest) { r.VatId = "ES12" }},
+		{name: "VAT ID too short", modify: func(r *RegistrationRequest) { r.VatId = "ES1" }, wantErr: "VAT ID must have at least 4 characters"},
+		{name: "VAT ID at the maximum", modify: func(r *RegistrationRequest) { r.VatId = "ES" + strings.Repeat("1", maxVatIDLength-2) }},
+		{name: "VAT ID too long", modify: func(r *RegistrationRequest) { r.VatId = "ES" + strings.Repeat("1", maxVatIDLength-1) }, wantErr: "VAT ID must have at most 32 characters"},
+		{name: "email at the minimum", modify: func(r *RegistrationRequest) { r.Email = "a@b.es" }},
+		{name: "email too short", modify: func(r *RegistrationRequest) { r.Email = "a@b.e" }, wantErr: "email must have at least 6 characters"},
+		{name: "email at the maximum", modify: func(r *RegistrationRequest) { r.Email = email(maxEmailLength) }},
+		{name: "email too long", modify: func(r *RegistrationRequest) { r.Email = email(maxEmailLength + 1) }, wantErr: "email must have at most 254 characters"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := RegistrationRequest{FirstName: "Jane", LastName: "Doe", CompanyName: "ACME", Country: "ES", VatId: "ES12345678", Email: "jane@example.com"}
+			tt.modify(&req)
+			err := req.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("expected the request to be valid, got %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("expected error %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRegistrationRequestNormalize(t *testing.T) {
+	tests := []struct {
+		name string
+		req  RegistrationRequest
+		want RegistrationRequest
+	}{
+		{
+			name: "surrounding whitespace",
+			req:  RegistrationRequest{FirstName: " John ", LastName: "\tDoe\n", CompanyName: "  ACME Corp ", Country: " ES", VatId: "ES12345678 ", Email: " john@example.com "},
+			want: RegistrationRequest{FirstName: "John", LastName: "Doe", CompanyName: "ACME Corp", Country: "ES", VatId: "ES12345678", Email: "john@example.com"},
+		},
+		{
+			name: "case of codes and email",
+			req:  RegistrationRequest{Country: "es", VatId: "es b12345678", Email: "John.Doe@Example.COM", Language: " FR "},
+			want: RegistrationRequest{Country: "ES", VatId: "ESB12345678", Email: "john.doe@example.com", Language: "fr"},
+		},
+		{
+			name: "names keep their case and inner spaces",
+			req:  RegistrationRequest{FirstName: "Mary Ann", CompanyName: "acme  Iberia S.L."},
+			want: RegistrationRequest{FirstName: "Mary Ann", CompanyName: "acme  Iberia S.L."},
+		},
+		{
+			name: "only whitespace is empty",
+			req:  RegistrationRequest{FirstName: "   ", VatId: " \t "},
+			want: RegistrationRequest{},
+		},
+		{
+			name: "extra fields trimmed and empty ones removed",
+			req:  RegistrationRequest{Extra: map[string]string{"department": " Sales ", "role": "  "}},
+			want: RegistrationRequest{Extra: map[string]string{"department": "Sales"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Normalize()
+			if !reflect.DeepEqual(tt.req, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, tt.req)
+			}
+		})
+	}
+}
+
+func TestRegisterNormalizesBeforeLookup(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Production})
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Production)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	s.DB = dbService
+
+	if err := dbService.SaveRegistration(&db.Registration{RegistrationID: "reg-1", Email: "john@example.com", VatID: "ESB12345678"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same company typed differently is found as already registered
+	body := `{"firstName": " Jane ", "lastName": "Doe", "companyName": "ACME", "country": " es ", "vatId": " es b12345678 ", "email": " Jane@Example.com "}`
+	rec := postJSON(s, "/api/register", body)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected %d, got %d: %s", http.StatusConflict, rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "this VAT ID is already registered") {
+		t.Errorf("expected the VAT ID to be found, got %s", rec.Body.String())
+	}
+}
+
+func TestValidateEmailAlreadyRegistered(t *testing.T) {
+	tests := []struct {
+		runtime    configuration.RuntimeEnv
+		email      string
+		wantStatus int
+	}{
+		{runtime: configuration.Production, email: "John@Example.com", wantStatus: http.StatusConflict},
+		{runtime: configuration.Production, email: "jane@example.com", wantStatus: http.StatusOK},
+		// Development and preproduction amend the registration, so the email can be verified again
+		{runtime: configuration.Development, email: "john@example.com", wantStatus: http.StatusOK},
+		{runtime: configuration.Preproduction, email: "john@example.com", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.runtime)+" "+tt.email, func(t *testing.T) {
+			s := newTestServer(t, configuration.EnvConfig{Runtime: tt.runtime})
+			dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), tt.runtime)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dbService.Close()
+			s.DB = dbService
+
+			if err := dbService.SaveRegistration(&db.Registration{RegistrationID: "reg-1", Email: "john@example.com", VatID: "ES12345678"}); err != nil {
+				t.Fatal(err)
+			}
+
+			rec := postJSON(s, "/api/validate-email", `{"email": "`+tt.email+`"}`)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+			if tt.wantStatus == http.StatusConflict && !strings.Contains(rec.Body.String(), "This email is already registered") {
+				t.Errorf("expected the message to tell the email is registered, got %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestValidateEmailReturnsCodeOnlyInDevelopment(t *testing.T) {
+	tests := []struct {
+		runtime  configuration.RuntimeEnv
+		wantCode bool
+	}{
+		{runtime: configuration.Development, wantCode: true},
+		{runtime: configuration.Preproduction},
+		{runtime: configuration.Production},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.runtime), func(t *testing.T) {
+			s := newTestServer(t, configuration.EnvConfig{Runtime: tt.runtime})
+			dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), tt.runtime)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dbService.Close()
+			s.DB = dbService
+
+			rec := postJSON(s, "/api/validate-email", `{"email": "jane@example.com"}`)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+			}
+			var resp struct {
+				Data struct {
+					Code string `json:"code"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			// The code returned is the one verified, and outside development the caller must read it in the email
+			if !tt.wantCode {
+				if resp.Data.Code != "" || strings.Contains(rec.Body.String(), `"code"`) {
+					t.Fatalf("expected no code in the response, got %s", rec.Body.String())
+				}
+				return
+			}
+			if err := s.VerifyCode("jane@example.com", resp.Data.Code); err != nil {
+				t.Errorf("expected the code returned to verify the email, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRegisterRequiresVerifiedEmail(t *testing.T) {
+	const body = `{"firstName": "Jane", "lastName": "Doe", "companyName": "ACME", "country": "ES", "vatId": "ES12345678", "email": "jane@example.com"}`
+
+	tests := []struct {
+		name       string
+		verify     bool
+		age        time.Duration
+		wantStatus int
+	}{
+		{name: "not verified", wantStatus: http.StatusForbidden},
+		{name: "verified", verify: true, wantStatus: http.StatusOK},
+		{name: "verified too long ago", verify: true, age: time.Hour, wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Production, RequireVerifiedEmail: true})
+			s.Issuer = newTestIssuer(t, nil)
+			dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Production)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dbService.Close()
+			s.DB = dbService
+
+			start := time.Now()
+			s.now = func() time.Time { return start }
+			if tt.verify {
+				s.StoreVerificationCode("jane@example.com", "123456")
+				rec := postJSON(s, "/api/verify-code", `{"email": "Jane@Example.com", "code": "123456"}`)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("verify-code failed with %d: %s", rec.Code, rec.Body.String())
+				}
+			}
+
+			s.now = func() time.Time { return start.Add(tt.age) }
+			rec := postJSON(s, "/api/register", body)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+			if tt.wantStatus == http.StatusForbidden && !strings.Contains(rec.Body.String(), "verify your email") {
+				t.Errorf("expected the user to be asked to verify the email, got %s", rec.Body.String())
+			}
+			if tt.wantStatus == http.StatusOK && s.EmailVerified("jane@example.com") {
+				t.Errorf("expected the verification to be consumed by the registration")
+			}
+		})
+	}
+}
+
+func TestRegisterWithoutVerifiedEmailRequirement(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Production})
+	s.Issuer = newTestIssuer(t, nil)
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Production)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	s.DB = dbService
+
+	body := `{"firstName": "Jane", "lastName": "Doe", "companyName": "ACME", "country": "ES", "vatId": "ES12345678", "email": "jane@example.com"}`
+	if rec := postJSON(s, "/api/register", body); rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	// The request sent to the Issuer is saved with the registration
+	reg, err := dbService.GetRegistrationByEmail("jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload, err := dbService.GetIssuancePayload(reg.RegistrationID); err != nil || !strings.Contains(payload, "ACME") {
+		t.Errorf("expected the issuance payload to be saved, got %q: %v", payload, err)
+	}
+}
+
+func TestRegistrationRequestValidateAll(t *testing.T) {
+	req := RegistrationRequest{FirstName: "Jane", CompanyName: "A", Country: "ES", VatId: "ES12345678", Email: "jane@example"}
+
+	err := req.Validate()
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected ValidationErrors, got %v", err)
+	}
+	want := ValidationErrors{
+		"lastName":    "last name is required",
+		"companyName": "company name must have at least 2 characters",
+		"email":       "invalid email address format",
+	}
+	if !maps.Equal(errs, want) {
+		t.Errorf("expected %v, got %v", want, errs)
+	}
+	// The summary lists them in the order of the form
+	if got := err.Error(); got != "last name is required; company name must have at least 2 characters; invalid email address format" {
+		t.Errorf("unexpected summary %q", got)
+	}
+}
+
+func TestRegisterReportsAllInvalidFields(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{
+		Runtime:     configuration.Development,
+		ExtraFields: []configuration.ExtraFieldConfig{{Name: "department", Required: true}},
+	})
+
+	rec := postJSON(s, "/api/register", `{"firstName": "", "lastName": "Doe", "companyName": "ACME", "country": "ES", "vatId": "ES1", "email": "jane@example.com", "extra": {"salary": "1000"}}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d: %s", http.StatusBadRequest, rec.Code, rec.Body.String())
+	}
+
+	var resp struct {
+		Message string            `json:"message"`
+		Data    map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"firstName":        "first name is required",
+		"vatId":            "VAT ID must have at least 4 characters",
+		"extra.department": `extra field "department" is required`,
+		"extra.salary":     `unknown extra field "salary"`,
+	}
+	if !maps.Equal(resp.Data, want) {
+		t.Errorf("expected the errors %v, got %v", want, resp.Data)
+	}
+	if !strings.HasPrefix(resp.Message, "first name is required; VAT ID must have at least 4 characters; ") {
+		t.Errorf("expected a summary of the errors, got %q", resp.Message)
+	}
+}
+
+func TestRegisterReportsRejectedCountryWithOtherFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		country string
+		want    string
+	}{
+		{name: "blocked country", country: "FR", want: `registrations from country "FR" are not accepted, see /api/countries for the list of accepted countries`},
+		{name: "unknown country", country: "XX", want: `country code "XX" is not supported, see /api/countries for the list of supported countries`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, configuration.EnvConfig{
+				Runtime:   configuration.Development,
+				Countries: configuration.CountryConfig{UnknownPolicy: configuration.RejectUnknownCountry, Blocked: []string{"FR"}},
+			})
+
+			rec := postJSON(s, "/api/register", `{"firstName": "Jane", "lastName": "Doe", "companyName": "ACME", "country": "`+tt.country+`", "vatId": "ES1", "email": "jane@example.com"}`)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("expected %d, got %d: %s", http.StatusBadRequest, rec.Code, rec.Body.String())
+			}
+
+			var resp struct {
+				Data map[string]string `json:"data"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{
+				"country": tt.want,
+				"vatId":   "VAT ID must have at least 4 characters",
+			}
+			if !maps.Equal(resp.Data, want) {
+				t.Errorf("expected the errors %v, got %v", want, resp.Data)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/hesusruiz/onboardng/internal/buildinfo"
+	"gopkg.in/yaml.v3"
+)
+
+// healthStatus is the response of the health check, with the build of the server to know which one is deployed
+type healthStatus struct {
+	Status string `json:"status"`
+	buildinfo.Info
+}
+
+// HandleHealth replies that the server is up, for load balancers and monitoring, with the build being served
+func (s *Server) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	s.SendJSON(w, http.StatusOK, true, "OK", healthStatus{Status: "ok", Info: buildinfo.Get()})
+}
+
+// HandleAdminBuildInfo returns the build information of the binary recorded by the Go toolchain: the Go version,
+// the versions of the dependencies and the build settings
+func (s *Server) HandleAdminBuildInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		s.SendJSON(w, http.StatusNotFound, false, "The binary has no build information", nil)
+		return
+	}
+	s.SendJSON(w, http.StatusOK, true, "Build information", info)
+}
+
+// HandleAdminConfig returns the configuration of the environment loaded by the server, with the names of the
+// configuration file and without its secrets, to check that a deployment runs with the expected configuration
+func (s *Server) HandleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Go through YAML to name the settings as in the configuration file, and the durations as "10m"
+	var cfg map[string]any
+	out, err := yaml.Marshal(s.Config.Redacted())
+	if err == nil {
+		err = yaml.Unmarshal(out, &cfg)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "❌ Error encoding the configuration", "error", err)
+		s.SendJSON(w, http.StatusInternalServerError, false, "Failed to encode the configuration", nil)
+		return
+	}
+	s.SendJSON(w, http.StatusOK, true, "Configuration of "+string(s.Config.Runtime), cfg)
+}
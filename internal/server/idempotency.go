@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// idempotencyKeyHeader lets clients retry a registration safely: a repeated key gets the original result
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength limits the size of the keys we store
+const maxIdempotencyKeyLength = 255
+
+// defaultIdempotencyWindow is how long a key is remembered when the configuration does not specify it
+const defaultIdempotencyWindow = 24 * time.Hour
+
+// idempotentResponse is the result of the first request with a given key, replayed for the repeated ones.
+// done is closed when the first request completes, so concurrent repetitions wait for its result.
+type idempotentResponse struct {
+	fingerprint [32]byte
+	createdAt   time.Time
+	done        chan struct{}
+
+	status      int
+	contentType string
+	body        []byte
+}
+
+// responseCapture writes the response through to the client while keeping a copy of it
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *responseCapture) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+func (s *Server) idempotencyWindow() time.Duration {
+	if s.Config.IdempotencyWindow > 0 {
+		return s.Config.IdempotencyWindow
+	}
+	return defaultIdempotencyWindow
+}
+
+// Idempotent middleware returns the original result when a request is repeated with the same Idempotency-Key
+// within the idempotency window, instead of running the handler again. Concurrent repetitions wait for the
+// first request to complete. Reusing a key with a different request body is rejected.
+// Server errors are not remembered, so the client can retry them with the same key.
+func (s *Server) Idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			s.SendJSON(w, http.StatusBadRequest, false, "Idempotency-Key is too long", nil)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.sendBodyError(w, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := sha256.Sum256(body)
+
+		entry, first := s.startIdempotentRequest(key, fingerprint)
+		if !first {
+			select {
+			case <-entry.done:
+			case <-r.Context().Done():
+				return
+			}
+			if entry.fingerprint != fingerprint {
+				s.SendJSON(w, http.StatusUnprocessableEntity, false, "Idempotency-Key was already used with a different request", nil)
+				return
+			}
+			s.replayResponse(w, entry)
+			return
+		}
+
+		// The registration may have been done before a restart of the server. The registrations saved before the
+		// fingerprints were stored have none, and are replayed for any body.
+		reg, err := s.DB.GetRegistrationByIdempotencyKeyContext(r.Context(), key)
+		switch {
+		case err == nil && s.now().Sub(reg.CreatedAt) <= s.idempotencyWindow():
+			capture := &responseCapture{ResponseWriter: w}
+			if reg.IdempotencyFingerprint != "" && reg.IdempotencyFingerprint != hex.EncodeToString(fingerprint[:]) {
+				s.SendJSON(capture, http.StatusUnprocessableEntity, false, "Idempotency-Key was already used with a different request", nil)
+				// The entry is of this body, so it is forgotten for the original request to be repeated with the key
+				s.forgetIdempotentRequest(key, entry)
+			} else {
+				s.SendJSON(capture, http.StatusOK, true, "Registration successful", registrationResult{
+					RegistrationID: reg.RegistrationID,
+					CredentialID:   reg.CredentialID,
+					StatusToken:    s.statusToken(reg.RegistrationID),
+				})
+			}
+			s.finishIdempotentRequest(key, entry, capture)
+			return
+		case err != nil && !errors.Is(err, sql.ErrNoRows):
+			capture := &responseCapture{ResponseWriter: w}
+			s.SendJSON(capture, http.StatusInternalServerError, false, "Failed to check the Idempotency-Key", nil)
+			s.finishIdempotentRequest(key, entry, capture)
+			return
+		}
+
+		capture := &responseCapture{ResponseWriter: w}
+		defer s.finishIdempotentRequest(key, entry, capture)
+		next(capture, r.WithContext(context.WithValue(r.Context(), idempotencyFingerprintKey{}, hex.EncodeToString(fingerprint[:]))))
+	}
+}
+
+type idempotencyFingerprintKey struct{}
+
+// idempotencyFingerprint returns the fingerprint of the body of a request with an Idempotency-Key, stored with
+// the registration to tell apart the requests reusing the key after a restart. It is "" without a key.
+func idempotencyFingerprint(ctx context.Context) string {
+	fingerprint, _ := ctx.Value(idempotencyFingerprintKey{}).(string)
+	return fingerprint
+}
+
+// startIdempotentRequest returns the entry for the key, and whether this is the first request using it
+func (s *Server) startIdempotentRequest(key string, fingerprint [32]byte) (*idempotentResponse, bool) {
+	s.IdempotencyMu.Lock()
+	defer s.IdempotencyMu.Unlock()
+
+	if entry, exists := s.IdempotentResponses[key]; exists && s.now().Sub(entry.createdAt) <= s.idempotencyWindow() {
+		return entry, false
+	}
+
+	entry := &idempotentResponse{
+		fingerprint: fingerprint,
+		createdAt:   s.now(),
+		done:        make(chan struct{}),
+	}
+	s.IdempotentResponses[key] = entry
+	return entry, true
+}
+
+// finishIdempotentRequest records the response of the first request and releases the waiting repetitions
+func (s *Server) finishIdempotentRequest(key string, entry *idempotentResponse, capture *responseCapture) {
+	entry.status = capture.status
+	entry.contentType = capture.Header().Get("Content-Type")
+	entry.body = capture.body.Bytes()
+
+	if entry.status == 0 || entry.status >= 500 {
+		s.forgetIdempotentRequest(key, entry)
+	}
+
+	close(entry.done)
+}
+
+// forgetIdempotentRequest removes the entry of the key, so the next request using it runs again
+func (s *Server) forgetIdempotentRequest(key string, entry *idempotentResponse) {
+	s.IdempotencyMu.Lock()
+	defer s.IdempotencyMu.Unlock()
+	if s.IdempotentResponses[key] == entry {
+		delete(s.IdempotentResponses, key)
+	}
+}
+
+// replayResponse sends the response recorded for the first request with the same key
+func (s *Server) replayResponse(w http.ResponseWriter, entry *idempotentResponse) {
+	if entry.status == 0 || entry.status >= 500 {
+		s.SendJSON(w, http.StatusConflict, false, "The original request with this Idempotency-Key failed, please retry", nil)
+		return
+	}
+	w.Header().Set("Content-Type", entry.contentType)
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+// newIdempotencyTestServer returns a server with a database, and a handler wrapped by the Idempotent middleware
+// that counts its calls and replies with the given status after a short delay
+func newIdempotencyTestServer(t *testing.T, status int) (*Server, http.HandlerFunc, *atomic.Int32) {
+	t.Helper()
+
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development})
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Development)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbService.Close() })
+	s.DB = dbService
+
+	calls := &atomic.Int32{}
+	handler := s.Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		s.SendJSON(w, status, status < 400, "Registration successful", registrationResult{RegistrationID: "reg-" + string(rune('0'+n))})
+	})
+	return s, handler, calls
+}
+
+func sendWithKey(handler http.HandlerFunc, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/register", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(idempotencyKeyHeader, key)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestIdempotentConcurrentSubmissions(t *testing.T) {
+	_, handler, calls := newIdempotencyTestServer(t, http.StatusOK)
+
+	const n = 10
+	responses := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i] = sendWithKey(handler, "key-1", `{"email": "john@example.com"}`)
+		}()
+	}
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("expected the handler to run once, ran %d times", got)
+	}
+	replayed := 0
+	for _, rec := range responses {
+		if rec.Code != http.StatusOK || rec.Body.String() != responses[0].Body.String() {
+			t.Errorf("expected every response to be the original one, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("Idempotent-Replayed") == "true" {
+			replayed++
+		}
+	}
+	if replayed != n-1 {
+		t.Errorf("expected %d replayed responses, got %d", n-1, replayed)
+	}
+}
+
+func TestIdempotentKeys(t *testing.T) {
+	_, handler, calls := newIdempotencyTestServer(t, http.StatusOK)
+
+	first := sendWithKey(handler, "key-1", `{"email": "john@example.com"}`)
+
+	// A different key, or no key, runs the handler again
+	sendWithKey(handler, "key-2", `{"email": "john@example.com"}`)
+	sendWithKey(handler, "", `{"email": "john@example.com"}`)
+	if got := calls.Load(); got != 3 {
+		t.Errorf("expected 3 calls, got %d", got)
+	}
+
+	// The same key with a different request is rejected
+	rec := sendWithKey(handler, "key-1", `{"email": "jane@example.com"}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected %d for a reused key, got %d", http.StatusUnprocessableEntity, rec.Code)
+	}
+
+	// The same key with the same request replays the first response
+	rec = sendWithKey(handler, "key-1", `{"email": "john@example.com"}`)
+	if rec.Body.String() != first.Body.String() || calls.Load() != 3 {
+		t.Errorf("expected the first response %s, got %s", first.Body.String(), rec.Body.String())
+	}
+}
+
+func TestIdempotentServerErrorsAreNotRemembered(t *testing.T) {
+	_, handler, calls := newIdempotencyTestServer(t, http.StatusInternalServerError)
+
+	sendWithKey(handler, "key-1", `{}`)
+	sendWithKey(handler, "key-1", `{}`)
+	if got := calls.Load(); got != 2 {
+		t.Errorf("expected a failed request to be retried, got %d calls", got)
+	}
+}
+
+func TestIdempotentKeyStoredWithRegistration(t *testing.T) {
+	s, handler, calls := newIdempotencyTestServer(t, http.StatusOK)
+
+	reg := &db.Registration{
+		RegistrationID: "20260101-00000001",
+		Email:          "john@example.com",
+		VatID:          "ES12345678",
+		IdempotencyKey: "key-before-restart",
+	}
+	if err := s.DB.SaveRegistrationContext(context.Background(), reg); err != nil {
+		t.Fatal(err)
+	}
+	reg.CredentialID = "cred-1"
+	if err := s.DB.UpdateRegistrationStatusContext(context.Background(), reg); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a restart the in-memory cache is empty, the key is found in the database
+	rec := sendWithKey(handler, "key-before-restart", `{}`)
+	if calls.Load() != 0 {
+		t.Errorf("expected the handler not to run for a stored key")
+	}
+	if !strings.Contains(rec.Body.String(), reg.RegistrationID) || !strings.Contains(rec.Body.String(), "cred-1") {
+		t.Errorf("expected the stored registration, got %s", rec.Body.String())
+	}
+
+	// The fingerprints of the registrations are compared after a restart too
+	body := `{"email": "jane@example.com"}`
+	fingerprint := sha256.Sum256([]byte(body))
+	reg = &db.Registration{
+		RegistrationID:         "20260101-00000002",
+		Email:                  "jane@example.com",
+		VatID:                  "ES87654321",
+		IdempotencyKey:         "key-with-body",
+		IdempotencyFingerprint: hex.EncodeToString(fingerprint[:]),
+	}
+	if err := s.DB.SaveRegistrationContext(context.Background(), reg); err != nil {
+		t.Fatal(err)
+	}
+	rec = sendWithKey(handler, "key-with-body", `{"email": "mallory@example.com"}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected %d for a stored key reused with a different request, got %d: %s", http.StatusUnprocessableEntity, rec.Code, rec.Body.String())
+	}
+	rec = sendWithKey(handler, "key-with-body", body)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), reg.RegistrationID) {
+		t.Errorf("expected the stored registration for the original request, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if calls.Load() != 0 {
+		t.Errorf("expected the handler not to run for the stored keys")
+	}
+
+	// Outside of the window the key is forgotten
+	s.now = func() time.Time { return time.Now().Add(2 * defaultIdempotencyWindow) }
+	sendWithKey(handler, "key-before-restart", `{}`)
+	if calls.Load() != 1 {
+		t.Errorf("expected the handler to run for an expired key")
+	}
+}
+
+func TestIdempotentFingerprintInContext(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development})
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Development)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	s.DB = dbService
+
+	var got string
+	handler := s.Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		got = idempotencyFingerprint(r.Context())
+		s.SendJSON(w, http.StatusOK, true, "Registration successful", nil)
+	})
+
+	body := `{"email": "john@example.com"}`
+	sendWithKey(handler, "key-1", body)
+	want := sha256.Sum256([]byte(body))
+	if got != hex.EncodeToString(want[:]) {
+		t.Errorf("expected the fingerprint of the body for the handler, got %q", got)
+	}
+
+	sendWithKey(handler, "", body)
+	if got != "" {
+		t.Errorf("expected no fingerprint without a key, got %q", got)
+	}
+}
+
+func TestIdempotentWaitStopsWithContext(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development})
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Development)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	s.DB = dbService
+
+	// The first request hangs until the end of the test
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	handler := s.Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	go sendWithKey(handler, "key-1", `{}`)
+	<-started
+
+	// The repetition stops waiting when its client goes away
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodPost, "/api/register", strings.NewReader(`{}`)).WithContext(ctx)
+	req.Header.Set(idempotencyKeyHeader, "key-1")
+	done := make(chan struct{})
+	go func() {
+		handler(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the repeated request did not stop when its context was done")
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/hesusruiz/onboardng/credissuance"
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+// In asynchronous mode the Issuer accepts the request and later posts the result to the response URI of the request.
+// The URI points to the callback endpoint, with a token that is an HMAC of the registration id, so only the Issuer
+// that received the request can finalize the registration. The token is signed with the status secret, and with a
+// random secret the callbacks of the requests sent before a restart are rejected.
+
+// callbackTokenPrefix separates the callback tokens from the status tokens signed with the same secret
+const callbackTokenPrefix = "issuance-callback:"
+
+// callbackToken returns the token that authorizes the Issuer to send the result of the issuance of a registration
+func (s *Server) callbackToken(registrationID string) string {
+	mac := hmac.New(sha256.New, s.statusSecret)
+	mac.Write([]byte(callbackTokenPrefix + registrationID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issuanceCallbackURL returns the response URI where the Issuer sends the result of the issuance of a registration
+func (s *Server) issuanceCallbackURL(registrationID string) string {
+	query := url.Values{}
+	query.Set("registration_id", registrationID)
+	query.Set("token", s.callbackToken(registrationID))
+	return strings.TrimSuffix(s.Config.ApiUrl, "/") + s.apiPath("issuance-callback") + "?" + query.Encode()
+}
+
+// newIssuanceRequest builds the request to issue the credential of a registration, with the response URI
+// of the registration when the Issuer works in asynchronous mode
+func (s *Server) newIssuanceRequest(reg *db.Registration) *credissuance.LEARIssuanceRequestBody {
+	applicant := credissuance.Applicant{
+		Email:       reg.Email,
+		FirstName:   reg.FirstName,
+		LastName:    reg.LastName,
+		CompanyName: reg.CompanyName,
+		Country:     reg.Country,
+		VatID:       reg.VatID,
+	}
+	cred := credissuance.NewLEARIssuanceRequestBody(applicant, s.Config.CredentialPowers(), s.Config.CredentialClaims(reg.ExtraFields), s.Config.Issuer)
+	if s.Config.Issuer.Async() {
+		cred.ResponseUri = s.issuanceCallbackURL(reg.RegistrationID)
+	}
+	return cred
+}
+
+// awaitIssuance records that the Issuer accepted the request to issue the credential of a registration,
+// which stays pending until the Issuer sends the result
+func (s *Server) awaitIssuance(ctx context.Context, reg *db.Registration, queued bool) {
+	slog.InfoContext(ctx, "Issuance accepted, waiting for the result of the Issuer", "registration_id", reg.RegistrationID)
+	reg.IssuanceError = ""
+	reg.Status = db.StatusPending
+	s.updateRegistration(ctx, reg, queued)
+}
+
+// issuanceFailure is the result sent by the Issuer when it could not issue the credential.
+// A successful result is like the response of the Issuer in synchronous mode.
+type issuanceFailure struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// HandleIssuanceCallback receives the result of an asynchronous issuance from the Issuer. When the credential
+// was issued, the registration is completed and the welcome email is sent with the credential offer. Otherwise
+// the registration fails like when the Issuer fails in synchronous mode, and is retried later.
+// The requests are authorized by the token of the response URI, so they do not need the CSRF token.
+func (s *Server) HandleIssuanceCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	registrationID := r.URL.Query().Get("registration_id")
+	token := r.URL.Query().Get("token")
+	if registrationID == "" || !hmac.Equal([]byte(token), []byte(s.callbackToken(registrationID))) {
+		slog.WarnContext(r.Context(), "⚠️ Rejected issuance callback", "ip", clientIP(r), "registration_id", registrationID)
+		s.SendJSON(w, http.StatusForbidden, false, "Invalid token", nil)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.sendBodyError(w, err)
+		return
+	}
+	var failure issuanceFailure
+	if err := json.Unmarshal(body, &failure); err != nil {
+		s.SendJSON(w, http.StatusBadRequest, false, "Invalid issuance result", nil)
+		return
+	}
+
+	reg, err := s.DB.GetRegistrationByIDContext(r.Context(), registrationID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.SendJSON(w, http.StatusNotFound, false, "Registration not found", nil)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "❌ Error reading the registration of the issuance callback", "registration_id", registrationID, "error", err)
+		s.SendJSON(w, http.StatusInternalServerError, false, "Failed to read the registration", nil)
+		return
+	}
+
+	// The Issuer may send the result again, and the welcome email is sent only once
+	if reg.Status == db.StatusIssued {
+		s.SendJSON(w, http.StatusOK, true, "Issuance already recorded", nil)
+		return
+	}
+
+	// The registration is finalized even if the Issuer goes away
+	ctx := context.WithoutCancel(r.Context())
+	if failure.Error != "" {
+		reason := "issuer callback: " + failure.Error
+		if failure.ErrorDescription != "" {
+			reason += ": " + failure.ErrorDescription
+		}
+		slog.ErrorContext(ctx, "❌ Asynchronous issuance failed", "registration_id", reg.RegistrationID, "error", reason)
+
+		payload, err := s.DB.GetIssuancePayloadContext(ctx, reg.RegistrationID)
+		if err != nil {
+			slog.ErrorContext(ctx, "❌ Error reading the issuance payload", "registration_id", reg.RegistrationID, "error", err)
+		}
+		s.failIssuance(ctx, reg, payload, reason, false)
+		s.SendJSON(w, http.StatusOK, true, "Issuance failure recorded", nil)
+		return
+	}
+
+	slog.InfoContext(ctx, "Credential issued asynchronously", "registration_id", reg.RegistrationID)
+	// The errors reported by the Issuer were handled above
+	result, _ := parseIssuanceResponse(ctx, reg, body)
+	s.completeIssuance(ctx, reg, result, false)
+	s.SendJSON(w, http.StatusOK, true, "Issuance recorded", nil)
+}
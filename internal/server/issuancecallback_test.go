@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+// newAsyncTestServer returns a server issuing the credentials asynchronously, and the response URIs sent to the Issuer
+func newAsyncTestServer(t *testing.T) (*Server, *db.Service, *[]string) {
+	t.Helper()
+	s := newTestServer(t, configuration.EnvConfig{
+		Runtime: configuration.Production,
+		ApiUrl:  "https://onboarding.example.com/",
+		Issuer:  configuration.IssuerConfig{OperationMode: configuration.AsyncOperationMode},
+	})
+
+	var responseURIs []string
+	s.Issuer = newTestIssuer(t, func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			OperationMode string `json:"operation_mode"`
+			ResponseURI   string `json:"response_uri"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &req); err != nil || req.OperationMode != "A" {
+			t.Errorf("expected an asynchronous request, got %s", body)
+		}
+		responseURIs = append(responseURIs, req.ResponseURI)
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Production)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbService.Close() })
+	s.DB = dbService
+	return s, dbService, &responseURIs
+}
+
+// postCallback sends the result of the Issuer to the response URI
+func postCallback(s *Server, responseURI string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, responseURI, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	s.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAsyncIssuance(t *testing.T) {
+	s, dbService, responseURIs := newAsyncTestServer(t)
+
+	body := `{"firstName": "Jane", "lastName": "Doe", "companyName": "ACME", "country": "ES", "vatId": "ES12345678", "email": "jane@example.com"}`
+	if rec := postJSON(s, "/api/register", body); rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	// The registration is pending until the Issuer sends the result
+	reg, err := dbService.GetRegistrationByEmail("jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.Status != db.StatusPending {
+		t.Fatalf("expected the registration to be pending, got %q", reg.Status)
+	}
+
+	if len(*responseURIs) != 1 || !strings.HasPrefix((*responseURIs)[0], "https://onboarding.example.com/api/issuance-callback?") {
+		t.Fatalf("expected the response URI of the callback endpoint, got %q", *responseURIs)
+	}
+	responseURI, err := url.Parse((*responseURIs)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responseURI.Query().Get("registration_id") != reg.RegistrationID {
+		t.Fatalf("expected the response URI of registration %s, got %s", reg.RegistrationID, responseURI)
+	}
+
+	// The token of a registration is not valid for another one, nor is the status token
+	forged := "/api/issuance-callback?registration_id=other&token=" + responseURI.Query().Get("token")
+	if rec := postCallback(s, forged, `{"credential_id": "cred-1"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("expected %d for a forged token, got %d", http.StatusForbidden, rec.Code)
+	}
+	statusToken := "/api/issuance-callback?registration_id=" + reg.RegistrationID + "&token=" + s.statusToken(reg.RegistrationID)
+	if rec := postCallback(s, statusToken, `{"credential_id": "cred-1"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("expected %d for the status token, got %d", http.StatusForbidden, rec.Code)
+	}
+
+	if rec := postCallback(s, responseURI.RequestURI(), `{"credential_id": "cred-1"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	reg, err = dbService.GetRegistrationByID(reg.RegistrationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.Status != db.StatusIssued || reg.CredentialID != "cred-1" {
+		t.Errorf("expected the credential to be issued, got status %q and credential %q", reg.Status, reg.CredentialID)
+	}
+
+	// A repeated result is accepted without processing it again
+	rec := postCallback(s, responseURI.RequestURI(), `{"credential_id": "cred-2"}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "already recorded") {
+		t.Errorf("expected the repeated result to be ignored, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAsyncIssuanceFailure(t *testing.T) {
+	s, dbService, responseURIs := newAsyncTestServer(t)
+
+	body := `{"firstName": "Jane", "lastName": "Doe", "companyName": "ACME", "country": "ES", "vatId": "ES12345678", "email": "jane@example.com"}`
+	if rec := postJSON(s, "/api/register", body); rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	responseURI, err := url.Parse((*responseURIs)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := postCallback(s, responseURI.RequestURI(), `{"error": "invalid_mandator"`); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for an invalid result, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	rec := postCallback(s, responseURI.RequestURI(), `{"error": "invalid_mandator", "error_description": "unknown organization"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	reg, err := dbService.GetRegistrationByEmail("jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.Status != db.StatusFailed || !strings.Contains(reg.IssuanceError, "unknown organization") {
+		t.Errorf("expected the registration to fail with the error of the Issuer, got status %q and error %q", reg.Status, reg.IssuanceError)
+	}
+}
+
+func TestNewServerAsyncRequiresApiUrl(t *testing.T) {
+	cfg := configuration.EnvConfig{
+		Runtime: configuration.Development,
+		Issuer:  configuration.IssuerConfig{OperationMode: configuration.AsyncOperationMode},
+	}
+	if _, err := NewServer(cfg, nil, nil, nil, t.TempDir()); err == nil {
+		t.Errorf("expected the asynchronous mode without api_url to be rejected")
+	}
+
+	// The callback endpoint is only served in asynchronous mode
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development})
+	if rec := postCallback(s, "/api/issuance-callback?registration_id=x&token=y", `{}`); rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d in synchronous mode, got %d", http.StatusNotFound, rec.Code)
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+// The defaults of the limit of issuances in flight, when the configuration enables it without specifying them
+const (
+	defaultIssuanceMaxQueued    = 100
+	defaultIssuanceQueueTimeout = 10 * time.Second
+)
+
+// errIssuanceBusy is returned when an issuance can not start because too many are in flight or waiting
+var errIssuanceBusy = errors.New("too many issuances in progress")
+
+// issuanceLimiter bounds the requests to the Verifier and Issuer in flight at once, so a spike of registrations
+// does not overwhelm them. The registrations above the limit wait for a slot, up to a maximum and a timeout.
+// A nil limiter does not limit anything.
+type issuanceLimiter struct {
+	slots     chan struct{}
+	waiting   atomic.Int32
+	maxQueued int32
+	timeout   time.Duration
+}
+
+// newIssuanceLimiter returns the limiter of the configuration, nil if the issuances are not limited
+func newIssuanceLimiter(cfg configuration.IssuanceLimitConfig) *issuanceLimiter {
+	if cfg.MaxInFlight <= 0 {
+		return nil
+	}
+	l := &issuanceLimiter{
+		slots:     make(chan struct{}, cfg.MaxInFlight),
+		maxQueued: int32(cfg.MaxQueued),
+		timeout:   cfg.QueueTimeout,
+	}
+	if l.maxQueued <= 0 {
+		l.maxQueued = defaultIssuanceMaxQueued
+	}
+	if l.timeout <= 0 {
+		l.timeout = defaultIssuanceQueueTimeout
+	}
+	return l
+}
+
+// acquire waits for a slot to issue a credential, returning the function to release it.
+// It returns errIssuanceBusy if the queue is full or the wait times out, or the error of ctx if it is done first.
+func (l *issuanceLimiter) acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	release = func() { <-l.slots }
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if l.waiting.Add(1) > l.maxQueued {
+		l.waiting.Add(-1)
+		return nil, errIssuanceBusy
+	}
+	defer l.waiting.Add(-1)
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, errIssuanceBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// retryAfter returns the seconds a client should wait before trying again when the issuances are busy
+func (l *issuanceLimiter) retryAfter() int {
+	if l == nil {
+		return 1
+	}
+	return int(math.Ceil(l.timeout.Seconds()))
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func TestIssuanceLimiter(t *testing.T) {
+	if l := newIssuanceLimiter(configuration.IssuanceLimitConfig{}); l != nil {
+		t.Fatal("expected no limiter by default")
+	}
+	var unlimited *issuanceLimiter
+	release, err := unlimited.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("expected no limit, got %v", err)
+	}
+	release()
+
+	l := newIssuanceLimiter(configuration.IssuanceLimitConfig{MaxInFlight: 1, MaxQueued: 1, QueueTimeout: 50 * time.Millisecond})
+	release, err = l.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The next one waits until the timeout
+	start := time.Now()
+	if _, err := l.acquire(context.Background()); !errors.Is(err, errIssuanceBusy) {
+		t.Fatalf("expected %v, got %v", errIssuanceBusy, err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected to wait for the timeout, waited %v", elapsed)
+	}
+
+	// A canceled request stops waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.acquire(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+
+	// A waiting one gets the slot when it is released
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release()
+	}()
+	release, err = l.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("expected the released slot, got %v", err)
+	}
+	release()
+	if l.retryAfter() != 1 {
+		t.Errorf("expected to retry after 1 second, got %d", l.retryAfter())
+	}
+}
+
+// postRegistration sends the registration to the API
+func postRegistration(s *Server, req RegistrationRequest) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(req)
+	return postJSON(s, "/api/register", string(body))
+}
+
+// companyRegistration returns a valid registration of the i-th company of a test
+func companyRegistration(i int) RegistrationRequest {
+	return testRegistrationRequest(func(r *RegistrationRequest) {
+		r.Email = "user" + strconv.Itoa(i) + "@example.com"
+		r.VatId = "B1234567" + strconv.Itoa(i)
+	})
+}
+
+func TestIssuanceLimit(t *testing.T) {
+	const maxInFlight = 2
+	var inFlight, maxSeen atomic.Int32
+	unblock := make(chan struct{})
+	f := newTestFlow(t, func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			seen := maxSeen.Load()
+			if n <= seen || maxSeen.CompareAndSwap(seen, n) {
+				break
+			}
+		}
+		<-unblock
+		w.Write([]byte(`{"credential_id": "cred-1"}`))
+	})
+	f.s.issuances = newIssuanceLimiter(configuration.IssuanceLimitConfig{MaxInFlight: maxInFlight, MaxQueued: 1, QueueTimeout: 5 * time.Second})
+
+	for i := range maxInFlight + 2 {
+		f.verifyEmail(t, companyRegistration(i).Email)
+	}
+
+	// The first registrations fill the slots and the queue
+	var wg sync.WaitGroup
+	release := sync.OnceFunc(func() { close(unblock) })
+	defer wg.Wait()
+	defer release()
+	for i := range maxInFlight + 1 {
+		wg.Go(func() {
+			if rec := postRegistration(f.s, companyRegistration(i)); rec.Code != http.StatusOK {
+				t.Errorf("registration %d: expected %d, got %d: %s", i, http.StatusOK, rec.Code, rec.Body.String())
+			}
+		})
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(f.issuanceRequests) < maxInFlight || f.s.issuances.waiting.Load() < 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d issuances in flight and one waiting", maxInFlight)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The next one is rejected, and can try again later
+	rec := postRegistration(f.s, companyRegistration(maxInFlight+1))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d, got %d: %s", http.StatusServiceUnavailable, rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Retry-After"); got != "5" {
+		t.Errorf("expected Retry-After 5, got %q", got)
+	}
+
+	release()
+	wg.Wait()
+	if got := maxSeen.Load(); got > maxInFlight {
+		t.Errorf("expected at most %d issuances in flight, got %d", maxInFlight, got)
+	}
+	if got := len(f.issuanceRequests); got != maxInFlight+1 {
+		t.Errorf("expected %d issuances, got %d", maxInFlight+1, got)
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/hesusruiz/onboardng/credissuance"
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+// The defaults of the retries of the failed issuances, when the configuration does not specify them
+const (
+	defaultIssuanceRetryInterval    = 10 * time.Minute
+	defaultIssuanceRetryCooldown    = 30 * time.Minute
+	defaultIssuanceRetryMaxAttempts = 5
+)
+
+// issuanceRetryBatch limits the issuances retried in each check, so a long outage does not flood the Issuer
+const issuanceRetryBatch = 20
+
+// issuanceRetryConfig returns the configuration of the retries with the defaults applied
+func (s *Server) issuanceRetryConfig() configuration.IssuanceRetryConfig {
+	cfg := s.Config.IssuanceRetry
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultIssuanceRetryInterval
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = defaultIssuanceRetryCooldown
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultIssuanceRetryMaxAttempts
+	}
+	return cfg
+}
+
+// retryable reports whether a failed issuance may be retried automatically: the access token could not be obtained,
+// or the Issuer did not process the request. After any other failure, e.g. a timeout, the credential may be issued
+// already and a retry would issue a duplicate, so it is left to be reissued manually.
+func retryable(err error) bool {
+	return errors.Is(err, credissuance.ErrTokenRequest) || errors.Is(err, credissuance.ErrIssuerUnprocessed)
+}
+
+// issuanceFailureKind describes for the logs why an issuance failed
+func issuanceFailureKind(err error) string {
+	switch {
+	case errors.Is(err, credissuance.ErrTokenRequest):
+		return "token"
+	case errors.Is(err, credissuance.ErrIssuerClient):
+		return "rejected"
+	case errors.Is(err, credissuance.ErrIssuerServer):
+		return "issuer_unavailable"
+	}
+	return "unknown"
+}
+
+// endIssuanceRetries stops the retries of an issuance that would fail again, leaving it to be reissued manually
+func (s *Server) endIssuanceRetries(ctx context.Context, reg *db.Registration) {
+	if err := s.DB.EndIssuanceRetriesContext(ctx, reg.RegistrationID, s.issuanceRetryConfig().MaxAttempts); err != nil {
+		slog.ErrorContext(ctx, "❌ Error ending the issuance retries", "registration_id", reg.RegistrationID, "error", err)
+	}
+}
+
+// RetryFailedIssuances checks periodically for issuances that failed and retries them, until the context is done.
+// It is started in its own goroutine, and stops when the server shuts down.
+func (s *Server) RetryFailedIssuances(ctx context.Context) {
+	cfg := s.issuanceRetryConfig()
+	if cfg.Disabled || s.DB == nil || s.Issuer == nil {
+		return
+	}
+
+	slog.Info("Retrying failed issuances in the background", "interval", cfg.Interval, "cooldown", cfg.Cooldown, "max_attempts", cfg.MaxAttempts)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopped retrying failed issuances")
+			return
+		case <-ticker.C:
+			s.retryFailedIssuances(ctx)
+		}
+	}
+}
+
+// retryFailedIssuances retries once the issuances that failed longer than the cooldown ago,
+// returning how many credentials were issued
+func (s *Server) retryFailedIssuances(ctx context.Context) int {
+	cfg := s.issuanceRetryConfig()
+
+	regs, err := s.DB.GetFailedIssuancesContext(ctx, s.now().Add(-cfg.Cooldown), cfg.MaxAttempts, issuanceRetryBatch)
+	if err != nil {
+		slog.ErrorContext(ctx, "❌ Error reading the failed issuances", "error", err)
+		return 0
+	}
+
+	issued := 0
+	for i := range regs {
+		// The retries share the issuance slots with the registrations, and wait for the next check when busy
+		release, err := s.issuances.acquire(ctx)
+		if err != nil {
+			break
+		}
+		ok := s.retryIssuance(ctx, &regs[i], cfg.MaxAttempts)
+		release()
+		if ok {
+			issued++
+		}
+	}
+	return issued
+}
+
+// retryIssuance calls again the Issuer for a registration whose issuance failed, reporting whether it was issued,
+// or accepted by the Issuer in asynchronous mode.
+// On success the welcome email is sent again, this time with the credential offer.
+func (s *Server) retryIssuance(ctx context.Context, reg *db.Registration, maxAttempts int) bool {
+	ctx, span := startSpan(ctx, "RetryIssuance", registrationAttributes(reg)...)
+	defer span.End()
+
+	// Count the retry before calling the Issuer, so a registration crashing the worker is not retried forever
+	retries, err := s.DB.AddIssuanceRetryContext(ctx, reg.RegistrationID)
+	if err != nil {
+		slog.ErrorContext(ctx, "❌ Error counting the issuance retry", "registration_id", reg.RegistrationID, "error", err)
+		return false
+	}
+
+	cred := s.newIssuanceRequest(reg)
+	s.recordIssuancePayload(ctx, reg, cred, false)
+
+	reg.IssuanceAt = s.now()
+	issResponse, err := s.Issuer.LEARIssuanceRequestContext(ctx, cred)
+	s.recordIssuerResponse(ctx, reg, issResponse, false)
+	var issResult *credissuance.IssuanceResult
+	if err == nil {
+		issResult, err = parseIssuanceResponse(ctx, reg, issResponse.Body)
+	}
+	if err != nil {
+		reg.IssuanceError = err.Error()
+		s.updateRegistration(ctx, reg, false)
+		if !retryable(err) {
+			s.endIssuanceRetries(ctx, reg)
+			slog.ErrorContext(ctx, "❌ Issuance retry failed and can not be retried, it has to be reissued manually", "registration_id", reg.RegistrationID, "retries", retries, "error", err)
+		} else if retries >= maxAttempts {
+			slog.ErrorContext(ctx, "❌ Issuance failed after all the retries, it has to be reissued manually", "registration_id", reg.RegistrationID, "retries", retries, "error", err)
+		} else {
+			slog.WarnContext(ctx, "⚠️ Issuance retry failed", "registration_id", reg.RegistrationID, "retries", retries, "error", err)
+		}
+		return false
+	}
+
+	if s.Config.Issuer.Async() {
+		slog.InfoContext(ctx, "Issuance accepted on retry", "registration_id", reg.RegistrationID, "retries", retries)
+		s.awaitIssuance(ctx, reg, false)
+		return true
+	}
+	slog.InfoContext(ctx, "Credential issued on retry", "registration_id", reg.RegistrationID, "retries", retries)
+	s.completeIssuance(ctx, reg, issResult, false)
+	return true
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+func TestRetryFailedIssuances(t *testing.T) {
+	cfg := configuration.EnvConfig{
+		Runtime:       configuration.Production,
+		IssuanceRetry: configuration.IssuanceRetryConfig{Cooldown: time.Minute, MaxAttempts: 2},
+	}
+	s := newTestServer(t, cfg)
+
+	// The Issuer fails the first call and works after it
+	calls := 0
+	s.Issuer = newTestIssuer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"credential_id": "cred-1"}`))
+	})
+
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Production)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	s.DB = dbService
+
+	failedAt := time.Now()
+	for _, reg := range []*db.Registration{
+		{RegistrationID: "reg-failed", Email: "a@example.com", VatID: "ES1", Country: "ES"},
+		{RegistrationID: "reg-issued", Email: "b@example.com", VatID: "ES2", Country: "ES"},
+	} {
+		if err := dbService.SaveRegistration(reg); err != nil {
+			t.Fatal(err)
+		}
+		reg.IssuanceAt = failedAt
+		reg.Status = db.StatusIssued
+		if reg.RegistrationID == "reg-failed" {
+			reg.Status = db.StatusFailed
+			reg.IssuanceError = "the Issuer is down"
+		}
+		if err := dbService.UpdateRegistrationStatus(reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing is retried during the cooldown
+	s.now = func() time.Time { return failedAt.Add(30 * time.Second) }
+	if issued := s.retryFailedIssuances(context.Background()); issued != 0 || calls != 0 {
+		t.Fatalf("expected no retries during the cooldown, got %d issued after %d calls", issued, calls)
+	}
+
+	// The first retry fails, and the registration stays failed
+	s.now = func() time.Time { return failedAt.Add(2 * time.Minute) }
+	if issued := s.retryFailedIssuances(context.Background()); issued != 0 || calls != 1 {
+		t.Fatalf("expected a failed retry, got %d issued after %d calls", issued, calls)
+	}
+	reg, err := dbService.GetRegistrationByID("reg-failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.Status != db.StatusFailed || reg.IssuanceError == "" {
+		t.Fatalf("expected the registration to stay failed, got status %q and error %q", reg.Status, reg.IssuanceError)
+	}
+
+	// The second retry, after another cooldown, issues the credential
+	s.now = func() time.Time { return failedAt.Add(4 * time.Minute) }
+	if issued := s.retryFailedIssuances(context.Background()); issued != 1 || calls != 2 {
+		t.Fatalf("expected the credential to be issued, got %d issued after %d calls", issued, calls)
+	}
+	reg, err = dbService.GetRegistrationByID("reg-failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.Status != db.StatusIssued || reg.IssuanceError != "" || reg.CredentialID != "cred-1" {
+		t.Errorf("expected the registration to be issued, got status %q, error %q and credential %q", reg.Status, reg.IssuanceError, reg.CredentialID)
+	}
+
+	// Issued registrations are not retried again
+	s.now = func() time.Time { return failedAt.Add(time.Hour) }
+	if issued := s.retryFailedIssuances(context.Background()); issued != 0 || calls != 2 {
+		t.Errorf("expected no more retries, got %d issued after %d calls", issued, calls)
+	}
+}
+
+func TestRetryFailedIssuancesGivesUp(t *testing.T) {
+	cfg := configuration.EnvConfig{
+		Runtime:       configuration.Production,
+		IssuanceRetry: configuration.IssuanceRetryConfig{Cooldown: time.Minute, MaxAttempts: 2},
+	}
+	s := newTestServer(t, cfg)
+
+	calls := 0
+	s.Issuer = newTestIssuer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Production)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	s.DB = dbService
+
+	reg := &db.Registration{RegistrationID: "reg-1", Email: "a@example.com", VatID: "ES1", Country: "ES"}
+	if err := dbService.SaveRegistration(reg); err != nil {
+		t.Fatal(err)
+	}
+	reg.Status = db.StatusFailed
+	reg.IssuanceError = "the Issuer is down"
+	if err := dbService.UpdateRegistrationStatus(reg); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 4; i++ {
+		s.now = func() time.Time { return time.Now().Add(time.Duration(i) * time.Hour) }
+		s.retryFailedIssuances(context.Background())
+	}
+	if calls != 2 {
+		t.Errorf("expected %d calls to the Issuer, got %d", 2, calls)
+	}
+}
+
+func TestRetryFailedIssuancesRejected(t *testing.T) {
+	cfg := configuration.EnvConfig{
+		Runtime:       configuration.Production,
+		IssuanceRetry: configuration.IssuanceRetryConfig{Cooldown: time.Minute, MaxAttempts: 5},
+	}
+	s := newTestServer(t, cfg)
+
+	// The Issuer rejects the request, which would be rejected again
+	calls := 0
+	s.Issuer = newTestIssuer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+	})
+
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Production)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	s.DB = dbService
+
+	reg := &db.Registration{RegistrationID: "reg-1", Email: "a@example.com", VatID: "ES1", Country: "ES"}
+	if err := dbService.SaveRegistration(reg); err != nil {
+		t.Fatal(err)
+	}
+	reg.Status = db.StatusFailed
+	reg.IssuanceError = "the Issuer is down"
+	if err := dbService.UpdateRegistrationStatus(reg); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		s.now = func() time.Time { return time.Now().Add(time.Duration(i) * time.Hour) }
+		s.retryFailedIssuances(context.Background())
+	}
+	if calls != 1 {
+		t.Errorf("expected a single call to the Issuer, got %d", calls)
+	}
+	reg, err = dbService.GetRegistrationByID("reg-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.Status != db.StatusFailed || !strings.Contains(reg.IssuanceError, "400") {
+		t.Errorf("expected the registration to stay failed with the rejection, got status %q and error %q", reg.Status, reg.IssuanceError)
+	}
+}
+
+func TestRetryFailedIssuancesNotAfterTimeout(t *testing.T) {
+	tests := []struct {
+		name  string
+		issue http.HandlerFunc
+	}{
+		{name: "gateway timeout", issue: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusGatewayTimeout)
+		}},
+		{name: "connection dropped", issue: func(w http.ResponseWriter, r *http.Request) {
+			conn, _, err := http.NewResponseController(w).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, configuration.EnvConfig{
+				Runtime:       configuration.Production,
+				IssuanceRetry: configuration.IssuanceRetryConfig{Cooldown: time.Minute, MaxAttempts: 5},
+			})
+
+			// The Issuer may have issued the credential before failing, so a retry could issue a duplicate
+			calls := 0
+			s.Issuer = newTestIssuer(t, func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				tt.issue(w, r)
+			})
+
+			dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Production)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dbService.Close()
+			s.DB = dbService
+
+			reg := &db.Registration{RegistrationID: "reg-1", Email: "a@example.com", VatID: "ES1", Country: "ES"}
+			if err := dbService.SaveRegistration(reg); err != nil {
+				t.Fatal(err)
+			}
+			reg.Status = db.StatusFailed
+			reg.IssuanceError = "the Verifier is down"
+			if err := dbService.UpdateRegistrationStatus(reg); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 1; i <= 3; i++ {
+				s.now = func() time.Time { return time.Now().Add(time.Duration(i) * time.Hour) }
+				s.retryFailedIssuances(context.Background())
+			}
+			if calls != 1 {
+				t.Errorf("expected a single call to the Issuer, got %d", calls)
+			}
+			reg, err = dbService.GetRegistrationByID("reg-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reg.Status != db.StatusFailed || reg.IssuanceError == "the Verifier is down" {
+				t.Errorf("expected the registration to stay failed with the new error, got status %q and error %q", reg.Status, reg.IssuanceError)
+			}
+		})
+	}
+}
+
+func TestRetryFailedIssuancesStopsWithContext(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{
+		Runtime:       configuration.Production,
+		IssuanceRetry: configuration.IssuanceRetryConfig{Interval: time.Millisecond},
+	})
+	s.Issuer = newTestIssuer(t, nil)
+
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Production)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	s.DB = dbService
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.RetryFailedIssuances(ctx)
+		close(done)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the worker did not stop when the context was done")
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/hesusruiz/onboardng/internal/mail"
+)
+
+// maxMailEventsSize limits the body of a batch of delivery events, larger than the one of the other endpoints
+const maxMailEventsSize = 1 << 20
+
+// HandleMailEvents receives the delivery events of the SendGrid Event Webhook, and records the delivery status
+// of the welcome emails so the team can follow up on the undeliverable addresses.
+// The requests are signed by SendGrid, so they do not need the CSRF token.
+func (s *Server) HandleMailEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.sendBodyError(w, err)
+		return
+	}
+
+	err = mail.VerifySendGridWebhook(s.mailEventsKey, r.Header.Get(mail.SendGridSignatureHeader), r.Header.Get(mail.SendGridTimestampHeader), body)
+	if err != nil {
+		slog.WarnContext(r.Context(), "⚠️ Rejected mail events", "ip", clientIP(r), "error", err)
+		s.SendJSON(w, http.StatusForbidden, false, "Invalid signature", nil)
+		return
+	}
+
+	events, err := mail.ParseSendGridEvents(body)
+	if err != nil {
+		s.SendJSON(w, http.StatusBadRequest, false, err.Error(), nil)
+		return
+	}
+
+	for _, event := range events {
+		updated, err := s.DB.UpdateDeliveryStatusContext(r.Context(), event.Recipient, event.Status)
+		if err != nil {
+			// SendGrid retries the whole batch, and applying an event twice is harmless
+			slog.ErrorContext(r.Context(), "❌ Error updating the delivery status", "email", event.Recipient, "error", err)
+			s.SendJSON(w, http.StatusInternalServerError, false, "Failed to record the events", nil)
+			return
+		}
+		if updated > 0 {
+			slog.InfoContext(r.Context(), "📧 Delivery status updated", "email", event.Recipient, "status", event.Status, "reason", event.Reason)
+		}
+	}
+
+	s.SendJSON(w, http.StatusOK, true, "Events recorded", nil)
+}
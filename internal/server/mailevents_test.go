@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+	"github.com/hesusruiz/onboardng/internal/mail"
+)
+
+func TestHandleMailEvents(t *testing.T) {
+	priv := mustGenerateKey(t)
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := configuration.EnvConfig{Runtime: configuration.Development}
+	cfg.Mail.SendGrid.WebhookKey = base64.StdEncoding.EncodeToString(der)
+	s := newTestServer(t, cfg)
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Development)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	s.DB = dbService
+
+	reg := &db.Registration{RegistrationID: "20260101-00000001", Email: "john@example.com", VatID: "B12345678"}
+	if err := dbService.SaveRegistration(reg); err != nil {
+		t.Fatal(err)
+	}
+
+	const body = `[{"email": "john@example.com", "event": "bounce", "reason": "550 5.1.1 User unknown"}]`
+	const timestamp = "1791540000"
+	hash := sha256.Sum256([]byte(timestamp + body))
+	sig, err := ecdsa.SignASN1(rand.Reader, priv, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(signature string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/mail-events", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(mail.SendGridSignatureHeader, signature)
+		req.Header.Set(mail.SendGridTimestampHeader, timestamp)
+		rec := httptest.NewRecorder()
+		s.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Requests not signed by SendGrid are rejected
+	forged, err := ecdsa.SignASN1(rand.Reader, mustGenerateKey(t), hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := post(base64.StdEncoding.EncodeToString(forged)); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected %d for a forged signature, got %d", http.StatusForbidden, rec.Code)
+	}
+
+	if rec := post(base64.StdEncoding.EncodeToString(sig)); rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	got, err := dbService.GetRegistrationByID(reg.RegistrationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.DeliveryStatus != db.DeliveryBounced {
+		t.Errorf("expected delivery status %q, got %q", db.DeliveryBounced, got.DeliveryStatus)
+	}
+}
+
+func TestMailEventsNotRoutedWithoutKey(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development})
+
+	rec := httptest.NewRecorder()
+	s.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/mail-events", strings.NewReader(`[]`)))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d without a webhook key, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func mustGenerateKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
@@ -0,0 +1,343 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+// The side effects of the registrations, the welcome email and the call to the webhook, are added to the outbox
+// in the same transaction that saves the change to the registration, and delivered right after it. The ones that
+// fail, or were not delivered because the server stopped, are delivered by DispatchOutbox in the background.
+
+// The defaults of the delivery of the outbox, when the configuration does not specify them
+const (
+	defaultOutboxInterval    = time.Minute
+	defaultOutboxMaxAttempts = 10
+	defaultWebhookTimeout    = 10 * time.Second
+)
+
+// outboxBatch limits the items delivered in each check
+const outboxBatch = 50
+
+// outboxLease is how long the items delivered right after being saved are reserved for that delivery,
+// before the dispatcher takes them if the server stopped in between
+const outboxLease = 5 * time.Minute
+
+// maxOutboxBackoff is the longest wait between two attempts to deliver an item
+const maxOutboxBackoff = 6 * time.Hour
+
+// webhookSignatureHeader has the HMAC-SHA256 of the body of the webhook calls, signed with the webhook secret
+const webhookSignatureHeader = "X-Onboarding-Signature"
+
+// The events sent to the webhook
+const (
+	webhookRegistrationCreated = "registration.created"
+)
+
+// welcomeEmailPayload is the payload of the welcome emails in the outbox
+type welcomeEmailPayload struct {
+	OfferURI string `json:"offer_uri,omitempty"`
+}
+
+// webhookEvent is the body of the calls to the webhook
+type webhookEvent struct {
+	Event        string              `json:"event"`
+	Time         time.Time           `json:"time"`
+	Registration webhookRegistration `json:"registration"`
+}
+
+// webhookRegistration is the data of a registration sent to the webhook
+type webhookRegistration struct {
+	RegistrationID string `json:"registration_id"`
+	Email          string `json:"email"`
+	FirstName      string `json:"first_name"`
+	LastName       string `json:"last_name"`
+	CompanyName    string `json:"company_name"`
+	Country        string `json:"country"`
+	VatID          string `json:"vat_id"`
+	Language       string `json:"language,omitempty"`
+	ReviewNote     string `json:"review_note,omitempty"`
+}
+
+// loadWebhookSecret reads the key signing the calls to the webhook, nil if the calls are not signed
+func loadWebhookSecret(file string) ([]byte, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook secret file: %w", err)
+	}
+	secret := []byte(strings.TrimSpace(string(content)))
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("the webhook secret in %s must have at least 32 characters", file)
+	}
+	return secret, nil
+}
+
+// outboxConfig returns the configuration of the outbox with the defaults applied
+func (s *Server) outboxConfig() configuration.OutboxConfig {
+	cfg := s.Config.Outbox
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultOutboxInterval
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultOutboxMaxAttempts
+	}
+	return cfg
+}
+
+// outboxBackoff returns the wait before the next attempt to deliver an item that failed the given number of times
+func (s *Server) outboxBackoff(attempts int) time.Duration {
+	backoff := s.outboxConfig().Interval
+	for range attempts - 1 {
+		backoff *= 2
+		if backoff >= maxOutboxBackoff {
+			return maxOutboxBackoff
+		}
+	}
+	return backoff
+}
+
+// welcomeEmailItem returns the item of the outbox sending the welcome email of a registration, reserved to be
+// delivered right after it is saved, or scheduled after the delay of the welcome email of the configuration
+func (s *Server) welcomeEmailItem(reg *db.Registration, offerURI string) *db.OutboxItem {
+	payload, _ := json.Marshal(welcomeEmailPayload{OfferURI: offerURI})
+	next := s.now().Add(outboxLease)
+	if delay := s.Config.Outbox.WelcomeEmailDelay; delay > 0 {
+		next = s.now().Add(delay)
+	}
+	return &db.OutboxItem{
+		Kind:           db.OutboxWelcomeEmail,
+		RegistrationID: reg.RegistrationID,
+		Payload:        string(payload),
+		NextAttemptAt:  next,
+	}
+}
+
+// scheduledWelcomeEmail tells whether the welcome email of the outbox item is left to DispatchOutbox, because
+// the configuration delays it. Without an item saved in the outbox it is sent right away, as nothing would send it.
+func (s *Server) scheduledWelcomeEmail(ctx context.Context, item *db.OutboxItem) bool {
+	if s.Config.Outbox.WelcomeEmailDelay <= 0 || item.ID == 0 {
+		return false
+	}
+	slog.InfoContext(ctx, "📧 Welcome email scheduled", "registration_id", item.RegistrationID, "at", item.NextAttemptAt)
+	return true
+}
+
+// registrationCreatedItems returns the items of the outbox to save with a new registration, reserved to be delivered
+// right after it is saved
+func (s *Server) registrationCreatedItems(reg *db.Registration) []*db.OutboxItem {
+	if s.Config.Webhook.URL == "" {
+		return nil
+	}
+	payload, err := json.Marshal(webhookEvent{
+		Event: webhookRegistrationCreated,
+		Time:  s.now(),
+		Registration: webhookRegistration{
+			RegistrationID: reg.RegistrationID,
+			Email:          reg.Email,
+			FirstName:      reg.FirstName,
+			LastName:       reg.LastName,
+			CompanyName:    reg.CompanyName,
+			Country:        reg.Country,
+			VatID:          reg.VatID,
+			Language:       reg.Language,
+			ReviewNote:     reg.ReviewNote,
+		},
+	})
+	if err != nil {
+		slog.Error("❌ Error marshalling the webhook event", "registration_id", reg.RegistrationID, "error", err)
+		return nil
+	}
+	return []*db.OutboxItem{{
+		Kind:           db.OutboxWebhook,
+		RegistrationID: reg.RegistrationID,
+		Payload:        string(payload),
+		NextAttemptAt:  s.now().Add(outboxLease),
+	}}
+}
+
+// recordWelcomeEmail records the new status of a registration with its welcome email in the outbox, so the email
+// is sent even if the server stops before sending it. It returns the item of the outbox, without id when it was not
+// saved because the registration is queued or the database failed.
+func (s *Server) recordWelcomeEmail(ctx context.Context, reg *db.Registration, offerURI string, queued bool) *db.OutboxItem {
+	item := s.welcomeEmailItem(reg, offerURI)
+	if !queued {
+		err := s.DB.UpdateRegistrationStatusContext(context.WithoutCancel(ctx), reg, item)
+		if err == nil {
+			return item
+		}
+		slog.ErrorContext(ctx, "❌ Error updating registration status", "registration_id", reg.RegistrationID, "error", err)
+		item.ID = 0
+	}
+	s.queueRegistration(ctx, reg)
+	return item
+}
+
+// sendWelcomeEmail sends the welcome email to the user of a registration, and records the result in the registration.
+// queued tells that the registration is in the queue because the database failed.
+func (s *Server) sendWelcomeEmail(ctx context.Context, reg *db.Registration, offerURI string, queued bool) error {
+	_, span := startSpan(ctx, "SendWelcomeEmail", registrationAttributes(reg)...)
+	err := s.Mail.SendWelcomeEmail(reg, offerURI)
+	endSpan(span, err)
+	if err != nil {
+		slog.ErrorContext(ctx, "❌ Error sending welcome email", "error", err)
+		reg.NotifEmailError = err.Error()
+	} else {
+		slog.InfoContext(ctx, "📧 Welcome email sent", "email", reg.Email)
+		reg.NotifEmailAt = time.Now()
+		reg.NotifEmailError = ""
+		reg.DeliveryStatus = db.DeliverySent
+	}
+	s.updateRegistration(ctx, reg, queued)
+	return err
+}
+
+// callWebhook posts the payload to the webhook of the configuration, signed with the webhook secret if any
+func (s *Server) callWebhook(ctx context.Context, payload string) error {
+	cfg := s.Config.Webhook
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, strings.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.webhookSecret != nil {
+		mac := hmac.New(sha256.New, s.webhookSecret)
+		mac.Write([]byte(payload))
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook replied with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// deliverOutboxItem delivers an item of the outbox and records the result
+func (s *Server) deliverOutboxItem(ctx context.Context, item *db.OutboxItem) {
+	s.recordOutboxDelivery(ctx, item, s.deliver(ctx, item))
+}
+
+// deliver performs the side effect of an item of the outbox
+func (s *Server) deliver(ctx context.Context, item *db.OutboxItem) error {
+	switch item.Kind {
+	case db.OutboxWelcomeEmail:
+		var payload welcomeEmailPayload
+		if err := json.Unmarshal([]byte(item.Payload), &payload); err != nil {
+			return fmt.Errorf("invalid welcome email payload: %w", err)
+		}
+		reg, err := s.DB.GetRegistrationByIDContext(ctx, item.RegistrationID)
+		if err != nil {
+			return fmt.Errorf("failed to read the registration: %w", err)
+		}
+		return s.sendWelcomeEmail(ctx, reg, payload.OfferURI, false)
+
+	case db.OutboxWebhook:
+		if s.Config.Webhook.URL == "" {
+			return fmt.Errorf("no webhook configured")
+		}
+		return s.callWebhook(ctx, item.Payload)
+	}
+	return fmt.Errorf("unknown outbox item kind %q", item.Kind)
+}
+
+// recordOutboxDelivery records the result of the delivery of an item of the outbox, to be retried later if it failed.
+// The items not saved in the outbox are not recorded, and not retried.
+func (s *Server) recordOutboxDelivery(ctx context.Context, item *db.OutboxItem, deliveryErr error) {
+	if item.ID == 0 {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+
+	if deliveryErr == nil {
+		if err := s.DB.CompleteOutboxItemContext(ctx, item.ID); err != nil {
+			slog.ErrorContext(ctx, "❌ Error recording the delivery of the outbox item, it will be delivered again", "id", item.ID, "kind", item.Kind, "error", err)
+		}
+		return
+	}
+
+	cfg := s.outboxConfig()
+	attempts := item.Attempts + 1
+	status, err := s.DB.RetryOutboxItemContext(ctx, item.ID, deliveryErr.Error(), s.now().Add(s.outboxBackoff(attempts)), cfg.MaxAttempts)
+	if err != nil {
+		slog.ErrorContext(ctx, "❌ Error recording the failed delivery of the outbox item", "id", item.ID, "kind", item.Kind, "error", err)
+		return
+	}
+	if status == db.OutboxFailed {
+		slog.ErrorContext(ctx, "❌ Delivery of the outbox item failed after all the attempts", "id", item.ID, "kind", item.Kind, "registration_id", item.RegistrationID, "attempts", attempts, "error", deliveryErr)
+	} else {
+		slog.WarnContext(ctx, "⚠️ Delivery of the outbox item failed, it will be retried", "id", item.ID, "kind", item.Kind, "registration_id", item.RegistrationID, "attempts", attempts, "error", deliveryErr)
+	}
+}
+
+// DispatchOutbox delivers the pending items of the outbox when they are due, starting with the ones left by a
+// previous run of the server, until the context is done.
+// It is started in its own goroutine, and stops when the server shuts down.
+func (s *Server) DispatchOutbox(ctx context.Context) {
+	if s.DB == nil {
+		return
+	}
+
+	cfg := s.outboxConfig()
+	slog.Info("Delivering the outbox in the background", "interval", cfg.Interval, "max_attempts", cfg.MaxAttempts)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		s.dispatchOutbox(ctx)
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopped delivering the outbox")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatchOutbox delivers once the pending items of the outbox that are due, returning how many were delivered
+func (s *Server) dispatchOutbox(ctx context.Context) int {
+	items, err := s.DB.GetPendingOutboxItemsContext(ctx, s.now(), outboxBatch)
+	if err != nil {
+		slog.ErrorContext(ctx, "❌ Error reading the pending outbox items", "error", err)
+		return 0
+	}
+
+	delivered := 0
+	for i := range items {
+		if ctx.Err() != nil {
+			break
+		}
+		err := s.deliver(ctx, &items[i])
+		s.recordOutboxDelivery(ctx, &items[i], err)
+		if err == nil {
+			delivered++
+		}
+	}
+	return delivered
+}
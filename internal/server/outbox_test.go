@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+// webhookCall is a request received by the test webhook
+type webhookCall struct {
+	body      string
+	signature string
+}
+
+// startTestWebhook starts a webhook for the server replying with an error to the first calls, as many as failures,
+// and returns the calls that succeeded
+func startTestWebhook(t *testing.T, s *Server, failures int32) chan webhookCall {
+	t.Helper()
+	calls := make(chan webhookCall, 8)
+	var received atomic.Int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if received.Add(1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		calls <- webhookCall{body: string(body), signature: r.Header.Get(webhookSignatureHeader)}
+	}))
+	t.Cleanup(hook.Close)
+
+	s.Config.Webhook.URL = hook.URL
+	s.webhookSecret = []byte("0123456789abcdef0123456789abcdef")
+	return calls
+}
+
+// checkWebhookCall checks that the call is a signed event for the registration
+func checkWebhookCall(t *testing.T, s *Server, call webhookCall, event string, registrationID string) {
+	t.Helper()
+	mac := hmac.New(sha256.New, s.webhookSecret)
+	mac.Write([]byte(call.body))
+	if call.signature != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("invalid webhook signature %q", call.signature)
+	}
+	var got webhookEvent
+	if err := json.Unmarshal([]byte(call.body), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Event != event || got.Registration.RegistrationID != registrationID {
+		t.Errorf("expected event %s of %s, got %s", event, registrationID, call.body)
+	}
+}
+
+// pendingOutboxKinds returns the kinds of the items of the outbox pending delivery at the given time
+func pendingOutboxKinds(t *testing.T, f *testFlow, before time.Time) []string {
+	t.Helper()
+	items, err := f.db.GetPendingOutboxItems(before, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, item := range items {
+		kinds = append(kinds, item.Kind)
+	}
+	return kinds
+}
+
+func TestRegistrationWebhook(t *testing.T) {
+	f := newTestFlow(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"credential_id": "cred-1"}`))
+	})
+	calls := startTestWebhook(t, f.s, 0)
+	req := testRegistrationRequest()
+
+	f.verifyEmail(t, req.Email)
+	var result registrationResult
+	f.call(t, "/api/register", req, http.StatusOK, &result)
+
+	select {
+	case call := <-calls:
+		checkWebhookCall(t, f.s, call, webhookRegistrationCreated, result.RegistrationID)
+	default:
+		t.Fatal("expected the webhook to be called")
+	}
+	f.smtp.Receive(t)
+
+	// Both the webhook and the welcome email were delivered, and nothing is left to the dispatcher
+	if pending := pendingOutboxKinds(t, f, time.Now().Add(24*time.Hour)); len(pending) != 0 {
+		t.Errorf("expected no pending items, got %v", pending)
+	}
+}
+
+func TestOutboxCrashRecovery(t *testing.T) {
+	f := newTestFlow(t, nil)
+	calls := startTestWebhook(t, f.s, 1)
+	start := time.Now()
+	f.s.now = func() time.Time { return start }
+
+	// The server stopped after saving a registration and recording its credential, before delivering the outbox
+	reg := &db.Registration{RegistrationID: "reg-1", Email: "jane@example.com", VatID: "ES-B12345678", Country: "ES", FirstName: "Jane", CompanyName: "ACME"}
+	if err := f.db.SaveRegistration(reg, f.s.registrationCreatedItems(reg)...); err != nil {
+		t.Fatal(err)
+	}
+	reg.Status = db.StatusIssued
+	if err := f.db.UpdateRegistrationStatus(reg, f.s.welcomeEmailItem(reg, "https://issuer.example.com/offers/1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The items are reserved for the delivery that was in progress
+	if delivered := f.s.dispatchOutbox(context.Background()); delivered != 0 {
+		t.Fatalf("expected no deliveries before the lease ends, got %d", delivered)
+	}
+
+	// After the restart the dispatcher delivers them, the webhook failing once
+	f.s.now = func() time.Time { return start.Add(outboxLease) }
+	if delivered := f.s.dispatchOutbox(context.Background()); delivered != 1 {
+		t.Fatalf("expected the welcome email to be delivered, got %d deliveries", delivered)
+	}
+	recipients, _ := f.smtp.Receive(t)
+	if !slices.Contains(recipients, reg.Email) {
+		t.Errorf("expected the welcome email to be sent to %s, got %v", reg.Email, recipients)
+	}
+	saved, err := f.db.GetRegistrationByID(reg.RegistrationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.NotifEmailAt.IsZero() || saved.DeliveryStatus != db.DeliverySent {
+		t.Errorf("expected the welcome email to be recorded, got %v and %q", saved.NotifEmailAt, saved.DeliveryStatus)
+	}
+
+	// The webhook is retried after the backoff
+	pending := pendingOutboxKinds(t, f, start.Add(outboxLease+time.Hour))
+	if !slices.Equal(pending, []string{db.OutboxWebhook}) {
+		t.Fatalf("expected the webhook to be pending, got %v", pending)
+	}
+	f.s.now = func() time.Time { return start.Add(outboxLease + f.s.outboxBackoff(1)) }
+	if delivered := f.s.dispatchOutbox(context.Background()); delivered != 1 {
+		t.Fatalf("expected the webhook to be delivered, got %d deliveries", delivered)
+	}
+	checkWebhookCall(t, f.s, <-calls, webhookRegistrationCreated, reg.RegistrationID)
+
+	// Everything was delivered once
+	f.s.now = func() time.Time { return start.Add(24 * time.Hour) }
+	if delivered := f.s.dispatchOutbox(context.Background()); delivered != 0 {
+		t.Errorf("expected nothing else to deliver, got %d deliveries", delivered)
+	}
+	select {
+	case message := <-f.smtp.Received:
+		t.Errorf("expected a single welcome email, got another one: %s", message)
+	default:
+	}
+}
+
+func TestOutboxGivesUp(t *testing.T) {
+	f := newTestFlow(t, nil)
+	startTestWebhook(t, f.s, 100)
+	f.s.Config.Outbox.MaxAttempts = 2
+	start := time.Now()
+	f.s.now = func() time.Time { return start }
+
+	reg := &db.Registration{RegistrationID: "reg-1", Email: "jane@example.com", VatID: "ES-B12345678"}
+	items := f.s.registrationCreatedItems(reg)
+	if err := f.db.SaveRegistration(reg, items...); err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt := range 2 {
+		f.s.now = func() time.Time { return start.Add(outboxLease + time.Duration(attempt)*maxOutboxBackoff) }
+		f.s.dispatchOutbox(context.Background())
+	}
+	item, err := f.db.GetOutboxItem(items[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Status != db.OutboxFailed || item.Attempts != 2 || item.LastError == "" {
+		t.Errorf("expected the webhook to fail after 2 attempts, got %+v", item)
+	}
+}
+
+func TestWelcomeEmailDelay(t *testing.T) {
+	f := newTestFlow(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"credential_id": "cred-1"}`))
+	})
+	f.s.Config.Outbox.WelcomeEmailDelay = 10 * time.Minute
+	start := time.Now()
+	f.s.now = func() time.Time { return start }
+	req := testRegistrationRequest()
+
+	f.verifyEmail(t, req.Email)
+	var result registrationResult
+	f.call(t, "/api/register", req, http.StatusOK, &result)
+
+	// The welcome email is not sent with the registration, but left in the outbox
+	select {
+	case message := <-f.smtp.Received:
+		t.Fatalf("expected the welcome email to be scheduled, got it sent: %s", message)
+	default:
+	}
+	if delivered := f.s.dispatchOutbox(context.Background()); delivered != 0 {
+		t.Fatalf("expected no deliveries before the delay, got %d", delivered)
+	}
+	pending := pendingOutboxKinds(t, f, start.Add(10*time.Minute))
+	if !slices.Equal(pending, []string{db.OutboxWelcomeEmail}) {
+		t.Fatalf("expected the welcome email to be pending after the delay, got %v", pending)
+	}
+
+	// The dispatcher sends it after the delay, also when started by another run of the server
+	f.s.now = func() time.Time { return start.Add(10 * time.Minute) }
+	if delivered := f.s.dispatchOutbox(context.Background()); delivered != 1 {
+		t.Fatalf("expected the welcome email to be delivered, got %d deliveries", delivered)
+	}
+	recipients, _ := f.smtp.Receive(t)
+	if !slices.Contains(recipients, req.Email) {
+		t.Errorf("expected the welcome email to be sent to %s, got %v", req.Email, recipients)
+	}
+	saved, err := f.db.GetRegistrationByID(result.RegistrationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Status != db.StatusIssued || saved.DeliveryStatus != db.DeliverySent {
+		t.Errorf("expected the registration issued with the email sent, got %q and %q", saved.Status, saved.DeliveryStatus)
+	}
+}
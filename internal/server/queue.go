@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+// defaultRegistrationQueueFile is next to the database, when the configuration does not specify it
+const defaultRegistrationQueueFile = "data/registration_queue.jsonl"
+
+// queueRegistration keeps a registration that could not be written to the database in the queue,
+// so it is saved when the database works again
+func (s *Server) queueRegistration(ctx context.Context, reg *db.Registration) error {
+	if err := s.queue.Append(reg); err != nil {
+		slog.ErrorContext(ctx, "❌ Error queuing the registration, it is lost", "registration_id", reg.RegistrationID, "email", reg.Email, "error", err)
+		return err
+	}
+	slog.WarnContext(ctx, "⚠️ Registration queued to be saved when the database works", "registration_id", reg.RegistrationID)
+	return nil
+}
+
+// updateRegistration records the new status of a registration in the database, or in the queue if the registration
+// is already queued or the database fails. The status is recorded even if the request is cancelled, as the
+// credential may have been issued already.
+func (s *Server) updateRegistration(ctx context.Context, reg *db.Registration, queued bool) {
+	if !queued {
+		err := s.DB.UpdateRegistrationStatusContext(context.WithoutCancel(ctx), reg)
+		if err == nil {
+			return
+		}
+		slog.ErrorContext(ctx, "❌ Error updating registration status", "registration_id", reg.RegistrationID, "error", err)
+	}
+	s.queueRegistration(ctx, reg)
+}
+
+// ReplayRegistrationQueue saves in the database the registrations queued while it was failing.
+// It is called at startup, and the registrations that still can not be saved stay in the queue.
+func (s *Server) ReplayRegistrationQueue() {
+	if s.DB == nil {
+		return
+	}
+	replayed, err := s.queue.Replay(s.DB)
+	if replayed > 0 {
+		slog.Info("Queued registrations saved in the database", "count", replayed)
+	}
+	if err != nil {
+		slog.Error("❌ Error saving queued registrations, they stay in the queue", "error", err)
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+func TestRegisterQueuedWhenDatabaseFails(t *testing.T) {
+	queueFile := filepath.Join(t.TempDir(), "queue.jsonl")
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Production, RegistrationQueueFile: queueFile})
+	s.Issuer = newTestIssuer(t, nil)
+
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Production)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.DB = dbService
+
+	// The database stops working, the registration goes on
+	dbService.Close()
+
+	body := `{"firstName": "Jane", "lastName": "Doe", "companyName": "ACME", "country": "ES", "vatId": "ES12345678", "email": "jane@example.com"}`
+	rec := postJSON(s, "/api/register", body)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"success":true`) {
+		t.Fatalf("expected the registration to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// The registration is saved with its final status when the database works again
+	s.DB, err = db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Production)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.DB.Close()
+	s.ReplayRegistrationQueue()
+
+	reg, err := s.DB.GetRegistrationContext(context.Background(), "ES12345678", "jane@example.com")
+	if err != nil {
+		t.Fatalf("expected the queued registration to be saved: %v", err)
+	}
+	if reg.Status != db.StatusIssued {
+		t.Errorf("expected status %q, got %q", db.StatusIssued, reg.Status)
+	}
+	if _, err := os.Stat(queueFile); !os.IsNotExist(err) {
+		t.Errorf("expected the queue to be emptied, got %v", err)
+	}
+}
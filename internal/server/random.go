@@ -0,0 +1,33 @@
+package server
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// randomDigits returns a random number of the given digits read from r, zero padded.
+// A failing source of randomness is an error, so callers never use predictable values.
+func randomDigits(r io.Reader, digits int) (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(digits)), nil)
+	n, err := rand.Int(r, max)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate random digits: %w", err)
+	}
+	return fmt.Sprintf("%0*d", digits, n), nil
+}
+
+// randomString returns a string of the given length with characters of alphabet chosen uniformly with r
+func randomString(r io.Reader, alphabet string, length int) (string, error) {
+	size := big.NewInt(int64(len(alphabet)))
+	buf := make([]byte, length)
+	for i := range buf {
+		n, err := rand.Int(r, size)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate random characters: %w", err)
+		}
+		buf[i] = alphabet[n.Int64()]
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+func TestRandomDigits(t *testing.T) {
+	got, err := randomDigits(bytes.NewReader(make([]byte, 8)), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "000000" {
+		t.Errorf("expected zero padded digits, got %q", got)
+	}
+
+	errBroken := errors.New("no entropy")
+	if _, err := randomDigits(iotest.ErrReader(errBroken), 6); !errors.Is(err, errBroken) {
+		t.Errorf("expected the error of the reader, got %v", err)
+	}
+}
+
+func TestFailingRandomSource(t *testing.T) {
+	errBroken := errors.New("no entropy")
+
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development})
+	s.random = iotest.ErrReader(errBroken)
+
+	// No predictable verification code is generated
+	rec := postJSON(s, "/api/validate-email", `{"email": "john@example.com"}`)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected %d, got %d: %s", http.StatusInternalServerError, rec.Code, rec.Body.String())
+	}
+	if _, ok := s.VerificationCodes["john@example.com"]; ok {
+		t.Errorf("expected no verification code to be stored")
+	}
+
+	// No registration is saved with a predictable id
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Development)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	s.DB = dbService
+
+	if _, err := s.saveNewRegistration(context.Background(), &db.Registration{Email: "john@example.com", VatID: "ES12345678"}); !errors.Is(err, errBroken) {
+		t.Errorf("expected the error of the random source, got %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"expvar"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// handlerPanics counts the panics recovered while serving requests, exported in /debug/vars
+var handlerPanics = expvar.NewInt("onboarding_handler_panics")
+
+// Recover middleware turns a panic of a handler into a 500 JSON response, logging it with its stack trace and the id
+// of the request, instead of dropping the connection. Nothing is sent if the handler had started the response.
+func (s *Server) Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &startedWriter{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// Aborting the handler is how the standard library cancels a response, not an error
+			if err, ok := recovered.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(recovered)
+			}
+
+			handlerPanics.Add(1)
+			slog.ErrorContext(r.Context(), "❌ Panic serving the request", "method", r.Method, "path", r.URL.Path, "panic", recovered, "stack", string(debug.Stack()))
+			if !sw.started {
+				s.SendJSON(sw, http.StatusInternalServerError, false, "Internal server error", nil)
+			}
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// startedWriter records whether the response was started, so a panic after it is not answered twice
+type startedWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *startedWriter) WriteHeader(status int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *startedWriter) Write(b []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the original writer, for http.ResponseController
+func (w *startedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
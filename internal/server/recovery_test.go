@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func TestRecoverMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(NewContextHandler(slog.NewTextHandler(&buf, nil))))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	s := newTestServer(t, configuration.EnvConfig{})
+	handler := RequestID(s.Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var emails []string
+		w.Header().Set("X-Test", "kept")
+		_ = emails[0]
+	})))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/register", nil)
+	req.Header.Set(requestIDHeader, "req-1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected %d, got %d", http.StatusInternalServerError, rec.Code)
+	}
+	var resp APIResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("expected a JSON response, got %q: %v", rec.Body.String(), err)
+	}
+	if resp.Success || resp.Message == "" {
+		t.Errorf("expected a failed response with a message, got %+v", resp)
+	}
+	if rec.Header().Get("X-Test") != "kept" || rec.Header().Get(requestIDHeader) != "req-1" {
+		t.Errorf("expected the headers set before the panic, got %v", rec.Header())
+	}
+
+	logs := buf.String()
+	for _, want := range []string{"Panic serving the request", "request_id=req-1", "index out of range", "recovery_test.go"} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("expected %q in the logs, got %s", want, logs)
+		}
+	}
+}
+
+func TestRecoverMiddlewareStartedResponse(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{})
+	handler := s.Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("partial"))
+		panic("after writing")
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusAccepted || rec.Body.String() != "partial" {
+		t.Errorf("expected the started response to be left alone, got %d: %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRecoverMiddlewareAbortHandler(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{})
+	handler := s.Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	defer func() {
+		if recovered := recover(); recovered != http.ErrAbortHandler {
+			t.Errorf("expected http.ErrAbortHandler to be panicked again, got %v", recovered)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultRedisKeyPrefix is added to the keys in Redis, when the configuration does not specify it
+const defaultRedisKeyPrefix = "onboarding:"
+
+// defaultRedisTimeout is how long a command waits for the reply, when the configuration does not specify it
+const defaultRedisTimeout = 2 * time.Second
+
+// redisStore keeps the rate limits and the verification codes in Redis, shared by all the replicas of the server.
+// The keys expire with the limits and codes, so nothing has to be cleaned up.
+type redisStore struct {
+	s      *Server
+	client *redis.Client
+	prefix string
+}
+
+// newRedisStore returns the store in the Redis server of the configuration.
+// The connections are opened with the first commands.
+func newRedisStore(s *Server) (*redisStore, error) {
+	cfg := s.Config.Redis
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultRedisTimeout
+	}
+	opts := &redis.Options{
+		Addr:         cfg.Addr,
+		DB:           cfg.DB,
+		DialTimeout:  timeout,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+		// The requests go on without the limits when Redis fails, so they are not delayed retrying the commands
+		MaxRetries:    -1,
+		DialerRetries: 1,
+	}
+	if cfg.PasswordFile != "" {
+		content, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Redis password file: %w", err)
+		}
+		opts.Password = strings.TrimSpace(string(content))
+	}
+
+	prefix := cfg.KeyPrefix
+	if prefix == "" {
+		prefix = defaultRedisKeyPrefix
+	}
+	return &redisStore{s: s, client: redis.NewClient(opts), prefix: prefix}, nil
+}
+
+// allowEmail counts the codes sent to the email in a window starting with the first one
+func (r *redisStore) allowEmail(ctx context.Context, email string) (bool, error) {
+	return r.count(ctx, r.prefix+"email-attempts:"+email, emailAttemptsWindow, maxEmailAttempts)
+}
+
+// allowEmailDaily counts the codes sent to the email in a day starting with the first one
+func (r *redisStore) allowEmailDaily(ctx context.Context, email string, limit int) (bool, error) {
+	return r.count(ctx, r.prefix+"email-daily:"+email, emailDailyWindow, limit)
+}
+
+// allowIP counts the requests from the IP address in windows of the burst, allowing on average the requests
+// per second of the token bucket of the memory store
+func (r *redisStore) allowIP(ctx context.Context, ip string) (bool, error) {
+	window := time.Duration(ipRequestsBurst/ipRequestsPerSecond) * time.Second
+	key := r.prefix + "ip:" + ip + ":" + strconv.FormatInt(r.s.now().UnixNano()/int64(window), 10)
+	return r.count(ctx, key, window, ipRequestsBurst)
+}
+
+// count adds one to the counter of the key, which expires after the window, reporting whether it is within the limit
+func (r *redisStore) count(ctx context.Context, key string, window time.Duration, limit int) (bool, error) {
+	// The counter is created with its expiration, so it never lives forever. Both run in a transaction, as otherwise
+	// the counter could expire in between, and INCR would create it again without expiration.
+	var n *redis.IntCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SetNX(ctx, key, 0, window)
+		n = pipe.Incr(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return n.Val() <= int64(limit), nil
+}
+
+// codeTTL is how long the codes are kept. They expire later than they are valid, so an expired code is reported
+// as such and not as a wrong one.
+func (r *redisStore) codeTTL() time.Duration {
+	return 2 * r.s.verificationCodeTTL()
+}
+
+func (r *redisStore) storeCode(ctx context.Context, email, code string) error {
+	key := r.prefix + "code:" + email
+	// In a transaction, so the code is never left without expiration
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "code", code, "created_at", r.s.now().UnixNano(), "failed", 0)
+		pipe.PExpire(ctx, key, r.codeTTL())
+		return nil
+	})
+	return err
+}
+
+func (r *redisStore) checkCode(ctx context.Context, email, code string) (failedAttempts int, err error) {
+	key := r.prefix + "code:" + email
+	entry, err := r.client.HGetAll(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if entry["code"] == "" {
+		return 0, ErrInvalidCode
+	}
+
+	if !sameCode(entry["code"], code) {
+		// The code may have been deleted in between, the counter must not live forever
+		var failed *redis.IntCmd
+		_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			failed = pipe.HIncrBy(ctx, key, "failed", 1)
+			pipe.PExpire(ctx, key, r.codeTTL())
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		if failed.Val() >= int64(r.s.verificationCodeMaxAttempts()) {
+			if err := r.client.Del(ctx, key).Err(); err != nil {
+				return 0, err
+			}
+			return int(failed.Val()), ErrTooManyAttempts
+		}
+		return int(failed.Val()), ErrInvalidCode
+	}
+
+	// Only the request deleting the code verifies the email
+	deleted, err := r.client.Del(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if deleted == 0 {
+		return 0, ErrInvalidCode
+	}
+	createdAt, _ := strconv.ParseInt(entry["created_at"], 10, 64)
+	if r.s.now().Sub(time.Unix(0, createdAt)) > r.s.verificationCodeTTL() {
+		return 0, ErrCodeExpired
+	}
+
+	return 0, r.client.Set(ctx, r.prefix+"verified:"+email, r.s.now().UnixNano(), r.s.verifiedEmailWindow()).Err()
+}
+
+func (r *redisStore) emailVerified(ctx context.Context, email string) (bool, error) {
+	value, err := r.client.Get(ctx, r.prefix+"verified:"+email).Result()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	verifiedAt, _ := strconv.ParseInt(value, 10, 64)
+	return r.s.now().Sub(time.Unix(0, verifiedAt)) <= r.s.verifiedEmailWindow(), nil
+}
+
+func (r *redisStore) consumeVerifiedEmail(ctx context.Context, email string) error {
+	return r.client.Del(ctx, r.prefix+"verified:"+email).Err()
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+// newRedisTestServers returns two replicas of the server sharing the limits and codes in the Redis server
+func newRedisTestServers(t *testing.T, cfg configuration.EnvConfig) (*Server, *Server, *miniredis.Miniredis) {
+	t.Helper()
+	redis := miniredis.RunT(t)
+	cfg.Redis = configuration.RedisConfig{Addr: redis.Addr()}
+	return newTestServer(t, cfg), newTestServer(t, cfg), redis
+}
+
+func TestRedisVerificationCodeAcrossReplicas(t *testing.T) {
+	first, second, _ := newRedisTestServers(t, configuration.EnvConfig{})
+
+	if err := first.StoreVerificationCode("john@example.com", "123456"); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.VerifyCode("john@example.com", "123456"); err != nil {
+		t.Fatalf("expected the code to be verified by the other replica, got %v", err)
+	}
+	if !first.EmailVerified("john@example.com") {
+		t.Errorf("expected the email to be verified in all the replicas")
+	}
+	if err := first.VerifyCode("john@example.com", "123456"); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("expected the code to be used once, got %v", err)
+	}
+
+	second.ConsumeVerifiedEmail("john@example.com")
+	if first.EmailVerified("john@example.com") {
+		t.Errorf("expected the verification to be consumed in all the replicas")
+	}
+}
+
+func TestRedisHashedVerificationCodes(t *testing.T) {
+	cfg := configuration.EnvConfig{VerificationCode: configuration.VerificationCodeConfig{Hashed: true}}
+
+	// The replicas must share the key of the hashes
+	cfg.Redis = configuration.RedisConfig{Addr: miniredis.RunT(t).Addr()}
+	if _, err := NewServer(cfg, nil, nil, nil, t.TempDir()); err == nil {
+		t.Fatal("expected the hashed codes in Redis without a key to be rejected")
+	}
+
+	cfg.VerificationCode.HashKeyFile = filepath.Join(t.TempDir(), "hash_key.txt")
+	if err := os.WriteFile(cfg.VerificationCode.HashKeyFile, []byte("0123456789abcdef0123456789abcdef\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	first, second, redis := newRedisTestServers(t, cfg)
+
+	if first.RegisterEmailAttempt("john@example.com") != nil {
+		t.Fatal("expected a code to be allowed")
+	}
+	if err := first.StoreVerificationCode("john@example.com", "123456"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range redis.Keys() {
+		if strings.Contains(key, "john") {
+			t.Errorf("expected the email to be hashed, got key %q", key)
+		}
+	}
+
+	if err := second.VerifyCode("jane@example.com", "123456"); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("expected the code of another email to be invalid, got %v", err)
+	}
+	if err := second.VerifyCode("john@example.com", "123456"); err != nil {
+		t.Fatalf("expected the code to be verified by the other replica, got %v", err)
+	}
+	if !first.EmailVerified("john@example.com") {
+		t.Errorf("expected the email to be verified in all the replicas")
+	}
+}
+
+func TestRedisVerificationCodeLockout(t *testing.T) {
+	first, second, redis := newRedisTestServers(t, configuration.EnvConfig{VerificationCode: configuration.VerificationCodeConfig{MaxAttempts: 3}})
+	first.StoreVerificationCode("john@example.com", "123456")
+
+	// The wrong guesses are counted in all the replicas
+	for i, s := range []*Server{first, second} {
+		if err := s.VerifyCode("john@example.com", "000000"); !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("attempt %d: expected %v, got %v", i+1, ErrInvalidCode, err)
+		}
+	}
+	if err := first.VerifyCode("john@example.com", "000000"); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("expected %v, got %v", ErrTooManyAttempts, err)
+	}
+	if err := second.VerifyCode("john@example.com", "123456"); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("expected the code to be invalidated, got %v", err)
+	}
+	if keys := redis.Keys(); len(keys) != 0 {
+		t.Errorf("expected no keys left, got %v", keys)
+	}
+}
+
+func TestRedisVerificationCodeExpires(t *testing.T) {
+	s, _, redis := newRedisTestServers(t, configuration.EnvConfig{VerificationCodeTTL: time.Minute})
+	start := time.Now()
+	s.now = func() time.Time { return start }
+	s.StoreVerificationCode("john@example.com", "123456")
+
+	s.now = func() time.Time { return start.Add(time.Minute + time.Second) }
+	redis.FastForward(time.Minute + time.Second)
+	if err := s.VerifyCode("john@example.com", "123456"); !errors.Is(err, ErrCodeExpired) {
+		t.Errorf("expected %v, got %v", ErrCodeExpired, err)
+	}
+
+	// The codes are removed from Redis after twice their time to live
+	s.StoreVerificationCode("john@example.com", "123456")
+	redis.FastForward(2 * time.Minute)
+	if keys := redis.Keys(); len(keys) != 0 {
+		t.Errorf("expected the code to expire, got %v", keys)
+	}
+}
+
+func TestRedisEmailRateLimit(t *testing.T) {
+	first, second, redis := newRedisTestServers(t, configuration.EnvConfig{})
+
+	for i, s := range []*Server{first, second, first} {
+		if s.RegisterEmailAttempt("john@example.com") != nil {
+			t.Fatalf("attempt %d: expected to be allowed", i+1)
+		}
+	}
+	if second.RegisterEmailAttempt("john@example.com") == nil {
+		t.Errorf("expected the limit to be shared by the replicas")
+	}
+	if second.RegisterEmailAttempt("jane@example.com") != nil {
+		t.Errorf("expected other emails to be allowed")
+	}
+
+	redis.FastForward(emailAttemptsWindow)
+	if first.RegisterEmailAttempt("john@example.com") != nil {
+		t.Errorf("expected to be allowed after the window")
+	}
+}
+
+func TestRedisRateLimitKeepsExpiration(t *testing.T) {
+	s, _, redis := newRedisTestServers(t, configuration.EnvConfig{})
+
+	// The counter is created with the expiration of its window, also when it is created again after expiring
+	for i := range 2 {
+		if err := s.RegisterEmailAttempt("john@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		counters := 0
+		for _, key := range redis.Keys() {
+			if strings.Contains(key, "email-attempts:") {
+				counters++
+				if ttl := redis.TTL(key); ttl != emailAttemptsWindow {
+					t.Errorf("attempt %d: expected the counter to expire after %v, got %v", i+1, emailAttemptsWindow, ttl)
+				}
+			}
+		}
+		if counters != 1 {
+			t.Fatalf("attempt %d: expected a counter, got %v", i+1, redis.Keys())
+		}
+		redis.FastForward(emailAttemptsWindow)
+	}
+}
+
+func TestRedisEmailDailyLimit(t *testing.T) {
+	first, second, redis := newRedisTestServers(t, configuration.EnvConfig{VerificationCode: configuration.VerificationCodeConfig{MaxCodesPerDay: 4}})
+
+	for i, s := range []*Server{first, second, first} {
+		if err := s.RegisterEmailAttempt("john@example.com"); err != nil {
+			t.Fatalf("attempt %d: expected to be allowed, got %v", i+1, err)
+		}
+	}
+	if err := second.RegisterEmailAttempt("john@example.com"); !errors.Is(err, ErrTooManyCodes) {
+		t.Fatalf("expected %v, got %v", ErrTooManyCodes, err)
+	}
+
+	// The codes refused by the short window do not count for the day, shared by the replicas
+	redis.FastForward(emailAttemptsWindow)
+	if err := second.RegisterEmailAttempt("john@example.com"); err != nil {
+		t.Fatalf("expected the fourth code of the day to be allowed, got %v", err)
+	}
+	if err := first.RegisterEmailAttempt("john@example.com"); !errors.Is(err, ErrDailyCodeLimit) {
+		t.Fatalf("expected %v, got %v", ErrDailyCodeLimit, err)
+	}
+
+	redis.FastForward(emailDailyWindow)
+	if err := first.RegisterEmailAttempt("john@example.com"); err != nil {
+		t.Errorf("expected to be allowed after the daily window, got %v", err)
+	}
+}
+
+func TestRedisIPRateLimit(t *testing.T) {
+	first, second, _ := newRedisTestServers(t, configuration.EnvConfig{})
+	// All the requests fall in the same window
+	start := time.Unix(1_800_000_000, 0)
+	first.now = func() time.Time { return start }
+	second.now = func() time.Time { return start }
+
+	statusOf := func(s *Server) int {
+		return postJSON(s, "/api/registration-status", `{}`).Code
+	}
+	for i := range ipRequestsBurst {
+		s := first
+		if i%2 == 1 {
+			s = second
+		}
+		if code := statusOf(s); code == http.StatusTooManyRequests {
+			t.Fatalf("request %d: expected to be allowed", i+1)
+		}
+	}
+	if code := statusOf(second); code != http.StatusTooManyRequests {
+		t.Errorf("expected the limit to be shared by the replicas, got %d", code)
+	}
+
+	// The next window allows the requests again
+	next := start.Add(time.Duration(ipRequestsBurst) * time.Second)
+	second.now = func() time.Time { return next }
+	if code := statusOf(second); code == http.StatusTooManyRequests {
+		t.Errorf("expected to be allowed in the next window")
+	}
+}
+
+func TestRedisPassword(t *testing.T) {
+	redis := miniredis.RunT(t)
+	redis.RequireAuth("secret")
+	passwordFile := filepath.Join(t.TempDir(), "redis_password.txt")
+	if err := os.WriteFile(passwordFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer(t, configuration.EnvConfig{Redis: configuration.RedisConfig{Addr: redis.Addr(), PasswordFile: passwordFile}})
+	if err := s.StoreVerificationCode("john@example.com", "123456"); err != nil {
+		t.Fatalf("expected the code to be stored with the password, got %v", err)
+	}
+
+	if _, err := NewServer(configuration.EnvConfig{Redis: configuration.RedisConfig{Addr: redis.Addr(), PasswordFile: filepath.Join(t.TempDir(), "missing.txt")}}, nil, nil, nil, t.TempDir()); err == nil {
+		t.Errorf("expected a missing password file to be rejected")
+	}
+}
+
+func TestRedisUnavailable(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{Redis: configuration.RedisConfig{Addr: "127.0.0.1:1", Timeout: time.Second}})
+
+	// The codes are not sent if they can not be stored, but the rate limits do not block the users
+	if s.RegisterEmailAttempt("john@example.com") != nil {
+		t.Errorf("expected the email to be allowed without Redis")
+	}
+	rec := postJSON(s, "/api/validate-email", `{"email": "john@example.com"}`)
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "Failed to generate the verification code") {
+		t.Errorf("expected an error storing the code, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if s.EmailVerified("john@example.com") {
+		t.Errorf("expected the email not to be verified without Redis")
+	}
+}
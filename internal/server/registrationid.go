@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+// Defaults of the format of the registration ids
+const (
+	defaultRegistrationIDSeparator = "-"
+	defaultRegistrationIDDigits    = 8
+	minRegistrationIDDigits        = 6
+)
+
+// maxRegistrationIDAttempts bounds the ids tried when saving a registration, in case they collide with existing ones
+const maxRegistrationIDAttempts = 5
+
+// validateRegistrationIDConfig rejects formats of the registration ids too short to be unguessable
+func (s *Server) validateRegistrationIDConfig() error {
+	if digits := s.Config.RegistrationID.Digits; digits != 0 && digits < minRegistrationIDDigits {
+		return fmt.Errorf("registration ids need at least %d digits, %d configured", minRegistrationIDDigits, digits)
+	}
+	return nil
+}
+
+// generateRegistrationID creates a human-readable but unguessable ID, in the format YYYYMMDD-{8-digit} by default
+func (s *Server) generateRegistrationID() (string, error) {
+	cfg := s.Config.RegistrationID
+	separator := cfg.Separator
+	if separator == "" {
+		separator = defaultRegistrationIDSeparator
+	}
+	digits := cfg.Digits
+	if digits == 0 {
+		digits = defaultRegistrationIDDigits
+	}
+
+	n, err := randomDigits(s.random, digits)
+	if err != nil {
+		return "", err
+	}
+	return cfg.Prefix + s.now().Format("20060102") + separator + n, nil
+}
+
+// saveNewRegistration saves a new registration with a fresh id, generating another one if it is already used.
+// It returns the items of the outbox saved with the registration, to be delivered right after.
+func (s *Server) saveNewRegistration(ctx context.Context, reg *db.Registration) (outbox []*db.OutboxItem, err error) {
+	ctx, span := startSpan(ctx, "SaveRegistration")
+	defer func() {
+		span.SetAttributes(registrationAttributes(reg)...)
+		endSpan(span, err)
+	}()
+
+	for range maxRegistrationIDAttempts {
+		reg.RegistrationID, err = s.generateRegistrationID()
+		if err != nil {
+			return nil, err
+		}
+		outbox = s.registrationCreatedItems(reg)
+		err = s.DB.SaveRegistrationContext(ctx, reg, outbox...)
+		if !errors.Is(err, db.ErrDuplicateRegistrationID) {
+			return outbox, err
+		}
+	}
+	return nil, fmt.Errorf("no free registration id after %d attempts: %w", maxRegistrationIDAttempts, err)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+func TestGenerateRegistrationIDFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  configuration.RegistrationIDConfig
+		want string
+	}{
+		{name: "default", want: `^20260102-\d{8}$`},
+		{name: "configured", cfg: configuration.RegistrationIDConfig{Prefix: "DOME-", Separator: "/", Digits: 12}, want: `^DOME-20260102/\d{12}$`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development, RegistrationID: tt.cfg})
+			s.now = func() time.Time { return time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC) }
+
+			id, err := s.generateRegistrationID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !regexp.MustCompile(tt.want).MatchString(id) {
+				t.Errorf("expected an id matching %s, got %s", tt.want, id)
+			}
+		})
+	}
+}
+
+func TestNewServerRejectsShortRegistrationIDs(t *testing.T) {
+	cfg := configuration.EnvConfig{
+		Runtime:        configuration.Development,
+		RegistrationID: configuration.RegistrationIDConfig{Digits: 3},
+	}
+	if _, err := NewServer(cfg, nil, nil, nil, t.TempDir()); err == nil {
+		t.Fatal("expected NewServer to reject registration ids of 3 digits")
+	}
+}
+
+func TestSaveNewRegistrationRetriesOnCollision(t *testing.T) {
+	for _, runtime := range []configuration.RuntimeEnv{configuration.Development, configuration.Production} {
+		t.Run(string(runtime), func(t *testing.T) {
+			s := newTestServer(t, configuration.EnvConfig{Runtime: runtime})
+			dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), runtime)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dbService.Close()
+			s.DB = dbService
+
+			// The random source gives zeros to the first id, which is already used, and then real random bytes
+			s.now = func() time.Time { return time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC) }
+			const usedID = "20260102-00000000"
+			if err := dbService.SaveRegistration(&db.Registration{RegistrationID: usedID, Email: "john@example.com", VatID: "ES12345678"}); err != nil {
+				t.Fatal(err)
+			}
+			s.random = io.MultiReader(bytes.NewReader(make([]byte, 4)), rand.Reader)
+
+			reg := &db.Registration{Email: "jane@example.com", VatID: "ES87654321"}
+			if _, err := s.saveNewRegistration(context.Background(), reg); err != nil {
+				t.Fatalf("saveNewRegistration failed: %v", err)
+			}
+			if reg.RegistrationID == usedID {
+				t.Fatalf("expected a fresh id, got the used one")
+			}
+			if _, err := dbService.GetRegistrationByID(reg.RegistrationID); err != nil {
+				t.Errorf("expected the registration to be saved with id %s: %v", reg.RegistrationID, err)
+			}
+		})
+	}
+}
+
+func TestSaveNewRegistrationGivesUp(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Production})
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Production)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	s.DB = dbService
+
+	// Every id collides when the random source only gives zeros
+	s.random = bytes.NewReader(make([]byte, 1024))
+	if _, err := s.saveNewRegistration(context.Background(), &db.Registration{Email: "john@example.com", VatID: "ES12345678"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.saveNewRegistration(context.Background(), &db.Registration{Email: "jane@example.com", VatID: "ES87654321"})
+	if !errors.Is(err, db.ErrDuplicateRegistrationID) {
+		t.Errorf("expected ErrDuplicateRegistrationID, got %v", err)
+	}
+}
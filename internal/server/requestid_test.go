@@ -0,0 +1,69 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		wantSame bool
+	}{
+		{name: "no incoming id", incoming: ""},
+		{name: "incoming id is reused", incoming: "proxy-1234", wantSame: true},
+		{name: "id with spaces is replaced", incoming: "forged log=line"},
+		{name: "too long id is replaced", incoming: strings.Repeat("a", maxRequestIDLength+1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = RequestIDFromContext(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.incoming != "" {
+				req.Header.Set(requestIDHeader, tt.incoming)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if seen == "" {
+				t.Fatalf("expected a request id in the context")
+			}
+			if got := rec.Header().Get(requestIDHeader); got != seen {
+				t.Errorf("expected the response header %q to be the request id %q", got, seen)
+			}
+			if (seen == tt.incoming) != tt.wantSame {
+				t.Errorf("unexpected request id %q for incoming %q", seen, tt.incoming)
+			}
+		})
+	}
+}
+
+func TestContextHandlerAddsRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewContextHandler(slog.NewTextHandler(&buf, nil))).With("component", "test")
+
+	logger.InfoContext(WithRequestID(context.Background(), "abc123"), "with id")
+	logger.InfoContext(context.Background(), "without id")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %q", buf.String())
+	}
+	if !strings.Contains(lines[0], "request_id=abc123") || !strings.Contains(lines[0], "component=test") {
+		t.Errorf("expected the request id in %q", lines[0])
+	}
+	if strings.Contains(lines[1], "request_id") {
+		t.Errorf("expected no request id in %q", lines[1])
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+// defaultRetentionInterval is the time between the purges of the old registrations, when the configuration
+// does not specify it
+const defaultRetentionInterval = 24 * time.Hour
+
+// PurgeOldRegistrations purges the registrations older than the retention of the configuration when started and then
+// periodically, until the context is done. It is started in its own goroutine, and does nothing without a retention.
+func (s *Server) PurgeOldRegistrations(ctx context.Context) {
+	cfg := s.Config.Retention
+	if !cfg.Enabled() || s.DB == nil {
+		return
+	}
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = defaultRetentionInterval
+	}
+
+	slog.Info("Purging the old registrations in the background", "max_age", cfg.MaxAge, "interval", interval, "anonymize", cfg.Anonymize, "purge_unissued", cfg.PurgeUnissued)
+	// Purge once at the start, as restarts more frequent than the interval would postpone it forever
+	s.purgeOldRegistrations(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopped purging the old registrations")
+			return
+		case <-ticker.C:
+			s.purgeOldRegistrations(ctx)
+		}
+	}
+}
+
+// purgeOldRegistrations deletes or anonymizes once the registrations older than the retention, returning how many
+func (s *Server) purgeOldRegistrations(ctx context.Context) int64 {
+	opts := db.NewPurgeOptions(s.Config.Retention, s.now())
+	purged, err := s.DB.PurgeRegistrationsContext(ctx, opts)
+	if err != nil {
+		slog.ErrorContext(ctx, "❌ Error purging the old registrations", "before", opts.Before, "error", err)
+		return 0
+	}
+	slog.InfoContext(ctx, "Purged the old registrations", "purged", purged, "before", opts.Before, "anonymized", opts.Anonymize)
+	return purged
+}
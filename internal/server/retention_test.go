@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+func TestPurgeOldRegistrations(t *testing.T) {
+	cfg := configuration.EnvConfig{
+		Runtime:   configuration.Production,
+		Retention: configuration.RetentionConfig{MaxAge: 24 * time.Hour},
+	}
+	s := newTestServer(t, cfg)
+
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Production)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	s.DB = dbService
+
+	for _, reg := range []*db.Registration{
+		{RegistrationID: "reg-issued", Email: "a@example.com", VatID: "ES1", Country: "ES"},
+		{RegistrationID: "reg-failed", Email: "b@example.com", VatID: "ES2", Country: "ES"},
+	} {
+		if err := dbService.SaveRegistration(reg); err != nil {
+			t.Fatal(err)
+		}
+		reg.Status = db.StatusIssued
+		if reg.RegistrationID == "reg-failed" {
+			reg.Status = db.StatusFailed
+		}
+		if err := dbService.UpdateRegistrationStatus(reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The registrations are kept during the retention
+	if purged := s.purgeOldRegistrations(context.Background()); purged != 0 {
+		t.Fatalf("expected nothing purged during the retention, got %d", purged)
+	}
+
+	// After it only the issued registration is purged, the failed one is kept to be reissued
+	s.now = func() time.Time { return time.Now().Add(25 * time.Hour) }
+	if purged := s.purgeOldRegistrations(context.Background()); purged != 1 {
+		t.Fatalf("expected 1 registration purged, got %d", purged)
+	}
+	if _, err := dbService.GetRegistrationByID("reg-failed"); err != nil {
+		t.Errorf("expected the failed registration to be kept: %v", err)
+	}
+
+	// Without retention the worker returns at once
+	s.Config.Retention = configuration.RetentionConfig{}
+	done := make(chan struct{})
+	go func() {
+		s.PurgeOldRegistrations(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the worker to return without retention")
+	}
+}
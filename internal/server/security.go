@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// The origins the pages load assets from and send requests to, allowed by the default Content-Security-Policy
+var (
+	scriptOrigins  = []string{"https://cdn.jsdelivr.net"}
+	styleOrigins   = []string{"https://fonts.googleapis.com"}
+	fontOrigins    = []string{"https://fonts.gstatic.com"}
+	connectOrigins = []string{"https://onboarddome.evidenceledger.eu", "https://onboarddev.dome.mycredential.eu"}
+)
+
+// hstsHeader tells browsers to use only HTTPS for a year, and is sent only when we serve TLS
+const hstsHeader = "max-age=31536000; includeSubDomains"
+
+// contentSecurityPolicy returns the policy configured, or else one allowing the assets of the pages.
+// Alpine.js evaluates the expressions in the HTML, so the scripts need 'unsafe-eval', and the pages have
+// inline scripts and styles.
+func (s *Server) contentSecurityPolicy() string {
+	if s.Config.ContentSecurityPolicy != "" {
+		return s.Config.ContentSecurityPolicy
+	}
+
+	connect := connectOrigins
+	if s.Config.ApiUrl != "" {
+		connect = append([]string{strings.TrimSuffix(s.Config.ApiUrl, "/")}, connectOrigins...)
+	}
+
+	directives := []string{
+		"default-src 'self'",
+		"script-src 'self' 'unsafe-inline' 'unsafe-eval' " + strings.Join(scriptOrigins, " "),
+		"style-src 'self' 'unsafe-inline' " + strings.Join(styleOrigins, " "),
+		"font-src 'self' " + strings.Join(fontOrigins, " "),
+		"img-src 'self' data:",
+		"connect-src 'self' " + strings.Join(connect, " "),
+		"frame-ancestors 'none'",
+		"base-uri 'self'",
+		"form-action 'self'",
+	}
+	return strings.Join(directives, "; ")
+}
+
+// SecurityHeaders middleware sets the security headers of all the responses, pages and API alike.
+// HSTS is only sent when the server serves TLS itself, as otherwise we can not know how we are reached.
+func (s *Server) SecurityHeaders(next http.Handler) http.Handler {
+	csp := s.contentSecurityPolicy()
+	hsts := s.Config.TLS.Enabled()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		h.Set("Content-Security-Policy", csp)
+		if hsts {
+			h.Set("Strict-Transport-Security", hstsHeader)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
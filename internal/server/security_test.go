@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      configuration.EnvConfig
+		wantHSTS bool
+		wantCSP  string
+	}{
+		{
+			name:    "plain HTTP",
+			cfg:     configuration.EnvConfig{Runtime: configuration.Development},
+			wantCSP: "script-src 'self' 'unsafe-inline' 'unsafe-eval' https://cdn.jsdelivr.net",
+		},
+		{
+			name:     "TLS",
+			cfg:      configuration.EnvConfig{Runtime: configuration.Production, TLS: configuration.TLSConfig{CertFile: "server.pem", KeyFile: "server.key"}},
+			wantHSTS: true,
+			wantCSP:  "frame-ancestors 'none'",
+		},
+		{
+			name:    "API URL",
+			cfg:     configuration.EnvConfig{Runtime: configuration.Development, ApiUrl: "https://api.example.com/"},
+			wantCSP: "connect-src 'self' https://api.example.com https://onboarddome.evidenceledger.eu",
+		},
+		{
+			name:    "configured policy",
+			cfg:     configuration.EnvConfig{Runtime: configuration.Development, ContentSecurityPolicy: "default-src 'none'"},
+			wantCSP: "default-src 'none'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.cfg)
+
+			// Both the pages and the API responses have the headers
+			for _, path := range []string{"/", "/api/csrf"} {
+				rec := httptest.NewRecorder()
+				s.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+				want := map[string]string{
+					"X-Content-Type-Options": "nosniff",
+					"X-Frame-Options":        "DENY",
+					"Referrer-Policy":        "strict-origin-when-cross-origin",
+				}
+				for header, value := range want {
+					if got := rec.Header().Get(header); got != value {
+						t.Errorf("%s: expected %s %q, got %q", path, header, value, got)
+					}
+				}
+				if csp := rec.Header().Get("Content-Security-Policy"); !strings.Contains(csp, tt.wantCSP) {
+					t.Errorf("%s: expected the Content-Security-Policy to contain %q, got %q", path, tt.wantCSP, csp)
+				}
+				if hsts := rec.Header().Get("Strict-Transport-Security"); (hsts != "") != tt.wantHSTS {
+					t.Errorf("%s: expected HSTS %v, got %q", path, tt.wantHSTS, hsts)
+				}
+			}
+		})
+	}
+}
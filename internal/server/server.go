@@ -1,53 +1,239 @@
 package server
 
 import (
-	"net"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"sync"
+	"time"
 
 	"golang.org/x/time/rate"
 
 	"github.com/hesusruiz/onboardng/credissuance"
+	"github.com/hesusruiz/onboardng/internal/configuration"
 	"github.com/hesusruiz/onboardng/internal/db"
 	"github.com/hesusruiz/onboardng/internal/mail"
 )
 
 type Server struct {
-	DB                *db.Service
-	Issuer            *credissuance.LEARIssuance
-	Mail              *mail.Service
-	EmailRateLimiter  map[string]*RateLimitEntry
-	VerificationCodes map[string]*VerificationCodeEntry
-	RateLimiterMu     sync.RWMutex
-	CodesMu           sync.RWMutex
-	IPLimiters        map[string]*rate.Limiter
-	IPLimitersMu      sync.Mutex
-	Handler           http.Handler
+	Config              configuration.EnvConfig
+	DB                  db.Registrar
+	Issuer              *credissuance.LEARIssuance
+	Mail                *mail.Service
+	EmailRateLimiter    map[string]*RateLimitEntry
+	EmailDailyLimiter   map[string]*RateLimitEntry
+	VerificationCodes   map[string]*VerificationCodeEntry
+	VerifiedEmails      map[string]time.Time
+	RateLimiterMu       sync.RWMutex
+	CodesMu             sync.RWMutex
+	IPLimiters          map[string]*rate.Limiter
+	IPLimitersMu        sync.Mutex
+	IdempotentResponses map[string]*idempotentResponse
+	IdempotencyMu       sync.Mutex
+	Handler             http.Handler
+
+	// now returns the current time, replaced in tests
+	now func() time.Time
+	// random is the source of the registration ids and verification codes, replaced in tests
+	random io.Reader
+	// statusSecret signs the tokens to query the status of a registration
+	statusSecret []byte
+	// queue keeps the registrations that could not be saved in the database
+	queue *db.Queue
+	// adminToken authorizes the requests to the admin endpoints, nil if it is not configured
+	adminToken []byte
+	// mailEventsKey verifies the delivery events sent by SendGrid, nil if they are not received
+	mailEventsKey *ecdsa.PublicKey
+	// trustedProxies are the reverse proxies whose forwarded headers tell the address of the client
+	trustedProxies []netip.Prefix
+	// issuances limits the issuances in flight at once, nil if they are not limited
+	issuances *issuanceLimiter
+	// webhookSecret signs the calls to the webhook, nil if they are not signed
+	webhookSecret []byte
+	// codeHashKey salts the hashes of the emails and the verification codes, nil if they are kept in plain text
+	codeHashKey []byte
+	// limits counts the requests limited, in memory or in Redis
+	limits rateLimits
+	// codes keeps the verification codes and the verified emails, in memory or in Redis
+	codes codeStore
 }
 
-func NewServer(dbService *db.Service, issuer *credissuance.LEARIssuance, mailService *mail.Service, staticFilesDir string) *Server {
+func NewServer(cfg configuration.EnvConfig, dbService db.Registrar, issuer *credissuance.LEARIssuance, mailService *mail.Service, staticFilesDir string) (*Server, error) {
 	s := &Server{
-		DB:                dbService,
-		Issuer:            issuer,
-		Mail:              mailService,
-		EmailRateLimiter:  make(map[string]*RateLimitEntry),
-		VerificationCodes: make(map[string]*VerificationCodeEntry),
-		IPLimiters:        make(map[string]*rate.Limiter),
+		Config:              cfg,
+		DB:                  dbService,
+		Issuer:              issuer,
+		Mail:                mailService,
+		EmailRateLimiter:    make(map[string]*RateLimitEntry),
+		EmailDailyLimiter:   make(map[string]*RateLimitEntry),
+		VerificationCodes:   make(map[string]*VerificationCodeEntry),
+		VerifiedEmails:      make(map[string]time.Time),
+		IPLimiters:          make(map[string]*rate.Limiter),
+		IdempotentResponses: make(map[string]*idempotentResponse),
+		now:                 time.Now,
+		random:              rand.Reader,
+	}
+
+	if err := configuration.ValidatePowers(cfg.CredentialPowers()); err != nil {
+		return nil, fmt.Errorf("invalid powers in the configuration: %w", err)
+	}
+	if err := cfg.ValidateClaims(); err != nil {
+		return nil, fmt.Errorf("invalid claims in the configuration: %w", err)
+	}
+
+	if err := cfg.Issuer.ValidateCredentialRequest(); err != nil {
+		return nil, fmt.Errorf("invalid issuer in the configuration: %w", err)
+	}
+	if cfg.Issuer.Async() && cfg.ApiUrl == "" {
+		return nil, fmt.Errorf("invalid issuer in the configuration: the asynchronous operation mode requires the api_url to receive the results")
+	}
+
+	s.issuances = newIssuanceLimiter(cfg.IssuanceLimit)
+
+	if cfg.Redis.Addr != "" {
+		store, err := newRedisStore(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis in the configuration: %w", err)
+		}
+		s.limits, s.codes = store, store
+		slog.Info("Keeping the rate limits and verification codes in Redis", "addr", cfg.Redis.Addr)
+	} else {
+		s.limits, s.codes = memoryStore{s}, memoryStore{s}
+	}
+
+	trustedProxies, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies in the configuration: %w", err)
+	}
+	s.trustedProxies = trustedProxies
+
+	if err := validateHoneypotFields(cfg.BotDetection.HoneypotFields); err != nil {
+		return nil, fmt.Errorf("invalid bot detection in the configuration: %w", err)
+	}
+
+	if err := cfg.ValidateAllowedOrigins(cfg.Runtime); err != nil {
+		return nil, fmt.Errorf("invalid CORS in the configuration: %w", err)
+	}
+
+	if err := cfg.Countries.ValidateCountryLists(); err != nil {
+		return nil, fmt.Errorf("invalid countries in the configuration: %w", err)
+	}
+
+	if err := s.validateRegistrationIDConfig(); err != nil {
+		return nil, fmt.Errorf("invalid registration id format in the configuration: %w", err)
+	}
+
+	if err := s.validateVerificationCodeConfig(); err != nil {
+		return nil, fmt.Errorf("invalid verification code format in the configuration: %w", err)
+	}
+	codeHashKey, err := loadCodeHashKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.codeHashKey = codeHashKey
+
+	if cfg.Webhook.URL != "" {
+		if u, err := url.Parse(cfg.Webhook.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("invalid webhook in the configuration: %q is not an HTTP URL", cfg.Webhook.URL)
+		}
+	}
+	webhookSecret, err := loadWebhookSecret(cfg.Webhook.SecretFile)
+	if err != nil {
+		return nil, err
+	}
+	s.webhookSecret = webhookSecret
+
+	statusSecret, err := loadStatusSecret(cfg.StatusSecretFile)
+	if err != nil {
+		return nil, err
+	}
+	s.statusSecret = statusSecret
+
+	queueFile := cfg.RegistrationQueueFile
+	if queueFile == "" {
+		queueFile = defaultRegistrationQueueFile
+	}
+	s.queue = db.NewQueue(queueFile)
+
+	adminToken, err := loadAdminToken(cfg.AdminTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	if adminToken == nil && cfg.Runtime == configuration.Development {
+		slog.Warn("⚠️ No admin token configured, the admin endpoints are open in development")
+	}
+	s.adminToken = adminToken
+
+	if cfg.Mail.SendGrid.WebhookKey != "" {
+		key, err := mail.ParseSendGridWebhookKey(cfg.Mail.SendGrid.WebhookKey)
+		if err != nil {
+			return nil, err
+		}
+		s.mailEventsKey = key
 	}
 
 	mux := http.NewServeMux()
 
 	// Static file serving
-	fileServer := http.FileServer(http.Dir(staticFilesDir))
-	mux.Handle("/", fileServer)
+	if prefix := s.Config.Prefix(); prefix != "" {
+		// The requests for the base path itself are redirected by the mux to the one with the trailing slash
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, staticFiles(staticFilesDir)))
+	} else {
+		mux.Handle("/", staticFiles(staticFilesDir))
+	}
 
 	// API Routes
-	mux.HandleFunc("/api/validate-email", s.EnableCORS(s.RateLimitIP(s.HandleValidateEmail)))
-	mux.HandleFunc("/api/verify-code", s.EnableCORS(s.HandleVerifyCode))
-	mux.HandleFunc("/api/register", s.EnableCORS(s.HandleRegister))
+	s.handleAPI(mux, "csrf", s.EnableCORS(s.HandleCSRFToken))
+	s.handleAPI(mux, "validate-email", s.EnableCORS(s.RateLimitIP(s.HandleValidateEmail)))
+	s.handleAPI(mux, "verify-code", s.EnableCORS(s.HandleVerifyCode))
+	s.handleAPI(mux, "register", s.EnableCORS(s.Idempotent(s.HandleRegister)))
+	s.handleAPI(mux, "registration-status", s.EnableCORS(s.RateLimitIP(s.HandleRegistrationStatus)))
+	s.handleAPI(mux, "countries", s.EnableCORS(s.HandleCountries))
+	s.handleAPI(mux, "form-token", s.EnableCORS(s.HandleFormToken))
+	s.handleAPI(mux, "health", s.HandleHealth)
+	if cfg.Issuer.Async() {
+		s.handleAPI(mux, "issuance-callback", s.HandleIssuanceCallback)
+	}
+	s.handleAdmin(mux, "stats", s.HandleAdminStats)
+	s.handleAdmin(mux, "registrations", s.HandleAdminRegistrations)
+	s.handleAdmin(mux, "registrations/search", s.HandleAdminSearchRegistrations)
+	s.handleAdmin(mux, "registrations/{id}", s.HandleAdminRegistration)
+	s.handleAdmin(mux, "registrations/{id}/payload", s.HandleAdminIssuancePayload)
+	s.handleAdmin(mux, "registrations/{id}/resend-welcome", s.HandleAdminResendWelcome)
+	s.handleAdmin(mux, "email-preview", s.HandleAdminEmailPreview)
+	s.handleAdmin(mux, "build-info", s.HandleAdminBuildInfo)
+	s.handleAdmin(mux, "config", s.HandleAdminConfig)
+	if s.mailEventsKey != nil {
+		s.handleAPI(mux, "mail-events", s.HandleMailEvents)
+	}
+
+	s.Handler = RequestID(s.ClientIP(s.Trace(s.Recover(s.SecurityHeaders(Compress(mux))))))
+	return s, nil
+}
+
+// handleAPI registers the handler for /api/{name} under the base path, unless the endpoint is disabled by the config.
+// Requests to a disabled endpoint fall through to the static file server, which replies 404.
+// The size of the request body is limited and must be JSON for all endpoints.
+func (s *Server) handleAPI(mux *http.ServeMux, name string, handler http.HandlerFunc) {
+	if !s.Config.Endpoints.Enabled(name) {
+		slog.Info("API endpoint disabled by configuration", "endpoint", s.apiPath(name))
+		return
+	}
+	limit, ok := apiBodyLimits[name]
+	if !ok {
+		limit = s.maxBodySize()
+	}
+	mux.HandleFunc(s.apiPath(name), traceRoute(s.apiPath(name), s.LimitBody(limit, s.RequireJSON(handler))))
+}
 
-	s.Handler = mux
-	return s
+// apiPath returns the path of the API endpoint with the name, under the base path
+func (s *Server) apiPath(name string) string {
+	return s.Config.Prefix() + "/api/" + name
 }
 
 func (s *Server) getIPLimiter(ip string) *rate.Limiter {
@@ -56,8 +242,7 @@ func (s *Server) getIPLimiter(ip string) *rate.Limiter {
 
 	limiter, exists := s.IPLimiters[ip]
 	if !exists {
-		// Allow 1 request per second with a burst of 5
-		limiter = rate.NewLimiter(1, 5)
+		limiter = rate.NewLimiter(ipRequestsPerSecond, ipRequestsBurst)
 		s.IPLimiters[ip] = limiter
 	}
 
@@ -66,13 +251,13 @@ func (s *Server) getIPLimiter(ip string) *rate.Limiter {
 
 func (s *Server) RateLimitIP(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		allowed, err := s.limits.allowIP(r.Context(), clientIP(r))
 		if err != nil {
-			ip = r.RemoteAddr
+			// The requests are not limited while the limits can not be checked
+			slog.ErrorContext(r.Context(), "❌ Error checking the rate limit of the IP address, allowed", "error", err)
+			allowed = true
 		}
-
-		limiter := s.getIPLimiter(ip)
-		if !limiter.Allow() {
+		if !allowed {
 			s.SendJSON(w, http.StatusTooManyRequests, false, "Too many requests", nil)
 			return
 		}
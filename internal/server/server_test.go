@@ -0,0 +1,231 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/common"
+	"github.com/hesusruiz/onboardng/credissuance"
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+// newTestServer returns a server without database, issuer or mail services, serving an empty static directory
+func newTestServer(t *testing.T, cfg configuration.EnvConfig) *Server {
+	t.Helper()
+	s, err := NewServer(cfg, nil, nil, nil, t.TempDir())
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	return s
+}
+
+// postJSON sends a POST request with a JSON body to the server handler, with a CSRF token obtained from the server
+func postJSON(s *Server, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	tokenRec := httptest.NewRecorder()
+	s.Handler.ServeHTTP(tokenRec, httptest.NewRequest(http.MethodGet, s.apiPath("csrf"), nil))
+	for _, cookie := range tokenRec.Result().Cookies() {
+		req.AddCookie(cookie)
+		req.Header.Set(csrfHeaderName, cookie.Value)
+	}
+
+	rec := httptest.NewRecorder()
+	s.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestDisabledEndpointIsNotRouted(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{
+		Runtime:   configuration.Development,
+		Endpoints: configuration.EndpointsConfig{"register": false, "verify-code": true},
+	})
+
+	rec := postJSON(s, "/api/register", `{}`)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected disabled /api/register to return %d, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	rec = postJSON(s, "/api/verify-code", `{"email": "john@example.com", "code": "000000"}`)
+	if rec.Code == http.StatusNotFound {
+		t.Errorf("expected explicitly enabled /api/verify-code to be routed, got %d", rec.Code)
+	}
+
+	rec = postJSON(s, "/api/validate-email", `{"email": "john@example.com"}`)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected /api/validate-email to be enabled by default, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCORSAllowedOrigins(t *testing.T) {
+	const page = "https://dome-marketplace.github.io"
+
+	tests := []struct {
+		name            string
+		allowed         []string
+		origin          string
+		wantOrigin      string
+		wantCredentials bool
+	}{
+		{name: "allowed origin is echoed", allowed: []string{page}, origin: page, wantOrigin: page, wantCredentials: true},
+		{name: "trailing slash in config", allowed: []string{page + "/"}, origin: page, wantOrigin: page, wantCredentials: true},
+		{name: "other origin gets no header", allowed: []string{page}, origin: "https://evil.example.com", wantOrigin: ""},
+		{name: "no allowed origins", origin: page, wantOrigin: ""},
+		{name: "wildcard echoes any origin without credentials", allowed: []string{"*"}, origin: "http://localhost:7777", wantOrigin: "http://localhost:7777"},
+		{name: "listed origin keeps credentials with the wildcard", allowed: []string{"*", page}, origin: page, wantOrigin: page, wantCredentials: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, configuration.EnvConfig{
+				Runtime:        configuration.Development,
+				AllowedOrigins: tt.allowed,
+			})
+
+			// The preflight and the actual request must carry the same validated origin
+			for _, method := range []string{http.MethodOptions, http.MethodGet} {
+				req := httptest.NewRequest(method, "/api/csrf", nil)
+				req.Header.Set("Origin", tt.origin)
+				rec := httptest.NewRecorder()
+				s.Handler.ServeHTTP(rec, req)
+
+				h := rec.Header()
+				if got := h.Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+					t.Errorf("%s: expected Access-Control-Allow-Origin %q, got %q", method, tt.wantOrigin, got)
+				}
+				if !strings.Contains(strings.Join(h.Values("Vary"), ","), "Origin") {
+					t.Errorf("%s: expected Vary: Origin", method)
+				}
+				if tt.wantOrigin == "" {
+					if h.Get("Access-Control-Allow-Credentials") != "" || h.Get("Access-Control-Allow-Methods") != "" {
+						t.Errorf("%s: expected no CORS headers for a disallowed origin, got %v", method, h)
+					}
+					continue
+				}
+				if got := h.Get("Access-Control-Allow-Credentials") == "true"; got != tt.wantCredentials {
+					t.Errorf("%s: expected credentials allowed %v, got %v", method, tt.wantCredentials, got)
+				}
+				if h.Get("Access-Control-Allow-Methods") != corsAllowedMethods || h.Get("Access-Control-Allow-Headers") != corsAllowedHeaders {
+					t.Errorf("%s: unexpected allowed methods or headers: %v", method, h)
+				}
+			}
+		})
+	}
+}
+
+func TestCORSWildcardOnlyInDevelopment(t *testing.T) {
+	for _, runtime := range []configuration.RuntimeEnv{configuration.Preproduction, configuration.Production} {
+		cfg := configuration.EnvConfig{Runtime: runtime, AllowedOrigins: []string{"*"}}
+		if _, err := NewServer(cfg, nil, nil, nil, ""); err == nil || !strings.Contains(err.Error(), "allowedOrigins") {
+			t.Errorf("%s: expected the wildcard origin to be rejected, got: %v", runtime, err)
+		}
+	}
+}
+
+// newTestIssuer returns an issuance service calling a fake Verifier, and a fake Issuer answering with issue.
+// A nil issue issues every credential requested.
+func newTestIssuer(t *testing.T, issue http.HandlerFunc) *credissuance.LEARIssuance {
+	t.Helper()
+
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/token" {
+			w.Write([]byte(`{"access_token": "test-token"}`))
+			return
+		}
+		if issue != nil {
+			issue(w, r)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(fake.Close)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	didKey, err := common.DidKeyFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key.txt")
+	if err := os.WriteFile(keyFile, []byte(hex.EncodeToString(key.D.FillBytes(make([]byte, 32)))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	credentialFile := filepath.Join(dir, "machine.txt")
+	if err := os.WriteFile(credentialFile, []byte("machine-credential"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	issuer, err := credissuance.NewLEARIssuance(configuration.EnvConfig{
+		PrivateKeyFile:        keyFile,
+		MachineCredentialFile: credentialFile,
+		MyDidkey:              didKey,
+		Verifier:              configuration.VerifierConfig{URL: fake.URL, TokenEndpoint: fake.URL + "/token"},
+		Issuer:                configuration.IssuerConfig{CredentialIssuancePath: fake.URL + "/issuances"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issuer
+}
+
+func TestBasePathRoutes(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>Onboarding</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(configuration.EnvConfig{BasePath: "/onboarding/"}, nil, nil, nil, dir)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	tests := []struct {
+		path         string
+		wantStatus   int
+		wantBody     string
+		wantLocation string
+	}{
+		{path: "/onboarding/", wantStatus: http.StatusOK, wantBody: "<h1>Onboarding</h1>"},
+		// The redirects of the file server are relative, so they stay under the base path
+		{path: "/onboarding/index.html", wantStatus: http.StatusMovedPermanently, wantLocation: "./"},
+		{path: "/onboarding", wantStatus: http.StatusTemporaryRedirect, wantLocation: "/onboarding/"},
+		{path: "/onboarding/api/countries", wantStatus: http.StatusOK, wantBody: `"success":true`},
+		{path: "/", wantStatus: http.StatusNotFound},
+		{path: "/index.html", wantStatus: http.StatusNotFound},
+		{path: "/api/countries", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		s.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.wantStatus || !strings.Contains(rec.Body.String(), tt.wantBody) {
+			t.Errorf("%s: expected %d with %q, got %d: %s", tt.path, tt.wantStatus, tt.wantBody, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("Location"); got != tt.wantLocation {
+			t.Errorf("%s: expected Location %q, got %q", tt.path, tt.wantLocation, got)
+		}
+	}
+
+	// The CSRF cookie is sent to the API under the base path, and the token is accepted there
+	rec := httptest.NewRecorder()
+	s.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/onboarding/api/csrf", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Path != "/onboarding/api/" {
+		t.Fatalf("expected the CSRF cookie for /onboarding/api/, got %v", cookies)
+	}
+	if rec := postJSON(s, "/onboarding/api/verify-code", `{"email": "a@example.com", "code": "000000"}`); rec.Code == http.StatusForbidden {
+		t.Errorf("expected the CSRF token to be accepted under the base path, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fingerprintedCacheControl lets browsers and proxies keep the fingerprinted assets for a year without revalidating,
+// as a change in their contents gives them a new name
+const fingerprintedCacheControl = "public, max-age=31536000, immutable"
+
+// fingerprintedAsset matches the names of the assets copied with the hash of their contents, like style.0123456789.css
+var fingerprintedAsset = regexp.MustCompile(`^/assets/.+\.[0-9a-f]{10}\.(css|js)$`)
+
+// cacheFingerprinted serves the static files with next, allowing to cache the fingerprinted assets for long.
+// The rest is left to the default revalidation with Last-Modified, as their contents may change under the same name.
+func cacheFingerprinted(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fingerprintedAsset.MatchString(r.URL.Path) {
+			w.Header().Set("Cache-Control", fingerprintedCacheControl)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// staticFiles serves the generated site in dir, with ETags from the contents of the files so the conditional requests
+// of the browsers get a 304 across rebuilds and restarts, and long caching of the fingerprinted assets
+func staticFiles(dir string) http.Handler {
+	fs := http.Dir(dir)
+	return cacheFingerprinted(&contentETags{fs: fs, next: http.FileServer(fs), tags: map[string]fileETag{}})
+}
+
+// contentETags sets the ETag of the static files from the hash of their contents before serving them with next,
+// which then replies to If-None-Match. The hashes are kept while the size and modification time of the file hold.
+type contentETags struct {
+	fs   http.FileSystem
+	next http.Handler
+
+	mu   sync.Mutex
+	tags map[string]fileETag
+}
+
+// fileETag is the ETag of a file with the size and modification time it was computed for
+type fileETag struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+func (c *contentETags) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		if etag := c.etag(r.URL.Path); etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+	}
+	c.next.ServeHTTP(w, r)
+}
+
+// etag returns the ETag of the file served for the path, the index.html of a directory, or "" if there is none
+func (c *contentETags) etag(urlPath string) string {
+	name := path.Clean("/" + urlPath)
+	if strings.HasSuffix(urlPath, "/") {
+		name = path.Join(name, "index.html")
+	}
+	f, err := c.fs.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return ""
+	}
+
+	c.mu.Lock()
+	cached, ok := c.tags[name]
+	c.mu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.etag
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	etag := `"` + hex.EncodeToString(h.Sum(nil))[:16] + `"`
+	c.mu.Lock()
+	c.tags[name] = fileETag{size: info.Size(), modTime: info.ModTime(), etag: etag}
+	c.mu.Unlock()
+	return etag
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheFingerprinted(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "assets"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"dome.0123456789.css", "dome.css", "logo.0123456789.png"} {
+		if err := os.WriteFile(filepath.Join(dir, "assets", name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := cacheFingerprinted(http.FileServer(http.Dir(dir)))
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/assets/dome.0123456789.css", want: fingerprintedCacheControl},
+		{path: "/assets/dome.css"},
+		{path: "/assets/logo.0123456789.png"},
+		// The errors of the file server drop the caching headers
+		{path: "/assets/missing.0123456789.js"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if got := rec.Header().Get("Cache-Control"); got != tt.want {
+			t.Errorf("%s: expected Cache-Control %q, got %q", tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestStaticFilesETag(t *testing.T) {
+	dir := t.TempDir()
+	page := filepath.Join(dir, "index.html")
+	if err := os.WriteFile(page, []byte("<h1>Onboarding</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler := staticFiles(dir)
+
+	get := func(path, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/", "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected the page with an ETag, got %d with %q", rec.Code, etag)
+	}
+	if rec := get("/", etag); rec.Code != http.StatusNotModified {
+		t.Errorf("expected %d for the same contents, got %d", http.StatusNotModified, rec.Code)
+	}
+
+	// A rebuild with the same contents keeps the ETag, even if it touched the file
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(page, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get("/", etag); rec.Code != http.StatusNotModified {
+		t.Errorf("expected %d after touching the file, got %d", http.StatusNotModified, rec.Code)
+	}
+
+	if err := os.WriteFile(page, []byte("<h1>Onboarding v2</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec = get("/", etag)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("expected the new contents with a new ETag, got %d with %q", rec.Code, rec.Header().Get("ETag"))
+	}
+
+	if rec := get("/missing.html", ""); rec.Code != http.StatusNotFound || rec.Header().Get("ETag") != "" {
+		t.Errorf("expected a 404 without ETag, got %d with %q", rec.Code, rec.Header().Get("ETag"))
+	}
+}
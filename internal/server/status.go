@@ -0,0 +1,98 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+// The status token returned at registration time is an HMAC of the registration id, so only the user who
+// registered can query the status, without us having to store the tokens.
+
+// loadStatusSecret reads the key used to sign the status tokens from the file, or generates a random one if
+// no file is configured. With a random key, the tokens are not valid after a restart of the server.
+func loadStatusSecret(file string) ([]byte, error) {
+	if file == "" {
+		slog.Warn("⚠️ No status token secret configured, registration status tokens will not survive a restart")
+		secret := make([]byte, 32)
+		rand.Read(secret)
+		return secret, nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read status token secret file: %w", err)
+	}
+	secret := []byte(strings.TrimSpace(string(content)))
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("the status token secret in %s must have at least 32 characters", file)
+	}
+	return secret, nil
+}
+
+// statusToken returns the token that authorizes querying the status of the registration
+func (s *Server) statusToken(registrationID string) string {
+	mac := hmac.New(sha256.New, s.statusSecret)
+	mac.Write([]byte(registrationID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// registrationStatus is the sanitized status of a registration returned to the user
+type registrationStatus struct {
+	RegistrationID string `json:"registration_id"`
+	Status         string `json:"status"`
+}
+
+// HandleRegistrationStatus tells a user whether the credential of their registration was issued.
+// It requires the registration id and the status token returned at registration time, and never exposes
+// internal details like the issuance errors.
+func (s *Server) HandleRegistrationStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	registrationID := r.URL.Query().Get("registration_id")
+	token := r.URL.Query().Get("token")
+	if registrationID == "" || token == "" {
+		s.SendJSON(w, http.StatusBadRequest, false, "registration_id and token are required", nil)
+		return
+	}
+
+	// An invalid token and an unknown registration get the same reply, so ids can not be probed
+	const notFound = "Registration not found"
+	if !hmac.Equal([]byte(token), []byte(s.statusToken(registrationID))) {
+		s.SendJSON(w, http.StatusNotFound, false, notFound, nil)
+		return
+	}
+
+	reg, err := s.DB.GetRegistrationByIDContext(r.Context(), registrationID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.SendJSON(w, http.StatusNotFound, false, notFound, nil)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "❌ Error reading registration status", "registration_id", registrationID, "error", err)
+		s.SendJSON(w, http.StatusInternalServerError, false, "Failed to read the registration status", nil)
+		return
+	}
+
+	status := reg.Status
+	if status == "" {
+		status = db.StatusPending
+	}
+	s.SendJSON(w, http.StatusOK, true, "Registration status", registrationStatus{
+		RegistrationID: reg.RegistrationID,
+		Status:         status,
+	})
+}
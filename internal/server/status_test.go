@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+)
+
+func getStatus(s *Server, registrationID, token string) *httptest.ResponseRecorder {
+	query := url.Values{"registration_id": {registrationID}, "token": {token}}
+	rec := httptest.NewRecorder()
+	s.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/registration-status?"+query.Encode(), nil))
+	return rec
+}
+
+func TestHandleRegistrationStatus(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development})
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Development)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	s.DB = dbService
+
+	registrations := map[string]string{
+		"20260101-00000001": "",
+		"20260101-00000002": db.StatusIssued,
+		"20260101-00000003": db.StatusFailed,
+	}
+	for id, status := range registrations {
+		reg := &db.Registration{RegistrationID: id, Email: id + "@example.com", VatID: id}
+		if err := dbService.SaveRegistration(reg); err != nil {
+			t.Fatal(err)
+		}
+		if status != "" {
+			reg.Status = status
+			reg.IssuanceError = "internal error from the issuer"
+			if err := dbService.UpdateRegistrationStatus(reg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name       string
+		id         string
+		token      string
+		wantCode   int
+		wantStatus string
+	}{
+		{name: "pending", id: "20260101-00000001", wantCode: http.StatusOK, wantStatus: db.StatusPending},
+		{name: "issued", id: "20260101-00000002", wantCode: http.StatusOK, wantStatus: db.StatusIssued},
+		{name: "failed", id: "20260101-00000003", wantCode: http.StatusOK, wantStatus: db.StatusFailed},
+		{name: "token of another registration", id: "20260101-00000001", token: s.statusToken("20260101-00000002"), wantCode: http.StatusNotFound},
+		{name: "unknown registration", id: "20260101-99999999", wantCode: http.StatusNotFound},
+		{name: "missing token", id: "20260101-00000001", token: "-", wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Each case is a different client, so the rate limit does not interfere
+			s.IPLimitersMu.Lock()
+			clear(s.IPLimiters)
+			s.IPLimitersMu.Unlock()
+
+			token := tt.token
+			switch token {
+			case "":
+				token = s.statusToken(tt.id)
+			case "-":
+				token = ""
+			}
+
+			rec := getStatus(s, tt.id, token)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rec.Code, rec.Body.String())
+			}
+			if strings.Contains(rec.Body.String(), "internal error") {
+				t.Errorf("the response exposes the issuance error: %s", rec.Body.String())
+			}
+			if tt.wantStatus == "" {
+				return
+			}
+
+			var resp struct {
+				Data registrationStatus `json:"data"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Data.Status != tt.wantStatus || resp.Data.RegistrationID != tt.id {
+				t.Errorf("expected %s for %s, got %+v", tt.wantStatus, tt.id, resp.Data)
+			}
+		})
+	}
+}
+
+func TestHandleRegistrationStatusRateLimited(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Development})
+
+	// Invalid tokens are rejected before reaching the database, but still count for the rate limit
+	limited := false
+	for range 20 {
+		if getStatus(s, "20260101-00000001", "invalid").Code == http.StatusTooManyRequests {
+			limited = true
+			break
+		}
+	}
+	if !limited {
+		t.Errorf("expected the endpoint to be rate limited per IP")
+	}
+}
+
+func TestLoadStatusSecret(t *testing.T) {
+	dir := t.TempDir()
+	short := filepath.Join(dir, "short.txt")
+	good := filepath.Join(dir, "good.txt")
+	os.WriteFile(short, []byte("too short\n"), 0600)
+	os.WriteFile(good, []byte(strings.Repeat("s", 32)+"\n"), 0600)
+
+	if _, err := loadStatusSecret(short); err == nil {
+		t.Errorf("expected a short secret to be rejected")
+	}
+	if _, err := loadStatusSecret(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Errorf("expected a missing file to be an error")
+	}
+	secret, err := loadStatusSecret(good)
+	if err != nil || string(secret) != strings.Repeat("s", 32) {
+		t.Errorf("expected the trimmed secret, got %q, %v", secret, err)
+	}
+
+	// Without a file the secret is random
+	a, _ := loadStatusSecret("")
+	b, _ := loadStatusSecret("")
+	if len(a) != 32 || string(a) == string(b) {
+		t.Errorf("expected random 32-byte secrets")
+	}
+}
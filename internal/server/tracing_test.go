@@ -0,0 +1,131 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"github.com/hesusruiz/onboardng/internal/db"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans installs a tracer provider keeping the spans ended during the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+	return recorder
+}
+
+// spanAttribute returns the value of the attribute of the span, or "" if it has none
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) string {
+	for _, attr := range span.Attributes() {
+		if attr.Key == key {
+			return attr.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestTraceRegistration(t *testing.T) {
+	recorder := recordSpans(t)
+
+	s := newTestServer(t, configuration.EnvConfig{Runtime: configuration.Production})
+	s.Issuer = newTestIssuer(t, nil)
+	dbService, err := db.Open(filepath.Join(t.TempDir(), "test.db"), configuration.Production)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	s.DB = dbService
+
+	body := `{"firstName": "Jane", "lastName": "Doe", "companyName": "ACME", "country": "ES", "vatId": "ES12345678", "email": "jane@example.com"}`
+	if rec := postJSON(s, "/api/register", body); rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	reg, err := dbService.GetRegistrationByEmail("jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	request, ok := spans["POST /api/register"]
+	if !ok {
+		t.Fatalf("expected a span for the request, got %v", recorder.Ended())
+	}
+	if got := spanAttribute(request, "http.response.status_code"); got != "200" {
+		t.Errorf("expected the status 200 in the span of the request, got %q", got)
+	}
+
+	// The registration id and the country identify the registration in its spans
+	for _, name := range []string{"POST /api/register", "SaveRegistration", "SendWelcomeEmail"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("expected a span %q", name)
+			continue
+		}
+		if span.SpanContext().TraceID() != request.SpanContext().TraceID() {
+			t.Errorf("expected the span %q in the trace of the request", name)
+		}
+		if got := spanAttribute(span, "registration.id"); got != reg.RegistrationID {
+			t.Errorf("expected the registration id %q in the span %q, got %q", reg.RegistrationID, name, got)
+		}
+		if got := spanAttribute(span, "registration.country"); got != "ES" {
+			t.Errorf("expected the country ES in the span %q, got %q", name, got)
+		}
+	}
+
+	// The token is requested inside the issuance request
+	issuance, token := spans["LEARIssuanceRequest"], spans["RequestToken"]
+	if issuance == nil || token == nil {
+		t.Fatalf("expected spans for the issuance and the token, got %v", recorder.Ended())
+	}
+	if issuance.Parent().SpanID() != request.SpanContext().SpanID() {
+		t.Errorf("expected the issuance to be a child of the request")
+	}
+	if token.Parent().SpanID() != issuance.SpanContext().SpanID() {
+		t.Errorf("expected the token request to be a child of the issuance")
+	}
+	if got := spanAttribute(issuance, "registration.country"); got != "ES" {
+		t.Errorf("expected the country ES in the span of the issuance, got %q", got)
+	}
+}
+
+func TestTraceContinuesCallerTrace(t *testing.T) {
+	recorder := recordSpans(t)
+
+	s := &Server{}
+	handler := s.Trace(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "failed", http.StatusBadGateway)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/api/health", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected a span, got %d", len(spans))
+	}
+	if got := spans[0].SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected the trace of the caller to be continued, got %s", got)
+	}
+	if spans[0].Status().Code != codes.Error {
+		t.Errorf("expected a server error to mark the span as failed, got %v", spans[0].Status())
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+// Limits of the length of the verification codes
+const (
+	defaultVerificationCodeLength = 6
+	minVerificationCodeLength     = 4
+	maxVerificationCodeLength     = 12
+)
+
+// alphanumericCodeAlphabet has the uppercase letters and digits, without 0, 1, I, L and O which are easily confused
+const alphanumericCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+// validateVerificationCodeConfig rejects unknown character sets and lengths too short to be unguessable or too long to type
+func (s *Server) validateVerificationCodeConfig() error {
+	cfg := s.Config.VerificationCode
+	switch cfg.Charset {
+	case "", configuration.NumericCodes, configuration.AlphanumericCodes:
+	default:
+		return fmt.Errorf("unknown charset %q, expected %q or %q", cfg.Charset, configuration.NumericCodes, configuration.AlphanumericCodes)
+	}
+	if cfg.Length != 0 && (cfg.Length < minVerificationCodeLength || cfg.Length > maxVerificationCodeLength) {
+		return fmt.Errorf("the length must be between %d and %d, %d configured", minVerificationCodeLength, maxVerificationCodeLength, cfg.Length)
+	}
+	return nil
+}
+
+// generateCode returns the code sent to validate an email, 6 digits by default
+func (s *Server) generateCode() (string, error) {
+	cfg := s.Config.VerificationCode
+	length := cfg.Length
+	if length == 0 {
+		length = defaultVerificationCodeLength
+	}
+	if cfg.Charset == configuration.AlphanumericCodes {
+		return randomString(s.random, alphanumericCodeAlphabet, length)
+	}
+	return randomDigits(s.random, length)
+}
+
+// normalizeCode puts a code typed by the user in the format generated, ignoring the case and surrounding spaces
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// loadCodeHashKey returns the key salting the hashes of the emails and the codes, nil if they are kept in plain text
+func loadCodeHashKey(cfg configuration.EnvConfig) ([]byte, error) {
+	if !cfg.VerificationCode.Hashed {
+		return nil, nil
+	}
+	file := cfg.VerificationCode.HashKeyFile
+	if file == "" {
+		if cfg.Redis.Addr != "" {
+			return nil, fmt.Errorf("the hashed verification codes in Redis need a hashKeyFile shared by the replicas")
+		}
+		key := make([]byte, 32)
+		rand.Read(key)
+		return key, nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read verification code hash key file: %w", err)
+	}
+	key := []byte(strings.TrimSpace(string(content)))
+	if len(key) < 32 {
+		return nil, fmt.Errorf("the verification code hash key in %s must have at least 32 characters", file)
+	}
+	return key, nil
+}
+
+// codeHash returns the salted hash of the parts, with a label telling what they are
+func (s *Server) codeHash(label string, parts ...string) string {
+	mac := hmac.New(sha256.New, s.codeHashKey)
+	mac.Write([]byte(label))
+	for _, part := range parts {
+		mac.Write([]byte{0})
+		mac.Write([]byte(part))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// emailKey returns how the email is kept by the rate limits and the codes: its hash, or itself if not hashed
+func (s *Server) emailKey(email string) string {
+	if s.codeHashKey == nil {
+		return email
+	}
+	return s.codeHash("email", email)
+}
+
+// codeKey returns how the code sent to the email is kept: its hash with the email, or itself if not hashed
+func (s *Server) codeKey(email, code string) string {
+	if s.codeHashKey == nil {
+		return code
+	}
+	return s.codeHash("code", email, code)
+}
+
+// sameCode compares a kept code with the one provided in constant time, not telling how much of it matches
+func sameCode(kept, provided string) bool {
+	return subtle.ConstantTimeCompare([]byte(kept), []byte(provided)) == 1
+}
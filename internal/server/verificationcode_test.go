@@ -0,0 +1,137 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+func TestGenerateCodeFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      configuration.VerificationCodeConfig
+		pattern  string
+		alphabet string
+	}{
+		{name: "default", pattern: `^[0-9]{6}$`, alphabet: "0123456789"},
+		{name: "numeric", cfg: configuration.VerificationCodeConfig{Length: 8, Charset: configuration.NumericCodes}, pattern: `^[0-9]{8}$`, alphabet: "0123456789"},
+		{name: "alphanumeric", cfg: configuration.VerificationCodeConfig{Length: 10, Charset: configuration.AlphanumericCodes}, pattern: `^[A-HJKMNP-Z2-9]{10}$`, alphabet: alphanumericCodeAlphabet},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, configuration.EnvConfig{VerificationCode: tt.cfg})
+			re := regexp.MustCompile(tt.pattern)
+
+			const codes = 2000
+			counts := make(map[rune]int)
+			total := 0
+			for range codes {
+				code, err := s.generateCode()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !re.MatchString(code) {
+					t.Fatalf("code %q does not match %s", code, tt.pattern)
+				}
+				for _, c := range code {
+					counts[c]++
+					total++
+				}
+			}
+
+			// Every character of the alphabet appears with about the same frequency
+			expected := float64(total) / float64(len(tt.alphabet))
+			for _, c := range tt.alphabet {
+				if got := float64(counts[c]); got < 0.75*expected || got > 1.25*expected {
+					t.Errorf("character %q appeared %v times, expected about %v", c, got, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidVerificationCodeConfig(t *testing.T) {
+	tests := []configuration.VerificationCodeConfig{
+		{Length: 3},
+		{Length: 13},
+		{Charset: "hex"},
+	}
+
+	for _, cfg := range tests {
+		if _, err := NewServer(configuration.EnvConfig{VerificationCode: cfg}, nil, nil, nil, t.TempDir()); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+}
+
+func TestVerifyAlphanumericCodeIgnoresCase(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{
+		Runtime:          configuration.Development,
+		VerificationCode: configuration.VerificationCodeConfig{Charset: configuration.AlphanumericCodes},
+	})
+	s.StoreVerificationCode("john@example.com", "ABC234")
+
+	rec := postJSON(s, "/api/verify-code", `{"email": "john@example.com", "code": " abc234 "}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"success":true`) {
+		t.Errorf("expected the code to be verified, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHashedVerificationCodes(t *testing.T) {
+	s := newTestServer(t, configuration.EnvConfig{VerificationCode: configuration.VerificationCodeConfig{Hashed: true}})
+
+	codes := map[string]string{"john@example.com": "123456", "jane@example.com": "654321"}
+	for email, code := range codes {
+		if s.RegisterEmailAttempt(email) != nil {
+			t.Fatalf("expected a code to be allowed for %s", email)
+		}
+		if err := s.StoreVerificationCode(email, code); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Neither the emails nor the codes are kept in plain text
+	for key, entry := range s.VerificationCodes {
+		if strings.Contains(key, "@") || entry.Code == codes["john@example.com"] || entry.Code == codes["jane@example.com"] {
+			t.Errorf("expected the email and code to be hashed, got %q: %q", key, entry.Code)
+		}
+	}
+	for key := range s.EmailRateLimiter {
+		if strings.Contains(key, "@") {
+			t.Errorf("expected the email of the rate limiter to be hashed, got %q", key)
+		}
+	}
+
+	// The hashes match the code of each email only
+	if err := s.VerifyCode("jane@example.com", codes["john@example.com"]); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("expected the code of another email to be invalid, got %v", err)
+	}
+	if err := s.VerifyCode("john@example.com", codes["john@example.com"]); err != nil {
+		t.Fatalf("expected the code to be verified, got %v", err)
+	}
+	if !s.EmailVerified("john@example.com") || s.EmailVerified("jane@example.com") {
+		t.Errorf("expected only john@example.com to be verified")
+	}
+	s.ConsumeVerifiedEmail("john@example.com")
+	if s.EmailVerified("john@example.com") {
+		t.Errorf("expected the verification to be consumed")
+	}
+
+	// The rate limit counts each email apart
+	for range maxEmailAttempts - 1 {
+		if s.RegisterEmailAttempt("john@example.com") != nil {
+			t.Fatal("expected the attempts within the limit to be allowed")
+		}
+	}
+	if s.RegisterEmailAttempt("john@example.com") == nil {
+		t.Errorf("expected the attempts over the limit to be blocked")
+	}
+	if s.RegisterEmailAttempt("jane@example.com") != nil {
+		t.Errorf("expected the other email not to be limited")
+	}
+}
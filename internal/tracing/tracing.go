@@ -0,0 +1,48 @@
+// Package tracing exports the traces of the server to an OpenTelemetry collector over OTLP/HTTP.
+// The rest of the server creates its spans with the global tracer provider, which does nothing until Setup is called.
+package tracing
+
+import (
+	"context"
+
+	"github.com/hesusruiz/onboardng/internal/buildinfo"
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+// defaultServiceName identifies the server in the traces, when the configuration does not specify it
+const defaultServiceName = "onboarding"
+
+// Setup exports the spans to the collector of the configuration, and returns the function flushing the pending ones
+// when the server stops. Without an endpoint nothing is exported, and the returned function does nothing.
+func Setup(cfg configuration.TracingConfig, runtime configuration.RuntimeEnv) (func(context.Context) error, error) {
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	res := resource.NewSchemaless(
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(buildinfo.Get().Version),
+		semconv.DeploymentEnvironmentName(string(runtime)),
+	)
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	// Continue the traces of the callers sending a traceparent header
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
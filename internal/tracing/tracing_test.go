@@ -0,0 +1,58 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/hesusruiz/onboardng/internal/configuration"
+	"go.opentelemetry.io/otel"
+)
+
+func TestSetupWithoutEndpoint(t *testing.T) {
+	before := otel.GetTracerProvider()
+	shutdown, err := Setup(configuration.TracingConfig{}, configuration.Development)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if otel.GetTracerProvider() != before {
+		t.Error("expected the tracer provider not to be replaced without an endpoint")
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("unexpected error shutting down: %v", err)
+	}
+}
+
+func TestSetupExportsSpans(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+
+	before := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(before)
+
+	shutdown, err := Setup(configuration.TracingConfig{Endpoint: collector.URL}, configuration.Preproduction)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, span := otel.Tracer("test").Start(context.Background(), "registration")
+	span.End()
+
+	// Stopping flushes the spans waiting for the next batch
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error shutting down: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(paths) != 1 || paths[0] != "POST /v1/traces" {
+		t.Errorf("expected the span to be posted to /v1/traces, got %v", paths)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// liveReloadPath is the Server-Sent Events endpoint that pages generated in watch mode subscribe to
+const liveReloadPath = "/__livereload"
+
+// liveReload tells the browsers connected to liveReloadPath to reload the page after the site is regenerated
+type liveReload struct {
+	mu      sync.Mutex
+	clients map[chan struct{}]bool
+}
+
+func newLiveReload() *liveReload {
+	return &liveReload{clients: make(map[chan struct{}]bool)}
+}
+
+// ServeHTTP keeps the connection open, sending a "reload" event every time the site is regenerated
+func (lr *liveReload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := make(chan struct{}, 1)
+	lr.mu.Lock()
+	lr.clients[ch] = true
+	lr.mu.Unlock()
+
+	defer func() {
+		lr.mu.Lock()
+		delete(lr.clients, ch)
+		lr.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ch:
+			fmt.Fprint(w, "event: reload\ndata: reload\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// broadcast sends the reload event to all connected browsers
+func (lr *liveReload) broadcast() {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	for ch := range lr.clients {
+		// Do not block on slow clients, they already have a reload pending
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
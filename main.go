@@ -1,47 +1,87 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/hesusruiz/onboardng/credissuance"
+	"github.com/hesusruiz/onboardng/internal/buildinfo"
 	"github.com/hesusruiz/onboardng/internal/configuration"
 	"github.com/hesusruiz/onboardng/internal/db"
 	"github.com/hesusruiz/onboardng/internal/mail"
 	"github.com/hesusruiz/onboardng/internal/server"
-	"gopkg.in/yaml.v3"
+	"github.com/hesusruiz/onboardng/internal/tracing"
 )
 
 func main() {
 	generateFlag := flag.Bool("gen", false, "only generate frontend and exit, otherwise start server also")
 	watchFlag := flag.Bool("watch", false, "watch for changes and start server")
+	cleanFlag := flag.Bool("clean", false, "remove the files generated before that do not correspond to the source anymore")
 	envFlag := flag.String("env", "dev", "environment to serve (dev, pre or pro)")
 	port := flag.String("port", "7777", "port for the server")
+	configFlag := flag.String("config", "config.yaml", "path to the configuration file")
+	versionFlag := flag.Bool("version", false, "print the version of the build and exit")
+	selftestFlag := flag.Bool("selftest", false, "check that the Verifier and the Issuer of the environment are reachable and accept the machine credential, and exit")
 	flag.Parse()
 
+	if *versionFlag {
+		fmt.Println("onboardng", buildinfo.Get())
+		return
+	}
+
+	// Add the id of the request being served to the logs written while serving it
+	slog.SetDefault(slog.New(server.NewContextHandler(slog.NewTextHandler(os.Stderr, nil))))
+
 	// Load configuration
-	configData, err := os.ReadFile("config.yaml")
+	loaded, err := configuration.Load(*configFlag)
 	if err != nil {
-		slog.Error("❌ Error reading config.yaml", "error", err)
+		slog.Error("❌ Error loading configuration", "error", err)
 		os.Exit(1)
 	}
-	var cfg configuration.Config
-	if err := yaml.Unmarshal(configData, &cfg); err != nil {
-		slog.Error("❌ Error parsing config.yaml", "error", err)
-		os.Exit(1)
+	cfg := *loaded
+
+	if *selftestFlag {
+		os.Exit(selfTest(cfg, configuration.RuntimeEnv(*envFlag)))
 	}
+	slog.Info("Starting onboarding", "version", buildinfo.Get().String())
 
-	// Initial generation of the frontend
-	if err := generate(cfg); err != nil {
+	// Initial generation of the frontend. In watch mode the pages reload themselves when regenerated.
+	g, err := newSiteGenerator(cfg)
+	if err != nil {
 		slog.Error("❌ Error generating frontend", "error", err)
 		os.Exit(1)
 	}
+	g.liveReload = *watchFlag && !*generateFlag
+	g.minify = cfg.Minify && configuration.RuntimeEnv(*envFlag) != configuration.Development && !g.liveReload
+	g.clean = cfg.Clean || *cleanFlag
+	g.fingerprint = cfg.Fingerprint && !g.liveReload
+	g.basePath = cfg.Environments[*envFlag].Prefix()
+	genErr := g.generateAll()
+	if genErr != nil {
+		// A broken page does not block the rest: they are written and served, and the broken one is reported
+		var pagesErr *pagesError
+		if !errors.As(genErr, &pagesErr) || !pagesErr.partial() {
+			slog.Error("❌ Error generating frontend", "error", genErr)
+			os.Exit(1)
+		}
+		slog.Error("❌ Some pages could not be generated, the rest were", "error", genErr)
+	}
 
 	if *generateFlag {
+		if genErr != nil {
+			// All the pages that could be generated are written, the failure is for the deploy pipeline to notice
+			os.Exit(1)
+		}
 		slog.Info("Frontend generated. Exiting.")
 		os.Exit(0)
 	}
@@ -55,29 +95,27 @@ func main() {
 
 	runtimeEnv := configuration.RuntimeEnv(*envFlag)
 
-	// Setup issuer
-	issuerCfg := configuration.EnvConfig{
-		Runtime:               runtimeEnv,
-		Debug:                 srvConfig.Debug,
-		PrivateKeyFile:        srvConfig.PrivateKeyFile,
-		MachineCredentialFile: srvConfig.MachineCredentialFile,
-		MyDidkey:              srvConfig.MyDidkey,
-		Verifier: configuration.VerifierConfig{
-			URL:           srvConfig.Verifier.URL,
-			TokenEndpoint: srvConfig.Verifier.TokenEndpoint,
-		},
-		Issuer: configuration.IssuerConfig{
-			CredentialIssuancePath: srvConfig.Issuer.CredentialIssuancePath,
-		},
+	if err := srvConfig.TLS.Validate(); err != nil {
+		slog.Error("❌ Invalid TLS configuration", "error", err)
+		os.Exit(1)
 	}
-	issuanceService, err := credissuance.NewLEARIssuance(issuerCfg)
+
+	// Export the traces to the collector, if configured
+	shutdownTracing, err := tracing.Setup(srvConfig.Tracing, runtimeEnv)
+	if err != nil {
+		slog.Error("❌ Error setting up the tracing", "error", err)
+		os.Exit(1)
+	}
+
+	// Setup issuer
+	issuanceService, err := credissuance.NewLEARIssuance(issuerConfig(srvConfig, runtimeEnv))
 	if err != nil {
 		slog.Error("❌ Error creating issuance service", "error", err)
 		os.Exit(1)
 	}
 
 	// Initialize Database service
-	dbService, err := db.NewService(runtimeEnv)
+	dbService, err := db.NewService(srvConfig.Database, runtimeEnv)
 	if err != nil {
 		slog.Error("❌ Error initializing database service", "error", err)
 		os.Exit(1)
@@ -85,28 +123,128 @@ func main() {
 	defer dbService.Close()
 
 	// Initialize Mail service
-	mailService, err := mail.NewMailService(runtimeEnv, srvConfig.Mail)
+	mailService, err := mail.NewMailService(runtimeEnv, srvConfig.Mail, os.DirFS(filepath.Join(cfg.SrcDir, "email")))
 	if err != nil {
 		slog.Error("❌ Error initializing mail service", "error", err)
 		os.Exit(1)
 	}
 
-	srv := server.NewServer(dbService, issuanceService, mailService, cfg.DestDir)
+	srvConfig.Runtime = runtimeEnv
+	srv, err := server.NewServer(srvConfig, dbService, issuanceService, mailService, cfg.DestDir)
+	if err != nil {
+		slog.Error("❌ Error initializing server", "error", err)
+		os.Exit(1)
+	}
+
+	// Save the registrations queued while the database was failing
+	srv.ReplayRegistrationQueue()
+
+	handler := srv.Handler
 
-	// Start Watcher if requested
+	// Start Watcher if requested, serving the live reload events to the browser
 	if *watchFlag {
-		go startWatcher(cfg)
+		lr := newLiveReload()
+		mux := http.NewServeMux()
+		mux.Handle(srvConfig.Prefix()+liveReloadPath, lr)
+		mux.Handle("/", srv.Handler)
+		handler = mux
+
+		go startWatcher(cfg, *configFlag, g, lr)
 	}
 
-	// Start Server
-	slog.Info("🚀 Server running", "env", *envFlag, "dir", cfg.DestDir, "url", "https://onboarddev.dome.mycredential.eu")
-	if err := http.ListenAndServe(":"+*port, srv.Handler); err != nil {
+	// Stop the server and the background workers on Ctrl-C or when the service is stopped
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	retryDone := make(chan struct{})
+	go func() {
+		srv.RetryFailedIssuances(ctx)
+		close(retryDone)
+	}()
+
+	// Deliver the welcome emails and webhook calls left pending by a previous run, and the ones failing from now on
+	outboxDone := make(chan struct{})
+	go func() {
+		srv.DispatchOutbox(ctx)
+		close(outboxDone)
+	}()
+
+	go srv.SendDailyDigests(ctx)
+
+	// Delete or anonymize the registrations older than the retention, if configured
+	go srv.PurgeOldRegistrations(ctx)
+
+	// Reload the templates of the pages and emails on SIGHUP, so a typo can be fixed without a restart
+	go reloadOnHangup(ctx, g, mailService)
+
+	httpServer := &http.Server{Addr: ":" + *port, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			slog.Error("❌ Error shutting down the server", "error", err)
+		}
+	}()
+
+	// Start Server, with TLS if configured. Otherwise TLS is terminated by a proxy in front of us.
+	if srvConfig.TLS.Enabled() {
+		slog.Info("🚀 Server running with TLS", "env", *envFlag, "dir", cfg.DestDir, "port", *port, "cert", srvConfig.TLS.CertFile)
+		err = httpServer.ListenAndServeTLS(srvConfig.TLS.CertFile, srvConfig.TLS.KeyFile)
+	} else {
+		slog.Info("🚀 Server running", "env", *envFlag, "dir", cfg.DestDir, "url", "https://onboarddev.dome.mycredential.eu")
+		err = httpServer.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		slog.Error("Server failed", "error", err)
 		os.Exit(1)
 	}
+
+	// Wait for the issuance being retried and the outbox being delivered, if any, before closing the database
+	<-retryDone
+	<-outboxDone
+
+	// Send the issuance errors waiting for the digest, instead of losing them
+	if err := mailService.FlushIssuerErrors(); err != nil {
+		slog.Error("❌ Error sending the digest of issuer errors", "error", err)
+	}
+	if err := mailService.Close(); err != nil {
+		slog.Error("❌ Error closing the connection to the mail server", "error", err)
+	}
+	tracingCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := shutdownTracing(tracingCtx); err != nil {
+		slog.Error("❌ Error exporting the pending traces", "error", err)
+	}
+	slog.Info("Server stopped")
+}
+
+// shutdownTimeout is how long the requests being served can take to complete when the server stops
+const shutdownTimeout = 30 * time.Second
+
+// watchDebounce is how long the watcher waits for a burst of file events to settle before regenerating
+const watchDebounce = 300 * time.Millisecond
+
+// issuerConfig returns the configuration of the client of the Verifier and the Issuer of the environment
+func issuerConfig(srvConfig configuration.EnvConfig, runtimeEnv configuration.RuntimeEnv) configuration.EnvConfig {
+	return configuration.EnvConfig{
+		Runtime:               runtimeEnv,
+		Debug:                 srvConfig.Debug,
+		PrivateKeyFile:        srvConfig.PrivateKeyFile,
+		MachineCredentialFile: srvConfig.MachineCredentialFile,
+		MyDidkey:              srvConfig.MyDidkey,
+		KeyType:               srvConfig.KeyType,
+		SecondaryKey:          srvConfig.SecondaryKey,
+		Verifier: configuration.VerifierConfig{
+			URL:           srvConfig.Verifier.URL,
+			TokenEndpoint: srvConfig.Verifier.TokenEndpoint,
+		},
+		Issuer: srvConfig.Issuer,
+	}
 }
 
-func startWatcher(cfg configuration.Config) {
+// startWatcher regenerates the site with g when the sources change, and tells the browsers to reload via lr
+func startWatcher(cfg configuration.Config, configFile string, g *siteGenerator, lr *liveReload) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		slog.Error("❌ Watcher Error", "error", err)
@@ -116,36 +254,58 @@ func startWatcher(cfg configuration.Config) {
 
 	watchPaths := []string{
 		cfg.SrcDir,
-		"config.yaml",
+		configFile,
 	}
 
 	for _, path := range watchPaths {
-		err = filepath.Walk(path, func(walkPath string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				return watcher.Add(walkPath)
-			}
-			return nil
-		})
-		if err != nil {
+		if err := watchTree(watcher, path); err != nil {
 			slog.Warn("⚠️ Error walking path", "path", path, "error", err)
 		}
 	}
 
 	slog.Info("👀 Watching for changes...")
 
+	// Editors generate several events for a single save (and atomic saves write a temporary file first),
+	// so we collect the changed files until no event arrives for watchDebounce, and regenerate once.
+	pending := make(map[string]bool)
+	debounce := time.NewTimer(watchDebounce)
+	debounce.Stop()
+
 	for {
 		select {
 		case event, ok := <-watcher.Events:
 			if !ok {
 				return
 			}
+
+			// Track newly created directories, so files added to them are watched too
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := watchTree(watcher, event.Name); err != nil {
+						slog.Warn("⚠️ Error watching new directory", "path", event.Name, "error", err)
+					}
+				}
+			}
+
 			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
-				slog.Info("📝 File updated. Regenerating...", "file", event.Name)
-				generate(cfg)
+				pending[event.Name] = true
+				debounce.Reset(watchDebounce)
 			}
+
+		case <-debounce.C:
+			changed := make([]string, 0, len(pending))
+			for file := range pending {
+				changed = append(changed, file)
+			}
+			clear(pending)
+
+			slog.Info("📝 Files updated. Regenerating...", "files", changed)
+			if err := g.regenerate(changed...); err != nil {
+				slog.Error("❌ Error regenerating frontend", "error", err)
+				continue
+			}
+			lr.broadcast()
+
 		case err, ok := <-watcher.Errors:
 			if !ok {
 				return
@@ -154,3 +314,41 @@ func startWatcher(cfg configuration.Config) {
 		}
 	}
 }
+
+// reloadOnHangup reloads the templates of the site and the emails each time the process receives SIGHUP,
+// until the context is done. The templates failing to parse are reported, and the previous ones are kept.
+func reloadOnHangup(ctx context.Context, g *siteGenerator, mailService *mail.Service) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			slog.Info("🔄 Reloading templates...")
+			if err := g.reload(); err != nil {
+				slog.Error("❌ Error reloading the page templates", "error", err)
+			}
+			if err := mailService.ReloadTemplates(); err != nil {
+				slog.Error("❌ Error reloading the email templates, keeping the previous ones", "error", err)
+				continue
+			}
+			slog.Info("✅ Email templates reloaded")
+		}
+	}
+}
+
+// watchTree adds to the watcher the given path and, if it is a directory, all its subdirectories
+func watchTree(watcher *fsnotify.Watcher, path string) error {
+	return filepath.Walk(path, func(walkPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return watcher.Add(walkPath)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+)
+
+// The minifiers below are deliberately conservative: they only remove what is certainly not significant
+// (comments and redundant whitespace), so the rendering of the pages does not change.
+// They are deterministic, so identical inputs always produce identical outputs.
+
+// rawTextElements are copied verbatim by minifyHTML, except style which is minified as CSS
+var rawTextElements = []string{"script", "style", "pre", "textarea"}
+
+// minifyHTML removes comments and collapses whitespace in the text between tags.
+// Tags and their attributes (which may contain Alpine.js expressions) are copied verbatim.
+func minifyHTML(src []byte) []byte {
+	var out bytes.Buffer
+	out.Grow(len(src))
+
+	for i := 0; i < len(src); {
+		switch {
+		case bytes.HasPrefix(src[i:], []byte("<!--")):
+			end := bytes.Index(src[i+4:], []byte("-->"))
+			if end < 0 {
+				out.Write(src[i:])
+				return out.Bytes()
+			}
+			end += i + 4 + 3
+			// Keep conditional comments, they are interpreted by some email clients and browsers
+			if bytes.HasPrefix(src[i:], []byte("<!--[if")) {
+				out.Write(src[i:end])
+			}
+			i = end
+
+		case src[i] == '<':
+			end := tagEnd(src, i)
+			tag := src[i:end]
+			out.Write(tag)
+			i = end
+
+			name := tagName(tag)
+			for _, raw := range rawTextElements {
+				if name != raw {
+					continue
+				}
+				closing := []byte("</" + raw)
+				contentEnd := bytes.Index(bytes.ToLower(src[i:]), closing)
+				if contentEnd < 0 {
+					contentEnd = len(src) - i
+				}
+				content := src[i : i+contentEnd]
+				if raw == "style" {
+					content = minifyCSS(content)
+				}
+				out.Write(content)
+				i += contentEnd
+			}
+
+		default:
+			end := bytes.IndexByte(src[i:], '<')
+			if end < 0 {
+				end = len(src) - i
+			}
+			out.Write(collapseWhitespace(src[i : i+end]))
+			i += end
+		}
+	}
+
+	return bytes.TrimSpace(out.Bytes())
+}
+
+// tagEnd returns the index just after the end of the tag starting at src[start], skipping quoted attribute values
+func tagEnd(src []byte, start int) int {
+	var quote byte
+	for i := start + 1; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i + 1
+		}
+	}
+	return len(src)
+}
+
+// tagName returns the lowercase name of an opening tag, or "" for closing tags and declarations
+func tagName(tag []byte) string {
+	if len(tag) < 2 || tag[1] == '/' || tag[1] == '!' {
+		return ""
+	}
+	end := bytes.IndexAny(tag[1:], " \t\r\n/>")
+	if end < 0 {
+		return ""
+	}
+	return strings.ToLower(string(tag[1 : 1+end]))
+}
+
+// collapseWhitespace replaces each run of whitespace with a single newline if it contained one,
+// or with a single space otherwise
+func collapseWhitespace(text []byte) []byte {
+	var out bytes.Buffer
+	inSpace, sawNewline := false, false
+
+	for _, c := range text {
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' {
+			inSpace = true
+			sawNewline = sawNewline || c == '\n'
+			continue
+		}
+		if inSpace {
+			if sawNewline {
+				out.WriteByte('\n')
+			} else {
+				out.WriteByte(' ')
+			}
+			inSpace, sawNewline = false, false
+		}
+		out.WriteByte(c)
+	}
+	if inSpace {
+		if sawNewline {
+			out.WriteByte('\n')
+		} else {
+			out.WriteByte(' ')
+		}
+	}
+
+	return out.Bytes()
+}
+
+// minifyCSS removes comments and redundant whitespace from a stylesheet, leaving strings untouched
+func minifyCSS(src []byte) []byte {
+	var out bytes.Buffer
+	out.Grow(len(src))
+
+	pendingSpace := false
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+
+		switch {
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := bytes.Index(src[i+2:], []byte("*/"))
+			if end < 0 {
+				i = len(src)
+			} else {
+				i += 2 + end + 1
+			}
+
+		case c == '"' || c == '\'':
+			if pendingSpace {
+				out.WriteByte(' ')
+				pendingSpace = false
+			}
+			end := i + 1
+			for end < len(src) && src[end] != c {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end = min(end+1, len(src))
+			out.Write(src[i:end])
+			i = end - 1
+
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f':
+			pendingSpace = out.Len() > 0 && strings.IndexByte("{};,>", out.Bytes()[out.Len()-1]) < 0
+
+		case strings.IndexByte("{};,>", c) >= 0:
+			// No whitespace is needed around these. Colons are excluded because they are
+			// significant in selectors (e.g. "a :hover" is not "a:hover").
+			pendingSpace = false
+			out.WriteByte(c)
+
+		default:
+			if pendingSpace {
+				out.WriteByte(' ')
+				pendingSpace = false
+			}
+			out.WriteByte(c)
+		}
+	}
+
+	return out.Bytes()
+}
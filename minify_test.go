@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestMinifyHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "collapses whitespace between tags",
+			in:   "<div>\n    <p>Hello   world</p>\n\n</div>",
+			want: "<div>\n<p>Hello world</p>\n</div>",
+		},
+		{
+			name: "removes comments but keeps conditional ones",
+			in:   "<p>a</p><!-- a comment --><!--[if mso]>x<![endif]--><p>b</p>",
+			want: "<p>a</p><!--[if mso]>x<![endif]--><p>b</p>",
+		},
+		{
+			name: "keeps attributes verbatim",
+			in:   `<div x-data="{ a:  1,   b: 'x > y' }">  text  </div>`,
+			want: `<div x-data="{ a:  1,   b: 'x > y' }"> text </div>`,
+		},
+		{
+			name: "keeps raw text elements verbatim",
+			in:   "<pre>  a\n   b</pre>  <script>\n  let x = '  y  ';\n</script>",
+			want: "<pre>  a\n   b</pre> <script>\n  let x = '  y  ';\n</script>",
+		},
+		{
+			name: "minifies inline styles",
+			in:   "<style>\n  /* comment */\n  a , b {\n    color : red ;\n  }\n</style>",
+			want: "<style>a,b{color : red;}</style>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(minifyHTML([]byte(tt.in)))
+			if got != tt.want {
+				t.Errorf("minifyHTML(%q)\n got: %q\nwant: %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMinifyCSS(t *testing.T) {
+	in := "/* header */\n.a > .b  {\n  content: \"  keep  this  \";\n  margin: 0 auto;\n}\n\n@media (max-width: 600px) {\n  .c { display: none; }\n}\n"
+	want := `.a>.b{content: "  keep  this  ";margin: 0 auto;}@media (max-width: 600px){.c{display: none;}}`
+
+	if got := string(minifyCSS([]byte(in))); got != want {
+		t.Errorf("minifyCSS\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestMinifyIsDeterministic(t *testing.T) {
+	page, err := os.ReadFile("docs/index.html")
+	if err != nil {
+		t.Skip("skipping test because the generated page does not exist")
+	}
+
+	first := minifyHTML(page)
+	second := minifyHTML(page)
+	if !bytes.Equal(first, second) {
+		t.Errorf("minifying the same input twice produced different outputs")
+	}
+	if len(first) >= len(page) {
+		t.Errorf("expected the minified page to be smaller: %d >= %d", len(first), len(page))
+	}
+	if again := minifyHTML(first); !bytes.Equal(first, again) {
+		t.Errorf("minifying an already minified page changed it")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hesusruiz/onboardng/credissuance"
+	"github.com/hesusruiz/onboardng/internal/configuration"
+)
+
+// selfTestTimeout limits how long the self-test waits for the Verifier and the Issuer
+const selfTestTimeout = time.Minute
+
+// selfTest checks that the Verifier of the environment gives an access token for its machine credential and
+// that its Issuer is reachable, without issuing any credential. It prints the result of each check and returns
+// the exit code: 0 when all passed, 1 otherwise, so it can gate the deploys.
+func selfTest(cfg configuration.Config, runtimeEnv configuration.RuntimeEnv) int {
+	srvConfig, ok := cfg.Environments[string(runtimeEnv)]
+	if !ok {
+		fmt.Println("ERROR: environment not found in the configuration:", runtimeEnv)
+		return 1
+	}
+
+	fmt.Println("Environment:      ", runtimeEnv)
+	fmt.Println("Token endpoint:   ", srvConfig.Verifier.TokenEndpoint)
+	fmt.Println("Issuance endpoint:", srvConfig.Issuer.CredentialIssuancePath)
+
+	issuance, err := credissuance.NewLEARIssuance(issuerConfig(srvConfig, runtimeEnv))
+	if err != nil {
+		fmt.Println("\nERROR: the keys or the machine credential can not be loaded:", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+	result := issuance.SelfTest(ctx)
+
+	fmt.Println()
+	if result.TokenErr != nil {
+		fmt.Printf("Verifier: ERROR: no access token for %s: %v\n", result.DidKey, result.TokenErr)
+	} else {
+		fmt.Printf("Verifier: OK: access token obtained for %s\n", result.DidKey)
+	}
+	if result.IssuerErr != nil {
+		fmt.Println("Issuer:   ERROR: the issuance endpoint is not reachable:", result.IssuerErr)
+	} else {
+		fmt.Printf("Issuer:   OK: the issuance endpoint replied with status %d\n", result.IssuerStatus)
+	}
+
+	if !result.OK() {
+		return 1
+	}
+	return 0
+}